@@ -0,0 +1,243 @@
+package assistant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// Alexa Smart Home directives, see
+// https://developer.amazon.com/docs/device-apis/message-guide.html
+type AlexaDirective struct {
+	Directive struct {
+		Header   alexaHeader `json:"header"`
+		Endpoint *struct {
+			Scope      alexaScope `json:"scope"`
+			EndpointId string     `json:"endpointId"`
+		} `json:"endpoint,omitempty"`
+		Payload json.RawMessage `json:"payload"`
+	} `json:"directive"`
+}
+
+type alexaHeader struct {
+	Namespace        string `json:"namespace"`
+	Name             string `json:"name"`
+	PayloadVersion   string `json:"payloadVersion"`
+	MessageId        string `json:"messageId"`
+	CorrelationToken string `json:"correlationToken,omitempty"`
+}
+
+type alexaScope struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+}
+
+// Returns the access token the directive was sent with. Alexa puts it in
+// the directive rather than in a header.
+func (d *AlexaDirective) Token() string {
+	if e := d.Directive.Endpoint; e != nil {
+		return e.Scope.Token
+	}
+	var p struct {
+		Scope   alexaScope `json:"scope"`
+		Grantee alexaScope `json:"grantee"`
+	}
+	json.Unmarshal(d.Directive.Payload, &p)
+	if p.Scope.Token != "" {
+		return p.Scope.Token
+	}
+	return p.Grantee.Token
+}
+
+type AlexaResponse struct {
+	Event struct {
+		Header   alexaHeader    `json:"header"`
+		Endpoint *alexaEndpoint `json:"endpoint,omitempty"`
+		Payload  interface{}    `json:"payload"`
+	} `json:"event"`
+	Context *alexaContext `json:"context,omitempty"`
+}
+
+type alexaEndpoint struct {
+	EndpointId string `json:"endpointId"`
+}
+
+type alexaContext struct {
+	Properties []*alexaProperty `json:"properties"`
+}
+
+type alexaProperty struct {
+	Namespace    string      `json:"namespace"`
+	Name         string      `json:"name"`
+	Value        interface{} `json:"value"`
+	TimeOfSample string      `json:"timeOfSample"`
+	Uncertainty  int         `json:"uncertaintyInMilliseconds"`
+}
+
+type alexaCapability struct {
+	Type       string           `json:"type"`
+	Interface  string           `json:"interface"`
+	Version    string           `json:"version"`
+	Properties *alexaProperties `json:"properties,omitempty"`
+}
+
+type alexaProperties struct {
+	Supported   []alexaName `json:"supported"`
+	Retrievable bool        `json:"retrievable"`
+}
+
+type alexaName struct {
+	Name string `json:"name"`
+}
+
+func alexaInterface(iface string, property string) *alexaCapability {
+	c := &alexaCapability{Type: "AlexaInterface", Interface: iface, Version: "3"}
+	if property != "" {
+		c.Properties = &alexaProperties{Supported: []alexaName{{property}}, Retrievable: true}
+	}
+	return c
+}
+
+func (a *Assistant) alexaResponse(d *AlexaDirective, namespace string, name string) *AlexaResponse {
+	res := &AlexaResponse{}
+	res.Event.Header = alexaHeader{
+		Namespace:        namespace,
+		Name:             name,
+		PayloadVersion:   "3",
+		MessageId:        newMessageId(),
+		CorrelationToken: d.Directive.Header.CorrelationToken,
+	}
+	if e := d.Directive.Endpoint; e != nil {
+		res.Event.Endpoint = &alexaEndpoint{e.EndpointId}
+	}
+	res.Event.Payload = struct{}{}
+	return res
+}
+
+func (a *Assistant) alexaError(d *AlexaDirective, typ string, msg string) *AlexaResponse {
+	res := a.alexaResponse(d, "Alexa", "ErrorResponse")
+	res.Event.Payload = map[string]string{"type": typ, "message": msg}
+	return res
+}
+
+// Answers a directive sent on behalf of the user with email
+func (a *Assistant) Alexa(ctx context.Context, email string, d *AlexaDirective) *AlexaResponse {
+	h := d.Directive.Header
+	switch h.Namespace + "." + h.Name {
+	case "Alexa.Discovery.Discover":
+		return a.alexaDiscover(d, email)
+	case "Alexa.Authorization.AcceptGrant":
+		// We don't send events to Alexa, so there's nothing to keep
+		return a.alexaResponse(d, "Alexa.Authorization", "AcceptGrant.Response")
+	}
+	if d.Directive.Endpoint == nil {
+		return a.alexaError(d, "INVALID_DIRECTIVE", "missing endpoint")
+	}
+
+	eps, err := a.endpointsById(email)
+	if err != nil {
+		slog.Error("finding alexa endpoints", "err", err)
+		return a.alexaError(d, "INTERNAL_ERROR", err.Error())
+	}
+	e := eps[d.Directive.Endpoint.EndpointId]
+	if e == nil {
+		return a.alexaError(d, "NO_SUCH_ENDPOINT", "")
+	}
+
+	switch h.Namespace + "." + h.Name {
+	case "Alexa.ReportState":
+		st := a.state(ctx, e)
+		if !st.Online {
+			return a.alexaError(d, "ENDPOINT_UNREACHABLE", "")
+		}
+		return a.alexaState(d, e, st, "StateReport")
+	case "Alexa.PowerController.TurnOn", "Alexa.PowerController.TurnOff":
+		on := h.Name == "TurnOn"
+		st := &state{Online: true, On: on}
+		if on {
+			st.Level = 100
+		}
+		err = a.setOn(ctx, email, e, on)
+		return a.alexaResult(d, e, st, err)
+	case "Alexa.BrightnessController.SetBrightness":
+		var p struct {
+			Brightness int `json:"brightness"`
+		}
+		if err := json.Unmarshal(d.Directive.Payload, &p); err != nil {
+			return a.alexaError(d, "INVALID_DIRECTIVE", err.Error())
+		}
+		err = a.setLevel(ctx, email, e, p.Brightness)
+		return a.alexaResult(d, e, &state{Online: true, On: p.Brightness > 0, Level: p.Brightness}, err)
+	}
+	return a.alexaError(d, "INVALID_DIRECTIVE", "unsupported directive")
+}
+
+func (a *Assistant) alexaDiscover(d *AlexaDirective, email string) *AlexaResponse {
+	eps, err := a.endpoints(email)
+	if err != nil {
+		slog.Error("finding alexa endpoints", "err", err)
+		return a.alexaError(d, "INTERNAL_ERROR", err.Error())
+	}
+	var endpoints []map[string]interface{}
+	for _, e := range eps {
+		caps := []*alexaCapability{
+			alexaInterface("Alexa", ""),
+			alexaInterface("Alexa.PowerController", "powerState"),
+		}
+		category := "SWITCH"
+		if e.light {
+			category = "LIGHT"
+		}
+		if e.kind == kindLevel {
+			caps = append(caps, alexaInterface("Alexa.BrightnessController", "brightness"))
+		}
+		desc := e.Function.Name + " of " + e.Device.Id
+		if e.profiled {
+			desc = e.Device.Profile + " " + e.Device.Id
+		}
+		endpoints = append(endpoints, map[string]interface{}{
+			"endpointId":        e.Id,
+			"manufacturerName":  "iot",
+			"friendlyName":      e.name(),
+			"description":       desc,
+			"displayCategories": []string{category},
+			"capabilities":      caps,
+		})
+	}
+	res := a.alexaResponse(d, "Alexa.Discovery", "Discover.Response")
+	res.Event.Payload = map[string]interface{}{"endpoints": endpoints}
+	return res
+}
+
+func (a *Assistant) alexaResult(d *AlexaDirective, e *endpoint, st *state, err error) *AlexaResponse {
+	switch {
+	case err == nil:
+		return a.alexaState(d, e, st, "Response")
+	case errors.Is(err, errOffline):
+		return a.alexaError(d, "ENDPOINT_UNREACHABLE", "")
+	case errors.Is(err, model.ErrInvalidParam):
+		return a.alexaError(d, "VALUE_OUT_OF_RANGE", err.Error())
+	}
+	return a.alexaError(d, "INTERNAL_ERROR", err.Error())
+}
+
+func (a *Assistant) alexaState(d *AlexaDirective, e *endpoint, st *state, name string) *AlexaResponse {
+	res := a.alexaResponse(d, "Alexa", name)
+	now := time.Now().UTC().Format(time.RFC3339)
+	power := "OFF"
+	if st.On {
+		power = "ON"
+	}
+	props := []*alexaProperty{
+		{Namespace: "Alexa.PowerController", Name: "powerState", Value: power, TimeOfSample: now},
+	}
+	if e.kind == kindLevel {
+		props = append(props, &alexaProperty{Namespace: "Alexa.BrightnessController", Name: "brightness", Value: st.Level, TimeOfSample: now})
+	}
+	res.Context = &alexaContext{props}
+	return res
+}
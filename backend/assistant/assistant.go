@@ -0,0 +1,301 @@
+// Package assistant lets voice assistants control devices. Devices with the
+// light or switch profile show up as one light or switch. Of other devices,
+// functions that switch something on and off, or set a level within a
+// range, show up as switches and lights of the user that owns the device or
+// can control it.
+package assistant
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/twinone/iot/backend/audit"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/rules"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+// How a function is controlled
+type kind int
+
+const (
+	// Digital writes without parameters, or a single bool parameter
+	kindOnOff kind = iota + 1
+	// A single number parameter with a min and a max, shown as 0-100%
+	kindLevel
+)
+
+var errOffline = errors.New("device offline")
+
+// A function of a device an assistant can control
+type endpoint struct {
+	// Unique among the endpoints of a user
+	Id       string
+	Device   *model.Device
+	Function *model.Function
+	kind     kind
+	// Shown as a light rather than a switch
+	light bool
+	// Whether it's a device with a profile, whose state is reported by
+	// attribute rather than by pin
+	profiled bool
+	// Of a light that has a brightness, the function switching it on and off
+	onOff *model.Function
+}
+
+// The state of an endpoint as the device last reported it
+type state struct {
+	Online bool
+	On     bool
+	// 0 to 100
+	Level int
+}
+
+type Assistant struct {
+	hub   *ws.Hub
+	store store.Store
+}
+
+func New(hub *ws.Hub, st store.Store) *Assistant {
+	return &Assistant{hub: hub, store: st}
+}
+
+func kindOf(f *model.Function) kind {
+	switch {
+	case len(f.Params) == 0 && f.Cmd == model.CmdDigitalWrite:
+		return kindOnOff
+	case len(f.Params) != 1:
+		return 0
+	}
+	p := &f.Params[0]
+	switch {
+	case p.Type == model.ParamBool:
+		return kindOnOff
+	case (p.Type == model.ParamInt || p.Type == model.ParamFloat) && p.Min != nil && p.Max != nil && *p.Max > *p.Min:
+		return kindLevel
+	}
+	return 0
+}
+
+// Assistants restrict the characters of ids, so both parts are encoded
+func endpointId(deviceId, function string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(deviceId)) + "#" +
+		base64.RawURLEncoding.EncodeToString([]byte(function))
+}
+
+// Returns the functions of the devices email owns or can control that an
+// assistant can use
+func (a *Assistant) endpoints(email string) ([]*endpoint, error) {
+	devices, err := a.store.FindDevicesByOwner(email)
+	if err != nil {
+		return nil, err
+	}
+	shares, err := a.store.FindSharesByUser(email)
+	if err != nil {
+		return nil, err
+	}
+	for _, sh := range shares {
+		if !sh.Role.Allows(model.RoleController) {
+			continue
+		}
+		if d, err := a.store.FindDevice(sh.DeviceId); err == nil && d.Deleted == 0 {
+			devices = append(devices, d)
+		}
+	}
+
+	var res []*endpoint
+	for _, d := range devices {
+		if conn := a.hub.GetConn(d.Id); conn != nil {
+			// Has the functions the device declared
+			d = conn.Device
+		}
+		functions, err := store.DeviceFunctions(a.store, d)
+		if err != nil {
+			return nil, err
+		}
+		if e := profileEndpoint(d, functions); e != nil {
+			res = append(res, e)
+			continue
+		}
+		for _, f := range functions {
+			if k := kindOf(f); k != 0 {
+				res = append(res, &endpoint{Id: endpointId(d.Id, f.Name), Device: d, Function: f, kind: k, light: k == kindLevel})
+			}
+		}
+	}
+	return res, nil
+}
+
+// Returns the endpoint of a device with the light or switch profile, named
+// after the device, or nil if it has another or doesn't conform to it
+func profileEndpoint(d *model.Device, functions []*model.Function) *endpoint {
+	if d.Profile != model.ProfileLight && d.Profile != model.ProfileSwitch {
+		return nil
+	}
+	if err := model.FindProfile(d.Profile).Check(functions); err != nil {
+		slog.Debug("ignoring profile", "device", d.Id, "err", err)
+		return nil
+	}
+	byName := make(map[string]*model.Function, len(functions))
+	for _, f := range functions {
+		byName[f.Name] = f
+	}
+	e := &endpoint{
+		// Function names aren't empty, so this doesn't clash
+		Id:       endpointId(d.Id, ""),
+		Device:   d,
+		Function: byName["on"],
+		kind:     kindOnOff,
+		light:    d.Profile == model.ProfileLight,
+		profiled: true,
+	}
+	if f := byName["brightness"]; f != nil && d.Profile == model.ProfileLight {
+		e.onOff, e.Function, e.kind = e.Function, f, kindLevel
+	}
+	return e
+}
+
+// Returns the endpoints of email by id
+func (a *Assistant) endpointsById(email string) (map[string]*endpoint, error) {
+	eps, err := a.endpoints(email)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]*endpoint, len(eps))
+	for _, e := range eps {
+		res[e.Id] = e
+	}
+	return res, nil
+}
+
+// Returns the name users call an endpoint by
+func (e *endpoint) name() string {
+	switch {
+	case e.profiled && e.Device.Name == "":
+		return e.Device.Id
+	case e.profiled:
+		return e.Device.Name
+	case e.Device.Name == "":
+		return e.Function.Name
+	}
+	return e.Device.Name + " " + e.Function.Name
+}
+
+func (a *Assistant) online(ctx context.Context, e *endpoint) bool {
+	return a.hub.GetConn(e.Device.Id) != nil || a.hub.RemoteOnline(ctx, []string{e.Device.Id})[e.Device.Id]
+}
+
+// Returns the state of e from the shadow of its device, keyed by pin, or by
+// attribute for devices with a profile
+func (a *Assistant) state(ctx context.Context, e *endpoint) *state {
+	st := &state{Online: a.online(ctx, e)}
+	sh, err := a.store.FindShadow(e.Device.Id)
+	if err != nil {
+		if err != store.ErrNotFound {
+			slog.Error("finding shadow", "device", e.Device.Id, "err", err)
+		}
+		return st
+	}
+	if e.profiled {
+		st.On = isOn(sh.Reported["on"])
+		if e.kind == kindLevel {
+			if f, err := strconv.ParseFloat(sh.Reported["brightness"], 64); err == nil {
+				st.Level = toPercent(&e.Function.Params[0], f)
+			}
+		}
+		return st
+	}
+	v := sh.Reported[strconv.Itoa(e.Function.Pin)]
+	switch e.kind {
+	case kindOnOff:
+		st.On = isOn(v)
+	case kindLevel:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			st.Level = toPercent(&e.Function.Params[0], f)
+			st.On = st.Level > 0
+		}
+	}
+	return st
+}
+
+func isOn(v string) bool {
+	switch strings.ToLower(v) {
+	case "high", "1", "true", "on":
+		return true
+	}
+	return false
+}
+
+func toPercent(p *model.Param, v float64) int {
+	pct := (v - *p.Min) / (*p.Max - *p.Min) * 100
+	return int(math.Round(math.Max(0, math.Min(100, pct))))
+}
+
+func fromPercent(p *model.Param, pct int) string {
+	v := *p.Min + (*p.Max-*p.Min)*float64(pct)/100
+	if p.Type == model.ParamInt {
+		return strconv.FormatInt(int64(math.Round(v)), 10)
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Switches e on or off, level endpoints go to their max or min
+func (a *Assistant) setOn(ctx context.Context, email string, e *endpoint, on bool) error {
+	if e.onOff != nil {
+		return a.run(ctx, email, e, e.onOff, strconv.FormatBool(on))
+	}
+	if e.kind == kindLevel {
+		pct := 0
+		if on {
+			pct = 100
+		}
+		return a.setLevel(ctx, email, e, pct)
+	}
+	var arg string
+	switch {
+	case len(e.Function.Params) == 1:
+		arg = strconv.FormatBool(on)
+	case on:
+		arg = model.ValHigh
+	default:
+		arg = model.ValLow
+	}
+	return a.run(ctx, email, e, e.Function, arg)
+}
+
+// Sets a level endpoint to pct of its range, on/off ones switch on above 0
+func (a *Assistant) setLevel(ctx context.Context, email string, e *endpoint, pct int) error {
+	if e.kind == kindOnOff {
+		return a.setOn(ctx, email, e, pct > 0)
+	}
+	if pct < 0 || pct > 100 {
+		return model.ErrInvalidParam
+	}
+	return a.run(ctx, email, e, e.Function, fromPercent(&e.Function.Params[0], pct))
+}
+
+func newMessageId() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func (a *Assistant) run(ctx context.Context, email string, e *endpoint, f *model.Function, arg string) error {
+	if !a.online(ctx, e) {
+		return errOffline
+	}
+	_, err := rules.Run(audit.WithVia(ctx, "assistant"), a.hub, a.store, email, &model.Action{
+		DeviceId: e.Device.Id,
+		Function: f.Name,
+		Args:     []string{arg},
+	})
+	return err
+}
@@ -0,0 +1,245 @@
+package assistant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// Google Smart Home intents, see
+// https://developers.home.google.com/cloud-to-cloud/intents
+const (
+	IntentSync       = "action.devices.SYNC"
+	IntentQuery      = "action.devices.QUERY"
+	IntentExecute    = "action.devices.EXECUTE"
+	IntentDisconnect = "action.devices.DISCONNECT"
+
+	googleTypeSwitch = "action.devices.types.SWITCH"
+	googleTypeLight  = "action.devices.types.LIGHT"
+
+	googleTraitOnOff      = "action.devices.traits.OnOff"
+	googleTraitBrightness = "action.devices.traits.Brightness"
+
+	googleCmdOnOff      = "action.devices.commands.OnOff"
+	googleCmdBrightness = "action.devices.commands.BrightnessAbsolute"
+)
+
+type GoogleRequest struct {
+	RequestId string `json:"requestId"`
+	Inputs    []struct {
+		Intent  string          `json:"intent"`
+		Payload json.RawMessage `json:"payload"`
+	} `json:"inputs"`
+}
+
+// Returns the intent of r, "" if it has none
+func (r *GoogleRequest) Intent() string {
+	if len(r.Inputs) == 0 {
+		return ""
+	}
+	return r.Inputs[0].Intent
+}
+
+type GoogleResponse struct {
+	RequestId string      `json:"requestId"`
+	Payload   interface{} `json:"payload"`
+}
+
+type googleDevice struct {
+	Id     string   `json:"id"`
+	Type   string   `json:"type"`
+	Traits []string `json:"traits"`
+	Name   struct {
+		Name      string   `json:"name"`
+		Nicknames []string `json:"nicknames,omitempty"`
+	} `json:"name"`
+	WillReportState bool `json:"willReportState"`
+	DeviceInfo      struct {
+		Manufacturer string `json:"manufacturer"`
+	} `json:"deviceInfo"`
+}
+
+type googleError struct {
+	ErrorCode string `json:"errorCode"`
+}
+
+// Answers a fulfillment request made on behalf of the user with email
+func (a *Assistant) Google(ctx context.Context, email string, req *GoogleRequest) *GoogleResponse {
+	res := &GoogleResponse{RequestId: req.RequestId}
+	var err error
+	switch req.Intent() {
+	case IntentSync:
+		res.Payload, err = a.googleSync(email)
+	case IntentQuery:
+		res.Payload, err = a.googleQuery(ctx, email, req.Inputs[0].Payload)
+	case IntentExecute:
+		res.Payload, err = a.googleExecute(ctx, email, req.Inputs[0].Payload)
+	case IntentDisconnect:
+		res.Payload = struct{}{}
+	default:
+		res.Payload = &googleError{ErrorCode: "notSupported"}
+	}
+	if err != nil {
+		slog.Error("answering google intent", "intent", req.Intent(), "err", err)
+		res.Payload = &googleError{ErrorCode: "hardError"}
+	}
+	return res
+}
+
+func (a *Assistant) googleSync(email string) (interface{}, error) {
+	eps, err := a.endpoints(email)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]*googleDevice, 0, len(eps))
+	for _, e := range eps {
+		d := &googleDevice{Id: e.Id, Type: googleTypeSwitch, Traits: []string{googleTraitOnOff}}
+		if e.light {
+			d.Type = googleTypeLight
+		}
+		if e.kind == kindLevel {
+			d.Traits = append(d.Traits, googleTraitBrightness)
+		}
+		d.Name.Name = e.name()
+		d.DeviceInfo.Manufacturer = "iot"
+		devices = append(devices, d)
+	}
+	return map[string]interface{}{
+		"agentUserId": email,
+		"devices":     devices,
+	}, nil
+}
+
+type googleDevices struct {
+	Devices []struct {
+		Id string `json:"id"`
+	} `json:"devices"`
+}
+
+func googleState(e *endpoint, st *state) map[string]interface{} {
+	res := map[string]interface{}{
+		"online": st.Online,
+		"on":     st.On,
+	}
+	if e.kind == kindLevel {
+		res["brightness"] = st.Level
+	}
+	if st.Online {
+		res["status"] = "SUCCESS"
+	} else {
+		res["status"] = "OFFLINE"
+		res["errorCode"] = "deviceOffline"
+	}
+	return res
+}
+
+func (a *Assistant) googleQuery(ctx context.Context, email string, payload json.RawMessage) (interface{}, error) {
+	var req googleDevices
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return &googleError{ErrorCode: "protocolError"}, nil
+	}
+	eps, err := a.endpointsById(email)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]interface{}, len(req.Devices))
+	for _, d := range req.Devices {
+		e := eps[d.Id]
+		if e == nil {
+			states[d.Id] = map[string]interface{}{"status": "ERROR", "errorCode": "deviceNotFound"}
+			continue
+		}
+		states[d.Id] = googleState(e, a.state(ctx, e))
+	}
+	return map[string]interface{}{"devices": states}, nil
+}
+
+type googleCommand struct {
+	Devices []struct {
+		Id string `json:"id"`
+	} `json:"devices"`
+	Execution []struct {
+		Command string `json:"command"`
+		Params  struct {
+			On         *bool `json:"on"`
+			Brightness *int  `json:"brightness"`
+		} `json:"params"`
+	} `json:"execution"`
+}
+
+type googleCommandResult struct {
+	Ids       []string               `json:"ids"`
+	Status    string                 `json:"status"`
+	States    map[string]interface{} `json:"states,omitempty"`
+	ErrorCode string                 `json:"errorCode,omitempty"`
+}
+
+func (a *Assistant) googleExecute(ctx context.Context, email string, payload json.RawMessage) (interface{}, error) {
+	var req struct {
+		Commands []googleCommand `json:"commands"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return &googleError{ErrorCode: "protocolError"}, nil
+	}
+	eps, err := a.endpointsById(email)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*googleCommandResult
+	for _, cmd := range req.Commands {
+		for _, d := range cmd.Devices {
+			res := &googleCommandResult{Ids: []string{d.Id}, Status: "SUCCESS"}
+			results = append(results, res)
+			e := eps[d.Id]
+			if e == nil {
+				res.Status, res.ErrorCode = "ERROR", "deviceNotFound"
+				continue
+			}
+			st := &state{Online: true}
+			for _, ex := range cmd.Execution {
+				var err error
+				switch {
+				case ex.Command == googleCmdOnOff && ex.Params.On != nil:
+					err = a.setOn(ctx, email, e, *ex.Params.On)
+					st.On = *ex.Params.On
+					if e.kind == kindLevel && st.On {
+						st.Level = 100
+					}
+				case ex.Command == googleCmdBrightness && ex.Params.Brightness != nil:
+					err = a.setLevel(ctx, email, e, *ex.Params.Brightness)
+					st.Level = *ex.Params.Brightness
+					st.On = st.Level > 0
+				default:
+					err = errUnsupported
+				}
+				if err != nil {
+					res.Status, res.ErrorCode = googleErrorCode(err)
+					break
+				}
+			}
+			if res.Status == "SUCCESS" {
+				res.States = googleState(e, st)
+				delete(res.States, "status")
+			}
+		}
+	}
+	return map[string]interface{}{"commands": results}, nil
+}
+
+var errUnsupported = errors.New("unsupported command")
+
+func googleErrorCode(err error) (status string, code string) {
+	switch {
+	case errors.Is(err, errOffline):
+		return "OFFLINE", "deviceOffline"
+	case errors.Is(err, errUnsupported):
+		return "ERROR", "functionNotSupported"
+	case errors.Is(err, model.ErrInvalidParam):
+		return "ERROR", "valueOutOfRange"
+	}
+	return "ERROR", "hardError"
+}
@@ -0,0 +1,59 @@
+// Package audit records who did what to which device in the store's
+// append-only audit log, for accountability in shared households and
+// commercial installs.
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+// Where actions taken with a context come from, see model.AuditEntry
+type Source struct {
+	Via        string
+	RemoteAddr string
+}
+
+type sourceKey struct{}
+
+func NewContext(ctx context.Context, src Source) context.Context {
+	return context.WithValue(ctx, sourceKey{}, src)
+}
+
+func FromContext(ctx context.Context) Source {
+	src, _ := ctx.Value(sourceKey{}).(Source)
+	return src
+}
+
+// Returns ctx with the source's Via replaced, keeping its address
+func WithVia(ctx context.Context, via string) context.Context {
+	src := FromContext(ctx)
+	src.Via = via
+	return NewContext(ctx, src)
+}
+
+// Records that actor did action to d. Commands are recorded before they're
+// sent, so failing to record is logged rather than stopping them.
+func Record(ctx context.Context, st store.Store, actor string, action model.AuditAction, d *model.Device, payload string) {
+	if st == nil {
+		return
+	}
+	src := FromContext(ctx)
+	e := &model.AuditEntry{
+		Time:       time.Now().Unix(),
+		Actor:      actor,
+		Via:        src.Via,
+		Action:     action,
+		DeviceId:   d.Id,
+		Owner:      d.Owner,
+		Payload:    payload,
+		RemoteAddr: src.RemoteAddr,
+	}
+	if err := st.InsertAudit(e); err != nil {
+		slog.Error("recording audit entry", "device", d.Id, "action", action, "actor", actor, "err", err)
+	}
+}
@@ -0,0 +1,673 @@
+// Package client is the device side of the protocol, for devices and
+// services written in Go. It connects, says HELLO and OWNER, declares its
+// functions, answers their invocations and reconnects with backoff when
+// the connection drops, resuming its session to get what it missed:
+//
+//	c := client.New(client.Config{URL: "wss://iot.example.com/ws", Id: "lamp", Owner: "me@example.com"})
+//	c.Handle(model.Function{Name: "Light", Cmd: model.CmdDigitalWrite, Pin: 5}, func(args []string) (string, error) {
+//		return args[0], setLight(args[0] == model.ValHigh)
+//	})
+//	err := c.Run(ctx)
+//
+// With a Key, functions handled with HandleSealed are only invoked with
+// commands sealed for the device, see the e2e package. With a SigningKey,
+// only what the backend signed with it is acted on, see the signing
+// package.
+package client
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/twinone/iot/backend/e2e"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/signing"
+	"github.com/twinone/iot/backend/wire"
+)
+
+// Protocol revision spoken, see ws/version.go
+const protocolVersion = 2
+
+// Close codes of things reconnecting won't fix, see ws/close.go
+const (
+	closeUnauthorized  = 4003
+	closeOwnerMismatch = 4004
+	closeUnknownOwner  = 4005
+	closeVersion       = 4006
+	closeRemoved       = 4010
+	// Another connection took the id, taking it back would go on forever
+	closeReplaced     = 4014
+	closeUnregistered = 4016
+)
+
+const (
+	writeWait   = 10 * time.Second
+	compressMin = 128
+	// How long the server may stay silent, it pings well before
+	defaultReadWait = 2 * time.Minute
+)
+
+var (
+	ErrNotConnected = errors.New("not connected")
+	// The server turned us away for good, see the close code in the error
+	ErrRejected = errors.New("rejected by the server")
+)
+
+type Config struct {
+	// Of the backend's WebSocket endpoint, like wss://iot.example.com/ws
+	URL string
+	Id  string
+	// Issued by POST /api/devices/{id}/token, if the backend asks for them
+	Token string
+	// Claims the device for this user the first time, if it isn't paired
+	Owner string
+	Name  string
+	// Announced in INFO, so firmware updates can target the device
+	Model    string
+	Firmware string
+	// How long we may stay silent, the server's default if 0
+	KeepAlive time.Duration
+	// Offer permessage-deflate, which the backend may accept, to save
+	// bandwidth on metered links
+	Compression bool
+	// One of the wire subprotocols to ask for, wire.SubprotocolCBOR for
+	// the smallest messages. Text if empty or the backend doesn't speak it.
+	Subprotocol string
+	// Commands are sealed for its public half, announced in HELLO. The
+	// server keeps the first one, pair the device again to change it.
+	Key *ecdh.PrivateKey
+	// Sealed commands older than this are refused, the server could replay
+	// them. Needs a synced clock, 0 doesn't check.
+	MaxSealedAge time.Duration
+	// The backend's public key, from GET /api/signing-keys. If set,
+	// messages that aren't signed with it are ignored, save the HELLO,
+	// PAIR, ERR and MSG that don't need to be.
+	SigningKey *signing.Key
+	// Signed messages older than this are ignored, 0 doesn't check
+	MaxSignedAge time.Duration
+	// Ask the backend for the time on every connection, see Now
+	SyncTime bool
+	// Waits between reconnections, doubling from Min up to Max
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Header     http.Header
+	Logger     *slog.Logger
+}
+
+// Runs an invocation of a function, args are those after the pin. Returns
+// what to answer with after the command and pin, like the new value.
+type Handler func(args []string) (string, error)
+
+type Client struct {
+	cfg Config
+	log *slog.Logger
+
+	// Called when the device isn't paired yet, with the code a user must
+	// enter in the dashboard
+	OnPair func(code string)
+	// Called with every other message from the server, like DELTA or MSG
+	OnMessage func(cmd string, args []string)
+	// Called when the backend moves us to a new signing key, to keep it
+	// for next time
+	OnSigningKey func(k *signing.Key)
+	// Called with the time whenever the backend sends it, in the device's
+	// timezone, to set a clock
+	OnTime func(t time.Time)
+
+	mx        sync.Mutex
+	functions []model.Function
+	handlers  map[string]Handler
+	// Handlers of functions only invoked sealed
+	sealed map[string]bool
+	// Highest sequence number got in this session, to resume it after
+	// reconnecting
+	lastSeq uint64
+	// Nil while disconnected
+	ws *websocket.Conn
+	// Serializes writes to ws
+	writeMx sync.Mutex
+	// Negotiated for the current connection, guarded by writeMx
+	codec wire.Codec
+	// The SigningKey, or the one we were moved to
+	signKey *signing.Key
+	// What to add to the local clock to get the backend's, in loc, and
+	// when we last asked for it. Guarded by mx.
+	clockOffset time.Duration
+	loc         *time.Location
+	timeAsked   time.Time
+}
+
+func New(cfg Config) *Client {
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = 2 * time.Minute
+	}
+	log := cfg.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	return &Client{
+		cfg:      cfg,
+		log:      log.With("device", cfg.Id),
+		handlers: make(map[string]Handler),
+		sealed:   make(map[string]bool),
+		signKey:  cfg.SigningKey,
+	}
+}
+
+// Declares f and runs h when it's invoked. Handlers run one at a time on
+// the connection's goroutine, so they mustn't block for long. Functions
+// handled after connecting are declared on the next connection.
+func (c *Client) Handle(f model.Function, h Handler) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.functions = append(c.functions, f)
+	c.handlers[f.Cmd+" "+strconv.Itoa(f.Pin)] = h
+}
+
+// Like Handle, but f is only invoked with commands sealed for the Key, so
+// the server can't see or forge them. Panics without a Key.
+func (c *Client) HandleSealed(f model.Function, h Handler) {
+	if c.cfg.Key == nil {
+		panic("client: HandleSealed without a Key")
+	}
+	f.E2E = true
+	c.Handle(f, h)
+	c.mx.Lock()
+	c.sealed[f.Cmd+" "+strconv.Itoa(f.Pin)] = true
+	c.mx.Unlock()
+}
+
+// Connects and serves the connection, reconnecting whenever it drops,
+// until ctx is done or the server turns us away for good
+func (c *Client) Run(ctx context.Context) error {
+	backoff := c.cfg.MinBackoff
+	for {
+		start := time.Now()
+		err := c.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrRejected) {
+			return err
+		}
+		// A connection that stayed up a while starts over
+		if time.Since(start) > c.cfg.MaxBackoff {
+			backoff = c.cfg.MinBackoff
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		c.log.Warn("disconnected, reconnecting", "err", err, "in", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > c.cfg.MaxBackoff {
+			backoff = c.cfg.MaxBackoff
+		}
+	}
+}
+
+// Sends a message, like Send("REPORT", "5", "HIGH")
+func (c *Client) Send(cmd string, args ...string) error {
+	c.mx.Lock()
+	ws := c.ws
+	c.mx.Unlock()
+	if ws == nil {
+		return ErrNotConnected
+	}
+	return c.write(ws, cmd, args...)
+}
+
+// Sends sensor readings, like {"temperature": 21.5}
+func (c *Client) Telemetry(values map[string]float64) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		args = append(args, k, strconv.FormatFloat(values[k], 'f', -1, 64))
+	}
+	return c.Send(model.RespTelemetry, args...)
+}
+
+// Reports the current state of the device, like {"5": "HIGH"}
+func (c *Client) Report(values map[string]string) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		args = append(args, k, values[k])
+	}
+	return c.Send(model.RespReport, args...)
+}
+
+// Asks the backend for the time, Now has it once it answers
+func (c *Client) SyncTime() error {
+	c.mx.Lock()
+	c.timeAsked = time.Now()
+	c.mx.Unlock()
+	return c.Send(model.RespTime)
+}
+
+// Returns the time by the backend's clock in the device's timezone, false
+// if it hasn't told us yet
+func (c *Client) Now() (time.Time, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.loc == nil {
+		return time.Now(), false
+	}
+	return time.Now().Add(c.clockOffset).In(c.loc), true
+}
+
+// Handles TIME <unix ms> <utc offset> <timezone>
+func (c *Client) setTime(args []string) {
+	if len(args) < 3 {
+		c.log.Warn("invalid time", "args", args)
+		return
+	}
+	ms, err1 := strconv.ParseInt(args[0], 10, 64)
+	offset, err2 := strconv.Atoi(args[1])
+	if err1 != nil || err2 != nil {
+		c.log.Warn("invalid time", "args", args)
+		return
+	}
+	now := time.Now()
+	server := time.UnixMilli(ms)
+	c.mx.Lock()
+	// The answer took about half the round trip to get here, pushes
+	// didn't wait for a question
+	if !c.timeAsked.IsZero() {
+		server = server.Add(now.Sub(c.timeAsked) / 2)
+		c.timeAsked = time.Time{}
+	}
+	// Fixed, so devices don't need the timezone database
+	c.loc = time.FixedZone(args[2], offset)
+	c.clockOffset = server.Sub(now)
+	t := server.In(c.loc)
+	c.mx.Unlock()
+	c.log.Debug("time synced", "offset", c.clockOffset, "timezone", args[2])
+	if c.OnTime != nil {
+		c.OnTime(t)
+	}
+}
+
+// Sends a line of the device's log to the backend, level is one of
+// model.LogDebug, LogInfo, LogWarn or LogError. Whitespace in text is
+// collapsed.
+func (c *Client) Log(level model.LogLevel, text string) error {
+	return c.Send(model.RespLog, append([]string{level}, strings.Fields(text)...)...)
+}
+
+func (c *Client) write(ws *websocket.Conn, cmd string, args ...string) error {
+	c.writeMx.Lock()
+	defer c.writeMx.Unlock()
+	data, err := c.codec.Encode(&wire.Message{Cmd: cmd, Args: args})
+	if err != nil {
+		return err
+	}
+	frame := websocket.TextMessage
+	if c.codec.Binary() {
+		frame = websocket.BinaryMessage
+	}
+	// Short messages aren't worth compressing, when it was negotiated
+	ws.EnableWriteCompression(len(data) >= compressMin)
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return ws.WriteMessage(frame, data)
+}
+
+// Connects once and serves the connection until it drops
+func (c *Client) session(ctx context.Context) error {
+	subprotocols := []string{wire.SubprotocolText}
+	if c.cfg.Subprotocol != "" && c.cfg.Subprotocol != wire.SubprotocolText {
+		subprotocols = append([]string{c.cfg.Subprotocol}, subprotocols...)
+	}
+	dialer := websocket.Dialer{
+		HandshakeTimeout:  writeWait,
+		Subprotocols:      subprotocols,
+		EnableCompression: c.cfg.Compression,
+	}
+	ws, _, err := dialer.DialContext(ctx, c.cfg.URL, c.cfg.Header)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	codec := wire.ForSubprotocol(ws.Subprotocol())
+	c.writeMx.Lock()
+	c.codec = codec
+	c.writeMx.Unlock()
+
+	if err := c.handshake(ws); err != nil {
+		return err
+	}
+	c.mx.Lock()
+	c.ws = ws
+	c.mx.Unlock()
+	defer func() {
+		c.mx.Lock()
+		c.ws = nil
+		c.mx.Unlock()
+	}()
+	c.log.Info("connected", "url", c.cfg.URL)
+
+	// Says BYE when we're told to stop, so our will isn't published
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.write(ws, model.RespBye)
+			ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	readWait := defaultReadWait
+	if c.cfg.KeepAlive > 0 {
+		readWait = 2 * c.cfg.KeepAlive
+	}
+	ws.SetReadDeadline(time.Now().Add(readWait))
+	ws.SetPingHandler(func(data string) error {
+		ws.SetReadDeadline(time.Now().Add(readWait))
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+	})
+	for {
+		typ, data, err := ws.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				switch ce.Code {
+				case closeUnauthorized, closeOwnerMismatch, closeUnknownOwner, closeVersion, closeRemoved, closeReplaced, closeUnregistered:
+					return fmt.Errorf("%w: %d %s", ErrRejected, ce.Code, ce.Text)
+				}
+			}
+			return err
+		}
+		ws.SetReadDeadline(time.Now().Add(readWait))
+		if typ != websocket.TextMessage && !codec.Binary() {
+			continue
+		}
+		msg, err := codec.Decode(data)
+		if err != nil {
+			c.log.Debug("decoding message", "err", err)
+			continue
+		}
+		c.process(ws, msg)
+	}
+}
+
+// Introduces the device, the server answers HELLO and maybe PAIR later
+func (c *Client) handshake(ws *websocket.Conn) error {
+	hello := []string{c.cfg.Id}
+	if c.cfg.Token != "" {
+		hello = append(hello, c.cfg.Token)
+	}
+	hello = append(hello, "version="+strconv.Itoa(protocolVersion))
+	if c.cfg.KeepAlive > 0 {
+		hello = append(hello, "keepalive="+strconv.Itoa(int(c.cfg.KeepAlive/time.Second)))
+	}
+	if c.cfg.Key != nil {
+		hello = append(hello, "key="+e2e.EncodePublicKey(c.cfg.Key.PublicKey()))
+	}
+	c.mx.Lock()
+	hello = append(hello, "resume="+strconv.FormatUint(c.lastSeq, 10))
+	if c.signKey != nil {
+		hello = append(hello, "verify="+c.signKey.Id)
+	}
+	c.mx.Unlock()
+	if err := c.write(ws, model.RespHello, hello...); err != nil {
+		return err
+	}
+	if c.cfg.Owner != "" {
+		if err := c.write(ws, model.RespOwner, c.cfg.Owner); err != nil {
+			return err
+		}
+	}
+	if c.cfg.Name != "" {
+		if err := c.write(ws, model.RespName, c.cfg.Name); err != nil {
+			return err
+		}
+	}
+	if c.cfg.Model != "" || c.cfg.Firmware != "" {
+		if err := c.write(ws, model.RespInfo, "model", c.cfg.Model, "firmware", c.cfg.Firmware); err != nil {
+			return err
+		}
+	}
+	if c.cfg.SyncTime {
+		c.mx.Lock()
+		c.timeAsked = time.Now()
+		c.mx.Unlock()
+		if err := c.write(ws, model.RespTime); err != nil {
+			return err
+		}
+	}
+
+	c.mx.Lock()
+	functions, err := json.Marshal(c.functions)
+	n := len(c.functions)
+	c.mx.Unlock()
+	if err != nil || n == 0 {
+		return err
+	}
+	return c.write(ws, model.RespFuncs, string(functions))
+}
+
+// Handles a message from the server, "[seq] cmd args..." in the text
+// protocol
+func (c *Client) process(ws *websocket.Conn, msg *wire.Message) {
+	if msg.Seq != 0 {
+		c.mx.Lock()
+		if msg.Seq > c.lastSeq {
+			c.lastSeq = msg.Seq
+		}
+		c.mx.Unlock()
+	}
+	args := msg.Args
+	if len(msg.Payload) > 0 {
+		// Last, as the text protocol puts it
+		args = append(args, string(msg.Payload))
+	}
+	c.dispatch(ws, msg.Cmd, args, false)
+	if msg.Seq != 0 {
+		seq := strconv.FormatUint(msg.Seq, 10)
+		if err := c.write(ws, model.RespAck, seq); err != nil {
+			c.log.Warn("acknowledging", "seq", seq, "err", err)
+		}
+	}
+}
+
+// Acts on a message, signed if it came in SIG and was verified
+func (c *Client) dispatch(ws *websocket.Conn, cmd string, args []string, signed bool) {
+	switch cmd {
+	case model.RespHello:
+		c.log.Debug("server hello", "args", args)
+		for _, a := range args {
+			if a == "resume=0" {
+				// What we missed is gone, sequence numbers start over
+				c.mx.Lock()
+				c.lastSeq = 0
+				c.mx.Unlock()
+			}
+		}
+		return
+	case model.RespOwner:
+		// OWNER accepted <email> or OWNER rejected <reason>, closing follows
+		c.log.Info("server owner", "args", args)
+		return
+	case model.MsgPair:
+		c.log.Info("waiting to be paired", "code", strings.Join(args, " "))
+		if c.OnPair != nil && len(args) > 0 {
+			c.OnPair(args[0])
+		}
+		return
+	case model.MsgError:
+		c.log.Warn("server error", "args", args)
+		return
+	case model.MsgSigned:
+		c.verify(ws, args)
+		return
+	}
+	c.mx.Lock()
+	verifying := c.signKey != nil
+	c.mx.Unlock()
+	if verifying && !signed && cmd != model.MsgTopic {
+		c.log.Warn("ignoring unsigned message", "cmd", cmd)
+		return
+	}
+	switch cmd {
+	case model.MsgKey:
+		c.rotate(ws, args, signed)
+	case model.CmdE2E:
+		c.unseal(ws, args)
+	case model.MsgTime:
+		c.setTime(args)
+	default:
+		c.invoke(ws, cmd, args)
+	}
+}
+
+// Checks "SIG <key id> <time> <signature> <command>" and acts on the
+// command if it's signed with our key
+func (c *Client) verify(ws *websocket.Conn, args []string) {
+	c.mx.Lock()
+	k := c.signKey
+	c.mx.Unlock()
+	if k == nil || len(args) < 4 {
+		c.log.Warn("unexpected signed message")
+		return
+	}
+	t, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || args[0] != k.Id || !k.Verify(c.cfg.Id, t, []byte(strings.Join(args[3:], " ")), args[2]) {
+		c.log.Warn("ignoring badly signed message", "key", args[0])
+		return
+	}
+	if c.cfg.MaxSignedAge > 0 && time.Since(time.Unix(t, 0)) > c.cfg.MaxSignedAge {
+		c.log.Warn("ignoring old signed message", "cmd", args[3], "signed", time.Unix(t, 0))
+		return
+	}
+	c.dispatch(ws, args[3], args[4:], true)
+}
+
+// Moves to the key in "KEY <key id> <public key>", signed with the old one
+func (c *Client) rotate(ws *websocket.Conn, args []string, signed bool) {
+	if !signed || len(args) < 2 {
+		return
+	}
+	k, err := signing.ParsePublicKey(args[1])
+	if err != nil || k.Id != args[0] {
+		c.log.Warn("invalid signing key", "key", args[0], "err", err)
+		return
+	}
+	c.mx.Lock()
+	c.signKey = k
+	c.mx.Unlock()
+	c.log.Info("moved to new signing key", "key", k.Id)
+	if c.OnSigningKey != nil {
+		c.OnSigningKey(k)
+	}
+	if err := c.write(ws, model.RespKeyAck, k.Id); err != nil {
+		c.log.Warn("acknowledging signing key", "err", err)
+	}
+}
+
+// Runs the handler of a command like "DW 5 HIGH" and answers "DW 5 <result>"
+func (c *Client) invoke(ws *websocket.Conn, cmd string, args []string) {
+	reply, ok := c.run(cmd, args, false)
+	if !ok {
+		return
+	}
+	if err := c.write(ws, cmd, reply...); err != nil {
+		c.log.Warn("answering", "cmd", cmd, "err", err)
+	}
+}
+
+// Opens a sealed command "E2E <ref> <blob>", runs its handler and answers
+// "E2E <ref> <blob>" with the sealed result
+func (c *Client) unseal(ws *websocket.Conn, args []string) {
+	if c.cfg.Key == nil || len(args) < 2 {
+		c.log.Warn("unexpected sealed command")
+		return
+	}
+	text, s, err := e2e.Open(c.cfg.Key, args[1])
+	if err != nil {
+		c.log.Warn("opening sealed command", "err", err)
+		return
+	}
+	if c.cfg.MaxSealedAge > 0 && time.Since(s.Time) > c.cfg.MaxSealedAge {
+		c.log.Warn("refusing old sealed command", "sealed", s.Time)
+		return
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return
+	}
+	reply, ok := c.run(fields[0], fields[1:], true)
+	if !ok {
+		return
+	}
+	blob, err := s.Seal(strings.Join(append([]string{fields[0]}, reply...), " "))
+	if err != nil {
+		c.log.Warn("sealing answer", "err", err)
+		return
+	}
+	if err := c.write(ws, model.CmdE2E, args[0], blob); err != nil {
+		c.log.Warn("answering", "cmd", model.CmdE2E, "err", err)
+	}
+}
+
+// Runs the handler of cmd and returns the pin and result to answer with,
+// false if there's nothing to answer. Functions handled sealed only run if
+// the command was.
+func (c *Client) run(cmd string, args []string, sealed bool) ([]string, bool) {
+	var h Handler
+	if len(args) > 0 {
+		key := cmd + " " + args[0]
+		c.mx.Lock()
+		h = c.handlers[key]
+		refused := c.sealed[key] && !sealed
+		c.mx.Unlock()
+		if refused {
+			c.log.Warn("refusing unsealed command", "cmd", cmd, "pin", args[0])
+			return nil, false
+		}
+	}
+	if h == nil {
+		if c.OnMessage != nil {
+			c.OnMessage(cmd, args)
+		}
+		return nil, false
+	}
+	res, err := h(args[1:])
+	if err != nil {
+		// The server gives up waiting
+		c.log.Warn("invoking", "cmd", cmd, "pin", args[0], "err", err)
+		return nil, false
+	}
+	reply := []string{args[0]}
+	if res != "" {
+		reply = append(reply, res)
+	}
+	return reply, true
+}
@@ -0,0 +1,151 @@
+// Package nats implements ws.DeviceRouter with NATS. Every device has its
+// own subject, presence is kept in a JetStream key-value bucket.
+package nats
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/twinone/iot/backend/ws"
+)
+
+const (
+	presenceBucket = "iot_presence"
+	devicePrefix   = "iot.device."
+	// Subscribers of a device subject form a queue group, so while a device
+	// moves between nodes only one of them gets each message
+	deviceQueue = "iot"
+)
+
+type Broker struct {
+	nc *natsgo.Conn
+	kv natsgo.KeyValue
+}
+
+// Connects to the server at url, e.g. nats://localhost:4222. JetStream
+// must be enabled for the presence bucket.
+func Open(url string, name string) (*Broker, error) {
+	nc, err := natsgo.Connect(url, natsgo.Name(name))
+	if err != nil {
+		return nil, err
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	kv, err := js.KeyValue(presenceBucket)
+	if err == natsgo.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(&natsgo.KeyValueConfig{Bucket: presenceBucket, TTL: ws.PresenceTTL})
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &Broker{nc: nc, kv: kv}, nil
+}
+
+// Channels are named like "iot:node:a", subjects are separated by dots
+func subject(channel string) string {
+	return strings.ReplaceAll(channel, ":", ".")
+}
+
+// Device ids may contain characters that aren't allowed in subjects and keys
+func token(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+// Round trips to the server
+func (b *Broker) Ping(ctx context.Context) error {
+	return b.nc.FlushWithContext(ctx)
+}
+
+func (b *Broker) Publish(ctx context.Context, channel string, data []byte) error {
+	return b.nc.Publish(subject(channel), data)
+}
+
+func (b *Broker) Subscribe(ctx context.Context, channel string, handler func(data []byte)) error {
+	sub, err := b.nc.Subscribe(subject(channel), func(m *natsgo.Msg) {
+		handler(m.Data)
+	})
+	if err != nil {
+		return err
+	}
+	// Make sure the server knows about it before we return
+	if err := b.nc.FlushWithContext(ctx); err != nil {
+		sub.Unsubscribe()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		sub.Unsubscribe()
+	}()
+	return nil
+}
+
+func (b *Broker) SubscribeDevice(ctx context.Context, id string, handler func(data []byte)) (func(), error) {
+	sub, err := b.nc.QueueSubscribe(devicePrefix+token(id), deviceQueue, func(m *natsgo.Msg) {
+		// The reply only tells the sender someone has the device
+		m.Respond(nil)
+		handler(m.Data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() { sub.Unsubscribe() }, nil
+}
+
+func (b *Broker) PublishDevice(ctx context.Context, id string, data []byte) error {
+	_, err := b.nc.RequestWithContext(ctx, devicePrefix+token(id), data)
+	if err == natsgo.ErrNoResponders {
+		return ws.ErrNotConnected
+	}
+	return err
+}
+
+// The bucket TTL applies to every key, so ttl is ignored
+func (b *Broker) SetPresence(ctx context.Context, id, node string, ttl time.Duration) error {
+	_, err := b.kv.Put(token(id), []byte(node))
+	return err
+}
+
+func (b *Broker) ClearPresence(ctx context.Context, id, node string) error {
+	e, err := b.kv.Get(token(id))
+	if err == natsgo.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if string(e.Value()) != node {
+		return nil
+	}
+	// Fails if another node claimed it since we read it
+	if err := b.kv.Delete(token(id), natsgo.LastRevision(e.Revision())); err != nil && err != natsgo.ErrKeyExists {
+		return err
+	}
+	return nil
+}
+
+func (b *Broker) Presence(ctx context.Context, ids ...string) ([]string, error) {
+	res := make([]string, len(ids))
+	for i, id := range ids {
+		e, err := b.kv.Get(token(id))
+		if err == natsgo.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res[i] = string(e.Value())
+	}
+	return res, nil
+}
+
+// Delivers pending messages before closing the connection
+func (b *Broker) Close() error {
+	return b.nc.Drain()
+}
@@ -0,0 +1,102 @@
+// Package redis implements ws.Broker with Redis pub/sub, and keys with
+// a TTL for presence
+package redis
+
+import (
+	"context"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+const presencePrefix = "iot:presence:"
+
+// Deletes the presence key only if it still belongs to the node
+var clearScript = goredis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+type Broker struct {
+	client *goredis.Client
+}
+
+// Connects to the server at url, e.g. redis://localhost:6379/0
+func Open(url string) (*Broker, error) {
+	opt, err := goredis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := goredis.NewClient(opt)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &Broker{client: client}, nil
+}
+
+func (b *Broker) Ping(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
+
+func (b *Broker) Publish(ctx context.Context, channel string, data []byte) error {
+	return b.client.Publish(ctx, channel, data).Err()
+}
+
+func (b *Broker) Subscribe(ctx context.Context, channel string, handler func(data []byte)) error {
+	ps := b.client.Subscribe(ctx, channel)
+	// Wait for the confirmation so no message published after we return is missed
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return err
+	}
+	go func() {
+		defer ps.Close()
+		ch := ps.Channel()
+		for {
+			select {
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				handler([]byte(msg.Payload))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *Broker) SetPresence(ctx context.Context, id, node string, ttl time.Duration) error {
+	return b.client.Set(ctx, presencePrefix+id, node, ttl).Err()
+}
+
+func (b *Broker) ClearPresence(ctx context.Context, id, node string) error {
+	return clearScript.Run(ctx, b.client, []string{presencePrefix + id}, node).Err()
+}
+
+func (b *Broker) Presence(ctx context.Context, ids ...string) ([]string, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = presencePrefix + id
+	}
+	vals, err := b.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, len(ids))
+	for i, v := range vals {
+		// Missing keys are nil
+		if s, ok := v.(string); ok {
+			res[i] = s
+		}
+	}
+	return res, nil
+}
+
+func (b *Broker) Close() error {
+	return b.client.Close()
+}
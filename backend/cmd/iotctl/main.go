@@ -0,0 +1,290 @@
+// Command iotctl uses the backend's API from a terminal or a script:
+//
+//	iotctl -url https://iot.example.com login me@example.com
+//	iotctl devices
+//	iotctl invoke lamp light HIGH
+//	iotctl events
+//
+// The token login gets is kept in ~/.iotctl. Flags can also be set in the
+// environment, like IOT_URL and IOT_TOKEN.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/namsral/flag"
+	"github.com/twinone/iot/backend/signing"
+)
+
+const usage = `Usage: iotctl [flags] <command> [args]
+
+Commands:
+  login <email>                   sign in with a password read from stdin, keeping the token
+  whoami                          show your user
+  devices                         list your devices and those shared with you
+  device <id>                     show a device
+  rename <id> <name>              rename a device
+  rm <id>                         delete a device
+  invoke <id> <function> [args]   invoke a function and print the answer
+  exec <id> <command>             send a raw command, like "DW 5 HIGH"
+  events                          print the events of your devices as they happen
+  token <id>                      issue the token a device sends in HELLO
+  shares <id>                     list who a device is shared with
+  share <id> <email> <role>       share a device as viewer, controller or admin
+  unshare <id> <email>            stop sharing a device
+  connections                     list the connections of an instance (operators)
+  kick <id>                       disconnect a device (operators)
+  tenants                         list tenants (operators)
+  move <email> <tenant>           move a user to a tenant, "default" for the default one (operators)
+  signing-keys                    list the public keys devices can verify commands with
+  keygen                          make a key for signing_key, printing it, its id and public half
+
+Flags:
+`
+
+var flags = flag.NewFlagSetWithEnvPrefix("iotctl", "IOT", flag.ExitOnError)
+
+var (
+	baseURL = flags.String("url", "http://localhost:8080", "URL of the backend")
+	token   = flags.String("token", "", "Token to authenticate with, the one login kept if empty")
+	raw     = flags.Bool("json", false, "Print JSON instead of tables")
+)
+
+func main() {
+	log.SetFlags(0)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+	args := flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *token == "" {
+		if data, err := os.ReadFile(tokenFile()); err == nil {
+			*token = strings.TrimSpace(string(data))
+		}
+	}
+
+	cmd, args := args[0], args[1:]
+	need := func(n int) {
+		if len(args) < n {
+			flags.Usage()
+			os.Exit(2)
+		}
+	}
+	id := func() string { return url.PathEscape(args[0]) }
+	switch cmd {
+	case "login":
+		need(1)
+		login(args[0])
+	case "whoami":
+		var res struct {
+			User json.RawMessage `json:"user"`
+		}
+		call("GET", "/api/profile", nil, &res)
+		printJSON(res.User)
+	case "devices":
+		var devices []struct {
+			Id     string `json:"id"`
+			Name   string `json:"name"`
+			Owner  string `json:"owner"`
+			Online bool   `json:"online"`
+			Role   string `json:"role"`
+		}
+		data := call("GET", "/api/devices", nil, &devices)
+		if *raw {
+			printJSON(data)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tONLINE\tOWNER\tROLE")
+		for _, d := range devices {
+			fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\n", d.Id, d.Name, d.Online, d.Owner, d.Role)
+		}
+		w.Flush()
+	case "device":
+		need(1)
+		printJSON(call("GET", "/api/devices/"+id(), nil, nil))
+	case "rename":
+		need(2)
+		call("PATCH", "/api/devices/"+id(), map[string]string{"name": strings.Join(args[1:], " ")}, nil)
+	case "rm":
+		need(1)
+		call("DELETE", "/api/devices/"+id(), nil, nil)
+	case "invoke":
+		need(2)
+		body := map[string][]string{"args": args[2:]}
+		printJSON(call("POST", "/api/devices/"+id()+"/functions/"+url.PathEscape(args[1]), body, nil))
+	case "exec":
+		need(2)
+		call("POST", "/api/exec", map[string]string{"id": args[0], "cmd": strings.Join(args[1:], " ")}, nil)
+	case "events":
+		events()
+	case "token":
+		need(1)
+		printJSON(call("POST", "/api/devices/"+id()+"/token", nil, nil))
+	case "shares":
+		need(1)
+		printJSON(call("GET", "/api/devices/"+id()+"/shares", nil, nil))
+	case "share":
+		need(3)
+		call("PUT", "/api/devices/"+id()+"/shares/"+url.PathEscape(args[1]), map[string]string{"role": args[2]}, nil)
+	case "unshare":
+		need(2)
+		call("DELETE", "/api/devices/"+id()+"/shares/"+url.PathEscape(args[1]), nil, nil)
+	case "connections":
+		printJSON(call("GET", "/api/admin/connections", nil, nil))
+	case "kick":
+		need(1)
+		call("DELETE", "/api/admin/connections/"+id(), nil, nil)
+	case "tenants":
+		printJSON(call("GET", "/api/admin/tenants", nil, nil))
+	case "move":
+		need(2)
+		call("PUT", "/api/admin/tenants/"+url.PathEscape(args[1])+"/users/"+id(), nil, nil)
+	case "signing-keys":
+		printJSON(call("GET", "/api/signing-keys", nil, nil))
+	case "keygen":
+		keygen()
+	default:
+		log.Fatal("unknown command ", cmd)
+	}
+}
+
+func tokenFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".iotctl"
+	}
+	return filepath.Join(home, ".iotctl")
+}
+
+// Calls the API, decoding the response into res if it isn't nil, and
+// returns its body. Exits on errors.
+func call(method, path string, body interface{}, res interface{}) []byte {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(*baseURL, "/")+path, r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		log.Fatal("not signed in, run iotctl login")
+	case resp.StatusCode >= 300:
+		log.Fatalf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if res != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, res); err != nil {
+			log.Fatal("unexpected response: ", err)
+		}
+	}
+	return data
+}
+
+func printJSON(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		os.Stdout.Write(data)
+		return
+	}
+	out.WriteByte('\n')
+	out.WriteTo(os.Stdout)
+}
+
+func login(email string) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Fatal(err)
+	}
+	var res struct {
+		Token string `json:"token"`
+	}
+	call("POST", "/auth/login", map[string]string{"email": email, "password": strings.TrimRight(password, "\r\n")}, &res)
+	if err := os.WriteFile(tokenFile(), []byte(res.Token+"\n"), 0600); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintln(os.Stderr, "Signed in as", email)
+}
+
+// Prints events as JSON lines until the connection drops
+func events() {
+	u := strings.TrimSuffix(*baseURL, "/") + "/api/events"
+	u = "ws" + strings.TrimPrefix(u, "http")
+	h := http.Header{}
+	if *token != "" {
+		h.Set("Authorization", "Bearer "+*token)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(u, h)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			log.Fatal("not signed in, run iotctl login")
+		}
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(append(data, '\n'))
+	}
+}
+
+// Prints a new signing key, which never leaves this machine
+func keygen() {
+	seed, err := signing.GenerateKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	k, err := signing.ParseKey(seed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("signing_key:", seed)
+	fmt.Println("id:         ", k.Id)
+	fmt.Println("public key: ", k.Encode())
+}
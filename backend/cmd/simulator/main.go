@@ -0,0 +1,251 @@
+// Command simulator connects many fake devices to a backend to load test
+// the hub and shake out races before real hardware does. Devices send
+// telemetry at a fixed rate, answer commands and can be made to drop
+// their connection without BYE now and then, or to read slowly.
+//
+//	go run ./cmd/simulator -url ws://localhost:8080/ws -owner me@example.com -n 1000 -rate 2 -flap 5m -slow 0.05
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/namsral/flag"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/ws"
+)
+
+// Flags can also be set in the environment, like SIM_URL
+var flags = flag.NewFlagSetWithEnvPrefix("simulator", "SIM", flag.ExitOnError)
+
+var (
+	url         = flags.String("url", "ws://localhost:8080/ws", "WebSocket endpoint of the backend")
+	owner       = flags.String("owner", "", "Registered user the devices belong to")
+	n           = flags.Int("n", 10, "Number of devices")
+	prefix      = flags.String("prefix", "sim-", "Prefix of the device ids, followed by their number")
+	tokenSource = flags.String("tokens", "", "File with a line \"<id> <token>\" per device, if the backend asks for tokens")
+	rate        = flags.Float64("rate", 1, "Telemetry messages per second per device, 0 for none")
+	ramp        = flags.Duration("ramp", 10*time.Second, "Time over which devices connect at first")
+	flap        = flags.Duration("flap", 0, "Mean time a connection lasts before it's dropped without BYE, 0 to keep it")
+	slow        = flags.Float64("slow", 0, "Fraction of devices that read slowly")
+	slowDelay   = flags.Duration("slow_delay", time.Second, "How long slow devices wait before each read")
+	keepAlive   = flags.Duration("keepalive", 0, "Keepalive devices ask for in HELLO, the server's default if 0")
+	duration    = flags.Duration("duration", 0, "How long to run, until interrupted if 0")
+)
+
+// Tokens of the devices by id, from -tokens
+var tokens = map[string]string{}
+
+// Counters printed every few seconds
+var stats struct {
+	connected, dials, dialErrors, drops int64
+	sent, received, acks                int64
+}
+
+func main() {
+	flags.Parse(os.Args[1:])
+	if *owner == "" {
+		log.Fatal("-owner is required")
+	}
+	if *tokenSource != "" {
+		data, err := os.ReadFile(*tokenSource)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if f := strings.Fields(line); len(f) == 2 {
+				tokens[f[0]] = f[1]
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		cancel()
+	}()
+	go report(ctx)
+
+	var wg sync.WaitGroup
+	for i := 0; i < *n; i++ {
+		d := &device{
+			id:   *prefix + strconv.Itoa(i),
+			slow: rand.Float64() < *slow,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Spread the first connections over the ramp
+			if *ramp > 0 {
+				select {
+				case <-time.After(time.Duration(rand.Int63n(int64(*ramp)))):
+				case <-ctx.Done():
+					return
+				}
+			}
+			d.run(ctx)
+		}()
+	}
+	wg.Wait()
+	printStats()
+}
+
+func report(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			printStats()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func printStats() {
+	log.Printf("connected %d, dials %d (%d failed), drops %d, sent %d, received %d, acks %d",
+		atomic.LoadInt64(&stats.connected), atomic.LoadInt64(&stats.dials), atomic.LoadInt64(&stats.dialErrors),
+		atomic.LoadInt64(&stats.drops), atomic.LoadInt64(&stats.sent), atomic.LoadInt64(&stats.received),
+		atomic.LoadInt64(&stats.acks))
+}
+
+type device struct {
+	id   string
+	slow bool
+}
+
+// Connects over and over until ctx is done
+func (d *device) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := d.session(ctx); err != nil && ctx.Err() == nil {
+			log.Println(d.id+":", err)
+		}
+		select {
+		case <-time.After(time.Second + time.Duration(rand.Int63n(int64(time.Second)))):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (d *device) session(ctx context.Context) error {
+	atomic.AddInt64(&stats.dials, 1)
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second, Subprotocols: []string{ws.SubprotocolText}}
+	conn, _, err := dialer.DialContext(ctx, *url, nil)
+	if err != nil {
+		atomic.AddInt64(&stats.dialErrors, 1)
+		return err
+	}
+	defer conn.Close()
+	atomic.AddInt64(&stats.connected, 1)
+	defer atomic.AddInt64(&stats.connected, -1)
+
+	// Only the writer goroutine writes, the reader hands it answers
+	out := make(chan string, 16)
+	hello := model.RespHello + " " + d.id
+	if token := tokens[d.id]; token != "" {
+		hello += " " + token
+	}
+	hello += " version=" + strconv.Itoa(ws.ProtocolVersion)
+	if *keepAlive > 0 {
+		hello += fmt.Sprintf(" keepalive=%d", int(*keepAlive/time.Second))
+	}
+	out <- hello
+	out <- model.RespOwner + " " + *owner
+	out <- model.RespFuncs + ` [{"name":"light","cmd":"DW","pin":5,"params":[{"name":"value","type":"enum","values":["HIGH","LOW"]}]}]`
+
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() { readErr <- d.read(conn, out, done) }()
+
+	var telemetry <-chan time.Time
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer ticker.Stop()
+		telemetry = ticker.C
+	}
+	var drop <-chan time.Time
+	if *flap > 0 {
+		drop = time.After(time.Duration(rand.ExpFloat64() * float64(*flap)))
+	}
+	for {
+		var msg string
+		select {
+		case msg = <-out:
+		case <-telemetry:
+			msg = fmt.Sprintf("%s temp %.1f hum %d", model.RespTelemetry, 15+10*rand.Float64(), 30+rand.Intn(40))
+		case <-drop:
+			// Like a device losing power, the server publishes its will
+			atomic.AddInt64(&stats.drops, 1)
+			return nil
+		case err := <-readErr:
+			return err
+		case <-ctx.Done():
+			conn.WriteMessage(websocket.TextMessage, []byte(model.RespBye))
+			return nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			return err
+		}
+		atomic.AddInt64(&stats.sent, 1)
+	}
+}
+
+// Answers commands like "DW 5 HIGH" by echoing them, and acknowledges
+// messages with a sequence number
+func (d *device) read(conn *websocket.Conn, out chan<- string, done <-chan struct{}) error {
+	send := func(msg string) {
+		select {
+		case out <- msg:
+		case <-done:
+		}
+	}
+	for {
+		if d.slow {
+			time.Sleep(*slowDelay)
+		}
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&stats.received, 1)
+
+		fields := strings.Fields(string(data))
+		if len(fields) > 1 {
+			if _, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+				send(model.RespAck + " " + fields[0])
+				atomic.AddInt64(&stats.acks, 1)
+				fields = fields[1:]
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case model.CmdDigitalWrite, model.CmdAnalogWrite, model.CmdDigitalRead, model.CmdAnalogRead, model.CmdNop:
+			send(strings.Join(fields, " "))
+		case model.MsgError:
+			log.Println(d.id+": server error:", strings.Join(fields[1:], " "))
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Package config loads the backend's settings from a file, the
+// environment and command line flags, in increasing order of precedence.
+//
+// The file is YAML if its name ends in .yaml or .yml, TOML if it ends in
+// .toml, and "name value" lines otherwise. Every setting is a string, lists
+// are comma separated or YAML/TOML lists. A setting like session_ttl can be
+// overridden with IOT_SESSION_TTL, or SESSION_TTL as older deployments do,
+// and with -session_ttl.
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables overriding settings
+const EnvPrefix = "IOT_"
+
+// Read if no other file is given with -config or IOT_CONFIG
+const DefaultFile = "./config"
+
+// Values of the settings by name
+type Config map[string]*string
+
+// Settings are defined like flags, then loaded:
+//
+//	s := config.NewSettings()
+//	c := config.Config{"addr": s.String("addr", ":8080", "Address to listen on")}
+//	err := s.Load(os.Args[1:])
+type Settings struct {
+	fs     *flag.FlagSet
+	file   *string
+	values Config
+}
+
+func NewSettings() *Settings {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	return &Settings{
+		fs:     fs,
+		file:   fs.String("config", "", "Config file, "+DefaultFile+" if it exists"),
+		values: make(Config),
+	}
+}
+
+// Defines a setting and returns where its value will be once loaded
+func (s *Settings) String(name, value, usage string) *string {
+	v := s.fs.String(name, value, usage)
+	s.values[name] = v
+	return v
+}
+
+// Loads the settings from the file, environment and args, which don't
+// include the program name. Unknown settings in the file are an error, so
+// typos don't go unnoticed.
+func (s *Settings) Load(args []string) error {
+	if err := s.fs.Parse(args); err != nil {
+		return err
+	}
+	// Applied again last, they take precedence
+	flags := make(map[string]string)
+	s.fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+
+	path, required := *s.file, true
+	if path == "" {
+		path = os.Getenv(EnvPrefix + "CONFIG")
+	}
+	if path == "" {
+		path, required = DefaultFile, false
+	}
+	values, err := readFile(path)
+	if os.IsNotExist(err) && !required {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	for name, v := range values {
+		if s.values[name] == nil {
+			return fmt.Errorf("%s: unknown setting %s", path, name)
+		}
+		*s.values[name] = v
+	}
+
+	for name, v := range s.values {
+		env := strings.ToUpper(name)
+		if e, ok := os.LookupEnv(EnvPrefix + env); ok {
+			*v = e
+		} else if e, ok := os.LookupEnv(env); ok {
+			*v = e
+		}
+	}
+
+	for name, v := range flags {
+		if p := s.values[name]; p != nil {
+			*p = v
+		}
+	}
+	return nil
+}
+
+// Returns the settings in the file at path by name
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		_, err = toml.Decode(string(data), &raw)
+	default:
+		return readLines(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		if values[name], err = format(v); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return values, nil
+}
+
+// Reads "name value" or "name=value" lines, skipping blank ones and #
+// comments
+func readLines(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value := line, ""
+		if i := strings.IndexAny(line, " \t="); i >= 0 {
+			name, value = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		if name == "" {
+			return nil, fmt.Errorf("line %d: no setting", n)
+		}
+		values[name] = value
+	}
+	return values, scanner.Err()
+}
+
+// Turns what YAML or TOML decoded into a setting
+func format(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			s, err := format(e)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", errors.New("must be a string, number, boolean or list")
+}
+
+// Returns the value of a setting, "" if it isn't defined
+func (c Config) Get(name string) string {
+	if v := c[name]; v != nil {
+		return *v
+	}
+	return ""
+}
+
+func (c Config) Bool(name string) bool {
+	b, _ := strconv.ParseBool(c.Get(name))
+	return b
+}
+
+func (c Config) Int(name string) (int, error) {
+	n, err := strconv.Atoi(c.Get(name))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", name, c.Get(name))
+	}
+	return n, nil
+}
+
+func (c Config) Duration(name string) (time.Duration, error) {
+	d, err := time.ParseDuration(c.Get(name))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", name, c.Get(name))
+	}
+	return d, nil
+}
+
+// Returns the elements of a comma separated setting, none if it's empty
+func (c Config) List(name string) []string {
+	var res []string
+	for _, s := range strings.Split(c.Get(name), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, s)
+		}
+	}
+	return res
+}
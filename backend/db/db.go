@@ -14,6 +14,26 @@ const (
 	UsersCollection       = "users"
 	AccesTokensCollection = "accesstokens"
 	FunctionsCollection   = "functions"
+	DevicesCollection     = "devices"
+	QueuesCollection      = "queues"
+	ShadowsCollection     = "shadows"
+	GroupsCollection      = "groups"
+	SharesCollection      = "shares"
+	RulesCollection       = "rules"
+	SchedulesCollection   = "schedules"
+	ScenesCollection      = "scenes"
+	WebhooksCollection    = "webhooks"
+	FirmwareCollection    = "firmware"
+	// Firmware images, apart so listing firmware doesn't load them
+	FirmwareDataCollection = "firmwaredata"
+	RolloutsCollection     = "rollouts"
+	PresenceCollection     = "presence"
+	TenantsCollection      = "tenants"
+	NotifyPrefsCollection  = "notificationprefs"
+	AuditCollection        = "audit"
+	HistoryCollection      = "history"
+	APIKeysCollection      = "apikeys"
+	IdentitiesCollection   = "identities"
 )
 
 var defaultSession *mgo.Session
@@ -117,6 +137,788 @@ func RemoveAccessToken(token string) {
 	c.Remove(bson.M{"token": token})
 }
 
+func FindIdentity(query bson.M) (*model.Identity, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	id := &model.Identity{}
+	err := s.DB(DBName).C(IdentitiesCollection).Find(query).One(id)
+	return id, err
+}
+
+func FindIdentities(query bson.M) ([]*model.Identity, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var ids []*model.Identity
+	err := s.DB(DBName).C(IdentitiesCollection).Find(query).All(&ids)
+	return ids, err
+}
+
+func InsertIdentity(id *model.Identity) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	return s.DB(DBName).C(IdentitiesCollection).Insert(id)
+}
+
+func RemoveIdentity(query bson.M) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	return s.DB(DBName).C(IdentitiesCollection).Remove(query)
+}
+
+func FindAPIKeyByHash(hash string) (*model.APIKey, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	k := &model.APIKey{}
+	err := s.DB(DBName).C(APIKeysCollection).Find(bson.M{"hash": hash}).One(k)
+	return k, err
+}
+
+func FindAPIKeys(query bson.M) ([]*model.APIKey, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var keys []*model.APIKey
+	err := s.DB(DBName).C(APIKeysCollection).Find(query).All(&keys)
+	return keys, err
+}
+
+func InsertAPIKey(k *model.APIKey) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	return s.DB(DBName).C(APIKeysCollection).Insert(k)
+}
+
+func RemoveAPIKey(id string, owner string) error {
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(APIKeysCollection)
+	return c.Remove(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner})
+}
+
+func FindDeviceById(id string) (*model.Device, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	d := &model.Device{}
+	c := s.DB(DBName).C(DevicesCollection)
+	if err := c.Find(bson.M{"id": id}).One(d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func FindDevicesByOwner(owner string) []*model.Device {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var d []*model.Device
+	c := s.DB(DBName).C(DevicesCollection)
+	if err := c.Find(bson.M{"owner": owner, "deleted": bson.M{"$not": bson.M{"$gt": 0}}}).Sort("name", "id").All(&d); err != nil {
+		log.Println(err)
+		return nil
+	}
+	return d
+}
+
+// Devices that aren't deleted and were seen, but not since seenBefore
+func FindStaleDevices(seenBefore int64) ([]*model.Device, error) {
+	return findDevices(bson.M{
+		"deleted":  bson.M{"$not": bson.M{"$gt": 0}},
+		"lastseen": bson.M{"$gt": 0, "$lt": seenBefore},
+	})
+}
+
+// Devices deleted before deletedBefore, of any owner if owner is empty
+func FindDeletedDevices(owner string, deletedBefore int64) ([]*model.Device, error) {
+	filter := bson.M{"deleted": bson.M{"$gt": 0, "$lt": deletedBefore}}
+	if owner != "" {
+		filter["owner"] = owner
+	}
+	return findDevices(filter)
+}
+
+func findDevices(filter bson.M) ([]*model.Device, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var d []*model.Device
+	err := s.DB(DBName).C(DevicesCollection).Find(filter).All(&d)
+	return d, err
+}
+
+func UpsertDevice(d *model.Device) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(DevicesCollection)
+	_, err := c.Upsert(bson.M{"id": d.Id}, d)
+	return err
+}
+
+func RemoveDevice(id string) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(DevicesCollection)
+	return c.Remove(bson.M{"id": id})
+}
+
+func UpdateLastSeen(id string, lastSeen int64) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(DevicesCollection)
+	_, err := c.UpdateAll(bson.M{"id": id}, bson.M{"$set": bson.M{"lastseen": lastSeen}})
+	return err
+}
+
+// A presence change with an id to keep them in order
+type presence struct {
+	Id                   bson.ObjectId `bson:"_id"`
+	model.PresenceChange `bson:",inline"`
+}
+
+// Returns the newest presence changes of a device first
+func FindPresence(deviceId string, limit int) ([]*model.PresenceChange, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var ps []presence
+	c := s.DB(DBName).C(PresenceCollection)
+	if err := c.Find(bson.M{"deviceid": deviceId}).Sort("-_id").Limit(limit).All(&ps); err != nil {
+		return nil, err
+	}
+	res := make([]*model.PresenceChange, len(ps))
+	for i := range ps {
+		res[i] = &ps[i].PresenceChange
+	}
+	return res, nil
+}
+
+// Inserts a presence change and removes the ones past the newest keep
+func InsertPresence(p *model.PresenceChange, keep int) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(PresenceCollection)
+	if err := c.Insert(&presence{Id: bson.NewObjectId(), PresenceChange: *p}); err != nil {
+		return err
+	}
+	var oldest presence
+	err := c.Find(bson.M{"deviceid": p.DeviceId}).Sort("-_id").Skip(keep - 1).One(&oldest)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = c.RemoveAll(bson.M{"deviceid": p.DeviceId, "_id": bson.M{"$lt": oldest.Id}})
+	return err
+}
+
+type queue struct {
+	DeviceId string                 `bson:"id"`
+	Messages []*model.QueuedMessage `bson:"messages"`
+}
+
+func FindQueue(deviceId string) []*model.QueuedMessage {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	q := &queue{}
+	c := s.DB(DBName).C(QueuesCollection)
+	if err := c.Find(bson.M{"id": deviceId}).One(q); err != nil {
+		return nil
+	}
+	return q.Messages
+}
+
+func SaveQueue(deviceId string, msgs []*model.QueuedMessage) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(QueuesCollection)
+	if len(msgs) == 0 {
+		_, err := c.RemoveAll(bson.M{"id": deviceId})
+		return err
+	}
+	_, err := c.Upsert(bson.M{"id": deviceId}, &queue{DeviceId: deviceId, Messages: msgs})
+	return err
+}
+
+func FindShadow(deviceId string) *model.Shadow {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	sh := &model.Shadow{}
+	c := s.DB(DBName).C(ShadowsCollection)
+	if err := c.Find(bson.M{"id": deviceId}).One(sh); err != nil {
+		return nil
+	}
+	return sh
+}
+
+func UpsertShadow(sh *model.Shadow) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(ShadowsCollection)
+	_, err := c.Upsert(bson.M{"id": sh.DeviceId}, sh)
+	return err
+}
+
+func FindGroupById(id string) *model.Group {
+	if !bson.IsObjectIdHex(id) {
+		return nil
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	g := &model.Group{}
+	c := s.DB(DBName).C(GroupsCollection)
+	if err := c.FindId(bson.ObjectIdHex(id)).One(g); err != nil {
+		return nil
+	}
+	return g
+}
+
+func FindGroupsByOwner(owner string) []*model.Group {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var g []*model.Group
+	c := s.DB(DBName).C(GroupsCollection)
+	if err := c.Find(bson.M{"owner": owner}).Sort("name").All(&g); err != nil {
+		log.Println(err)
+		return nil
+	}
+	return g
+}
+
+func UpsertGroup(g *model.Group) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(GroupsCollection)
+	_, err := c.UpsertId(g.Id, g)
+	return err
+}
+
+func RemoveGroup(id string, owner string) error {
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(GroupsCollection)
+	return c.Remove(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner})
+}
+
+func FindShare(deviceId string, email string) *model.Share {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	sh := &model.Share{}
+	c := s.DB(DBName).C(SharesCollection)
+	if err := c.Find(bson.M{"deviceid": deviceId, "email": email}).One(sh); err != nil {
+		return nil
+	}
+	return sh
+}
+
+func FindShares(query bson.M) ([]*model.Share, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var sh []*model.Share
+	c := s.DB(DBName).C(SharesCollection)
+	err := c.Find(query).All(&sh)
+	return sh, err
+}
+
+func UpsertShare(sh *model.Share) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(SharesCollection)
+	_, err := c.Upsert(bson.M{"deviceid": sh.DeviceId, "email": sh.Email}, sh)
+	return err
+}
+
+func RemoveShare(deviceId string, email string) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(SharesCollection)
+	_, err := c.RemoveAll(bson.M{"deviceid": deviceId, "email": email})
+	return err
+}
+
+func FindRuleById(id string) *model.Rule {
+	if !bson.IsObjectIdHex(id) {
+		return nil
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	r := &model.Rule{}
+	c := s.DB(DBName).C(RulesCollection)
+	if err := c.FindId(bson.ObjectIdHex(id)).One(r); err != nil {
+		return nil
+	}
+	return r
+}
+
+func FindRules(query bson.M) ([]*model.Rule, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var r []*model.Rule
+	c := s.DB(DBName).C(RulesCollection)
+	err := c.Find(query).All(&r)
+	return r, err
+}
+
+func UpsertRule(r *model.Rule) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(RulesCollection)
+	_, err := c.UpsertId(r.Id, r)
+	return err
+}
+
+func RemoveRule(id string, owner string) error {
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(RulesCollection)
+	return c.Remove(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner})
+}
+
+func FindScheduleById(id string) *model.Schedule {
+	if !bson.IsObjectIdHex(id) {
+		return nil
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	sc := &model.Schedule{}
+	c := s.DB(DBName).C(SchedulesCollection)
+	if err := c.FindId(bson.ObjectIdHex(id)).One(sc); err != nil {
+		return nil
+	}
+	return sc
+}
+
+func FindSchedules(query bson.M) ([]*model.Schedule, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var sc []*model.Schedule
+	c := s.DB(DBName).C(SchedulesCollection)
+	err := c.Find(query).All(&sc)
+	return sc, err
+}
+
+func UpsertSchedule(sc *model.Schedule) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(SchedulesCollection)
+	_, err := c.UpsertId(sc.Id, sc)
+	return err
+}
+
+func RemoveSchedule(id string, owner string) error {
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(SchedulesCollection)
+	return c.Remove(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner})
+}
+
+func FindSceneById(id string) *model.Scene {
+	if !bson.IsObjectIdHex(id) {
+		return nil
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	sc := &model.Scene{}
+	c := s.DB(DBName).C(ScenesCollection)
+	if err := c.FindId(bson.ObjectIdHex(id)).One(sc); err != nil {
+		return nil
+	}
+	return sc
+}
+
+func FindScenes(query bson.M) ([]*model.Scene, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var sc []*model.Scene
+	c := s.DB(DBName).C(ScenesCollection)
+	err := c.Find(query).All(&sc)
+	return sc, err
+}
+
+func UpsertScene(sc *model.Scene) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(ScenesCollection)
+	_, err := c.UpsertId(sc.Id, sc)
+	return err
+}
+
+func RemoveScene(id string, owner string) error {
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(ScenesCollection)
+	return c.Remove(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner})
+}
+
+func FindWebhookById(id string) *model.Webhook {
+	if !bson.IsObjectIdHex(id) {
+		return nil
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	wh := &model.Webhook{}
+	c := s.DB(DBName).C(WebhooksCollection)
+	if err := c.FindId(bson.ObjectIdHex(id)).One(wh); err != nil {
+		return nil
+	}
+	return wh
+}
+
+func FindWebhooks(query bson.M) ([]*model.Webhook, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var wh []*model.Webhook
+	c := s.DB(DBName).C(WebhooksCollection)
+	err := c.Find(query).All(&wh)
+	return wh, err
+}
+
+func UpsertWebhook(wh *model.Webhook) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(WebhooksCollection)
+	_, err := c.UpsertId(wh.Id, wh)
+	return err
+}
+
+func RemoveWebhook(id string, owner string) error {
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(WebhooksCollection)
+	return c.Remove(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner})
+}
+
+func FindFirmwareById(id string) *model.Firmware {
+	if !bson.IsObjectIdHex(id) {
+		return nil
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	f := &model.Firmware{}
+	c := s.DB(DBName).C(FirmwareCollection)
+	if err := c.FindId(bson.ObjectIdHex(id)).One(f); err != nil {
+		return nil
+	}
+	return f
+}
+
+func FindFirmwares(query bson.M) ([]*model.Firmware, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var f []*model.Firmware
+	c := s.DB(DBName).C(FirmwareCollection)
+	err := c.Find(query).Sort("_id").All(&f)
+	return f, err
+}
+
+type firmwareData struct {
+	Id   bson.ObjectId `bson:"_id"`
+	Data []byte        `bson:"data"`
+}
+
+// Inserts the image before the firmware, so there's never a firmware
+// without one
+func InsertFirmware(f *model.Firmware, data []byte) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	if err := s.DB(DBName).C(FirmwareDataCollection).Insert(&firmwareData{Id: f.Id, Data: data}); err != nil {
+		return err
+	}
+	return s.DB(DBName).C(FirmwareCollection).Insert(f)
+}
+
+func FindFirmwareData(id string) ([]byte, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, mgo.ErrNotFound
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	fd := &firmwareData{}
+	c := s.DB(DBName).C(FirmwareDataCollection)
+	if err := c.FindId(bson.ObjectIdHex(id)).One(fd); err != nil {
+		return nil, err
+	}
+	return fd.Data, nil
+}
+
+func RemoveFirmware(id string, owner string) error {
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(FirmwareCollection)
+	if err := c.Remove(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner}); err != nil {
+		return err
+	}
+	return s.DB(DBName).C(FirmwareDataCollection).RemoveId(bson.ObjectIdHex(id))
+}
+
+func FindRolloutById(id string) *model.Rollout {
+	if !bson.IsObjectIdHex(id) {
+		return nil
+	}
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	r := &model.Rollout{}
+	c := s.DB(DBName).C(RolloutsCollection)
+	if err := c.FindId(bson.ObjectIdHex(id)).One(r); err != nil {
+		return nil
+	}
+	return r
+}
+
+func FindRollouts(query bson.M) ([]*model.Rollout, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var r []*model.Rollout
+	c := s.DB(DBName).C(RolloutsCollection)
+	err := c.Find(query).Sort("_id").All(&r)
+	return r, err
+}
+
+func UpsertRollout(r *model.Rollout) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(RolloutsCollection)
+	_, err := c.UpsertId(r.Id, r)
+	return err
+}
+
+func UpdateUserTenant(email string, tenant string) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(UsersCollection)
+	return c.Update(bson.M{"email": email}, bson.M{"$set": bson.M{"tenant": tenant}})
+}
+
+func UpdateUserDisabled(email string, disabled bool) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(UsersCollection)
+	return c.Update(bson.M{"email": email}, bson.M{"$set": bson.M{"disabled": disabled}})
+}
+
+func FindTenant(id string) *model.Tenant {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	t := &model.Tenant{}
+	c := s.DB(DBName).C(TenantsCollection)
+	if err := c.Find(bson.M{"id": id}).One(t); err != nil {
+		return nil
+	}
+	return t
+}
+
+func FindTenants() ([]*model.Tenant, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	var t []*model.Tenant
+	c := s.DB(DBName).C(TenantsCollection)
+	err := c.Find(nil).Sort("id").All(&t)
+	return t, err
+}
+
+func UpsertTenant(t *model.Tenant) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(TenantsCollection)
+	_, err := c.Upsert(bson.M{"id": t.Id}, t)
+	return err
+}
+
+func RemoveTenant(id string) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(TenantsCollection)
+	return c.Remove(bson.M{"id": id})
+}
+
+func FindNotificationPrefs(email string) *model.NotificationPrefs {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	p := &model.NotificationPrefs{}
+	c := s.DB(DBName).C(NotifyPrefsCollection)
+	if err := c.Find(bson.M{"email": email}).One(p); err != nil {
+		return nil
+	}
+	return p
+}
+
+func UpsertNotificationPrefs(p *model.NotificationPrefs) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(NotifyPrefsCollection)
+	_, err := c.Upsert(bson.M{"email": p.Email}, p)
+	return err
+}
+
+// Returns the newest commands matching q first
+func FindHistory(q *model.HistoryQuery) ([]*model.HistoryEntry, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	filter := bson.M{"deviceid": q.DeviceId}
+	if q.Function != "" {
+		filter["function"] = q.Function
+	}
+	if q.Result != "" {
+		filter["result"] = q.Result
+	}
+	if q.Before != "" {
+		filter["_id"] = bson.M{"$lt": q.Before}
+	}
+
+	var res []*model.HistoryEntry
+	err := s.DB(DBName).C(HistoryCollection).Find(filter).Sort("-_id").Limit(q.Limit).All(&res)
+	return res, err
+}
+
+// Inserts a command and removes the ones of its device past the newest keep
+func InsertHistory(e *model.HistoryEntry, keep int) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	c := s.DB(DBName).C(HistoryCollection)
+	e.Id = bson.NewObjectId()
+	if err := c.Insert(e); err != nil {
+		return err
+	}
+	var oldest model.HistoryEntry
+	err := c.Find(bson.M{"deviceid": e.DeviceId}).Sort("-_id").Skip(keep - 1).One(&oldest)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = c.RemoveAll(bson.M{"deviceid": e.DeviceId, "_id": bson.M{"$lt": oldest.Id}})
+	return err
+}
+
+// Removes the commands sent before before and returns how many
+func PruneHistory(before int64) (int, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	info, err := s.DB(DBName).C(HistoryCollection).RemoveAll(bson.M{"time": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+func InsertAudit(e *model.AuditEntry) error {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	e.Id = bson.NewObjectId()
+	return s.DB(DBName).C(AuditCollection).Insert(e)
+}
+
+// Returns the newest audit entries matching q first
+func FindAudit(q *model.AuditQuery) ([]*model.AuditEntry, error) {
+	s := defaultSession.Copy()
+	defer s.Close()
+
+	filter := bson.M{}
+	for k, v := range map[string]string{"owner": q.Owner, "deviceid": q.DeviceId, "actor": q.Actor} {
+		if v != "" {
+			filter[k] = v
+		}
+	}
+	times := bson.M{}
+	if q.Since != 0 {
+		times["$gte"] = q.Since
+	}
+	if q.Until != 0 {
+		times["$lte"] = q.Until
+	}
+	if len(times) > 0 {
+		filter["time"] = times
+	}
+	if q.Before != "" {
+		filter["_id"] = bson.M{"$lt": q.Before}
+	}
+
+	var res []*model.AuditEntry
+	err := s.DB(DBName).C(AuditCollection).Find(filter).Sort("-_id").Limit(q.Limit).All(&res)
+	return res, err
+}
+
 func InsertUser(u *model.User) {
 	s := defaultSession.Copy()
 	defer s.Close()
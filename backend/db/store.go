@@ -0,0 +1,512 @@
+package db
+
+import (
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Store implements store.Store on top of the MongoDB helpers in this
+// package. Init must be called before using it.
+type Store struct{}
+
+func (Store) FindDevice(id string) (*model.Device, error) {
+	d, err := FindDeviceById(id)
+	if err == mgo.ErrNotFound {
+		return nil, store.ErrNotFound
+	}
+	return d, err
+}
+
+func (Store) FindDevicesByOwner(owner string) ([]*model.Device, error) {
+	return FindDevicesByOwner(owner), nil
+}
+
+func (Store) FindStaleDevices(seenBefore int64) ([]*model.Device, error) {
+	return FindStaleDevices(seenBefore)
+}
+
+func (Store) FindDeletedDevices(owner string, deletedBefore int64) ([]*model.Device, error) {
+	return FindDeletedDevices(owner, deletedBefore)
+}
+
+func (Store) SaveDevice(d *model.Device) error {
+	return UpsertDevice(d)
+}
+
+func (Store) RemoveDevice(id string) error {
+	return RemoveDevice(id)
+}
+
+func (Store) SaveLastSeen(id string, lastSeen int64) error {
+	return UpdateLastSeen(id, lastSeen)
+}
+
+func (Store) FindPresence(deviceId string) ([]*model.PresenceChange, error) {
+	return FindPresence(deviceId, store.MaxPresence)
+}
+
+func (Store) InsertPresence(p *model.PresenceChange) error {
+	return InsertPresence(p, store.MaxPresence)
+}
+
+func (Store) FindUserByEmail(email string) (*model.User, error) {
+	if u := FindUserByEmail(email); u != nil {
+		return u, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (Store) InsertUser(u *model.User) error {
+	InsertUser(u)
+	return nil
+}
+
+func (Store) FindUserByAccessToken(token string) (*model.User, error) {
+	if u := FindUserByAccessToken(token); u != nil {
+		return u, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (Store) InsertAccessToken(t *model.AccessToken) error {
+	InsertAccessToken(t)
+	return nil
+}
+
+func (Store) RemoveAccessToken(token string) error {
+	RemoveAccessToken(token)
+	return nil
+}
+
+func (Store) FindIdentity(provider string, subject string) (*model.Identity, error) {
+	id, err := FindIdentity(bson.M{"provider": provider, "subject": subject})
+	if err == mgo.ErrNotFound {
+		return nil, store.ErrNotFound
+	}
+	return id, err
+}
+
+func (Store) FindIdentitiesByUser(email string) ([]*model.Identity, error) {
+	return FindIdentities(bson.M{"email": email})
+}
+
+func (Store) InsertIdentity(id *model.Identity) error {
+	return InsertIdentity(id)
+}
+
+func (Store) RemoveIdentity(email string, provider string) error {
+	if err := RemoveIdentity(bson.M{"email": email, "provider": provider}); err != nil {
+		if err == mgo.ErrNotFound {
+			return store.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (Store) FindAPIKeyByHash(hash string) (*model.APIKey, error) {
+	k, err := FindAPIKeyByHash(hash)
+	if err == mgo.ErrNotFound {
+		return nil, store.ErrNotFound
+	}
+	return k, err
+}
+
+func (Store) FindAPIKeysByOwner(owner string) ([]*model.APIKey, error) {
+	return FindAPIKeys(bson.M{"owner": owner})
+}
+
+func (Store) InsertAPIKey(k *model.APIKey) (string, error) {
+	k.Id = bson.NewObjectId()
+	if err := InsertAPIKey(k); err != nil {
+		return "", err
+	}
+	return k.Id.Hex(), nil
+}
+
+func (Store) RemoveAPIKey(id string, owner string) error {
+	if err := RemoveAPIKey(id, owner); err != nil {
+		if err == mgo.ErrNotFound {
+			return store.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (Store) FindFunctionsByOwner(owner string) ([]*model.Function, error) {
+	return FindFunctionsByEmail(owner), nil
+}
+
+func (Store) InsertFunction(f *model.Function) (string, error) {
+	return InsertFunction(f), nil
+}
+
+func (Store) RemoveFunction(id string, owner string) error {
+	RemoveFunction(id, owner)
+	return nil
+}
+
+func (Store) FindQueue(deviceId string) ([]*model.QueuedMessage, error) {
+	return FindQueue(deviceId), nil
+}
+
+func (Store) SaveQueue(deviceId string, q []*model.QueuedMessage) error {
+	return SaveQueue(deviceId, q)
+}
+
+func (Store) FindShadow(deviceId string) (*model.Shadow, error) {
+	if sh := FindShadow(deviceId); sh != nil {
+		return sh, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (Store) SaveShadow(sh *model.Shadow) error {
+	return UpsertShadow(sh)
+}
+
+func (Store) FindGroup(id string) (*model.Group, error) {
+	if g := FindGroupById(id); g != nil {
+		return g, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (Store) FindGroupsByOwner(owner string) ([]*model.Group, error) {
+	return FindGroupsByOwner(owner), nil
+}
+
+func (Store) InsertGroup(g *model.Group) (string, error) {
+	g.Id = bson.NewObjectId()
+	if err := UpsertGroup(g); err != nil {
+		return "", err
+	}
+	return g.Id.Hex(), nil
+}
+
+func (Store) SaveGroup(g *model.Group) error {
+	return UpsertGroup(g)
+}
+
+func (Store) RemoveGroup(id string, owner string) error {
+	if err := RemoveGroup(id, owner); err != nil {
+		if err == mgo.ErrNotFound {
+			return store.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (Store) FindShare(deviceId string, email string) (*model.Share, error) {
+	if sh := FindShare(deviceId, email); sh != nil {
+		return sh, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (Store) FindSharesByDevice(deviceId string) ([]*model.Share, error) {
+	return FindShares(bson.M{"deviceid": deviceId})
+}
+
+func (Store) FindSharesByUser(email string) ([]*model.Share, error) {
+	return FindShares(bson.M{"email": email})
+}
+
+func (Store) SaveShare(sh *model.Share) error {
+	return UpsertShare(sh)
+}
+
+func (Store) RemoveShare(deviceId string, email string) error {
+	return RemoveShare(deviceId, email)
+}
+
+func (Store) FindRule(id string) (*model.Rule, error) {
+	if r := FindRuleById(id); r != nil {
+		return r, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (Store) FindRulesByOwner(owner string) ([]*model.Rule, error) {
+	return FindRules(bson.M{"owner": owner})
+}
+
+func (Store) FindRulesByDevice(deviceId string) ([]*model.Rule, error) {
+	return FindRules(bson.M{"trigger.deviceid": deviceId})
+}
+
+func (Store) InsertRule(r *model.Rule) (string, error) {
+	r.Id = bson.NewObjectId()
+	if err := UpsertRule(r); err != nil {
+		return "", err
+	}
+	return r.Id.Hex(), nil
+}
+
+func (Store) SaveRule(r *model.Rule) error {
+	return UpsertRule(r)
+}
+
+func (Store) RemoveRule(id string, owner string) error {
+	if err := RemoveRule(id, owner); err != nil {
+		if err == mgo.ErrNotFound {
+			return store.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (Store) FindSchedule(id string) (*model.Schedule, error) {
+	if sc := FindScheduleById(id); sc != nil {
+		return sc, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (Store) FindSchedulesByOwner(owner string) ([]*model.Schedule, error) {
+	return FindSchedules(bson.M{"owner": owner})
+}
+
+func (Store) FindDueSchedules(now int64) ([]*model.Schedule, error) {
+	return FindSchedules(bson.M{"enabled": true, "next": bson.M{"$gt": 0, "$lte": now}})
+}
+
+func (Store) InsertSchedule(sc *model.Schedule) (string, error) {
+	sc.Id = bson.NewObjectId()
+	if err := UpsertSchedule(sc); err != nil {
+		return "", err
+	}
+	return sc.Id.Hex(), nil
+}
+
+func (Store) SaveSchedule(sc *model.Schedule) error {
+	return UpsertSchedule(sc)
+}
+
+func (Store) RemoveSchedule(id string, owner string) error {
+	if err := RemoveSchedule(id, owner); err != nil {
+		if err == mgo.ErrNotFound {
+			return store.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (Store) FindScene(id string) (*model.Scene, error) {
+	if sc := FindSceneById(id); sc != nil {
+		return sc, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (Store) FindScenesByOwner(owner string) ([]*model.Scene, error) {
+	return FindScenes(bson.M{"owner": owner})
+}
+
+func (Store) InsertScene(sc *model.Scene) (string, error) {
+	sc.Id = bson.NewObjectId()
+	if err := UpsertScene(sc); err != nil {
+		return "", err
+	}
+	return sc.Id.Hex(), nil
+}
+
+func (Store) SaveScene(sc *model.Scene) error {
+	return UpsertScene(sc)
+}
+
+func (Store) RemoveScene(id string, owner string) error {
+	if err := RemoveScene(id, owner); err != nil {
+		if err == mgo.ErrNotFound {
+			return store.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (Store) FindWebhook(id string) (*model.Webhook, error) {
+	if wh := FindWebhookById(id); wh != nil {
+		return wh, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (Store) FindWebhooksByOwner(owner string) ([]*model.Webhook, error) {
+	return FindWebhooks(bson.M{"owner": owner})
+}
+
+func (Store) InsertWebhook(wh *model.Webhook) (string, error) {
+	wh.Id = bson.NewObjectId()
+	if err := UpsertWebhook(wh); err != nil {
+		return "", err
+	}
+	return wh.Id.Hex(), nil
+}
+
+func (Store) SaveWebhook(wh *model.Webhook) error {
+	return UpsertWebhook(wh)
+}
+
+func (Store) RemoveWebhook(id string, owner string) error {
+	if err := RemoveWebhook(id, owner); err != nil {
+		if err == mgo.ErrNotFound {
+			return store.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (Store) FindFirmware(id string) (*model.Firmware, error) {
+	if f := FindFirmwareById(id); f != nil {
+		return f, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (Store) FindFirmwaresByOwner(owner string) ([]*model.Firmware, error) {
+	return FindFirmwares(bson.M{"owner": owner})
+}
+
+func (Store) InsertFirmware(f *model.Firmware, data []byte) (string, error) {
+	f.Id = bson.NewObjectId()
+	if err := InsertFirmware(f, data); err != nil {
+		return "", err
+	}
+	return f.Id.Hex(), nil
+}
+
+func (Store) FindFirmwareData(id string) ([]byte, error) {
+	data, err := FindFirmwareData(id)
+	if err == mgo.ErrNotFound {
+		return nil, store.ErrNotFound
+	}
+	return data, err
+}
+
+func (Store) RemoveFirmware(id string, owner string) error {
+	if err := RemoveFirmware(id, owner); err != nil {
+		if err == mgo.ErrNotFound {
+			return store.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (Store) FindRollout(id string) (*model.Rollout, error) {
+	if r := FindRolloutById(id); r != nil {
+		return r, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (Store) FindRolloutsByOwner(owner string) ([]*model.Rollout, error) {
+	return FindRollouts(bson.M{"owner": owner})
+}
+
+func (Store) InsertRollout(r *model.Rollout) (string, error) {
+	r.Id = bson.NewObjectId()
+	if err := UpsertRollout(r); err != nil {
+		return "", err
+	}
+	return r.Id.Hex(), nil
+}
+
+func (Store) SaveRollout(r *model.Rollout) error {
+	return UpsertRollout(r)
+}
+
+func (Store) SaveUserTenant(email string, tenant string) error {
+	if err := UpdateUserTenant(email, tenant); err != nil {
+		if err == mgo.ErrNotFound {
+			return store.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (Store) SaveUserDisabled(email string, disabled bool) error {
+	if err := UpdateUserDisabled(email, disabled); err != nil {
+		if err == mgo.ErrNotFound {
+			return store.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (Store) FindTenant(id string) (*model.Tenant, error) {
+	if t := FindTenant(id); t != nil {
+		return t, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (Store) FindTenants() ([]*model.Tenant, error) {
+	return FindTenants()
+}
+
+func (Store) SaveTenant(t *model.Tenant) error {
+	return UpsertTenant(t)
+}
+
+func (Store) RemoveTenant(id string) error {
+	if err := RemoveTenant(id); err != nil {
+		if err == mgo.ErrNotFound {
+			return store.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (Store) FindNotificationPrefs(email string) (*model.NotificationPrefs, error) {
+	if p := FindNotificationPrefs(email); p != nil {
+		return p, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (Store) SaveNotificationPrefs(p *model.NotificationPrefs) error {
+	return UpsertNotificationPrefs(p)
+}
+
+func (Store) FindHistory(q *model.HistoryQuery) ([]*model.HistoryEntry, error) {
+	return FindHistory(q)
+}
+
+func (Store) InsertHistory(e *model.HistoryEntry) error {
+	return InsertHistory(e, store.MaxHistory)
+}
+
+func (Store) PruneHistory(before int64) (int, error) {
+	return PruneHistory(before)
+}
+
+func (Store) InsertAudit(e *model.AuditEntry) error {
+	return InsertAudit(e)
+}
+
+func (Store) FindAudit(q *model.AuditQuery) ([]*model.AuditEntry, error) {
+	return FindAudit(q)
+}
+
+func (Store) Ping() error {
+	s := defaultSession.Copy()
+	defer s.Close()
+	return s.Ping()
+}
+
+func (Store) Close() error {
+	defaultSession.Close()
+	return nil
+}
@@ -0,0 +1,166 @@
+// Package e2e seals commands for devices so the server only routes opaque
+// blobs. Devices have an X25519 key and announce the public half in HELLO
+// with key=, the server keeps the first one it's given. A caller seals a
+// command like "DW 5 HIGH" for the device's public key and sends the blob
+// in "E2E <ref> <blob>", the device opens it and answers "E2E <ref> <blob>"
+// sealed with the same session:
+//
+//	blob, s, err := e2e.Seal(pub, "DW 5 HIGH")
+//	// POST /api/devices/{id}/e2e {"ref": "1", "data": blob}
+//	answer, err := s.Open(resp.Data)
+//
+// Blobs are base64, of an ephemeral public key (commands only), a nonce
+// and the AES-GCM ciphertext of the sealing time and the text.
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	keySize   = 32
+	nonceSize = 12
+	timeSize  = 8
+)
+
+var ErrMalformed = errors.New("malformed e2e blob")
+
+// Returns a new key for a device
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// Encodes a public key as devices announce it in HELLO
+func EncodePublicKey(pub *ecdh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub.Bytes())
+}
+
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+// The key of one command and its answer
+type Session struct {
+	aead cipher.AEAD
+	// When the command was sealed, by the clock of whoever sealed it.
+	// Devices should refuse old ones, the server could replay them.
+	Time time.Time
+}
+
+// Seals command for the device with public key pub. The session opens its
+// answer.
+func Seal(pub *ecdh.PublicKey, command string) (string, *Session, error) {
+	eph, err := GenerateKey()
+	if err != nil {
+		return "", nil, err
+	}
+	s, err := newSession(eph, pub, eph.PublicKey())
+	if err != nil {
+		return "", nil, err
+	}
+	s.Time = time.Now()
+	sealed, err := s.seal(eph.PublicKey().Bytes(), s.Time, command)
+	if err != nil {
+		return "", nil, err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), s, nil
+}
+
+// Opens a command sealed for the device with key priv. The session seals
+// its answer.
+func Open(priv *ecdh.PrivateKey, blob string) (string, *Session, error) {
+	b, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil || len(b) < keySize {
+		return "", nil, ErrMalformed
+	}
+	eph, err := ecdh.X25519().NewPublicKey(b[:keySize])
+	if err != nil {
+		return "", nil, ErrMalformed
+	}
+	s, err := newSession(priv, eph, eph)
+	if err != nil {
+		return "", nil, err
+	}
+	command, err := s.open(b[keySize:])
+	if err != nil {
+		return "", nil, err
+	}
+	return command, s, nil
+}
+
+// Seals the answer to the command the session was opened from
+func (s *Session) Seal(answer string) (string, error) {
+	sealed, err := s.seal(nil, time.Now(), answer)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Opens the answer to the command the session sealed
+func (s *Session) Open(blob string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return "", ErrMalformed
+	}
+	return s.open(b)
+}
+
+// Derives the key from the shared secret of priv and peer, bound to the
+// ephemeral key of the exchange
+func newSession(priv *ecdh.PrivateKey, peer *ecdh.PublicKey, eph *ecdh.PublicKey) (*Session, error) {
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte("iot-e2e-v1"))
+	h.Write(shared)
+	h.Write(eph.Bytes())
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{aead: aead}, nil
+}
+
+func (s *Session) seal(prefix []byte, t time.Time, text string) ([]byte, error) {
+	out := append(prefix[:len(prefix):len(prefix)], make([]byte, nonceSize)...)
+	nonce := out[len(prefix):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	plain := binary.BigEndian.AppendUint64(make([]byte, 0, timeSize+len(text)), uint64(t.Unix()))
+	plain = append(plain, text...)
+	return s.aead.Seal(out, nonce, plain, nil), nil
+}
+
+func (s *Session) open(b []byte) (string, error) {
+	if len(b) < nonceSize {
+		return "", ErrMalformed
+	}
+	plain, err := s.aead.Open(nil, b[:nonceSize], b[nonceSize:], nil)
+	if err != nil || len(plain) < timeSize {
+		return "", ErrMalformed
+	}
+	if s.Time.IsZero() {
+		s.Time = time.Unix(int64(binary.BigEndian.Uint64(plain)), 0)
+	}
+	return string(plain[timeSize:]), nil
+}
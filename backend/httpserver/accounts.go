@@ -0,0 +1,166 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// How long a login is valid for
+	jwtTTL = 30 * 24 * time.Hour
+	// Cookie the dashboard keeps the JWT in
+	jwtCookie = "token"
+
+	minPasswordLen = 8
+	maxPasswordLen = 72 // bcrypt ignores the rest
+)
+
+var errSigningMethod = errors.New("unexpected signing method")
+
+type credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+}
+
+func (s *Server) registerHandler(w http.ResponseWriter, r *http.Request) {
+	var c credentials
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	c.Email = strings.ToLower(strings.TrimSpace(c.Email))
+	if !strings.Contains(c.Email, "@") ||
+		len(c.Password) < minPasswordLen ||
+		len(c.Password) > maxPasswordLen ||
+		len(c.Name) > 64 {
+
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tenant, ok := s.TenantOf(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Emails are unique across tenants
+	if _, err := s.store.FindUserByEmail(c.Email); err != store.ErrNotFound {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(c.Password), bcrypt.DefaultCost)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	u := &model.User{
+		Email:        c.Email,
+		Name:         c.Name,
+		PasswordHash: string(hash),
+		Tenant:       tenant,
+	}
+	if err := s.store.InsertUser(u); err != nil {
+		log.Println("Error inserting user:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeSession(w, r, u)
+}
+
+func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	var c credentials
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	u, err := s.store.FindUserByEmail(strings.ToLower(strings.TrimSpace(c.Email)))
+	if err != nil || u.PasswordHash == "" || u.Disabled ||
+		bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(c.Password)) != nil {
+
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.writeSession(w, r, u)
+}
+
+// Responds with a new JWT for u, also setting it as a cookie for the dashboard
+func (s *Server) writeSession(w http.ResponseWriter, r *http.Request, u *model.User) {
+	exp := time.Now().Add(jwtTTL)
+	tok, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		Subject:   u.Email,
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: exp.Unix(),
+	}).SignedString(s.jwtSecret)
+	if err != nil {
+		log.Println("Error signing jwt:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     jwtCookie,
+		Value:    tok,
+		Path:     "/",
+		Expires:  exp,
+		HttpOnly: true,
+		// Other sites can't make the browser send it with their requests
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil,
+	})
+	WriteJSON(w, map[string]interface{}{
+		"token":   tok,
+		"expires": exp.Unix(),
+		"user":    u,
+	})
+}
+
+// Returns the user a JWT in the Authorization header or the token
+// cookie belongs to, or nil
+func (s *Server) jwtUser(r *http.Request) *model.User {
+	if s.jwtSecret == nil {
+		return nil
+	}
+
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if tok == "" {
+		c, err := r.Cookie(jwtCookie)
+		if err != nil {
+			return nil
+		}
+		tok = c.Value
+	}
+
+	claims := &jwt.StandardClaims{}
+	_, err := jwt.ParseWithClaims(tok, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errSigningMethod
+		}
+		return s.jwtSecret, nil
+	})
+	if err != nil {
+		return nil
+	}
+
+	u, err := s.store.FindUserByEmail(claims.Subject)
+	if err != nil {
+		return nil
+	}
+	return u
+}
@@ -0,0 +1,115 @@
+package httpserver
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+// How long a test message may take to be written
+const adminSendTimeout = 10 * time.Second
+
+// Lists the devices connected to this instance, of every owner. With
+// ?slow=true only those with a send queue over half full or that
+// overflowed it, fullest first.
+func (s *Server) connectionsHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	slow := r.URL.Query().Get("slow") == "true"
+	conns := s.hub.Conns()
+	res := make([]*ws.ConnInfo, 0, len(conns))
+	for _, conn := range conns {
+		info := conn.Info()
+		if slow && info.Queue <= info.QueueSize/2 && info.Overflows == 0 {
+			continue
+		}
+		res = append(res, info)
+	}
+	if slow {
+		sort.SliceStable(res, func(i, j int) bool { return res[i].Queue > res[j].Queue })
+	}
+	WriteJSON(w, res)
+}
+
+func (s *Server) connectionHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	conn := s.hub.GetConn(mux.Vars(r)["id"])
+	if conn == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, conn.Info())
+}
+
+// Disconnects a device on any instance, it's free to connect again
+func (s *Server) kickHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	id := mux.Vars(r)["id"]
+	if !s.hub.Disconnect(id, ws.CloseKicked, "disconnected by an operator") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Println("Admin", user.Email, "disconnected", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Disables a user on PUT, so they can't sign in and their devices are
+// disconnected and can't connect, or enables them again on DELETE
+func (s *Server) userDisabledHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	email := mux.Vars(r)["email"]
+	disabled := r.Method == http.MethodPut
+	if err := s.store.SaveUserDisabled(email, disabled); err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error saving user:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if disabled {
+		devices, err := s.store.FindDevicesByOwner(email)
+		if err != nil {
+			log.Println("Error finding devices:", err)
+		}
+		for _, d := range devices {
+			s.hub.Disconnect(d.Id, ws.CloseUnknownOwner, ws.ErrOwnerDisabled.Error())
+		}
+	}
+	log.Println("Admin", user.Email, "set disabled of", email, "to", disabled)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sends the body to a connected device as is, like "DW 5 HIGH"
+func (s *Server) adminSendHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	id := mux.Vars(r)["id"]
+	msg, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.hub.Config.MaxMessageSize)))
+	defer r.Body.Close()
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(msg) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if conn := s.hub.GetConn(id); conn != nil {
+		s.record(r, user, model.AuditInvoke, conn.Snapshot(), string(msg))
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), adminSendTimeout)
+	defer cancel()
+	switch err := s.hub.SendToDevice(ctx, id, msg); err {
+	case nil:
+		log.Printf("Admin %s sent %q to %s", user.Email, msg, id)
+		w.WriteHeader(http.StatusNoContent)
+	case ws.ErrNotConnected:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+}
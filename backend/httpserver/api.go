@@ -5,10 +5,10 @@ import (
 
 	"encoding/json"
 	"log"
+	"log/slog"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
-	"github.com/twinone/iot/backend/db"
 	"github.com/twinone/iot/backend/model"
 )
 
@@ -21,23 +21,57 @@ func (s *Server) execHandler(w http.ResponseWriter, r *http.Request, cookie *ses
 		return
 	}
 
-	log.Println("Hey")
-
-	for _, conn := range s.hub.GetConns(user.Email) {
-		if conn.Device.Id == e.DeviceId {
-			log.Println("Sending cmd", e.Cmd, "to", e.DeviceId)
-			conn.Send <- []byte(e.Cmd)
-		}
+	d := s.findDevice(e.DeviceId, user.Email, model.RoleController)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
-	return
 
+	s.withPayload(slog.With("device", e.DeviceId, "owner", d.Owner, "user", user.Email), e.Cmd).Info("sending command")
+	s.record(r, user, model.AuditInvoke, d, e.Cmd)
+	queued, err := s.hub.SendOrQueue(r.Context(), e.DeviceId, []byte(e.Cmd))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if queued {
+		// Sent when the device comes back
+		w.WriteHeader(http.StatusAccepted)
+	}
 }
 
+// Returns the user, their devices and functions. Takes the filters and
+// paging of /devices, and then only has the functions of the devices listed.
 func (s *Server) profileHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	q, err := s.parseDeviceQuery(r, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	functions, err := s.store.FindFunctionsByOwner(user.Email)
+	if err != nil {
+		log.Println("Error finding functions:", err)
+	}
+	functions = append(functions, s.sharedFunctions(user.Email)...)
+	devices, next := q.apply(s.listDevices(r.Context(), user.Email))
+	if !q.all() {
+		listed := make(map[string]bool, len(devices))
+		for _, d := range devices {
+			listed[d.Id] = true
+		}
+		var shown []*model.Function
+		for _, f := range functions {
+			if listed[f.DeviceId] {
+				shown = append(shown, f)
+			}
+		}
+		functions = shown
+	}
 	di := &model.DashboardInfo{
 		User:      user,
-		Devices:   s.hub.GetDevices(user.Email),
-		Functions: db.FindFunctionsByEmail(user.Email),
+		Devices:   devices,
+		Functions: functions,
+		Next:      next,
 	}
 	WriteJSON(w, di)
 }
@@ -50,7 +84,7 @@ func (s *Server) functionHandler(w http.ResponseWriter, r *http.Request, cookie
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	log.Println("Decoded:", f)
+	s.withPayload(slog.With("device", f.DeviceId, "owner", user.Email, "function", f.Name), f.Cmd).Debug("adding function")
 	defer r.Body.Close()
 	if len(f.Cmd) > 20 ||
 		f.Cmd == "" ||
@@ -62,9 +96,20 @@ func (s *Server) functionHandler(w http.ResponseWriter, r *http.Request, cookie
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	for i := range f.Params {
+		if err := f.Params[i].Check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	f.Owner = user.Email
-	id := db.InsertFunction(&f)
+	id, err := s.store.InsertFunction(&f)
+	if err != nil {
+		log.Println("Error inserting function:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
 	WriteJSON(w, map[string]string{
 		"id": id,
@@ -76,15 +121,119 @@ func (s *Server) deleteFunctionHandler(w http.ResponseWriter, r *http.Request, c
 	email := user.Email
 
 	log.Println("deleted function:", id, email)
-	db.RemoveFunction(id, email)
+	if err := s.store.RemoveFunction(id, email); err != nil {
+		log.Println("Error removing function:", err)
+	}
 
 }
 
 func (s *Server) registerApiHandlers(r *mux.Router) {
-	r.Handle("/profile", s.Auth(s.profileHandler)).Methods("GET")
+	r.Handle("/profile", s.Scoped(model.ScopeDevicesRead, s.profileHandler)).Methods("GET")
+	r.Handle("/dashboard", s.Scoped(model.ScopeDevicesRead, s.profileHandler)).Methods("GET")
+	r.Handle("/devices", s.Scoped(model.ScopeDevicesRead, s.devicesHandler)).Methods("GET")
+	r.Handle("/devices/deleted", s.Auth(s.deletedDevicesHandler)).Methods("GET")
+	r.Handle("/devices/{id}", s.Scoped(model.ScopeDevicesRead, s.deviceHandler)).Methods("GET")
+	r.Handle("/devices/{id}", s.Auth(s.updateDeviceHandler)).Methods("PATCH")
+	r.Handle("/devices/{id}", s.Auth(s.deleteDeviceHandler)).Methods("DELETE")
 	r.Handle("/function", s.Auth(s.functionHandler)).Methods("POST", "GET")
 	r.Handle("/function/{id}", s.Auth(s.deleteFunctionHandler)).Methods("DELETE")
-	r.Handle("/exec", s.Auth(s.execHandler)).Methods("POST")
+	r.Handle("/exec", s.Scoped(model.ScopeDevicesInvoke, s.execHandler)).Methods("POST")
+	r.Handle("/commands/bulk", s.Scoped(model.ScopeDevicesInvoke, s.bulkCommandsHandler)).Methods("POST")
+	r.Handle("/devices/{id}/shadow", s.Scoped(model.ScopeDevicesRead, s.shadowHandler)).Methods("GET")
+	r.Handle("/devices/{id}/shadow", s.Scoped(model.ScopeDevicesInvoke, s.updateShadowHandler)).Methods("PATCH")
+	r.Handle("/devices/{id}/telemetry", s.Scoped(model.ScopeDevicesRead, s.telemetryHandler)).Methods("GET")
+	r.Handle("/devices/{id}/restore", s.Auth(s.restoreDeviceHandler)).Methods("POST")
+	r.Handle("/devices/{id}/token", s.Auth(s.deviceTokenHandler)).Methods("POST")
+	r.Handle("/devices/{id}/history", s.Scoped(model.ScopeDevicesRead, s.historyHandler)).Methods("GET")
+	r.Handle("/devices/{id}/logs", s.Scoped(model.ScopeDevicesRead, s.deviceLogsHandler)).Methods("GET")
+	r.Handle("/devices/{id}/shares", s.Auth(s.sharesHandler)).Methods("GET")
+	r.Handle("/devices/{id}/shares/{email}", s.Auth(s.shareHandler)).Methods("PUT")
+	r.Handle("/devices/{id}/shares/{email}", s.Auth(s.unshareHandler)).Methods("DELETE")
+	r.Handle("/devices/{id}/functions/{name}", s.Scoped(model.ScopeDevicesInvoke, s.invokeHandler)).Methods("POST")
+	r.Handle("/devices/{id}/e2e", s.Auth(s.e2eHandler)).Methods("POST")
+	r.Handle("/devices/{id}/files/{name}", s.Auth(s.sendFileHandler)).Methods("PUT")
+	r.Handle("/signing-keys", s.Auth(s.signingKeysHandler)).Methods("GET")
+	r.Handle("/groups", s.Scoped(model.ScopeDevicesRead, s.groupsHandler)).Methods("GET")
+	r.Handle("/groups", s.Auth(s.createGroupHandler)).Methods("POST")
+	r.Handle("/groups/{id}", s.Scoped(model.ScopeDevicesRead, s.groupHandler)).Methods("GET")
+	r.Handle("/groups/{id}", s.Auth(s.updateGroupHandler)).Methods("PATCH")
+	r.Handle("/groups/{id}", s.Auth(s.deleteGroupHandler)).Methods("DELETE")
+	r.Handle("/groups/{id}/devices/{device}", s.Auth(s.addGroupDeviceHandler)).Methods("PUT")
+	r.Handle("/groups/{id}/devices/{device}", s.Auth(s.removeGroupDeviceHandler)).Methods("DELETE")
+	r.Handle("/groups/{id}/exec", s.Scoped(model.ScopeDevicesInvoke, s.execGroupHandler)).Methods("POST")
+	r.Handle("/groups/{id}/functions/{name}", s.Scoped(model.ScopeDevicesInvoke, s.invokeGroupHandler)).Methods("POST")
+	r.Handle("/tags/exec", s.Scoped(model.ScopeDevicesInvoke, s.execTaggedHandler)).Methods("POST")
+	r.Handle("/tags/functions/{name}", s.Scoped(model.ScopeDevicesInvoke, s.invokeTaggedHandler)).Methods("POST")
+	r.Handle("/profiles", s.Scoped(model.ScopeDevicesRead, s.profilesHandler)).Methods("GET")
+	r.Handle("/rules", s.Scoped(model.ScopeRulesManage, s.rulesHandler)).Methods("GET")
+	r.Handle("/rules", s.Scoped(model.ScopeRulesManage, s.createRuleHandler)).Methods("POST")
+	r.Handle("/rules/{id}", s.Scoped(model.ScopeRulesManage, s.ruleHandler)).Methods("GET")
+	r.Handle("/rules/{id}", s.Scoped(model.ScopeRulesManage, s.updateRuleHandler)).Methods("PUT")
+	r.Handle("/rules/{id}", s.Scoped(model.ScopeRulesManage, s.deleteRuleHandler)).Methods("DELETE")
+
+	r.Handle("/schedules", s.Scoped(model.ScopeRulesManage, s.schedulesHandler)).Methods("GET")
+	r.Handle("/schedules", s.Scoped(model.ScopeRulesManage, s.createScheduleHandler)).Methods("POST")
+	r.Handle("/schedules/{id}", s.Scoped(model.ScopeRulesManage, s.scheduleHandler)).Methods("GET")
+	r.Handle("/schedules/{id}", s.Scoped(model.ScopeRulesManage, s.updateScheduleHandler)).Methods("PUT")
+	r.Handle("/schedules/{id}", s.Scoped(model.ScopeRulesManage, s.deleteScheduleHandler)).Methods("DELETE")
+
+	r.Handle("/scenes", s.Scoped(model.ScopeRulesManage, s.scenesHandler)).Methods("GET")
+	r.Handle("/scenes", s.Scoped(model.ScopeRulesManage, s.createSceneHandler)).Methods("POST")
+	r.Handle("/scenes/{id}", s.Scoped(model.ScopeRulesManage, s.sceneHandler)).Methods("GET")
+	r.Handle("/scenes/{id}", s.Scoped(model.ScopeRulesManage, s.updateSceneHandler)).Methods("PUT")
+	r.Handle("/scenes/{id}", s.Scoped(model.ScopeRulesManage, s.deleteSceneHandler)).Methods("DELETE")
+	r.Handle("/scenes/{id}/activate", s.Scoped(model.ScopeDevicesInvoke, s.activateSceneHandler)).Methods("POST")
+
+	r.Handle("/identities", s.Auth(s.identitiesHandler)).Methods("GET")
+	r.Handle("/identities/{provider}", s.Auth(s.unlinkIdentityHandler)).Methods("DELETE")
+	r.Handle("/keys", s.Auth(s.apiKeysHandler)).Methods("GET")
+	r.Handle("/keys", s.Auth(s.createAPIKeyHandler)).Methods("POST")
+	r.Handle("/keys/{id}", s.Auth(s.deleteAPIKeyHandler)).Methods("DELETE")
+
+	r.Handle("/export", s.Auth(s.exportHandler)).Methods("GET")
+	r.Handle("/import", s.Auth(s.importHandler)).Methods("POST")
+
+	r.Handle("/webhooks", s.Auth(s.webhooksHandler)).Methods("GET")
+	r.Handle("/webhooks", s.Auth(s.createWebhookHandler)).Methods("POST")
+	r.Handle("/webhooks/{id}", s.Auth(s.webhookHandler)).Methods("GET")
+	r.Handle("/webhooks/{id}", s.Auth(s.updateWebhookHandler)).Methods("PUT")
+	r.Handle("/webhooks/{id}", s.Auth(s.deleteWebhookHandler)).Methods("DELETE")
+
+	if s.OTA != nil {
+		r.Handle("/firmware", s.Auth(s.firmwaresHandler)).Methods("GET")
+		r.Handle("/firmware", s.Auth(s.uploadFirmwareHandler)).Methods("POST")
+		r.Handle("/firmware/{id}", s.Auth(s.deleteFirmwareHandler)).Methods("DELETE")
+		r.Handle("/rollouts", s.Auth(s.rolloutsHandler)).Methods("GET")
+		r.Handle("/rollouts", s.Auth(s.createRolloutHandler)).Methods("POST")
+		r.Handle("/rollouts/{id}", s.Auth(s.rolloutHandler)).Methods("GET")
+		r.Handle("/rollouts/{id}", s.Auth(s.cancelRolloutHandler)).Methods("DELETE")
+	}
+	if s.Notifier != nil {
+		r.Handle("/notifications", s.Auth(s.notificationsHandler)).Methods("GET")
+		r.Handle("/notifications", s.Auth(s.updateNotificationsHandler)).Methods("PUT")
+	}
+	if s.Presence != nil {
+		r.Handle("/devices/{id}/presence", s.Scoped(model.ScopeDevicesRead, s.presenceHandler)).Methods("GET")
+	}
+	if len(s.admins) > 0 {
+		r.Handle("/admin/connections", s.Admin(s.connectionsHandler)).Methods("GET")
+		r.Handle("/admin/connections/{id}", s.Admin(s.connectionHandler)).Methods("GET")
+		r.Handle("/admin/connections/{id}", s.Admin(s.kickHandler)).Methods("DELETE")
+		r.Handle("/admin/connections/{id}/send", s.Admin(s.adminSendHandler)).Methods("POST")
+		r.Handle("/admin/tenants", s.Admin(s.tenantsHandler)).Methods("GET")
+		r.Handle("/admin/tenants", s.Admin(s.saveTenantHandler)).Methods("POST")
+		r.Handle("/admin/tenants/{id}", s.Admin(s.tenantHandler)).Methods("GET")
+		r.Handle("/admin/tenants/{id}", s.Admin(s.saveTenantHandler)).Methods("PUT")
+		r.Handle("/admin/tenants/{id}", s.Admin(s.deleteTenantHandler)).Methods("DELETE")
+		r.Handle("/admin/tenants/{id}/users/{email}", s.Admin(s.tenantUserHandler)).Methods("PUT")
+		r.Handle("/admin/users/{email}/disabled", s.Admin(s.userDisabledHandler)).Methods("PUT", "DELETE")
+	}
+	r.Handle("/audit", s.Auth(s.auditHandler)).Methods("GET")
+	r.Handle("/pair", s.Auth(s.pairHandler)).Methods("POST")
+	r.Handle("/events", s.Auth(s.eventsHandler)).Methods("GET")
+	r.Handle("/events/stream", s.Scoped(model.ScopeDevicesRead, s.eventStreamHandler)).Methods("GET")
+	r.Handle("/graphql", s.Auth(s.graphqlHandler)).Methods("POST")
+	r.Handle("/graphql", s.Auth(s.graphqlWSHandler)).Methods("GET")
 }
 
 func WriteJSON(w http.ResponseWriter, obj interface{}) {
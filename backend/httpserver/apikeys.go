@@ -0,0 +1,125 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+const (
+	// Maximum number of API keys per user
+	maxAPIKeys = 32
+	// Characters of a key shown to tell it apart, besides the prefix
+	apiKeyHintLen = 4
+)
+
+// Returns the API key the request is made with in the Authorization
+// header, or nil if there's none or it's not valid
+func (s *Server) apiKey(r *http.Request) *model.APIKey {
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !model.IsAPIKey(tok) {
+		return nil
+	}
+	k, err := store.FindAPIKey(s.store, tok)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error finding API key:", err)
+		}
+		return nil
+	}
+	return k
+}
+
+func newAPIKey() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return model.APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *Server) apiKeysHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	keys, err := s.store.FindAPIKeysByOwner(user.Email)
+	if err != nil {
+		log.Println("Error finding API keys:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []*model.APIKey{}
+	}
+	WriteJSON(w, keys)
+}
+
+// Creates a key from {"name": "backup script", "scopes": ["devices:read"],
+// "expires": 1700000000}, expires is optional. The response has the key,
+// which can't be seen again.
+func (s *Server) createAPIKeyHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	var k model.APIKey
+	if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if k.Name == "" || len(k.Name) > 64 || len(k.Scopes) == 0 ||
+		k.Expires != 0 && k.Expires <= time.Now().Unix() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, scope := range k.Scopes {
+		if !model.ValidScope(scope) {
+			http.Error(w, "unknown scope "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	keys, err := s.store.FindAPIKeysByOwner(user.Email)
+	if err != nil {
+		log.Println("Error finding API keys:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(keys) >= maxAPIKeys {
+		http.Error(w, "too many API keys", http.StatusBadRequest)
+		return
+	}
+
+	secret := newAPIKey()
+	k.Owner = user.Email
+	k.Hint = secret[:len(model.APIKeyPrefix)+apiKeyHintLen]
+	k.Hash = model.HashAPIKey(secret)
+	k.Created = time.Now().Unix()
+	if _, err := s.store.InsertAPIKey(&k); err != nil {
+		log.Println("Error inserting API key:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Println("User", user.Email, "created API key", k.Id.Hex())
+	WriteJSON(w, struct {
+		*model.APIKey
+		Key string `json:"key"`
+	}{&k, secret})
+}
+
+// Revokes a key, requests made with it fail from then on
+func (s *Server) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	id := mux.Vars(r)["id"]
+	if err := s.store.RemoveAPIKey(id, user.Email); err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error removing API key:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Println("User", user.Email, "revoked API key", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,65 @@
+package httpserver
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/audit"
+	"github.com/twinone/iot/backend/model"
+)
+
+// Records what user did to d in the audit log
+func (s *Server) record(r *http.Request, user *model.User, action model.AuditAction, d *model.Device, payload string) {
+	audit.Record(r.Context(), s.store, user.Email, action, d, payload)
+}
+
+// Returns the audit log of the devices the user owns, newest first. Filters
+// are ?device=, ?actor=, and ?since= and ?until= in Unix seconds. Pages of
+// ?limit= entries continue with ?before= the id of the last one. Admins of a
+// device shared with them can see its log with ?device=.
+func (s *Server) auditHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	query := r.URL.Query()
+	q := &model.AuditQuery{
+		Owner: user.Email,
+		Actor: query.Get("actor"),
+	}
+	var ok bool
+	if q.Limit, q.Before, ok = parsePage(query); !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var err error
+	if v := query.Get("since"); v != "" {
+		if q.Since, err = strconv.ParseInt(v, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if q.Until, err = strconv.ParseInt(v, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if id := query.Get("device"); id != "" {
+		d := s.findDevice(id, user.Email, model.RoleAdmin)
+		if d == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		q.DeviceId, q.Owner = d.Id, d.Owner
+	}
+
+	entries, err := s.store.FindAudit(q)
+	if err != nil {
+		log.Println("Error finding audit entries:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []*model.AuditEntry{}
+	}
+	WriteJSON(w, entries)
+}
@@ -1,56 +1,119 @@
 package httpserver
 
 import (
-	"encoding/json"
 	"net/http"
 
-	"context"
 	"crypto/rand"
 	"encoding/base64"
-	"io/ioutil"
 	"log"
+	"strings"
 
+	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
-	"github.com/twinone/iot/backend/db"
+	"github.com/twinone/iot/backend/audit"
 	"github.com/twinone/iot/backend/model"
 	"html/template"
 )
 
 type AuthedHandler = func(w http.ResponseWriter, r *http.Request, c *sessions.Session, user *model.User)
 
+// Lets through signed in users, API keys are refused
 func (s *Server) Auth(next AuthedHandler) http.HandlerFunc {
+	return s.Scoped("", next)
+}
+
+// Like Auth, but API keys with scope can use it too, acting as their owner
+func (s *Server) Scoped(scope model.Scope, next AuthedHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		c := s.GetCookie(r)
-		u := s.GetUser(c)
+		var u *model.User
+		key := s.apiKey(r)
+		if key != nil {
+			if scope == "" || !key.Allows(scope) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			var err error
+			if u, err = s.store.FindUserByEmail(key.Owner); err != nil {
+				u = nil
+			}
+		} else {
+			u = s.authenticate(r, c)
+		}
+		if u != nil && u.Disabled {
+			u = nil
+		}
+		if u != nil {
+			// Sessions only work on the domains of the user's tenant
+			if tenant, ok := s.TenantOf(r); !ok || tenant != u.Tenant {
+				u = nil
+			}
+		}
 		if u == nil {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 			return
 		}
 
+		// What they do from here on is audited as coming from the API
+		via := "api"
+		if key != nil {
+			via = "apikey:" + key.Id.Hex()
+		}
+		r = r.WithContext(audit.NewContext(r.Context(), audit.Source{
+			Via:        via,
+			RemoteAddr: s.hub.Config.TrustedProxies.ClientIP(r),
+		}))
 		next(w, r, c, u)
 	}
 }
 
+// Like Auth, but only lets through the operators listed in the admins
+// config
+func (s *Server) Admin(next AuthedHandler) http.HandlerFunc {
+	return s.Auth(func(w http.ResponseWriter, r *http.Request, c *sessions.Session, u *model.User) {
+		if !s.admins[u.Email] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next(w, r, c, u)
+	})
+}
+
 func (s *Server) signinHandler(w http.ResponseWriter, r *http.Request) {
 	c := s.GetCookie(r)
 	uid := randToken()
 	if id, ok := c.Values["state"]; ok {
 		uid = id.(string)
-		log.Println("SigninHandler found id:", id.(string))
-	} else {
-		log.Println("SigninHandler found nothing", id)
 	}
 	c.Values["state"] = uid
 	c.Save(r, w)
 
-	log.Println("uid:", uid)
+	type link struct{ Title, URL string }
+	var links []link
+	for _, p := range s.providers {
+		links = append(links, link{p.title, "/auth/" + p.name})
+	}
 	t := template.Must(template.ParseFiles("www/signin.html"))
-	t.Execute(w, s.getLoginURL(uid))
+	t.Execute(w, links)
 }
 
 func (s *Server) authCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	if name == "" {
+		// callback_url predates the other providers
+		name = "google"
+	}
+	p := s.provider(name)
+	if p == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	cookie := s.GetCookie(r)
-	savedState, ok := cookie.Values["state"]
+	savedState, ok := cookie.Values["oauth_state"]
 	if !ok {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
@@ -61,51 +124,74 @@ func (s *Server) authCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	delete(cookie.Values, "oauth_state")
 
 	code := r.URL.Query().Get("code")
-	tok, err := s.cfg.Exchange(context.Background(), code)
+	tok, err := p.cfg.Exchange(r.Context(), code)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	//log.Println("Got access token:", tok)
-	client := s.cfg.Client(context.Background(), tok)
-	resp, err := client.Get(userInfoEndpoint)
+	authedUser, err := p.identify(r.Context(), p.cfg.Client(r.Context(), tok))
 	if err != nil {
+		log.Println("Error identifying", p.name, "user:", err)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	defer resp.Body.Close()
-
-	data, _ := ioutil.ReadAll(resp.Body)
-	var authedUser = &model.User{}
-	json.Unmarshal(data, authedUser)
-
-	dbUser := db.FindUserByEmail(authedUser.Email)
-	if dbUser == nil {
-		db.InsertUser(authedUser)
+	user := s.signinUser(w, r, cookie, p.name, authedUser)
+	if user == nil {
+		return
 	}
 
-	db.InsertAccessToken(&model.AccessToken{
-		Email: authedUser.Email,
-		Token: state,
-	})
+	// Signing in again or linking an account starts a new session
+	if old, ok := cookie.Values["state"].(string); ok {
+		s.store.RemoveAccessToken(old)
+	}
+	token := randToken()
+	if err := s.store.InsertAccessToken(&model.AccessToken{
+		Email: user.Email,
+		Token: token,
+	}); err != nil {
+		log.Println("Error inserting access token:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	cookie.Values["state"] = token
+	cookie.Save(r, w)
 
+	// Back to where the user was sent to sign in from, like account linking
+	if next, ok := cookie.Values["next"].(string); ok && strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") {
+		delete(cookie.Values, "next")
+		cookie.Save(r, w)
+		http.Redirect(w, r, next, http.StatusTemporaryRedirect)
+		return
+	}
 	http.Redirect(w, r, "/dashboard", http.StatusTemporaryRedirect)
 }
 
 func (s *Server) signOutHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
-	tok := cookie.Values["state"]
-	log.Println("WARNING DEAUTHENTICATING TOKEN:", tok.(string))
-	db.RemoveAccessToken(tok.(string))
+	// Users signed in with a JWT may not have one
+	if tok, ok := cookie.Values["state"].(string); ok {
+		s.store.RemoveAccessToken(tok)
+	}
 
 	// Generate a new state for the user
 	cookie.Values["state"] = randToken()
 	cookie.Save(r, w)
+	http.SetCookie(w, &http.Cookie{Name: jwtCookie, Path: "/", MaxAge: -1})
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
+// Returns the user of a request authenticated either with a JWT
+// or with a provider sign in session, or nil
+func (s *Server) authenticate(r *http.Request, cookie *sessions.Session) *model.User {
+	if u := s.jwtUser(r); u != nil {
+		return u
+	}
+	return s.GetUser(cookie)
+}
+
 // Returns a User if the request is authenticated or nil if not
 func (s *Server) GetUser(cookie *sessions.Session) *model.User {
 	tok, ok := cookie.Values["state"]
@@ -113,12 +199,11 @@ func (s *Server) GetUser(cookie *sessions.Session) *model.User {
 		log.Println("No token")
 		return nil
 	}
-	log.Println("Get user for token", tok)
-	return db.FindUserByAccessToken(tok.(string))
-}
-
-func (s *Server) getLoginURL(state string) string {
-	return s.cfg.AuthCodeURL(state)
+	u, err := s.store.FindUserByAccessToken(tok.(string))
+	if err != nil {
+		return nil
+	}
+	return u
 }
 
 func randToken() string {
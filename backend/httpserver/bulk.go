@@ -0,0 +1,134 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/ws"
+)
+
+const (
+	// Maximum number of commands in a bulk request
+	maxBulkCommands = 256
+	// How many of them are invoked at once
+	bulkParallelism = 16
+)
+
+// The outcome of a bulk command
+const (
+	bulkOk      = "ok"
+	bulkFailed  = "failed"
+	bulkTimeout = "timeout"
+)
+
+type bulkCommand struct {
+	Device   string   `json:"device"`
+	Function string   `json:"function"`
+	Args     []string `json:"args,omitempty"`
+}
+
+type bulkResult struct {
+	Device   string      `json:"device"`
+	Function string      `json:"function"`
+	Status   string      `json:"status"`
+	Response *ws.Message `json:"response,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// Invokes the functions in the body {"commands": [{"device": "id",
+// "function": "on", "args": ["1"]}, ...]}, at most bulkParallelism at once.
+// Responds with the outcome of each one in the same order, commands that
+// failed don't stop the others.
+func (s *Server) bulkCommandsHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	var req struct {
+		Commands []*bulkCommand `json:"commands"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if len(req.Commands) == 0 || len(req.Commands) > maxBulkCommands {
+		http.Error(w, "too few or too many commands", http.StatusBadRequest)
+		return
+	}
+	for _, c := range req.Commands {
+		if c == nil || c.Device == "" || c.Function == "" || !validArgs(c.Args) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	results := make([]*bulkResult, len(req.Commands))
+	sem := make(chan struct{}, bulkParallelism)
+	var wg sync.WaitGroup
+	for i, c := range req.Commands {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, c *bulkCommand) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = s.bulkInvoke(r, user, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, res := range results {
+		if res.Status != bulkOk {
+			failed++
+		}
+	}
+	log.Println("Bulk commands:", len(results), "sent,", failed, "failed")
+	WriteJSON(w, map[string]interface{}{
+		"results": results,
+	})
+}
+
+// Invokes a single command of a bulk request like invokeHandler does
+func (s *Server) bulkInvoke(r *http.Request, user *model.User, c *bulkCommand) *bulkResult {
+	res := &bulkResult{Device: c.Device, Function: c.Function}
+	fail := func(err error) *bulkResult {
+		res.Status = bulkFailed
+		if err == ws.ErrTimeout || errors.Is(err, context.DeadlineExceeded) {
+			res.Status = bulkTimeout
+		}
+		res.Error = err.Error()
+		return res
+	}
+
+	d := s.findDevice(c.Device, user.Email, model.RoleController)
+	if d == nil {
+		return fail(errDeviceNotFound)
+	}
+	f := s.findFunction(d, c.Function)
+	if f == nil {
+		return fail(errFunctionNotFound)
+	}
+	if f.E2E {
+		return fail(errors.New("function is only invoked sealed"))
+	}
+	if err := f.Validate(c.Args); err != nil {
+		return fail(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ws.WithFunction(r.Context(), f.Name), invokeTimeout)
+	defer cancel()
+	cmd := f.Command(c.Args)
+	s.record(r, user, model.AuditInvoke, d, cmd)
+	resp, err := s.hub.Request(ctx, d.Id, []byte(cmd))
+	if err != nil {
+		return fail(err)
+	}
+	res.Status = bulkOk
+	res.Response = resp
+	return res
+}
@@ -0,0 +1,151 @@
+package httpserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// Orders of device listings
+const (
+	// By name, then id
+	sortName = "name"
+	// Most recently seen first
+	sortLastSeen = "lastseen"
+)
+
+var errBadCursor = errors.New("invalid cursor")
+
+// How a device listing is filtered, sorted and paged
+type deviceQuery struct {
+	tags   model.TagFilter
+	online bool
+	group  *model.Group
+	sort   string
+	// 0 lists them all
+	limit int
+	// Where the previous page ended, or nil
+	after *deviceCursor
+}
+
+// Where a page of a listing ended, sent to clients opaque
+type deviceCursor struct {
+	Sort     string `json:"s"`
+	Name     string `json:"n,omitempty"`
+	LastSeen int64  `json:"t,omitempty"`
+	Id       string `json:"i"`
+}
+
+func cursorOf(d *model.Device, order string) *deviceCursor {
+	c := &deviceCursor{Sort: order, Id: d.Id}
+	if order == sortName {
+		c.Name = d.Name
+	} else {
+		c.LastSeen = atomic.LoadInt64(&d.LastSeen)
+	}
+	return c
+}
+
+func (c *deviceCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseCursor(s string) (*deviceCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	var c deviceCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Id == "" {
+		return nil, errBadCursor
+	}
+	return &c, nil
+}
+
+// Reports whether a comes before b in their order
+func (a *deviceCursor) before(b *deviceCursor) bool {
+	if a.Sort == sortLastSeen && a.LastSeen != b.LastSeen {
+		return a.LastSeen > b.LastSeen
+	}
+	if a.Sort == sortName && a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.Id < b.Id
+}
+
+// Reads ?tag= (see devicesHandler), ?online=true, ?group=<id>, ?sort=name
+// or lastseen, and pages of ?limit= devices continuing with ?after=, the
+// cursor returned with the previous one
+func (s *Server) parseDeviceQuery(r *http.Request, user *model.User) (*deviceQuery, error) {
+	query := r.URL.Query()
+	q := &deviceQuery{sort: sortName}
+	var err error
+	if q.tags, err = model.ParseTagFilter(query["tag"]); err != nil {
+		return nil, err
+	}
+	if v := query.Get("online"); v != "" {
+		if q.online, err = strconv.ParseBool(v); err != nil {
+			return nil, errors.New("invalid online")
+		}
+	}
+	if id := query.Get("group"); id != "" {
+		if q.group = s.findGroup(id, user.Email); q.group == nil {
+			return nil, errors.New("no such group")
+		}
+	}
+	switch v := query.Get("sort"); v {
+	case "", sortName:
+	case sortLastSeen:
+		q.sort = v
+	default:
+		return nil, errors.New("invalid sort")
+	}
+	if v := query.Get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit < 1 || q.limit > maxPageSize {
+			return nil, errors.New("invalid limit")
+		}
+	}
+	if v := query.Get("after"); v != "" {
+		if q.after, err = parseCursor(v); err != nil || q.after.Sort != q.sort {
+			return nil, errBadCursor
+		}
+	}
+	return q, nil
+}
+
+// Whether the listing is all of the user's devices
+func (q *deviceQuery) all() bool {
+	return q.tags == nil && !q.online && q.group == nil && q.limit == 0
+}
+
+// Returns the page of devices q selects, and the cursor of the next page or
+// "" if it's the last one
+func (q *deviceQuery) apply(devices []*model.Device) ([]*model.Device, string) {
+	res := make([]*model.Device, 0, len(devices))
+	for _, d := range devices {
+		if q.tags != nil && !q.tags.Matches(d) || q.online && !d.Online || q.group != nil && !q.group.Has(d.Id) {
+			continue
+		}
+		if q.after != nil && !q.after.before(cursorOf(d, q.sort)) {
+			continue
+		}
+		res = append(res, d)
+	}
+	keys := make(map[*model.Device]*deviceCursor, len(res))
+	for _, d := range res {
+		keys[d] = cursorOf(d, q.sort)
+	}
+	sort.Slice(res, func(i, j int) bool { return keys[res[i]].before(keys[res[j]]) })
+	if q.limit == 0 || len(res) <= q.limit {
+		return res, ""
+	}
+	res = res[:q.limit]
+	return res, keys[res[len(res)-1]].encode()
+}
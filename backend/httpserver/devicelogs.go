@@ -0,0 +1,39 @@
+package httpserver
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+)
+
+// Returns the last lines a device logged, oldest first. Optionally only
+// those ?since= (unix or RFC 3339), at least ?level= and the newest
+// ?limit=. Device admins only, firmware tends to log more than it should.
+func (s *Server) deviceLogsHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	query := r.URL.Query()
+	q := &model.DeviceLogQuery{Level: query.Get("level")}
+	since, err := parseTime(query.Get("since"), time.Time{})
+	if err != nil || q.Level != "" && !model.ValidLogLevel(q.Level) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !since.IsZero() {
+		q.Since = since.Unix()
+	}
+	if v := query.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	d := s.findDevice(mux.Vars(r)["id"], user.Email, model.RoleAdmin)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, s.hub.DeviceLogs(d.Id, q))
+}
@@ -0,0 +1,459 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+const (
+	// Maximum length of a device name
+	maxDeviceNameLen = 64
+	// Maximum number of commands kept for an offline device
+	maxQueueSize = 1024
+)
+
+// Returns the devices of owner and the ones shared with them, live ones
+// as reported by their connection. Devices connected to other nodes are
+// only marked online.
+func (s *Server) listDevices(ctx context.Context, owner string) []*model.Device {
+	live := s.hub.GetDevices(owner)
+	saved, err := s.store.FindDevicesByOwner(owner)
+	if err != nil {
+		log.Println("Error finding devices:", err)
+		return live
+	}
+
+	res := make([]*model.Device, 0, len(saved)+len(live))
+	seen := make(map[string]bool, len(live))
+	for _, d := range live {
+		seen[d.Id] = true
+		res = append(res, d)
+	}
+	var ids []string
+	for _, d := range saved {
+		if !seen[d.Id] {
+			ids = append(ids, d.Id)
+		}
+	}
+	remote := s.hub.RemoteOnline(ctx, ids)
+	for _, d := range saved {
+		if !seen[d.Id] {
+			d.Online = remote[d.Id]
+			res = append(res, d)
+		}
+	}
+	return append(res, s.sharedDevices(ctx, owner)...)
+}
+
+// Returns the device with id if the user with email owns it or it was
+// shared with them with at least the role need, or nil. Connected devices
+// are a copy, changes to their settings go through Hub.ApplySettings.
+func (s *Server) findDevice(id string, email string, need model.Role) *model.Device {
+	var d *model.Device
+	if conn := s.hub.GetConn(id); conn != nil {
+		d = conn.Snapshot()
+	} else {
+		var err error
+		if d, err = s.store.FindDevice(id); err != nil {
+			if err != store.ErrNotFound {
+				log.Println("Error finding device:", err)
+			}
+			return nil
+		}
+	}
+	if d.Deleted != 0 || !s.role(d, email).Allows(need) {
+		return nil
+	}
+	return d
+}
+
+// Returns what the user with email can do with d, "" if nothing
+func (s *Server) role(d *model.Device, email string) model.Role {
+	if d.Owner == email {
+		return model.RoleOwner
+	}
+	sh, err := s.store.FindShare(d.Id, email)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error finding share:", err)
+		}
+		return ""
+	}
+	return sh.Role
+}
+
+// Lists the user's devices, only those with every tag in ?tag=floor=2 or
+// ?tag=location if given. See parseDeviceQuery for the other filters and
+// paging, the cursor of the next page is in X-Next-Cursor.
+func (s *Server) devicesHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	q, err := s.parseDeviceQuery(r, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	devices, next := q.apply(s.listDevices(r.Context(), user.Email))
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	WriteJSON(w, devices)
+}
+
+func (s *Server) deviceHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	d := s.findDevice(mux.Vars(r)["id"], user.Email, model.RoleViewer)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, d)
+}
+
+// Renames a device or changes its queues, tags, profile or timezone,
+// fields left out are kept
+func (s *Server) updateDeviceHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	var req struct {
+		Name      *string `json:"name"`
+		QueueSize *int    `json:"queue_size"`
+		QueueTTL  *int64  `json:"queue_ttl"`
+		// Empty goes back to the default
+		Overflow *string `json:"overflow"`
+		// Merged into the tags, null removes a tag
+		Tags map[string]*string `json:"tags"`
+		// Empty clears it
+		Profile *string `json:"profile"`
+		// Empty goes back to the default
+		Timezone *string `json:"timezone"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if req.Name != nil && (*req.Name == "" || len(*req.Name) > maxDeviceNameLen) ||
+		req.QueueSize != nil && (*req.QueueSize < -1 || *req.QueueSize > maxQueueSize) ||
+		req.QueueTTL != nil && *req.QueueTTL < 0 ||
+		req.Overflow != nil && *req.Overflow != "" && !model.ValidOverflow(*req.Overflow) ||
+		req.Profile != nil && *req.Profile != "" && model.FindProfile(*req.Profile) == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.Timezone != nil {
+		if _, err := model.LoadTimezone(*req.Timezone, time.UTC); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	d := s.findDevice(mux.Vars(r)["id"], user.Email, model.RoleAdmin)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var tags map[string]string
+	if req.Tags != nil {
+		tags = mergeTags(d.Tags, req.Tags)
+		if err := model.CheckTags(tags); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	renamed := req.Name != nil && *req.Name != d.Name
+	if req.Name != nil {
+		d.Name = *req.Name
+	}
+	if req.QueueSize != nil {
+		d.QueueSize = *req.QueueSize
+	}
+	if req.QueueTTL != nil {
+		d.QueueTTL = *req.QueueTTL
+	}
+	if req.Overflow != nil {
+		d.Overflow = *req.Overflow
+	}
+	if req.Tags != nil {
+		d.Tags = tags
+	}
+	if req.Profile != nil {
+		d.Profile = *req.Profile
+	}
+	moved := req.Timezone != nil && *req.Timezone != d.Timezone
+	if req.Timezone != nil {
+		d.Timezone = *req.Timezone
+	}
+	if err := s.store.SaveDevice(d); err != nil {
+		log.Println("Error saving device:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if renamed {
+		s.record(r, user, model.AuditRename, d, d.Name)
+	}
+	s.hub.ApplySettings(d)
+	if moved {
+		s.hub.PushTime(d.Id)
+	}
+	s.hub.Publish(ws.EventUpdated, d, nil)
+	WriteJSON(w, d)
+}
+
+// Returns a copy of tags with the changes, nil values remove a tag
+func mergeTags(tags map[string]string, changes map[string]*string) map[string]string {
+	res := make(map[string]string, len(tags)+len(changes))
+	for k, v := range tags {
+		res[k] = v
+	}
+	for k, v := range changes {
+		if v == nil {
+			delete(res, k)
+		} else {
+			res[k] = *v
+		}
+	}
+	return res
+}
+
+// Deletes a device: it's hidden and can't connect, but keeps its history,
+// shares and groups until it's purged after deleted_retention, so it can be
+// restored. With ?purge=true it's forgotten right away, deleted or not, and
+// has to be paired again.
+func (s *Server) deleteDeviceHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	id := mux.Vars(r)["id"]
+	purge := r.URL.Query().Get("purge") == "true"
+	d := s.findDevice(id, user.Email, model.RoleOwner)
+	if d == nil && purge {
+		d = s.findDeleted(id, user.Email)
+	}
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if purge {
+		if err := store.PurgeDevice(s.store, d); err != nil {
+			log.Println("Error removing device:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.hub.ClearDeviceLogs(d.Id)
+	} else {
+		d.Deleted = time.Now().Unix()
+		if err := s.store.SaveDevice(d); err != nil {
+			log.Println("Error deleting device:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	s.record(r, user, model.AuditRemove, d, "")
+	s.hub.Disconnect(d.Id, ws.CloseRemoved, "device removed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns the device with id if it's deleted and the user with email owns
+// it, or nil
+func (s *Server) findDeleted(id string, email string) *model.Device {
+	d, err := s.store.FindDevice(id)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error finding device:", err)
+		}
+		return nil
+	}
+	if d.Deleted == 0 || d.Owner != email {
+		return nil
+	}
+	return d
+}
+
+// Lists the user's deleted devices that weren't purged yet, most recently
+// deleted first
+func (s *Server) deletedDevicesHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	devices, err := s.store.FindDeletedDevices(user.Email, time.Now().Unix()+1)
+	if err != nil {
+		log.Println("Error finding deleted devices:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Deleted > devices[j].Deleted })
+	if devices == nil {
+		devices = []*model.Device{}
+	}
+	WriteJSON(w, devices)
+}
+
+// Brings back a deleted device as it was, it may connect again
+func (s *Server) restoreDeviceHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	d := s.findDeleted(mux.Vars(r)["id"], user.Email)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Deleted devices don't count towards devices_per_owner
+	if err := s.hub.CheckDeviceQuota(user.Email); err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+	d.Deleted = 0
+	if err := s.store.SaveDevice(d); err != nil {
+		log.Println("Error restoring device:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.record(r, user, model.AuditRestore, d, "")
+	WriteJSON(w, d)
+}
+
+// Issues a new provisioning token for a device the user owns, which it
+// must send in its HELLO. The token it had stops working and it's
+// disconnected if it's connected. Devices are claimed by pairing first.
+func (s *Server) deviceTokenHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	if s.hub.TokenSecret == nil {
+		// Tokens are disabled
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	d := s.findDevice(mux.Vars(r)["id"], user.Email, model.RoleAdmin)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if d.Deleted != 0 {
+		http.Error(w, "device deleted", http.StatusConflict)
+		return
+	}
+
+	token, err := s.hub.RotateToken(d)
+	if err != nil {
+		log.Println("Error saving device:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Println("User", user.Email, "issued a token for", d.Id)
+	WriteJSON(w, map[string]string{
+		"id":    d.Id,
+		"token": token,
+	})
+}
+
+func (s *Server) shadowHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	d := s.findDevice(mux.Vars(r)["id"], user.Email, model.RoleViewer)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	sh, err := s.hub.Shadow(d.Id)
+	if err != nil {
+		log.Println("Error loading shadow:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, sh)
+}
+
+// Changes the desired state of a device, null values remove a key
+func (s *Server) updateShadowHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	var req struct {
+		Desired map[string]*string `json:"desired"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	for k, v := range req.Desired {
+		// Keys and values travel as single words in the text protocol
+		if !isWord(k) || v != nil && !isWord(*v) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	d := s.findDevice(mux.Vars(r)["id"], user.Email, model.RoleController)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	sh, err := s.hub.SetDesired(d, req.Desired)
+	if err != nil {
+		log.Println("Error saving shadow:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	changes, _ := json.Marshal(req.Desired)
+	s.record(r, user, model.AuditDesired, d, string(changes))
+	WriteJSON(w, sh)
+}
+
+func isWord(s string) bool {
+	return s != "" && len(s) <= maxDeviceNameLen && !strings.ContainsAny(s, " \t\r\n")
+}
+
+// Claims the unpaired device that was sent the given code
+func (s *Server) pairHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	d, err := s.hub.Claim(req.Code, user.Email, user.Tenant)
+	if errors.Is(err, ws.ErrQuotaExceeded) {
+		writeQuotaError(w, err)
+		return
+	}
+	if err == ws.ErrTooManyAttempts {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Println("Device", d.Id, "paired to", user.Email)
+	s.record(r, user, model.AuditClaim, d, "")
+	WriteJSON(w, d)
+}
+
+// Responds 403 with which quota the user went over, e.g.
+// {"error": "quota exceeded", "quota": "devices", "limit": 10}, or 500 if
+// err isn't a QuotaError
+func writeQuotaError(w http.ResponseWriter, err error) {
+	var qe *ws.QuotaError
+	if !errors.As(err, &qe) {
+		log.Println("Error checking quota:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": ws.ErrQuotaExceeded.Error(),
+		"quota": qe.Quota,
+		"limit": qe.Limit,
+	})
+}
+
+// Streams the events of the user's devices over a WebSocket
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	ws.ServeEvents(s.hub, user.Email, w, r)
+}
+
+// Streams the same events as Server-Sent Events, for browsers that can't
+// use WebSockets
+func (s *Server) eventStreamHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	ws.ServeEventStream(s.hub, user.Email, w, r)
+}
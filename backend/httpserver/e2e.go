@@ -0,0 +1,53 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/ws"
+)
+
+// A sealed command or answer, see the e2e package
+type sealed struct {
+	// Tells answers to concurrent commands apart, a single word
+	Ref  string `json:"ref"`
+	Data string `json:"data"`
+}
+
+// Sends a command sealed for the device's public_key, the body {"ref": "1",
+// "data": "<blob>"}, and responds with its sealed answer in kind. The server
+// can't tell what's in either.
+func (s *Server) e2eHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	d := s.findDevice(mux.Vars(r)["id"], user.Email, model.RoleController)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if d.PublicKey == "" {
+		http.Error(w, "device doesn't do e2e", http.StatusBadRequest)
+		return
+	}
+	var req sealed
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validArgs([]string{req.Ref, req.Data}) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), invokeTimeout)
+	defer cancel()
+
+	s.record(r, user, model.AuditInvoke, d, model.CmdE2E+" "+req.Ref)
+	resp, err := s.hub.Request(ctx, d.Id, []byte(model.CmdE2E+" "+req.Ref+" "+req.Data))
+	switch err {
+	case nil:
+		WriteJSON(w, &sealed{Ref: resp.Arg(0), Data: resp.Arg(1)})
+	case ws.ErrTimeout:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,479 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/scheduler"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Largest export that can be imported
+const maxImportSize = 8 << 20
+
+// Returns the user's devices, groups, scenes, rules and schedules as a
+// JSON file, see model.Export
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	ex := &model.Export{
+		Version: model.ExportVersion,
+		Time:    time.Now().Unix(),
+		Owner:   user.Email,
+		Tenant:  user.Tenant,
+	}
+	devices, err := s.store.FindDevicesByOwner(user.Email)
+	for _, d := range devices {
+		ex.Devices = append(ex.Devices, model.ExportDevice(d))
+	}
+	if err == nil {
+		ex.Groups, err = s.store.FindGroupsByOwner(user.Email)
+	}
+	if err == nil {
+		ex.Scenes, err = s.store.FindScenesByOwner(user.Email)
+	}
+	if err == nil {
+		ex.Rules, err = s.store.FindRulesByOwner(user.Email)
+	}
+	if err == nil {
+		ex.Schedules, err = s.store.FindSchedulesByOwner(user.Email)
+	}
+	if err != nil {
+		log.Println("Error exporting:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="iot-export.json"`)
+	WriteJSON(w, ex)
+}
+
+// Imports an export into the user's account. ?conflict= says what happens
+// to what they already have, skip by default, see model.ImportConflict.
+// Everything is checked as if it was created through the API, and what
+// can't be imported is reported without stopping the rest.
+func (s *Server) importHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	conflict := r.URL.Query().Get("conflict")
+	if conflict == "" {
+		conflict = model.ImportSkip
+	}
+	if !model.ValidImportConflict(conflict) {
+		http.Error(w, "invalid conflict", http.StatusBadRequest)
+		return
+	}
+	var ex model.Export
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportSize)).Decode(&ex); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if ex.Version != model.ExportVersion {
+		http.Error(w, "unsupported export version", http.StatusBadRequest)
+		return
+	}
+
+	im := &importer{s: s, r: r, user: user, conflict: conflict, ids: make(map[string]string)}
+	if err := im.run(&ex); err != nil {
+		log.Println("Error importing:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if im.res.Errors == nil {
+		im.res.Errors = []string{}
+	}
+	WriteJSON(w, &im.res)
+}
+
+type importer struct {
+	s        *Server
+	r        *http.Request
+	user     *model.User
+	conflict model.ImportConflict
+	res      model.ImportResult
+	// The ids the exported devices have here, they change if the export
+	// comes from another tenant
+	ids map[string]string
+}
+
+// Existing groups, scenes, rules or schedules of the user by id and by
+// name, which imported ones conflict with
+type existing map[string]bson.ObjectId
+
+func (e existing) add(id bson.ObjectId, name string) {
+	e[id.Hex()] = id
+	e["name:"+name] = id
+}
+
+// Returns the id of what the imported item with id and name conflicts
+// with, "" if nothing
+func (e existing) find(id bson.ObjectId, name string) bson.ObjectId {
+	if id.Valid() {
+		if found, ok := e[id.Hex()]; ok {
+			return found
+		}
+	}
+	return e["name:"+name]
+}
+
+func (im *importer) run(ex *model.Export) error {
+	for _, ed := range ex.Devices {
+		id := ed.Id
+		if ex.Tenant != "" {
+			id = strings.TrimPrefix(id, ex.Tenant+":")
+		}
+		im.ids[ed.Id] = model.QualifyId(im.user.Tenant, id)
+	}
+	// Devices go first, the rest refers to them
+	for _, ed := range ex.Devices {
+		im.device(ed)
+	}
+
+	email := im.user.Email
+	groups, err := im.s.store.FindGroupsByOwner(email)
+	if err != nil {
+		return err
+	}
+	found := existing{}
+	for _, g := range groups {
+		found.add(g.Id, g.Name)
+	}
+	for _, g := range ex.Groups {
+		im.group(g, found)
+	}
+
+	scenes, err := im.s.store.FindScenesByOwner(email)
+	if err != nil {
+		return err
+	}
+	found = existing{}
+	for _, sc := range scenes {
+		found.add(sc.Id, sc.Name)
+	}
+	for _, sc := range ex.Scenes {
+		im.scene(sc, found)
+	}
+
+	rules, err := im.s.store.FindRulesByOwner(email)
+	if err != nil {
+		return err
+	}
+	found = existing{}
+	for _, rule := range rules {
+		found.add(rule.Id, rule.Name)
+	}
+	for _, rule := range ex.Rules {
+		im.rule(rule, found)
+	}
+
+	schedules, err := im.s.store.FindSchedulesByOwner(email)
+	if err != nil {
+		return err
+	}
+	found = existing{}
+	for _, sc := range schedules {
+		found.add(sc.Id, sc.Name)
+	}
+	for _, sc := range ex.Schedules {
+		im.schedule(sc, found)
+	}
+	return nil
+}
+
+func (im *importer) fail(counts *model.ImportCounts, what string, err error) {
+	counts.Failed++
+	im.res.Errors = append(im.res.Errors, what+": "+err.Error())
+}
+
+// Returns the id the device with id has here
+func (im *importer) deviceId(id string) string {
+	if moved, ok := im.ids[id]; ok {
+		return moved
+	}
+	return id
+}
+
+func (im *importer) action(a *model.Action) {
+	if a.DeviceId != "" {
+		a.DeviceId = im.deviceId(a.DeviceId)
+	}
+}
+
+// Returns the id an imported item is saved with, the one of what it
+// replaces or "" to insert it, and whether it's left out
+func (im *importer) resolve(found bson.ObjectId) (bson.ObjectId, bool) {
+	switch {
+	case found == "" || im.conflict == model.ImportDuplicate:
+		return "", false
+	case im.conflict == model.ImportSkip:
+		return "", true
+	}
+	return found, false
+}
+
+// Returns why the settings of an exported device can't be used
+func checkExportedDevice(ed *model.ExportedDevice) error {
+	switch {
+	case len(ed.Name) > maxDeviceNameLen:
+		return errors.New("name too long")
+	case ed.QueueSize < -1 || ed.QueueSize > maxQueueSize || ed.QueueTTL < 0:
+		return errors.New("invalid queue")
+	case ed.Overflow != "" && !model.ValidOverflow(ed.Overflow):
+		return errors.New("invalid overflow")
+	case ed.Profile != "" && model.FindProfile(ed.Profile) == nil:
+		return errors.New("unknown profile")
+	}
+	if ed.Tags != nil {
+		if err := model.CheckTags(ed.Tags); err != nil {
+			return err
+		}
+	}
+	_, err := model.LoadTimezone(ed.Timezone, time.UTC)
+	return err
+}
+
+// Onboards the device to the user if it isn't known here, or changes its
+// settings if they own it and it's to be replaced
+func (im *importer) device(ed *model.ExportedDevice) {
+	counts := &im.res.Devices
+	id := im.deviceId(ed.Id)
+	what := "device " + id
+	if !model.ValidDeviceId(strings.TrimPrefix(id, im.user.Tenant+":")) {
+		im.fail(counts, what, errors.New("invalid id"))
+		return
+	}
+	if err := checkExportedDevice(ed); err != nil {
+		im.fail(counts, what, err)
+		return
+	}
+
+	saved, err := im.s.store.FindDevice(id)
+	switch {
+	case err == store.ErrNotFound:
+		if !model.ValidNewDeviceId(strings.TrimPrefix(id, im.user.Tenant+":")) {
+			im.fail(counts, what, errors.New("invalid id for a new device"))
+			return
+		}
+		if err := im.s.hub.CheckDeviceQuota(im.user.Email); err != nil {
+			im.fail(counts, what, err)
+			return
+		}
+		d := &model.Device{Id: id, Owner: im.user.Email, Tenant: im.user.Tenant, PublicKey: ed.PublicKey, TokenNonce: ws.NewTokenNonce()}
+		applySettings(d, ed)
+		if err := im.s.store.SaveDevice(d); err != nil {
+			log.Println("Error saving device:", err)
+			im.fail(counts, what, errors.New("saving device"))
+			return
+		}
+		im.s.record(im.r, im.user, model.AuditClaim, d, "import")
+		counts.Created++
+		return
+	case err != nil:
+		log.Println("Error finding device:", err)
+		im.fail(counts, what, errors.New("finding device"))
+		return
+	case saved.Owner != im.user.Email:
+		im.fail(counts, what, errors.New("belongs to someone else"))
+		return
+	case saved.Deleted != 0:
+		im.fail(counts, what, errors.New("deleted, restore it first"))
+		return
+	case im.conflict != model.ImportReplace:
+		counts.Skipped++
+		return
+	}
+
+	d := im.s.findDevice(id, im.user.Email, model.RoleOwner)
+	if d == nil {
+		im.fail(counts, what, errDeviceNotFound)
+		return
+	}
+	renamed, moved := ed.Name != d.Name, ed.Timezone != d.Timezone
+	applySettings(d, ed)
+	if err := im.s.store.SaveDevice(d); err != nil {
+		log.Println("Error saving device:", err)
+		im.fail(counts, what, errors.New("saving device"))
+		return
+	}
+	if renamed {
+		im.s.record(im.r, im.user, model.AuditRename, d, d.Name)
+	}
+	im.s.hub.ApplySettings(d)
+	if moved {
+		im.s.hub.PushTime(d.Id)
+	}
+	im.s.hub.Publish(ws.EventUpdated, d, nil)
+	counts.Replaced++
+}
+
+func applySettings(d *model.Device, ed *model.ExportedDevice) {
+	d.Name = ed.Name
+	d.QueueSize = ed.QueueSize
+	d.QueueTTL = ed.QueueTTL
+	d.Overflow = ed.Overflow
+	d.Tags = ed.Tags
+	d.Profile = ed.Profile
+	d.Timezone = ed.Timezone
+}
+
+// Members the user doesn't own here are left out
+func (im *importer) group(g *model.Group, found existing) {
+	counts := &im.res.Groups
+	what := "group " + g.Name
+	if g.Name == "" || len(g.Name) > maxGroupNameLen || len(g.Devices) > maxGroupSize {
+		im.fail(counts, what, errors.New("invalid group"))
+		return
+	}
+	id, skip := im.resolve(found.find(g.Id, g.Name))
+	if skip {
+		counts.Skipped++
+		return
+	}
+
+	members := g.Devices
+	g.Devices = nil
+	for _, member := range members {
+		member = im.deviceId(member)
+		if im.s.findDevice(member, im.user.Email, model.RoleOwner) == nil {
+			im.res.Errors = append(im.res.Errors, fmt.Sprintf("%s: device %s not found", what, member))
+			continue
+		}
+		if !g.Has(member) {
+			g.Devices = append(g.Devices, member)
+		}
+	}
+	g.Owner = im.user.Email
+	g.Id = id
+
+	if id == "" {
+		_, err := im.s.store.InsertGroup(g)
+		im.saved(counts, what, err, &counts.Created)
+	} else {
+		im.saved(counts, what, im.s.store.SaveGroup(g), &counts.Replaced)
+	}
+}
+
+// Counts what was saved, or what failed to be with err
+func (im *importer) saved(counts *model.ImportCounts, what string, err error, n *int) {
+	if err != nil {
+		log.Println("Error importing "+what+":", err)
+		im.fail(counts, what, errors.New("saving"))
+		return
+	}
+	*n++
+}
+
+func (im *importer) scene(sc *model.Scene, found existing) {
+	counts := &im.res.Scenes
+	what := "scene " + sc.Name
+	if err := sc.Check(); err != nil {
+		im.fail(counts, what, err)
+		return
+	}
+	id, skip := im.resolve(found.find(sc.Id, sc.Name))
+	if skip {
+		counts.Skipped++
+		return
+	}
+	for i := range sc.Steps {
+		im.action(&sc.Steps[i].Action)
+		if err := im.s.actionError(&sc.Steps[i].Action, im.user); err != nil {
+			im.fail(counts, fmt.Sprintf("%s: step %d", what, i), err)
+			return
+		}
+	}
+	sc.Owner = im.user.Email
+	sc.Id = id
+
+	if id == "" {
+		_, err := im.s.store.InsertScene(sc)
+		im.saved(counts, what, err, &counts.Created)
+	} else {
+		im.saved(counts, what, im.s.store.SaveScene(sc), &counts.Replaced)
+	}
+}
+
+func (im *importer) rule(rule *model.Rule, found existing) {
+	counts := &im.res.Rules
+	what := "rule " + rule.Name
+	if err := rule.Check(); err != nil {
+		im.fail(counts, what, err)
+		return
+	}
+	id, skip := im.resolve(found.find(rule.Id, rule.Name))
+	if skip {
+		counts.Skipped++
+		return
+	}
+	rule.Trigger.DeviceId = im.deviceId(rule.Trigger.DeviceId)
+	if im.s.findDevice(rule.Trigger.DeviceId, im.user.Email, model.RoleViewer) == nil {
+		im.fail(counts, what+": trigger", errDeviceNotFound)
+		return
+	}
+	if rule.HasAction() {
+		im.action(&rule.Action)
+		if err := im.s.actionError(&rule.Action, im.user); err != nil {
+			im.fail(counts, what+": action", err)
+			return
+		}
+	}
+	rule.Owner = im.user.Email
+	rule.Id = id
+
+	if id == "" {
+		_, err := im.s.store.InsertRule(rule)
+		im.saved(counts, what, err, &counts.Created)
+	} else {
+		old := im.s.findRule(id.Hex(), im.user.Email)
+		im.saved(counts, what, im.s.store.SaveRule(rule), &counts.Replaced)
+		if old != nil {
+			im.s.invalidateRules(old.Trigger.DeviceId)
+		}
+	}
+	im.s.invalidateRules(rule.Trigger.DeviceId)
+}
+
+// Schedules start over from now, one-shot ones that already ran fail
+func (im *importer) schedule(sc *model.Schedule, found existing) {
+	counts := &im.res.Schedules
+	what := "schedule " + sc.Name
+	if err := sc.Check(); err != nil {
+		im.fail(counts, what, err)
+		return
+	}
+	id, skip := im.resolve(found.find(sc.Id, sc.Name))
+	if skip {
+		counts.Skipped++
+		return
+	}
+	next, err := scheduler.Next(sc, time.Now())
+	if err == nil && next == 0 {
+		err = errors.New("schedule never runs")
+	}
+	if err != nil {
+		im.fail(counts, what, err)
+		return
+	}
+	im.action(&sc.Action)
+	if err := im.s.actionError(&sc.Action, im.user); err != nil {
+		im.fail(counts, what+": action", err)
+		return
+	}
+	sc.Owner = im.user.Email
+	sc.Id = id
+	sc.Next = next
+	sc.LastRun = 0
+	sc.LastError = ""
+
+	if id == "" {
+		_, err := im.s.store.InsertSchedule(sc)
+		im.saved(counts, what, err, &counts.Created)
+	} else {
+		im.saved(counts, what, im.s.store.SaveSchedule(sc), &counts.Replaced)
+	}
+}
@@ -0,0 +1,48 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/ws"
+)
+
+// How long a file may take to reach a device, it goes a chunk at a time
+const fileTimeout = 2 * time.Minute
+
+// Sends the body to a device as the file called name, e.g. a certificate,
+// and answers once the device has all of it
+func (s *Server) sendFileHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	vars := mux.Vars(r)
+	d := s.findDevice(vars["id"], user.Email, model.RoleAdmin)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer r.Body.Close()
+
+	ctx, cancel := context.WithTimeout(r.Context(), fileTimeout)
+	defer cancel()
+
+	err := s.hub.SendFile(ctx, d.Id, vars["name"], http.MaxBytesReader(w, r.Body, ws.MaxFileSize))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case err == ws.ErrInvalidFileName:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err == ws.ErrFileTooLarge, errors.As(err, &tooLarge):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	case err == ws.ErrTimeout, err == context.DeadlineExceeded:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	case errors.Is(err, ws.ErrFileRejected):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+}
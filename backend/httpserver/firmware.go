@@ -0,0 +1,247 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+const (
+	// Largest firmware image accepted, an ESP8266 with 4MB of flash can't
+	// take more
+	maxFirmwareSize = 4 << 20
+	// Most devices a rollout can target
+	maxRolloutSize = 1024
+)
+
+// Returns the firmware with id if it belongs to owner, or nil
+func (s *Server) findFirmware(id string, owner string) *model.Firmware {
+	f, err := s.store.FindFirmware(id)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error finding firmware:", err)
+		}
+		return nil
+	}
+	if f.Owner != owner {
+		return nil
+	}
+	return f
+}
+
+// Returns the rollout with id if it belongs to owner, or nil
+func (s *Server) findRollout(id string, owner string) *model.Rollout {
+	ro, err := s.store.FindRollout(id)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error finding rollout:", err)
+		}
+		return nil
+	}
+	if ro.Owner != owner {
+		return nil
+	}
+	return ro
+}
+
+func (s *Server) firmwaresHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	fs, err := s.store.FindFirmwaresByOwner(user.Email)
+	if err != nil {
+		log.Println("Error finding firmware:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if fs == nil {
+		fs = []*model.Firmware{}
+	}
+	WriteJSON(w, fs)
+}
+
+// Uploads a firmware image for a hardware model, the body is the image:
+// POST /api/firmware?model=esp12e&version=1.4.0
+func (s *Server) uploadFirmwareHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	f := &model.Firmware{
+		Owner:   user.Email,
+		Model:   r.URL.Query().Get("model"),
+		Version: r.URL.Query().Get("version"),
+		Created: time.Now().Unix(),
+	}
+	if err := f.Check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxFirmwareSize))
+	defer r.Body.Close()
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "empty firmware", http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(data)
+	f.Size = int64(len(data))
+	f.SHA256 = hex.EncodeToString(sum[:])
+
+	if _, err := s.store.InsertFirmware(f, data); err != nil {
+		log.Println("Error inserting firmware:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, f)
+}
+
+// Deletes a firmware, unless a rollout is still installing it
+func (s *Server) deleteFirmwareHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	f := s.findFirmware(mux.Vars(r)["id"], user.Email)
+	if f == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rollouts, err := s.store.FindRolloutsByOwner(user.Email)
+	if err != nil {
+		log.Println("Error finding rollouts:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for _, ro := range rollouts {
+		if ro.FirmwareId == f.Id.Hex() && ro.Active() {
+			http.Error(w, "firmware in use by rollout "+ro.Id.Hex(), http.StatusConflict)
+			return
+		}
+	}
+	if err := s.store.RemoveFirmware(f.Id.Hex(), user.Email); err != nil {
+		log.Println("Error removing firmware:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Serves a firmware image to the device that was sent a signed URL for it
+func (s *Server) downloadFirmwareHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	q := r.URL.Query()
+	if !s.OTA.Verify(id, q.Get("exp"), q.Get("sig")) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	data, err := s.store.FindFirmwareData(id)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error finding firmware data:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+func (s *Server) rolloutsHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	rollouts, err := s.store.FindRolloutsByOwner(user.Email)
+	if err != nil {
+		log.Println("Error finding rollouts:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if rollouts == nil {
+		rollouts = []*model.Rollout{}
+	}
+	WriteJSON(w, rollouts)
+}
+
+// Installs a firmware on devices and the members of groups you own:
+// {"firmware": "...", "devices": ["..."], "groups": ["..."]}
+func (s *Server) createRolloutHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	var req struct {
+		Firmware string   `json:"firmware"`
+		Devices  []string `json:"devices"`
+		Groups   []string `json:"groups"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	f := s.findFirmware(req.Firmware, user.Email)
+	if f == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	ids := req.Devices
+	for _, gid := range req.Groups {
+		g := s.findGroup(gid, user.Email)
+		if g == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		ids = append(ids, g.Devices...)
+	}
+
+	var devices []*model.Device
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		d := s.findDevice(id, user.Email, model.RoleOwner)
+		if d == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		devices = append(devices, d)
+	}
+	if len(devices) == 0 || len(devices) > maxRolloutSize {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ro, err := s.OTA.Begin(f, devices)
+	if err != nil {
+		log.Println("Error starting rollout:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, ro)
+}
+
+func (s *Server) rolloutHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	ro := s.findRollout(mux.Vars(r)["id"], user.Email)
+	if ro == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, ro)
+}
+
+// Cancels a rollout, devices that already got it may still install it
+func (s *Server) cancelRolloutHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	ro := s.findRollout(mux.Vars(r)["id"], user.Email)
+	if ro == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := s.OTA.Cancel(ro); err != nil {
+		log.Println("Error canceling rollout:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
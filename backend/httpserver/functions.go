@@ -0,0 +1,99 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+// How long to wait for a device to answer a function invocation
+const invokeTimeout = 10 * time.Second
+
+// Returns the function called name on a device, or nil. Functions the
+// owner defined take precedence over the ones the device declared.
+func (s *Server) findFunction(d *model.Device, name string) *model.Function {
+	f, err := store.FindFunction(s.store, d, name)
+	if err != nil {
+		log.Println("Error finding functions:", err)
+	}
+	return f
+}
+
+// Invokes a function on a device and responds with the device's answer.
+// The optional body {"args": ["HIGH"]} is appended to the function's
+// command and pin, after checking it against the function's parameters.
+func (s *Server) invokeHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	vars := mux.Vars(r)
+	d := s.findDevice(vars["id"], user.Email, model.RoleController)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f := s.findFunction(d, vars["name"])
+	if f == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if f.E2E {
+		http.Error(w, "function is only invoked sealed", http.StatusBadRequest)
+		return
+	}
+
+	args, ok := invokeArgs(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := f.Validate(args); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ws.WithFunction(r.Context(), f.Name), invokeTimeout)
+	defer cancel()
+
+	cmd := f.Command(args)
+	s.record(r, user, model.AuditInvoke, d, cmd)
+	resp, err := s.hub.Request(ctx, d.Id, []byte(cmd))
+	switch err {
+	case nil:
+		WriteJSON(w, resp)
+	case ws.ErrTimeout:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+}
+
+// Reads the optional {"args": [...]} body of an invocation, returns false
+// if it's malformed
+func invokeArgs(r *http.Request) ([]string, bool) {
+	var req struct {
+		Args []string `json:"args"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return nil, false
+	}
+	defer r.Body.Close()
+	return req.Args, validArgs(req.Args)
+}
+
+// Arguments are sent to the device as single words
+func validArgs(args []string) bool {
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\r\n") {
+			return false
+		}
+	}
+	return true
+}
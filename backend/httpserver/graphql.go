@@ -0,0 +1,345 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+	"github.com/graph-gophers/graphql-go"
+	"github.com/twinone/iot/backend/audit"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+// The dashboard's view of the user, their devices and functions. Times
+// are Unix seconds.
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+	subscription: Subscription
+}
+
+type Query {
+	me: User!
+	# Owned and shared devices
+	devices: [Device!]!
+	device(id: ID!): Device
+}
+
+type Mutation {
+	# Invokes a function and returns what the device answered
+	invoke(device: ID!, function: String!, args: [String!]): Message!
+}
+
+type Subscription {
+	# Events of the devices you own, optionally of one device or some types
+	# like "connected", "message" or "presence"
+	events(device: ID, types: [String!]): Event!
+}
+
+type User {
+	email: String!
+	name: String!
+	picture: String!
+}
+
+type Device {
+	id: ID!
+	owner: String!
+	name: String!
+	online: Boolean!
+	# 0 waiting for HELLO, 1 for OWNER, 2 connected, 3 waiting to be paired
+	state: Int!
+	lastSeen: Float!
+	# What you can do with it if you don't own it
+	role: String
+	model: String!
+	firmware: String!
+	functions: [Function!]!
+}
+
+type Function {
+	name: String!
+	pin: Int!
+	cmd: String!
+	params: [Param!]!
+}
+
+type Param {
+	name: String!
+	type: String!
+	min: Float
+	max: Float
+	unit: String!
+	values: [String!]!
+}
+
+type Message {
+	cmd: String!
+	args: [String!]!
+	# JSON, only from devices speaking JSON
+	payload: String
+}
+
+type Event {
+	type: String!
+	time: Float!
+	device: Device!
+	message: Message
+	# Of presence events, online, stale or offline
+	state: String
+}
+`
+
+var (
+	errDeviceNotFound   = errors.New("device not found")
+	errFunctionNotFound = errors.New("function not found")
+)
+
+type userKey struct{}
+
+// Also marks what the user does as coming through GraphQL
+func withUser(ctx context.Context, user *model.User) context.Context {
+	return context.WithValue(audit.WithVia(ctx, "graphql"), userKey{}, user)
+}
+
+func ctxUser(ctx context.Context) *model.User {
+	return ctx.Value(userKey{}).(*model.User)
+}
+
+// A query, mutation or subscription, as sent by GraphQL clients
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+func (s *Server) graphqlHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	var req graphqlRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	WriteJSON(w, s.graphql.Exec(withUser(r.Context(), user), req.Query, req.OperationName, req.Variables))
+}
+
+// Resolves the fields of Query, Mutation and Subscription
+type graphqlRoot struct {
+	s *Server
+}
+
+func (q *graphqlRoot) Me(ctx context.Context) *graphqlUser {
+	return &graphqlUser{ctxUser(ctx)}
+}
+
+func (q *graphqlRoot) Devices(ctx context.Context) []*graphqlDevice {
+	devices := q.s.listDevices(ctx, ctxUser(ctx).Email)
+	res := make([]*graphqlDevice, len(devices))
+	for i, d := range devices {
+		res[i] = &graphqlDevice{q.s, d}
+	}
+	return res
+}
+
+func (q *graphqlRoot) Device(ctx context.Context, args struct{ Id graphql.ID }) *graphqlDevice {
+	email := ctxUser(ctx).Email
+	d := q.s.findDevice(string(args.Id), email, model.RoleViewer)
+	if d == nil {
+		return nil
+	}
+	if d.Owner != email {
+		// d may be the live one of the connection
+		shared := *d
+		shared.Role = q.s.role(d, email)
+		d = &shared
+	}
+	return &graphqlDevice{q.s, d}
+}
+
+func (q *graphqlRoot) Invoke(ctx context.Context, args struct {
+	Device   graphql.ID
+	Function string
+	Args     *[]string
+}) (*graphqlMessage, error) {
+	d := q.s.findDevice(string(args.Device), ctxUser(ctx).Email, model.RoleController)
+	if d == nil {
+		return nil, errDeviceNotFound
+	}
+	f := q.s.findFunction(d, args.Function)
+	if f == nil {
+		return nil, errFunctionNotFound
+	}
+	var fargs []string
+	if args.Args != nil {
+		fargs = *args.Args
+	}
+	if !validArgs(fargs) {
+		return nil, errors.New("arguments must be single words")
+	}
+	if err := f.Validate(fargs); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ws.WithFunction(ctx, f.Name), invokeTimeout)
+	defer cancel()
+	cmd := f.Command(fargs)
+	audit.Record(ctx, q.s.store, ctxUser(ctx).Email, model.AuditInvoke, d, cmd)
+	resp, err := q.s.hub.Request(ctx, d.Id, []byte(cmd))
+	if err != nil {
+		return nil, err
+	}
+	return &graphqlMessage{resp}, nil
+}
+
+func (q *graphqlRoot) Events(ctx context.Context, args struct {
+	Device *graphql.ID
+	Types  *[]string
+}) (<-chan *graphqlEvent, error) {
+	email := ctxUser(ctx).Email
+	if args.Device != nil && q.s.findDevice(string(*args.Device), email, model.RoleOwner) == nil {
+		return nil, errDeviceNotFound
+	}
+	types := make(map[string]bool)
+	if args.Types != nil {
+		for _, t := range *args.Types {
+			types[t] = true
+		}
+	}
+
+	sub := q.s.hub.Subscribe(email)
+	res := make(chan *graphqlEvent)
+	go func() {
+		defer close(res)
+		defer q.s.hub.Unsubscribe(sub)
+		for {
+			select {
+			case ev := <-sub.Events:
+				if len(types) > 0 && !types[ev.Type] || args.Device != nil && ev.Device.Id != string(*args.Device) {
+					continue
+				}
+				select {
+				case res <- &graphqlEvent{q.s, ev}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res, nil
+}
+
+type graphqlUser struct {
+	u *model.User
+}
+
+func (u *graphqlUser) Email() string   { return u.u.Email }
+func (u *graphqlUser) Name() string    { return u.u.Name }
+func (u *graphqlUser) Picture() string { return u.u.Picture }
+
+type graphqlDevice struct {
+	s *Server
+	d *model.Device
+}
+
+func (d *graphqlDevice) Id() graphql.ID    { return graphql.ID(d.d.Id) }
+func (d *graphqlDevice) Owner() string     { return d.d.Owner }
+func (d *graphqlDevice) Name() string      { return d.d.Name }
+func (d *graphqlDevice) Online() bool      { return d.d.Online }
+func (d *graphqlDevice) State() int32      { return int32(d.d.State) }
+func (d *graphqlDevice) LastSeen() float64 { return float64(d.d.LastSeen) }
+func (d *graphqlDevice) Model() string     { return d.d.Model }
+func (d *graphqlDevice) Firmware() string  { return d.d.Firmware }
+
+func (d *graphqlDevice) Role() *string {
+	if d.d.Role == "" {
+		return nil
+	}
+	role := string(d.d.Role)
+	return &role
+}
+
+func (d *graphqlDevice) Functions() ([]*graphqlFunction, error) {
+	functions, err := store.DeviceFunctions(d.s.store, d.d)
+	if err != nil {
+		log.Println("Error finding functions:", err)
+		return nil, errors.New("finding functions")
+	}
+	res := make([]*graphqlFunction, len(functions))
+	for i, f := range functions {
+		res[i] = &graphqlFunction{f}
+	}
+	return res, nil
+}
+
+type graphqlFunction struct {
+	f *model.Function
+}
+
+func (f *graphqlFunction) Name() string { return f.f.Name }
+func (f *graphqlFunction) Pin() int32   { return int32(f.f.Pin) }
+func (f *graphqlFunction) Cmd() string  { return string(f.f.Cmd) }
+
+func (f *graphqlFunction) Params() []*graphqlParam {
+	res := make([]*graphqlParam, len(f.f.Params))
+	for i := range f.f.Params {
+		res[i] = &graphqlParam{&f.f.Params[i]}
+	}
+	return res
+}
+
+type graphqlParam struct {
+	p *model.Param
+}
+
+func (p *graphqlParam) Name() string     { return p.p.Name }
+func (p *graphqlParam) Type() string     { return p.p.Type }
+func (p *graphqlParam) Min() *float64    { return p.p.Min }
+func (p *graphqlParam) Max() *float64    { return p.p.Max }
+func (p *graphqlParam) Unit() string     { return p.p.Unit }
+func (p *graphqlParam) Values() []string { return p.p.Values }
+
+type graphqlMessage struct {
+	m *ws.Message
+}
+
+func (m *graphqlMessage) Cmd() string    { return m.m.Cmd }
+func (m *graphqlMessage) Args() []string { return m.m.Args }
+
+func (m *graphqlMessage) Payload() *string {
+	if len(m.m.Payload) == 0 {
+		return nil
+	}
+	p := string(m.m.Payload)
+	return &p
+}
+
+type graphqlEvent struct {
+	s  *Server
+	ev *ws.Event
+}
+
+func (e *graphqlEvent) Type() string           { return e.ev.Type }
+func (e *graphqlEvent) Time() float64          { return float64(e.ev.Time) }
+func (e *graphqlEvent) Device() *graphqlDevice { return &graphqlDevice{e.s, e.ev.Device} }
+
+func (e *graphqlEvent) Message() *graphqlMessage {
+	if e.ev.Message == nil {
+		return nil
+	}
+	return &graphqlMessage{e.ev.Message}
+}
+
+func (e *graphqlEvent) State() *string {
+	if e.ev.State == "" {
+		return nil
+	}
+	return &e.ev.State
+}
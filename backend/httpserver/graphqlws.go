@@ -0,0 +1,179 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/gorilla/websocket"
+	"github.com/twinone/iot/backend/model"
+)
+
+// Subscriptions are served over WebSocket with the graphql-transport-ws
+// protocol, the one graphql-ws and Apollo speak
+const graphqlProtocol = "graphql-transport-ws"
+
+const (
+	// How long a client may stay silent, it's pinged well before that
+	graphqlPongWait   = 60 * time.Second
+	graphqlPingPeriod = graphqlPongWait * 9 / 10
+	graphqlWriteWait  = 10 * time.Second
+	// Largest operation a client may send
+	graphqlMaxMessage = 64 << 10
+	// Closes sent when the client breaks the protocol
+	graphqlCloseBadMessage   = 4400
+	graphqlCloseUnauthorized = 4401
+	graphqlCloseDuplicateId  = 4409
+)
+
+// Browsers authenticate with cookies, so they must come from our own
+// origin (the default check)
+var graphqlUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{graphqlProtocol},
+}
+
+type graphqlFrame struct {
+	Type    string          `json:"type"`
+	Id      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func (s *Server) graphqlWSHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	conn, err := graphqlUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != graphqlProtocol {
+		closeGraphQL(conn, websocket.CloseProtocolError, "unsupported subprotocol")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(withUser(r.Context(), user))
+	defer cancel()
+
+	// Only the writer goroutine writes
+	out := make(chan *graphqlFrame)
+	send := func(f *graphqlFrame) {
+		select {
+		case out <- f:
+		case <-ctx.Done():
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(graphqlPingPeriod)
+		defer ticker.Stop()
+		for {
+			var err error
+			select {
+			case f := <-out:
+				conn.SetWriteDeadline(time.Now().Add(graphqlWriteWait))
+				err = conn.WriteJSON(f)
+			case <-ticker.C:
+				conn.SetWriteDeadline(time.Now().Add(graphqlWriteWait))
+				err = conn.WriteMessage(websocket.PingMessage, nil)
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				// Unblocks the reader
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	// Operations going on by id
+	var mx sync.Mutex
+	ops := make(map[string]context.CancelFunc)
+
+	conn.SetReadLimit(graphqlMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(graphqlPongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(graphqlPongWait))
+		return nil
+	})
+	acked := false
+	for {
+		var f graphqlFrame
+		if err := conn.ReadJSON(&f); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(graphqlPongWait))
+		switch f.Type {
+		case "connection_init":
+			acked = true
+			send(&graphqlFrame{Type: "connection_ack"})
+		case "ping":
+			send(&graphqlFrame{Type: "pong"})
+		case "pong":
+		case "subscribe":
+			if !acked {
+				closeGraphQL(conn, graphqlCloseUnauthorized, "unauthorized")
+				return
+			}
+			var req graphqlRequest
+			if f.Id == "" || json.Unmarshal(f.Payload, &req) != nil {
+				closeGraphQL(conn, graphqlCloseBadMessage, "invalid subscribe")
+				return
+			}
+			opCtx, opCancel := context.WithCancel(ctx)
+			mx.Lock()
+			if ops[f.Id] != nil {
+				mx.Unlock()
+				opCancel()
+				closeGraphQL(conn, graphqlCloseDuplicateId, "subscriber for "+f.Id+" already exists")
+				return
+			}
+			ops[f.Id] = opCancel
+			mx.Unlock()
+			go s.graphqlOperation(opCtx, f.Id, &req, send, func() {
+				mx.Lock()
+				delete(ops, f.Id)
+				mx.Unlock()
+				opCancel()
+			})
+		case "complete":
+			mx.Lock()
+			if stop := ops[f.Id]; stop != nil {
+				stop()
+				delete(ops, f.Id)
+			}
+			mx.Unlock()
+		default:
+			closeGraphQL(conn, graphqlCloseBadMessage, "unknown message "+f.Type)
+			return
+		}
+	}
+}
+
+// Runs an operation sent over a WebSocket, sending its results until it
+// ends or ctx is canceled by the client completing it
+func (s *Server) graphqlOperation(ctx context.Context, id string, req *graphqlRequest, send func(*graphqlFrame), done func()) {
+	defer done()
+	results, err := s.graphql.Subscribe(ctx, req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		payload, _ := json.Marshal([]map[string]string{{"message": err.Error()}})
+		send(&graphqlFrame{Type: "error", Id: id, Payload: payload})
+		return
+	}
+	for res := range results {
+		payload, err := json.Marshal(res)
+		if err != nil {
+			continue
+		}
+		send(&graphqlFrame{Type: "next", Id: id, Payload: payload})
+	}
+	if ctx.Err() == nil {
+		send(&graphqlFrame{Type: "complete", Id: id})
+	}
+}
+
+func closeGraphQL(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(graphqlWriteWait))
+}
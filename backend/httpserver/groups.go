@@ -0,0 +1,290 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+const (
+	// Maximum length of a group name
+	maxGroupNameLen = 64
+	// Maximum number of devices in a group
+	maxGroupSize = 256
+)
+
+// Returns the group with id if it belongs to owner, or nil
+func (s *Server) findGroup(id string, owner string) *model.Group {
+	g, err := s.store.FindGroup(id)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error finding group:", err)
+		}
+		return nil
+	}
+	if g.Owner != owner {
+		return nil
+	}
+	return g
+}
+
+func (s *Server) saveGroup(w http.ResponseWriter, g *model.Group) {
+	if err := s.store.SaveGroup(g); err != nil {
+		log.Println("Error saving group:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, g)
+}
+
+func (s *Server) groupsHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	groups, err := s.store.FindGroupsByOwner(user.Email)
+	if err != nil {
+		log.Println("Error finding groups:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if groups == nil {
+		groups = []*model.Group{}
+	}
+	WriteJSON(w, groups)
+}
+
+// Creates a group from {"name": "Living room", "devices": ["a", "b"]},
+// devices are optional
+func (s *Server) createGroupHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	var g model.Group
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if g.Name == "" || len(g.Name) > maxGroupNameLen || len(g.Devices) > maxGroupSize {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	members := g.Devices
+	g.Devices = nil
+	for _, id := range members {
+		if s.findDevice(id, user.Email, model.RoleOwner) == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !g.Has(id) {
+			g.Devices = append(g.Devices, id)
+		}
+	}
+
+	g.Owner = user.Email
+	if _, err := s.store.InsertGroup(&g); err != nil {
+		log.Println("Error inserting group:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, &g)
+}
+
+func (s *Server) groupHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	g := s.findGroup(mux.Vars(r)["id"], user.Email)
+	if g == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, g)
+}
+
+// Renames a group
+func (s *Server) updateGroupHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if req.Name == "" || len(req.Name) > maxGroupNameLen {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	g := s.findGroup(mux.Vars(r)["id"], user.Email)
+	if g == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	g.Name = req.Name
+	s.saveGroup(w, g)
+}
+
+func (s *Server) deleteGroupHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	g := s.findGroup(mux.Vars(r)["id"], user.Email)
+	if g == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := s.store.RemoveGroup(g.Id.Hex(), user.Email); err != nil {
+		log.Println("Error removing group:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) addGroupDeviceHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	vars := mux.Vars(r)
+	g := s.findGroup(vars["id"], user.Email)
+	d := s.findDevice(vars["device"], user.Email, model.RoleOwner)
+	if g == nil || d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if g.Has(d.Id) {
+		WriteJSON(w, g)
+		return
+	}
+	if len(g.Devices) >= maxGroupSize {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	g.Devices = append(g.Devices, d.Id)
+	s.saveGroup(w, g)
+}
+
+func (s *Server) removeGroupDeviceHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	vars := mux.Vars(r)
+	g := s.findGroup(vars["id"], user.Email)
+	if g == nil || !g.Has(vars["device"]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	g.Remove(vars["device"])
+	s.saveGroup(w, g)
+}
+
+// Sends a command to every member of a group. Responds with the error of
+// each member that didn't get it, members that were offline get it when
+// they come back.
+func (s *Server) execGroupHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	g := s.findGroup(mux.Vars(r)["id"], user.Email)
+	if g == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.execDevices(w, r, user, g.Devices)
+}
+
+// Sends the command in the body {"cmd": "DW 5 HIGH"} to the devices with
+// ids the user owns, queueing it for offline ones. Responds with the error
+// of each device that didn't get it.
+func (s *Server) execDevices(w http.ResponseWriter, r *http.Request, user *model.User, ids []string) {
+	var req struct {
+		Cmd string `json:"cmd"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Cmd == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var owned []string
+	for _, id := range ids {
+		if d := s.findDevice(id, user.Email, model.RoleOwner); d != nil {
+			s.record(r, user, model.AuditInvoke, d, req.Cmd)
+			owned = append(owned, id)
+		}
+	}
+	s.withPayload(slog.With("owner", user.Email, "devices", len(owned)), req.Cmd).Info("sending command")
+	errs := make(map[string]string)
+	for id, err := range s.hub.Broadcast(r.Context(), owned, []byte(req.Cmd)) {
+		errs[id] = err.Error()
+	}
+	WriteJSON(w, map[string]interface{}{
+		"errors": errs,
+	})
+}
+
+// The outcome of invoking a function on one member of a group
+type invokeResult struct {
+	Response *ws.Message `json:"response,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// Invokes the function called name on every member of a group that has
+// one, in parallel. Responds with the answer or error of each member.
+func (s *Server) invokeGroupHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	g := s.findGroup(mux.Vars(r)["id"], user.Email)
+	if g == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.invokeDevices(w, r, user, g.Devices)
+}
+
+// Invokes the function called {name} on the devices with ids the user owns
+// that have one, like invokeGroupHandler
+func (s *Server) invokeDevices(w http.ResponseWriter, r *http.Request, user *model.User, ids []string) {
+	name := mux.Vars(r)["name"]
+	args, ok := invokeArgs(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	byDevice := make(map[string]*model.Function)
+	devices := make(map[string]*model.Device)
+	for _, id := range ids {
+		d := s.findDevice(id, user.Email, model.RoleOwner)
+		if d == nil {
+			continue
+		}
+		if f := s.findFunction(d, name); f != nil {
+			byDevice[id] = f
+			devices[id] = d
+		}
+	}
+	if len(byDevice) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), invokeTimeout)
+	defer cancel()
+
+	var mx sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]*invokeResult, len(byDevice))
+	for id, f := range byDevice {
+		wg.Add(1)
+		go func(id string, f *model.Function) {
+			defer wg.Done()
+			res := &invokeResult{}
+			var resp *ws.Message
+			err := f.Validate(args)
+			if err == nil {
+				cmd := f.Command(args)
+				s.record(r, user, model.AuditInvoke, devices[id], cmd)
+				resp, err = s.hub.Request(ws.WithFunction(ctx, f.Name), id, []byte(cmd))
+			}
+			if err != nil {
+				res.Error = err.Error()
+			} else {
+				res.Response = resp
+			}
+			mx.Lock()
+			results[id] = res
+			mx.Unlock()
+		}(id, f)
+	}
+	wg.Wait()
+	WriteJSON(w, results)
+}
@@ -0,0 +1,89 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// How long dependencies have to answer a probe
+const healthTimeout = 2 * time.Second
+
+type healthReport struct {
+	// ok or failing
+	Status string `json:"status"`
+	// What each dependency said, ok or the error
+	Checks map[string]string `json:"checks"`
+}
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Runs checks concurrently and answers 503 if any of them fails
+func (s *Server) writeHealth(w http.ResponseWriter, r *http.Request, checks []healthCheck) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(checks))
+	for _, c := range checks {
+		go func(c healthCheck) {
+			results <- result{c.name, c.check(ctx)}
+		}(c)
+	}
+	report := &healthReport{Status: "ok", Checks: make(map[string]string, len(checks))}
+wait:
+	for range checks {
+		select {
+		case res := <-results:
+			report.Checks[res.name] = "ok"
+			if res.err != nil {
+				report.Checks[res.name] = res.err.Error()
+				report.Status = "failing"
+			}
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	for _, c := range checks {
+		// Didn't answer in time, like a store ping that ignores ctx
+		if _, ok := report.Checks[c.name]; !ok {
+			report.Checks[c.name] = "timeout"
+			report.Status = "failing"
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	WriteJSON(w, report)
+}
+
+// Liveness: fails only if the hub is stuck, restarting won't fix an
+// unreachable database
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeHealth(w, r, []healthCheck{
+		{"hub", s.hub.Alive},
+	})
+}
+
+// Readiness: fails while the hub, the store or the cluster broker can't
+// serve devices, and once shutting down
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeHealth(w, r, []healthCheck{
+		{"hub", func(ctx context.Context) error {
+			if err := s.hub.Accepting(); err != nil {
+				return err
+			}
+			return s.hub.Alive(ctx)
+		}},
+		{"store", func(context.Context) error { return s.store.Ping() }},
+		{"cluster", s.hub.ClusterReady},
+	})
+}
@@ -0,0 +1,73 @@
+package httpserver
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Entries returned at once by the audit and history endpoints
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// Reads ?limit= and ?before=, the id of the last entry of the previous
+// page. Returns false if they're malformed.
+func parsePage(query url.Values) (int, bson.ObjectId, bool) {
+	limit := defaultPageSize
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return 0, "", false
+		}
+		limit = n
+	}
+	var before bson.ObjectId
+	if v := query.Get("before"); v != "" {
+		if !bson.IsObjectIdHex(v) {
+			return 0, "", false
+		}
+		before = bson.ObjectIdHex(v)
+	}
+	return limit, before, true
+}
+
+// Returns the commands sent to a device and what came of them, newest
+// first, optionally only those of ?function= or with ?result=. Pages like
+// the audit log.
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	query := r.URL.Query()
+	q := &model.HistoryQuery{
+		Function: query.Get("function"),
+		Result:   query.Get("result"),
+	}
+	var ok bool
+	if q.Limit, q.Before, ok = parsePage(query); !ok || q.Result != "" && !model.ValidResult(q.Result) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	d := s.findDevice(mux.Vars(r)["id"], user.Email, model.RoleViewer)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	q.DeviceId = d.Id
+
+	entries, err := s.store.FindHistory(q)
+	if err != nil {
+		log.Println("Error finding history:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []*model.HistoryEntry{}
+	}
+	WriteJSON(w, entries)
+}
@@ -4,7 +4,7 @@ import "net/http"
 
 func (s *Server) indexHandler(w http.ResponseWriter, r *http.Request) {
 	c := s.GetCookie(r)
-	u := s.GetUser(c)
+	u := s.authenticate(r, c)
 
 	if u == nil {
 		http.Redirect(w, r, "/signin", http.StatusTemporaryRedirect)
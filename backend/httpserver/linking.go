@@ -0,0 +1,322 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/twinone/iot/backend/assistant"
+	conf "github.com/twinone/iot/backend/config"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+const (
+	// How long an authorization code can be exchanged for tokens
+	linkCodeTTL = 10 * time.Minute
+	// How long an access token of a voice assistant is valid for
+	linkTokenTTL = time.Hour
+
+	linkCodeAudience  = "assistant-code"
+	linkTokenAudience = "assistant"
+	// Refresh tokens are kept hashed among the access tokens with this
+	// prefix, so they can't be used as sessions
+	linkTokenPrefix = "link:"
+	// And codes that weren't exchanged yet with this one
+	linkCodePrefix = "code:"
+)
+
+// Account linking lets voice assistants act on behalf of users: Google and
+// Alexa send them to /oauth/authorize, then exchange the code they get for
+// tokens at /oauth/token (the OAuth 2 authorization code flow)
+type linking struct {
+	clientId     string
+	clientSecret string
+	// Where codes may be sent, e.g. https://oauth-redirect.googleusercontent.com/r/<project>
+	redirects []string
+	// Signs codes and access tokens
+	secret []byte
+	// Held while a code is exchanged, so it can't be exchanged twice
+	mx sync.Mutex
+}
+
+// Codes also have the URI they were sent to, which the exchange must name
+type linkClaims struct {
+	jwt.StandardClaims
+	RedirectURI string `json:"redirect_uri,omitempty"`
+}
+
+func newLinking(config conf.Config) *linking {
+	if *config["voice_client_id"] == "" {
+		return nil
+	}
+	if *config["voice_client_secret"] == "" || *config["voice_secret"] == "" {
+		log.Fatal("voice_client_id needs voice_client_secret and voice_secret")
+	}
+	l := &linking{
+		clientId:     *config["voice_client_id"],
+		clientSecret: *config["voice_client_secret"],
+		secret:       []byte(*config["voice_secret"]),
+		redirects:    config.List("voice_redirect_uris"),
+	}
+	return l
+}
+
+func (l *linking) allowedRedirect(uri string) bool {
+	for _, r := range l.redirects {
+		if r == uri {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *linking) sign(claims linkClaims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(l.secret)
+}
+
+var errAudience = errors.New("wrong audience")
+
+func (l *linking) parse(tok string, audience string) (*linkClaims, error) {
+	claims := &linkClaims{}
+	_, err := jwt.ParseWithClaims(tok, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errSigningMethod
+		}
+		return l.secret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.Audience != audience {
+		return nil, errAudience
+	}
+	return claims, nil
+}
+
+func hashToken(tok string) string {
+	return hashWithPrefix(linkTokenPrefix, tok)
+}
+
+func hashWithPrefix(prefix string, tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return prefix + hex.EncodeToString(sum[:])
+}
+
+// Uses up the code with the given claims. Returns false if it was used
+// already or the user can't link anymore.
+func (s *Server) useLinkCode(claims *linkClaims) bool {
+	s.link.mx.Lock()
+	defer s.link.mx.Unlock()
+	key := hashWithPrefix(linkCodePrefix, claims.Id)
+	u, err := s.store.FindUserByAccessToken(key)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error finding code:", err)
+		}
+		return false
+	}
+	if err := s.store.RemoveAccessToken(key); err != nil {
+		log.Println("Error removing code:", err)
+		return false
+	}
+	return u.Email == claims.Subject && !u.Disabled
+}
+
+// Sends a signed in user back to the assistant with a code. Users that
+// aren't signed in are sent to sign in first and come back here after.
+func (s *Server) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect := q.Get("redirect_uri")
+	if q.Get("client_id") != s.link.clientId || !s.link.allowedRedirect(redirect) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	target, err := url.Parse(redirect)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" {
+		params := target.Query()
+		params.Set("error", "unsupported_response_type")
+		params.Set("state", q.Get("state"))
+		target.RawQuery = params.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+		return
+	}
+
+	c := s.GetCookie(r)
+	u := s.authenticate(r, c)
+	if u == nil {
+		c.Values["next"] = r.URL.RequestURI()
+		c.Save(r, w)
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+
+	// Kept until it's exchanged, so it can only be exchanged once
+	id := randToken()
+	if err := s.store.InsertAccessToken(&model.AccessToken{Email: u.Email, Token: hashWithPrefix(linkCodePrefix, id)}); err != nil {
+		log.Println("Error inserting code:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	code, err := s.link.sign(linkClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   u.Email,
+			Audience:  linkCodeAudience,
+			Id:        id,
+			ExpiresAt: time.Now().Add(linkCodeTTL).Unix(),
+		},
+		RedirectURI: redirect,
+	})
+	if err != nil {
+		log.Println("Error signing code:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Println("Linking assistant for", u.Email)
+	params := target.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	target.RawQuery = params.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// Exchanges a code or a refresh token for an access token
+func (s *Server) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if id != s.link.clientId || subtle.ConstantTimeCompare([]byte(secret), []byte(s.link.clientSecret)) != 1 {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	var email, refresh, key string
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		claims, err := s.link.parse(r.PostFormValue("code"), linkCodeAudience)
+		if err != nil || claims.RedirectURI != r.PostFormValue("redirect_uri") || !s.useLinkCode(claims) {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		email = claims.Subject
+		refresh = randToken()
+		key = hashToken(refresh)
+		if err := s.store.InsertAccessToken(&model.AccessToken{Email: email, Token: key}); err != nil {
+			log.Println("Error inserting access token:", err)
+			writeOAuthError(w, http.StatusInternalServerError, "server_error")
+			return
+		}
+	case "refresh_token":
+		key = hashToken(r.PostFormValue("refresh_token"))
+		u, err := s.store.FindUserByAccessToken(key)
+		if err != nil || u.Disabled {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		email = u.Email
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	// The access token names its refresh token, so unlinking revokes both
+	access, err := s.link.sign(linkClaims{StandardClaims: jwt.StandardClaims{
+		Subject:   email,
+		Audience:  linkTokenAudience,
+		Id:        key,
+		ExpiresAt: time.Now().Add(linkTokenTTL).Unix(),
+	}})
+	if err != nil {
+		log.Println("Error signing access token:", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+	res := map[string]interface{}{
+		"token_type":   "Bearer",
+		"access_token": access,
+		"expires_in":   int(linkTokenTTL.Seconds()),
+	}
+	if refresh != "" {
+		res["refresh_token"] = refresh
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, res)
+}
+
+// Returns the user an assistant access token belongs to and the key of its
+// refresh token, or nil if it's invalid or was revoked
+func (s *Server) linkedUser(tok string) (*model.User, string) {
+	claims, err := s.link.parse(tok, linkTokenAudience)
+	if err != nil {
+		return nil, ""
+	}
+	u, err := s.store.FindUserByAccessToken(claims.Id)
+	if err != nil || u.Email != claims.Subject || u.Disabled {
+		return nil, ""
+	}
+	return u, claims.Id
+}
+
+// Google Smart Home fulfillment
+func (s *Server) googleHandler(w http.ResponseWriter, r *http.Request) {
+	u, key := s.linkedUser(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if u == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var req assistant.GoogleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if req.Intent() == assistant.IntentDisconnect {
+		log.Println("Unlinking Google for", u.Email)
+		if err := s.store.RemoveAccessToken(key); err != nil {
+			log.Println("Error removing access token:", err)
+		}
+	}
+	WriteJSON(w, s.assistant.Google(r.Context(), u.Email, &req))
+}
+
+// Alexa Smart Home directives, forwarded by the skill's Lambda function
+func (s *Server) alexaHandler(w http.ResponseWriter, r *http.Request) {
+	var d assistant.AlexaDirective
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if tok == "" {
+		tok = d.Token()
+	}
+	u, _ := s.linkedUser(tok)
+	if u == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	WriteJSON(w, s.assistant.Alexa(r.Context(), u.Email, &d))
+}
@@ -0,0 +1,58 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+func (s *Server) notificationsHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	p, err := s.store.FindNotificationPrefs(user.Email)
+	if err == store.ErrNotFound {
+		p, err = &model.NotificationPrefs{}, nil
+	}
+	if err != nil {
+		log.Println("Error finding notification preferences:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if p.Channels == nil {
+		p.Channels = map[string]string{}
+	}
+	if p.Presence == nil {
+		p.Presence = []model.PresenceState{}
+	}
+	WriteJSON(w, p)
+}
+
+// Replaces how the user wants to be notified:
+// {"channels": {"email": "me@example.com"}, "presence": ["offline"], "will": true}
+func (s *Server) updateNotificationsHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	var p model.NotificationPrefs
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if err := p.Check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for ch := range p.Channels {
+		if !s.Notifier.Has(ch) {
+			http.Error(w, ch+" notifications aren't enabled", http.StatusBadRequest)
+			return
+		}
+	}
+	p.Email = user.Email
+	if err := s.store.SaveNotificationPrefs(&p); err != nil {
+		log.Println("Error saving notification preferences:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, &p)
+}
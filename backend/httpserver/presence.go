@@ -0,0 +1,39 @@
+package httpserver
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+)
+
+type presenceResponse struct {
+	State    model.PresenceState `json:"state"`
+	LastSeen int64               `json:"lastseen"`
+	// Newest first
+	History []*model.PresenceChange `json:"history"`
+}
+
+// Returns whether a device is online, stale or offline and how that
+// changed lately
+func (s *Server) presenceHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	d := s.findDevice(mux.Vars(r)["id"], user.Email, model.RoleViewer)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	history, err := s.store.FindPresence(d.Id)
+	if err != nil {
+		log.Println("Error finding presence:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if history == nil {
+		history = []*model.PresenceChange{}
+	}
+	res := &presenceResponse{History: history}
+	res.State, res.LastSeen = s.Presence.State(d)
+	WriteJSON(w, res)
+}
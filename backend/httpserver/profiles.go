@@ -0,0 +1,14 @@
+package httpserver
+
+import (
+	"net/http"
+
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+)
+
+// Lists the device profiles, with the functions and state attributes
+// devices of each have
+func (s *Server) profilesHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	WriteJSON(w, model.Profiles)
+}
@@ -0,0 +1,367 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	conf "github.com/twinone/iot/backend/config"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	googleUserinfo = "https://www.googleapis.com/oauth2/v3/userinfo"
+	githubUser     = "https://api.github.com/user"
+	githubEmails   = "https://api.github.com/user/emails"
+)
+
+// A way to sign in: Google, GitHub or an OpenID Connect provider. Users
+// are sent to /auth/<name>, and come back to /auth/<name>/callback
+// (Google to callback_url) where the account is linked to a user.
+type provider struct {
+	name string
+	// Shown on the sign in page, "Sign in with <title>"
+	title string
+	cfg   *oauth2.Config
+	// Returns who signed in, Sub is their subject at the provider
+	identify func(ctx context.Context, client *http.Client) (*model.User, error)
+}
+
+func newProviders(config conf.Config) []*provider {
+	var providers []*provider
+	if *config["client_id"] != "" {
+		providers = append(providers, &provider{
+			name:  "google",
+			title: "Google",
+			cfg: &oauth2.Config{
+				ClientID:     *config["client_id"],
+				RedirectURL:  *config["callback_url"],
+				ClientSecret: *config["client_secret"],
+				Scopes: []string{
+					// You have to select your own scope from here -> https://developers.google.com/identity/protocols/googlescopes#google_sign-in
+					"https://www.googleapis.com/auth/userinfo.email",
+					"https://www.googleapis.com/auth/userinfo.profile",
+				},
+				Endpoint: google.Endpoint,
+			},
+			identify: userinfo(googleUserinfo),
+		})
+	}
+
+	if *config["github_client_id"] != "" {
+		if *config["github_secret"] == "" || *config["public_url"] == "" {
+			log.Fatal("github_client_id needs github_secret and public_url")
+		}
+		providers = append(providers, &provider{
+			name:  "github",
+			title: "GitHub",
+			cfg: &oauth2.Config{
+				ClientID:     *config["github_client_id"],
+				ClientSecret: *config["github_secret"],
+				RedirectURL:  callbackURL(config, "github"),
+				Scopes:       []string{"read:user", "user:email"},
+				Endpoint:     github.Endpoint,
+			},
+			identify: githubIdentify,
+		})
+	}
+
+	if issuer := *config["oidc_issuer"]; issuer != "" {
+		if *config["oidc_client_id"] == "" || *config["oidc_client_secret"] == "" || *config["public_url"] == "" {
+			log.Fatal("oidc_issuer needs oidc_client_id, oidc_client_secret and public_url")
+		}
+		d, err := discover(issuer)
+		if err != nil {
+			log.Fatal("Error discovering ", issuer, ": ", err)
+		}
+		providers = append(providers, &provider{
+			name:  "oidc",
+			title: *config["oidc_name"],
+			cfg: &oauth2.Config{
+				ClientID:     *config["oidc_client_id"],
+				ClientSecret: *config["oidc_client_secret"],
+				RedirectURL:  callbackURL(config, "oidc"),
+				Scopes:       []string{"openid", "email", "profile"},
+				Endpoint:     oauth2.Endpoint{AuthURL: d.AuthURL, TokenURL: d.TokenURL},
+			},
+			identify: userinfo(d.UserinfoURL),
+		})
+	}
+	return providers
+}
+
+func callbackURL(config conf.Config, name string) string {
+	return strings.TrimSuffix(*config["public_url"], "/") + "/auth/" + name + "/callback"
+}
+
+func (s *Server) provider(name string) *provider {
+	for _, p := range s.providers {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// The endpoints of an OpenID Connect provider we use
+type discovery struct {
+	AuthURL     string `json:"authorization_endpoint"`
+	TokenURL    string `json:"token_endpoint"`
+	UserinfoURL string `json:"userinfo_endpoint"`
+}
+
+func discover(issuer string) (*discovery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	d := &discovery{}
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(ctx, http.DefaultClient, url, d); err != nil {
+		return nil, err
+	}
+	if d.AuthURL == "" || d.TokenURL == "" || d.UserinfoURL == "" {
+		return nil, errors.New("missing authorization, token or userinfo endpoint")
+	}
+	return d, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Identifies users by the standard claims at an OpenID Connect userinfo
+// endpoint, which model.User mirrors
+func userinfo(url string) func(ctx context.Context, client *http.Client) (*model.User, error) {
+	return func(ctx context.Context, client *http.Client) (*model.User, error) {
+		u := &model.User{}
+		if err := getJSON(ctx, client, url, u); err != nil {
+			return nil, err
+		}
+		if u.Sub == "" || u.Email == "" {
+			return nil, errors.New("no subject or email")
+		}
+		return u, nil
+	}
+}
+
+// GitHub isn't OpenID Connect, users are identified by their id and
+// primary email
+func githubIdentify(ctx context.Context, client *http.Client) (*model.User, error) {
+	var gu struct {
+		Id        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+		HTMLURL   string `json:"html_url"`
+	}
+	if err := getJSON(ctx, client, githubUser, &gu); err != nil {
+		return nil, err
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, githubEmails, &emails); err != nil {
+		return nil, err
+	}
+
+	u := &model.User{
+		Sub:     strconv.FormatInt(gu.Id, 10),
+		Name:    gu.Name,
+		Profile: gu.HTMLURL,
+		Picture: gu.AvatarURL,
+	}
+	if u.Name == "" {
+		u.Name = gu.Login
+	}
+	for _, e := range emails {
+		if e.Primary {
+			u.Email = e.Email
+			u.EmailVerified = e.Verified
+		}
+	}
+	if u.Email == "" {
+		return nil, errors.New("no primary email")
+	}
+	return u, nil
+}
+
+// Sends the user to sign in at a provider. Signed in users link the
+// account they sign in with to theirs.
+func (s *Server) providerSigninHandler(w http.ResponseWriter, r *http.Request) {
+	p := s.provider(mux.Vars(r)["provider"])
+	if p == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Checked by the callback, unlike the session token it's seen by the
+	// provider
+	c := s.GetCookie(r)
+	state := randToken()
+	c.Values["oauth_state"] = state
+	c.Save(r, w)
+	http.Redirect(w, r, p.cfg.AuthCodeURL(state), http.StatusFound)
+}
+
+// Returns the user that signs in as u at a provider. The account is linked
+// to the user already signed in, to the user with the same email if both
+// the provider and the one that user signed up with verified it, or to a
+// new user. Writes why not and returns nil
+// if it can't be.
+func (s *Server) signinUser(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, provider string, u *model.User) *model.User {
+	current := s.authenticate(r, cookie)
+	id, err := s.store.FindIdentity(provider, u.Sub)
+	switch err {
+	case nil:
+		if current != nil && current.Email != id.Email {
+			http.Error(w, "this account is linked to another user", http.StatusConflict)
+			return nil
+		}
+		user, err := s.store.FindUserByEmail(id.Email)
+		if err != nil {
+			log.Println("Error finding user:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return nil
+		}
+		return enabled(w, user)
+	case store.ErrNotFound:
+	default:
+		log.Println("Error finding identity:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+
+	user := current
+	if user == nil {
+		existing, err := s.store.FindUserByEmail(u.Email)
+		switch err {
+		case nil:
+			// Anyone can sign up with a password and an email that isn't
+			// theirs, so only users a provider verified the email of are
+			// joined
+			if !u.EmailVerified || !existing.EmailVerified {
+				http.Error(w, "a user with this email exists, sign in and link this account", http.StatusConflict)
+				return nil
+			}
+			user = existing
+		case store.ErrNotFound:
+			tenant, ok := s.TenantOf(r)
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return nil
+			}
+			u.Tenant = tenant
+			if err := s.store.InsertUser(u); err != nil {
+				log.Println("Error inserting user:", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return nil
+			}
+			user = u
+		default:
+			log.Println("Error finding user:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return nil
+		}
+	}
+	if enabled(w, user) == nil {
+		return nil
+	}
+
+	ids, err := s.store.FindIdentitiesByUser(user.Email)
+	if err != nil {
+		log.Println("Error finding identities:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	for _, id := range ids {
+		if id.Provider == provider {
+			http.Error(w, "another account of this provider is linked, unlink it first", http.StatusConflict)
+			return nil
+		}
+	}
+	if err := s.store.InsertIdentity(&model.Identity{
+		Provider: provider,
+		Subject:  u.Sub,
+		Email:    user.Email,
+		Linked:   time.Now().Unix(),
+	}); err != nil {
+		log.Println("Error inserting identity:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	log.Println("Linked", provider, "account", u.Sub, "to", user.Email)
+	return user
+}
+
+func enabled(w http.ResponseWriter, u *model.User) *model.User {
+	if u.Disabled {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	return u
+}
+
+func (s *Server) identitiesHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	ids, err := s.store.FindIdentitiesByUser(user.Email)
+	if err != nil {
+		log.Println("Error finding identities:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if ids == nil {
+		ids = []*model.Identity{}
+	}
+	WriteJSON(w, ids)
+}
+
+// Unlinks the account of a provider, unless it's the only way the user has
+// to sign in
+func (s *Server) unlinkIdentityHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	provider := mux.Vars(r)["provider"]
+	ids, err := s.store.FindIdentitiesByUser(user.Email)
+	if err != nil {
+		log.Println("Error finding identities:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if user.PasswordHash == "" && len(ids) == 1 && ids[0].Provider == provider {
+		http.Error(w, "it's the only way to sign in", http.StatusConflict)
+		return
+	}
+	if err := s.store.RemoveIdentity(user.Email, provider); err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error removing identity:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Println("Unlinked", provider, "account of", user.Email)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,169 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+// Returns the rule with id if it belongs to owner, or nil
+func (s *Server) findRule(id string, owner string) *model.Rule {
+	rule, err := s.store.FindRule(id)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error finding rule:", err)
+		}
+		return nil
+	}
+	if rule.Owner != owner {
+		return nil
+	}
+	return rule
+}
+
+// Decodes a rule from the body and checks the user can see its trigger
+// device and control its action device. Writes the error and returns nil
+// if it can't be used.
+func (s *Server) decodeRule(w http.ResponseWriter, r *http.Request, user *model.User) *model.Rule {
+	var rule model.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	defer r.Body.Close()
+	if err := rule.Check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if s.findDevice(rule.Trigger.DeviceId, user.Email, model.RoleViewer) == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if rule.HasAction() && !s.checkAction(w, &rule.Action, user) {
+		return nil
+	}
+	rule.Owner = user.Email
+	return &rule
+}
+
+// Checks the user can control the device of a and its function accepts
+// the args. Writes the error and returns false if not. Actions targeting
+// tags are checked on each device when they run.
+func (s *Server) checkAction(w http.ResponseWriter, a *model.Action, user *model.User) bool {
+	switch err := s.actionError(a, user); err {
+	case nil:
+		return true
+	case errDeviceNotFound, errFunctionNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+	return false
+}
+
+// Returns errDeviceNotFound if the user can't control the device of a,
+// errFunctionNotFound if it doesn't have the function, or why the function
+// doesn't accept the args
+func (s *Server) actionError(a *model.Action, user *model.User) error {
+	if a.DeviceId == "" {
+		return nil
+	}
+	d := s.findDevice(a.DeviceId, user.Email, model.RoleController)
+	if d == nil {
+		return errDeviceNotFound
+	}
+	if a.Function == "" {
+		return nil
+	}
+	f := s.findFunction(d, a.Function)
+	if f == nil {
+		return errFunctionNotFound
+	}
+	return f.Validate(a.Args)
+}
+
+func (s *Server) invalidateRules(deviceIds ...string) {
+	if s.Rules == nil {
+		return
+	}
+	for _, id := range deviceIds {
+		s.Rules.Invalidate(id)
+	}
+}
+
+func (s *Server) rulesHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	rules, err := s.store.FindRulesByOwner(user.Email)
+	if err != nil {
+		log.Println("Error finding rules:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if rules == nil {
+		rules = []*model.Rule{}
+	}
+	WriteJSON(w, rules)
+}
+
+func (s *Server) createRuleHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	rule := s.decodeRule(w, r, user)
+	if rule == nil {
+		return
+	}
+	if _, err := s.store.InsertRule(rule); err != nil {
+		log.Println("Error inserting rule:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.invalidateRules(rule.Trigger.DeviceId)
+	WriteJSON(w, rule)
+}
+
+func (s *Server) ruleHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	rule := s.findRule(mux.Vars(r)["id"], user.Email)
+	if rule == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, rule)
+}
+
+// Replaces a rule, e.g. to disable it
+func (s *Server) updateRuleHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	old := s.findRule(mux.Vars(r)["id"], user.Email)
+	if old == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rule := s.decodeRule(w, r, user)
+	if rule == nil {
+		return
+	}
+	rule.Id = old.Id
+	if err := s.store.SaveRule(rule); err != nil {
+		log.Println("Error saving rule:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.invalidateRules(old.Trigger.DeviceId, rule.Trigger.DeviceId)
+	WriteJSON(w, rule)
+}
+
+func (s *Server) deleteRuleHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	rule := s.findRule(mux.Vars(r)["id"], user.Email)
+	if rule == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := s.store.RemoveRule(rule.Id.Hex(), user.Email); err != nil {
+		log.Println("Error removing rule:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.invalidateRules(rule.Trigger.DeviceId)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,172 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/audit"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/rules"
+	"github.com/twinone/iot/backend/store"
+)
+
+// Returns the scene with id if it belongs to owner, or nil
+func (s *Server) findScene(id string, owner string) *model.Scene {
+	sc, err := s.store.FindScene(id)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error finding scene:", err)
+		}
+		return nil
+	}
+	if sc.Owner != owner {
+		return nil
+	}
+	return sc
+}
+
+// Decodes a scene from the body and checks the user can control the device
+// of every step. Writes the error and returns nil if it can't be used.
+func (s *Server) decodeScene(w http.ResponseWriter, r *http.Request, user *model.User) *model.Scene {
+	var sc model.Scene
+	if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	defer r.Body.Close()
+	if err := sc.Check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	for i := range sc.Steps {
+		if !s.checkAction(w, &sc.Steps[i].Action, user) {
+			return nil
+		}
+	}
+	sc.Owner = user.Email
+	return &sc
+}
+
+func (s *Server) scenesHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	scenes, err := s.store.FindScenesByOwner(user.Email)
+	if err != nil {
+		log.Println("Error finding scenes:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if scenes == nil {
+		scenes = []*model.Scene{}
+	}
+	WriteJSON(w, scenes)
+}
+
+// Creates a scene from e.g. {"name": "Good night", "steps": [
+// {"deviceid": "lamp", "function": "off"},
+// {"deviceid": "blinds", "cmd": "DW 4 LOW", "delay": 500}]}
+func (s *Server) createSceneHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	sc := s.decodeScene(w, r, user)
+	if sc == nil {
+		return
+	}
+	if _, err := s.store.InsertScene(sc); err != nil {
+		log.Println("Error inserting scene:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, sc)
+}
+
+func (s *Server) sceneHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	sc := s.findScene(mux.Vars(r)["id"], user.Email)
+	if sc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, sc)
+}
+
+func (s *Server) updateSceneHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	old := s.findScene(mux.Vars(r)["id"], user.Email)
+	if old == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	sc := s.decodeScene(w, r, user)
+	if sc == nil {
+		return
+	}
+	sc.Id = old.Id
+	if err := s.store.SaveScene(sc); err != nil {
+		log.Println("Error saving scene:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, sc)
+}
+
+func (s *Server) deleteSceneHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	sc := s.findScene(mux.Vars(r)["id"], user.Email)
+	if sc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := s.store.RemoveScene(sc.Id.Hex(), user.Email); err != nil {
+		log.Println("Error removing scene:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The outcome of one step of a scene
+type stepResult struct {
+	DeviceId string `json:"deviceid"`
+	// The command sent, or queued if the device was offline
+	Cmd   string `json:"cmd,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Runs the steps of a scene in order, waiting for their delays. A step that
+// fails doesn't stop the rest. Responds with the outcome of each step once
+// it's done.
+func (s *Server) activateSceneHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	sc := s.findScene(mux.Vars(r)["id"], user.Email)
+	if sc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	log.Println("Activating scene", sc.Id.Hex())
+	results := make([]*stepResult, len(sc.Steps))
+	for i := range sc.Steps {
+		st := &sc.Steps[i]
+		res := &stepResult{DeviceId: st.DeviceId}
+		results[i] = res
+		if st.Delay > 0 {
+			select {
+			case <-time.After(time.Duration(st.Delay) * time.Millisecond):
+			case <-r.Context().Done():
+			}
+		}
+		if err := r.Context().Err(); err != nil {
+			res.Error = err.Error()
+			continue
+		}
+		ctx, cancel := context.WithTimeout(audit.WithVia(r.Context(), "scene:"+sc.Id.Hex()), invokeTimeout)
+		cmd, err := rules.Run(ctx, s.hub, s.store, user.Email, &st.Action)
+		cancel()
+		if err != nil {
+			res.Error = err.Error()
+			continue
+		}
+		res.Cmd = cmd
+	}
+	WriteJSON(w, map[string]interface{}{
+		"steps": results,
+	})
+}
@@ -0,0 +1,138 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/scheduler"
+	"github.com/twinone/iot/backend/store"
+)
+
+// Returns the schedule with id if it belongs to owner, or nil
+func (s *Server) findSchedule(id string, owner string) *model.Schedule {
+	sc, err := s.store.FindSchedule(id)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error finding schedule:", err)
+		}
+		return nil
+	}
+	if sc.Owner != owner {
+		return nil
+	}
+	return sc
+}
+
+// Decodes a schedule from the body, checks the user can control its action
+// device and computes its next run. Writes the error and returns nil if it
+// can't be used.
+func (s *Server) decodeSchedule(w http.ResponseWriter, r *http.Request, user *model.User) *model.Schedule {
+	var sc model.Schedule
+	if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	defer r.Body.Close()
+	if err := sc.Check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	next, err := scheduler.Next(&sc, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if next == 0 {
+		http.Error(w, "schedule never runs", http.StatusBadRequest)
+		return nil
+	}
+	if !s.checkAction(w, &sc.Action, user) {
+		return nil
+	}
+	sc.Owner = user.Email
+	sc.Next = next
+	sc.LastRun = 0
+	sc.LastError = ""
+	return &sc
+}
+
+func (s *Server) schedulesHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	schedules, err := s.store.FindSchedulesByOwner(user.Email)
+	if err != nil {
+		log.Println("Error finding schedules:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if schedules == nil {
+		schedules = []*model.Schedule{}
+	}
+	WriteJSON(w, schedules)
+}
+
+// Creates a schedule from e.g. {"name": "Lights on", "enabled": true,
+// "cron": "30 7 * * 1-5", "timezone": "Europe/Madrid",
+// "action": {"deviceid": "a", "function": "on"}}, or "at" with a unix
+// time instead of "cron" to run it once
+func (s *Server) createScheduleHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	sc := s.decodeSchedule(w, r, user)
+	if sc == nil {
+		return
+	}
+	if _, err := s.store.InsertSchedule(sc); err != nil {
+		log.Println("Error inserting schedule:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, sc)
+}
+
+func (s *Server) scheduleHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	sc := s.findSchedule(mux.Vars(r)["id"], user.Email)
+	if sc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, sc)
+}
+
+// Replaces a schedule, e.g. to disable it. The next run is computed again.
+func (s *Server) updateScheduleHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	old := s.findSchedule(mux.Vars(r)["id"], user.Email)
+	if old == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	sc := s.decodeSchedule(w, r, user)
+	if sc == nil {
+		return
+	}
+	sc.Id = old.Id
+	sc.LastRun = old.LastRun
+	sc.LastError = old.LastError
+	if err := s.store.SaveSchedule(sc); err != nil {
+		log.Println("Error saving schedule:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, sc)
+}
+
+// Cancels a schedule
+func (s *Server) deleteScheduleHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	sc := s.findSchedule(mux.Vars(r)["id"], user.Email)
+	if sc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := s.store.RemoveSchedule(sc.Id.Hex(), user.Email); err != nil {
+		log.Println("Error removing schedule:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,57 +1,131 @@
 package httpserver
 
 import (
+	"log/slog"
 	"net/http"
 
 	"github.com/Don-V/mongostore"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	"github.com/graph-gophers/graphql-go"
+	"github.com/twinone/iot/backend/assistant"
+	conf "github.com/twinone/iot/backend/config"
 	"github.com/twinone/iot/backend/db"
+	"github.com/twinone/iot/backend/notify"
+	"github.com/twinone/iot/backend/ota"
+	"github.com/twinone/iot/backend/presence"
+	"github.com/twinone/iot/backend/rules"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/webhooks"
 	"github.com/twinone/iot/backend/ws"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
 type Server struct {
-	store *mongostore.MongoStore
-	cfg   *oauth2.Config
-	hub   *ws.Hub
+	cookies sessions.Store
+	store   store.Store
+	hub     *ws.Hub
+
+	// Sign in providers, in the order they're shown
+	providers []*provider
+
+	// Signs password login sessions, password accounts are disabled if nil
+	jwtSecret []byte
+
+	// Emails of the operators that can use the admin endpoints
+	admins map[string]bool
+
+	// Tenants by domain
+	tenants tenantCache
+
+	graphql *graphql.Schema
+
+	// Voice assistants, disabled if link is nil
+	link      *linking
+	assistant *assistant.Assistant
+
+	// Told when rules change, may be nil
+	Rules *rules.Engine
+	// Told when webhooks change, may be nil
+	Webhooks *webhooks.Dispatcher
+	// Updates firmware, the firmware endpoints are disabled if nil
+	OTA *ota.Manager
+	// Tracks presence, the presence endpoint is disabled if nil
+	Presence *presence.Tracker
+	// Sends notifications, the notification endpoints are disabled if nil
+	Notifier *notify.Notifier
 }
 
-func New(config map[string]*string, hub *ws.Hub) (s *Server) {
-	return &Server{
-		hub: hub,
-		//store: sessions.NewCookieStore([]byte(*config["cookie_store_secret"])),
-		store: mongostore.NewMongoStore(
+func New(config conf.Config, hub *ws.Hub, st store.Store) (s *Server) {
+	// Sessions live in MongoDB when we have it, otherwise in the cookie itself
+	var cookies sessions.Store = sessions.NewCookieStore([]byte(*config["cookie_store_secret"]))
+	if *config["store"] == "mongo" {
+		cookies = mongostore.NewMongoStore(
 			db.GetCookieCollection(),
 			3600*24*365*10,
 			false,
-			[]byte(*config["cookie_store_secret"])),
-
-		cfg: &oauth2.Config{
-			ClientID:     *config["client_id"],
-			RedirectURL:  *config["callback_url"],
-			ClientSecret: *config["client_secret"],
-			Scopes: []string{
-				// You have to select your own scope from here -> https://developers.google.com/identity/protocols/googlescopes#google_sign-in
-				"https://www.googleapis.com/auth/userinfo.email",
-				"https://www.googleapis.com/auth/userinfo.profile",
-			},
-			Endpoint: google.Endpoint,
-		},
+			[]byte(*config["cookie_store_secret"]))
+	}
+
+	var jwtSecret []byte
+	if *config["jwt_secret"] != "" {
+		jwtSecret = []byte(*config["jwt_secret"])
+	}
+
+	admins := make(map[string]bool)
+	for _, email := range config.List("admins") {
+		admins[email] = true
+	}
+
+	return &Server{
+		hub:       hub,
+		store:     st,
+		cookies:   cookies,
+		jwtSecret: jwtSecret,
+		admins:    admins,
+		link:      newLinking(config),
+		assistant: assistant.New(hub, st),
+		providers: newProviders(config),
 	}
 }
 
+// Adds payload to log if payloads may be logged, see ws.Config.LogPayloads
+func (s *Server) withPayload(log *slog.Logger, payload string) *slog.Logger {
+	if s.hub.Config.LogPayloads {
+		return log.With("payload", payload)
+	}
+	return log
+}
+
 func (s *Server) GetCookie(r *http.Request) *sessions.Session {
-	session, _ := s.store.Get(r, defaultCookie)
+	session, _ := s.cookies.Get(r, defaultCookie)
 	return session
 }
 
 func (s *Server) RegisterHandlers(r *mux.Router) {
 
 	//	r.HandleFunc("/", s.indexHandler)
+	r.HandleFunc("/healthz", s.healthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", s.readyzHandler).Methods("GET")
 	r.HandleFunc("/signin", s.signinHandler)
 	r.HandleFunc("/auth/callback", s.authCallbackHandler)
+	if s.jwtSecret != nil {
+		r.HandleFunc("/auth/register", s.registerHandler).Methods("POST")
+		r.HandleFunc("/auth/login", s.loginHandler).Methods("POST")
+	}
+	r.HandleFunc("/auth/{provider}", s.providerSigninHandler).Methods("GET")
+	r.HandleFunc("/auth/{provider}/callback", s.authCallbackHandler)
+	if s.link != nil {
+		r.HandleFunc("/oauth/authorize", s.authorizeHandler).Methods("GET")
+		r.HandleFunc("/oauth/token", s.tokenHandler).Methods("POST")
+		r.HandleFunc("/smarthome/google", s.googleHandler).Methods("POST")
+		r.HandleFunc("/smarthome/alexa", s.alexaHandler).Methods("POST")
+	}
+	if s.OTA != nil {
+		// Devices download firmware without a session, the URL is signed
+		r.HandleFunc("/ota/{id}", s.downloadFirmwareHandler).Methods("GET")
+	}
+
+	s.graphql = graphql.MustParseSchema(graphqlSchema, &graphqlRoot{s})
 
 	// protected endpoints
 	apiRouter := r.PathPrefix("/api/").Subrouter()
@@ -0,0 +1,179 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+// Returns copies of the devices shared with the user with email, with
+// their role set
+func (s *Server) sharedDevices(ctx context.Context, email string) []*model.Device {
+	shares, err := s.store.FindSharesByUser(email)
+	if err != nil {
+		log.Println("Error finding shares:", err)
+		return nil
+	}
+
+	var res []*model.Device
+	var offline []string
+	for _, sh := range shares {
+		var d model.Device
+		if conn := s.hub.GetConn(sh.DeviceId); conn != nil {
+			d = *conn.Snapshot()
+		} else {
+			saved, err := s.store.FindDevice(sh.DeviceId)
+			if err != nil {
+				if err != store.ErrNotFound {
+					log.Println("Error finding device:", err)
+				}
+				continue
+			}
+			if saved.Deleted != 0 {
+				continue
+			}
+			d = *saved
+			offline = append(offline, d.Id)
+		}
+		d.Role = sh.Role
+		res = append(res, &d)
+	}
+	remote := s.hub.RemoteOnline(ctx, offline)
+	for _, d := range res {
+		if remote[d.Id] {
+			d.Online = true
+		}
+	}
+	return res
+}
+
+// Returns the functions of the devices shared with the user with email,
+// which belong to the owners of the devices
+func (s *Server) sharedFunctions(email string) []*model.Function {
+	shares, err := s.store.FindSharesByUser(email)
+	if err != nil {
+		log.Println("Error finding shares:", err)
+		return nil
+	}
+
+	var res []*model.Function
+	byOwner := make(map[string][]*model.Function)
+	for _, sh := range shares {
+		d, err := s.store.FindDevice(sh.DeviceId)
+		if err != nil || d.Deleted != 0 {
+			continue
+		}
+		functions, ok := byOwner[d.Owner]
+		if !ok {
+			if functions, err = s.store.FindFunctionsByOwner(d.Owner); err != nil {
+				log.Println("Error finding functions:", err)
+			}
+			byOwner[d.Owner] = functions
+		}
+		for _, f := range functions {
+			if f.DeviceId == d.Id {
+				res = append(res, f)
+			}
+		}
+	}
+	return res
+}
+
+func (s *Server) sharesHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	d := s.findDevice(mux.Vars(r)["id"], user.Email, model.RoleAdmin)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	shares, err := s.store.FindSharesByDevice(d.Id)
+	if err != nil {
+		log.Println("Error finding shares:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if shares == nil {
+		shares = []*model.Share{}
+	}
+	WriteJSON(w, shares)
+}
+
+// Shares a device with a user or changes their role: {"role": "viewer"}.
+// Admins can share with viewers and controllers, only the owner can make
+// someone an admin.
+func (s *Server) shareHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	var req struct {
+		Role model.Role `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.Role.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+	d := s.findDevice(vars["id"], user.Email, model.RoleAdmin)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	email := vars["email"]
+	if email == d.Owner || email == user.Email {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Users of other tenants don't exist as far as we're concerned
+	if u, err := s.store.FindUserByEmail(email); err != nil || u.Tenant != user.Tenant {
+		if err != nil && err != store.ErrNotFound {
+			log.Println("Error finding user:", err)
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Admins can't promote anyone to their level or demote each other
+	if mine := s.role(d, user.Email); mine != model.RoleOwner &&
+		(req.Role == model.RoleAdmin || s.role(d, email) == model.RoleAdmin) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	sh := &model.Share{DeviceId: d.Id, Email: email, Role: req.Role}
+	if err := s.store.SaveShare(sh); err != nil {
+		log.Println("Error saving share:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.record(r, user, model.AuditShare, d, email+" "+string(req.Role))
+	WriteJSON(w, sh)
+}
+
+// Stops sharing a device with a user. Anyone can remove themselves.
+func (s *Server) unshareHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	vars := mux.Vars(r)
+	email := vars["email"]
+	need := model.RoleAdmin
+	if email == user.Email {
+		need = model.RoleViewer
+	}
+	d := s.findDevice(vars["id"], user.Email, need)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if email != user.Email && s.role(d, user.Email) != model.RoleOwner && s.role(d, email) == model.RoleAdmin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := s.store.RemoveShare(d.Id, email); err != nil {
+		log.Println("Error removing share:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.record(r, user, model.AuditUnshare, d, email)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,27 @@
+package httpserver
+
+import (
+	"net/http"
+
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+)
+
+type signingKey struct {
+	Id        string `json:"id"`
+	PublicKey string `json:"public_key"`
+	// The one commands are signed with, the others are being rotated out
+	Current bool `json:"current"`
+}
+
+// Lists the public keys devices can be provisioned with to verify what
+// they're sent, the current one first. Empty if signing is disabled.
+func (s *Server) signingKeysHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	keys := []signingKey{}
+	if s.hub.Signer != nil {
+		for i, k := range s.hub.Signer.Keys() {
+			keys = append(keys, signingKey{Id: k.Id, PublicKey: k.Encode(), Current: i == 0})
+		}
+	}
+	WriteJSON(w, keys)
+}
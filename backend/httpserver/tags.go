@@ -0,0 +1,48 @@
+package httpserver
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+)
+
+// Returns the ids of the user's devices with every tag in ?tag=, writing
+// the error and returning false if there are no valid filters
+func (s *Server) taggedDevices(w http.ResponseWriter, r *http.Request, user *model.User) ([]string, bool) {
+	filter, err := model.ParseTagFilter(r.URL.Query()["tag"])
+	if err != nil || filter == nil {
+		http.Error(w, "needs ?tag= filters", http.StatusBadRequest)
+		return nil, false
+	}
+	devices, err := s.store.FindDevicesByOwner(user.Email)
+	if err != nil {
+		log.Println("Error finding devices:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	var ids []string
+	for _, d := range devices {
+		if filter.Matches(d) {
+			ids = append(ids, d.Id)
+		}
+	}
+	return ids, true
+}
+
+// Sends a command to every device with the tags in ?tag=, like
+// execGroupHandler
+func (s *Server) execTaggedHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	if ids, ok := s.taggedDevices(w, r, user); ok {
+		s.execDevices(w, r, user, ids)
+	}
+}
+
+// Invokes a function on every device with the tags in ?tag= that has it,
+// like invokeGroupHandler
+func (s *Server) invokeTaggedHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	if ids, ok := s.taggedDevices(w, r, user); ok {
+		s.invokeDevices(w, r, user, ids)
+	}
+}
@@ -0,0 +1,84 @@
+package httpserver
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/telemetry"
+)
+
+const (
+	// Range queried when from isn't given
+	defaultTelemetryRange = 24 * time.Hour
+	// Points per metric aimed for when aggregating without a step
+	telemetryResolution = 500
+)
+
+// Parses unix seconds or RFC 3339, returns def if s is empty
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Returns the readings of a device. Query parameters, all optional:
+// from, to, metric, agg (avg, min, max, sum, count or last) and step
+// (e.g. 5m), which defaults to whatever gives about 500 points.
+func (s *Server) telemetryHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	if s.hub.Telemetry == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	d := s.findDevice(mux.Vars(r)["id"], user.Email, model.RoleViewer)
+	if d == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	to, err := parseTime(q.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, "invalid to", http.StatusBadRequest)
+		return
+	}
+	from, err := parseTime(q.Get("from"), to.Add(-defaultTelemetryRange))
+	if err != nil || from.After(to) {
+		http.Error(w, "invalid from", http.StatusBadRequest)
+		return
+	}
+
+	points, err := s.hub.Telemetry.Query(d.Id, q.Get("metric"), from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if agg := q.Get("agg"); agg != "" {
+		step := to.Sub(from) / telemetryResolution
+		if q.Get("step") != "" {
+			if step, err = time.ParseDuration(q.Get("step")); err != nil {
+				http.Error(w, "invalid step", http.StatusBadRequest)
+				return
+			}
+		}
+		if step < time.Second {
+			step = time.Second
+		}
+		if points, err = telemetry.Downsample(points, step, agg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if points == nil {
+		points = []telemetry.Point{}
+	}
+	WriteJSON(w, points)
+}
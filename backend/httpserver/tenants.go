@@ -0,0 +1,200 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+// How long the domains of tenants are cached for, other instances see
+// changes after this long
+const tenantsTTL = time.Minute
+
+// Tenants by domain, loaded from the store as needed
+type tenantCache struct {
+	mx       sync.Mutex
+	byDomain map[string]string
+	loaded   time.Time
+}
+
+// Returns the tenant the domain of r belongs to, "" for the default one.
+// False means the tenants couldn't be loaded, and r is best turned away.
+func (s *Server) TenantOf(r *http.Request) (string, bool) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	c := &s.tenants
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.byDomain == nil || time.Since(c.loaded) > tenantsTTL {
+		tenants, err := s.store.FindTenants()
+		if err != nil {
+			log.Println("Error finding tenants:", err)
+			return "", false
+		}
+		c.byDomain = make(map[string]string)
+		for _, t := range tenants {
+			for _, d := range t.Domains {
+				c.byDomain[d] = t.Id
+			}
+		}
+		c.loaded = time.Now()
+	}
+	return c.byDomain[host], true
+}
+
+// Makes the next TenantOf reload the tenants
+func (s *Server) invalidateTenants() {
+	s.tenants.mx.Lock()
+	s.tenants.byDomain = nil
+	s.tenants.mx.Unlock()
+}
+
+// Returns the tenant with id, or nil
+func (s *Server) findTenant(id string) *model.Tenant {
+	t, err := s.store.FindTenant(id)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error finding tenant:", err)
+		}
+		return nil
+	}
+	return t
+}
+
+func (s *Server) tenantsHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	tenants, err := s.store.FindTenants()
+	if err != nil {
+		log.Println("Error finding tenants:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if tenants == nil {
+		tenants = []*model.Tenant{}
+	}
+	WriteJSON(w, tenants)
+}
+
+func (s *Server) tenantHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	t := s.findTenant(mux.Vars(r)["id"])
+	if t == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, t)
+}
+
+// Creates a tenant, or replaces the name and domains of the one with the
+// id in the path: {"id": "acme", "name": "Acme", "domains": ["iot.acme.com"]}
+func (s *Server) saveTenantHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	var t model.Tenant
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	t.Created = time.Now().Unix()
+	if id, ok := mux.Vars(r)["id"]; ok {
+		old := s.findTenant(id)
+		if old == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		t.Id, t.Created = id, old.Created
+	} else if s.findTenant(t.Id) != nil {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	for i, d := range t.Domains {
+		t.Domains[i] = strings.ToLower(d)
+	}
+	if err := t.Check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A domain can only lead to one tenant
+	tenants, err := s.store.FindTenants()
+	if err != nil {
+		log.Println("Error finding tenants:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for _, other := range tenants {
+		if other.Id == t.Id {
+			continue
+		}
+		for _, d := range other.Domains {
+			for _, mine := range t.Domains {
+				if d == mine {
+					http.Error(w, "domain "+d+" belongs to tenant "+other.Id, http.StatusConflict)
+					return
+				}
+			}
+		}
+	}
+
+	if err := s.store.SaveTenant(&t); err != nil {
+		log.Println("Error saving tenant:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.invalidateTenants()
+	log.Println("Admin", user.Email, "saved tenant", t.Id)
+	WriteJSON(w, &t)
+}
+
+// Deletes a tenant. Its users and devices are kept, but they can't get in
+// until they're moved to another tenant.
+func (s *Server) deleteTenantHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	id := mux.Vars(r)["id"]
+	if err := s.store.RemoveTenant(id); err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error removing tenant:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.invalidateTenants()
+	log.Println("Admin", user.Email, "deleted tenant", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Moves the user with email to a tenant, "default" being the default one.
+// The devices they own stay behind and must be registered again.
+func (s *Server) tenantUserHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	vars := mux.Vars(r)
+	tenant := vars["id"]
+	if tenant == "default" {
+		tenant = ""
+	} else if s.findTenant(tenant) == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := s.store.SaveUserTenant(vars["email"], tenant); err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error saving user tenant:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Println("Admin", user.Email, "moved", vars["email"], "to tenant", vars["id"])
+	w.WriteHeader(http.StatusNoContent)
+}
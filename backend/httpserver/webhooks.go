@@ -0,0 +1,145 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/webhooks"
+)
+
+// Maximum number of webhooks per user
+const maxWebhooks = 16
+
+// Returns the webhook with id if it belongs to owner, or nil
+func (s *Server) findWebhook(id string, owner string) *model.Webhook {
+	wh, err := s.store.FindWebhook(id)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Println("Error finding webhook:", err)
+		}
+		return nil
+	}
+	if wh.Owner != owner {
+		return nil
+	}
+	return wh
+}
+
+// Decodes a webhook from the body. Writes the error and returns nil if it
+// can't be used.
+func (s *Server) decodeWebhook(w http.ResponseWriter, r *http.Request, user *model.User) *model.Webhook {
+	var wh model.Webhook
+	if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	defer r.Body.Close()
+	if err := wh.Check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	wh.Owner = user.Email
+	return &wh
+}
+
+func (s *Server) invalidateWebhooks(owner string) {
+	if s.Webhooks != nil {
+		s.Webhooks.Invalidate(owner)
+	}
+}
+
+func (s *Server) webhooksHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	hooks, err := s.store.FindWebhooksByOwner(user.Email)
+	if err != nil {
+		log.Println("Error finding webhooks:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if hooks == nil {
+		hooks = []*model.Webhook{}
+	}
+	WriteJSON(w, hooks)
+}
+
+// Registers a webhook from e.g. {"url": "https://example.com/hook",
+// "events": ["connected", "disconnected"], "enabled": true}. A secret is
+// generated if none is given.
+func (s *Server) createWebhookHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	wh := s.decodeWebhook(w, r, user)
+	if wh == nil {
+		return
+	}
+	hooks, err := s.store.FindWebhooksByOwner(user.Email)
+	if err != nil {
+		log.Println("Error finding webhooks:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(hooks) >= maxWebhooks {
+		http.Error(w, "too many webhooks", http.StatusBadRequest)
+		return
+	}
+	if wh.Secret == "" {
+		wh.Secret = webhooks.NewSecret()
+	}
+	if _, err := s.store.InsertWebhook(wh); err != nil {
+		log.Println("Error inserting webhook:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.invalidateWebhooks(user.Email)
+	WriteJSON(w, wh)
+}
+
+func (s *Server) webhookHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	wh := s.findWebhook(mux.Vars(r)["id"], user.Email)
+	if wh == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, wh)
+}
+
+// Replaces a webhook, the secret is kept if none is given
+func (s *Server) updateWebhookHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	old := s.findWebhook(mux.Vars(r)["id"], user.Email)
+	if old == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	wh := s.decodeWebhook(w, r, user)
+	if wh == nil {
+		return
+	}
+	wh.Id = old.Id
+	if wh.Secret == "" {
+		wh.Secret = old.Secret
+	}
+	if err := s.store.SaveWebhook(wh); err != nil {
+		log.Println("Error saving webhook:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.invalidateWebhooks(user.Email)
+	WriteJSON(w, wh)
+}
+
+func (s *Server) deleteWebhookHandler(w http.ResponseWriter, r *http.Request, cookie *sessions.Session, user *model.User) {
+	wh := s.findWebhook(mux.Vars(r)["id"], user.Email)
+	if wh == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := s.store.RemoveWebhook(wh.Id.Hex(), user.Email); err != nil {
+		log.Println("Error removing webhook:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.invalidateWebhooks(user.Email)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,166 @@
+// Package janitor enforces retention: devices that haven't been seen for
+// too long are deleted, deleted ones are purged once their grace period is
+// over, and old history and telemetry are dropped.
+package janitor
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/twinone/iot/backend/audit"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/telemetry"
+	"github.com/twinone/iot/backend/ws"
+)
+
+// Timeout of asking the cluster whether stale devices are connected
+const lookupTimeout = 5 * time.Second
+
+// A zero retention keeps things forever
+type Config struct {
+	// How long a device may go unseen before it's deleted
+	DeviceRetention time.Duration
+	// How long deleted devices are kept before they're purged for good
+	DeletedRetention time.Duration
+	// How long commands are kept in the history
+	HistoryRetention time.Duration
+	// How long telemetry points are kept, for stores that implement
+	// telemetry.Pruner
+	TelemetryRetention time.Duration
+	// How often it runs
+	Interval time.Duration
+}
+
+var DefaultConfig = Config{
+	Interval: time.Hour,
+}
+
+var (
+	pruned = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iot_pruned_total",
+		Help: "Things removed for being past their retention: deleted and purged devices, history entries and telemetry points.",
+	}, []string{"kind"})
+	lastRun = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "iot_janitor_last_run_timestamp_seconds",
+		Help: "Unix time the janitor last finished.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(pruned, lastRun)
+}
+
+// Every node may run one, what they do is idempotent and telemetry kept in
+// memory is only pruned by its own node
+type Janitor struct {
+	hub       *ws.Hub
+	store     store.Store
+	telemetry telemetry.Store
+	cfg       Config
+	quit      chan struct{}
+}
+
+func New(hub *ws.Hub, st store.Store, tel telemetry.Store, cfg Config) *Janitor {
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultConfig.Interval
+	}
+	return &Janitor{hub: hub, store: st, telemetry: tel, cfg: cfg, quit: make(chan struct{})}
+}
+
+func (j *Janitor) Start() {
+	go j.run()
+}
+
+func (j *Janitor) Stop() {
+	close(j.quit)
+}
+
+func (j *Janitor) run() {
+	t := time.NewTicker(j.cfg.Interval)
+	defer t.Stop()
+	for {
+		j.sweep(time.Now())
+		select {
+		case <-t.C:
+		case <-j.quit:
+			return
+		}
+	}
+}
+
+func (j *Janitor) sweep(now time.Time) {
+	if j.cfg.DeviceRetention > 0 {
+		j.deleteStale(now.Add(-j.cfg.DeviceRetention))
+	}
+	if j.cfg.DeletedRetention > 0 {
+		j.purgeDeleted(now.Add(-j.cfg.DeletedRetention))
+	}
+	if j.cfg.HistoryRetention > 0 {
+		n, err := j.store.PruneHistory(now.Add(-j.cfg.HistoryRetention).Unix())
+		if err != nil {
+			slog.Error("pruning history", "err", err)
+		}
+		pruned.WithLabelValues("history").Add(float64(n))
+	}
+	if p, ok := j.telemetry.(telemetry.Pruner); ok && j.cfg.TelemetryRetention > 0 {
+		n, err := p.Prune(now.Add(-j.cfg.TelemetryRetention))
+		if err != nil {
+			slog.Error("pruning telemetry", "err", err)
+		}
+		pruned.WithLabelValues("telemetry").Add(float64(n))
+	}
+	lastRun.Set(float64(time.Now().Unix()))
+}
+
+// Marks the devices not seen since before as deleted, unless they're
+// connected somewhere and just didn't have their LastSeen saved yet
+func (j *Janitor) deleteStale(before time.Time) {
+	stale, err := j.store.FindStaleDevices(before.Unix())
+	if err != nil {
+		slog.Error("finding stale devices", "err", err)
+		return
+	}
+	var ids []string
+	for _, d := range stale {
+		ids = append(ids, d.Id)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	remote := j.hub.RemoteOnline(ctx, ids)
+	cancel()
+
+	ctx = audit.WithVia(context.Background(), "janitor")
+	for _, d := range stale {
+		if remote[d.Id] || j.hub.GetConn(d.Id) != nil {
+			continue
+		}
+		d.Deleted = time.Now().Unix()
+		if err := j.store.SaveDevice(d); err != nil {
+			slog.Error("deleting stale device", "device", d.Id, "err", err)
+			continue
+		}
+		audit.Record(ctx, j.store, "", model.AuditRemove, d, "stale")
+		pruned.WithLabelValues("devices_deleted").Inc()
+		slog.Info("deleted stale device", "device", d.Id, "owner", d.Owner, "lastseen", d.LastSeen)
+	}
+}
+
+// Removes for good the devices deleted before before
+func (j *Janitor) purgeDeleted(before time.Time) {
+	deleted, err := j.store.FindDeletedDevices("", before.Unix())
+	if err != nil {
+		slog.Error("finding deleted devices", "err", err)
+		return
+	}
+	for _, d := range deleted {
+		if err := store.PurgeDevice(j.store, d); err != nil {
+			slog.Error("purging device", "device", d.Id, "err", err)
+			continue
+		}
+		j.hub.ClearDeviceLogs(d.Id)
+		pruned.WithLabelValues("devices_purged").Inc()
+		slog.Info("purged device", "device", d.Id, "owner", d.Owner)
+	}
+}
@@ -0,0 +1,34 @@
+package model
+
+import "errors"
+
+// Invokes a function of a device, or sends it a command like "DW 5 HIGH".
+// Rules and schedules run them on behalf of their owner.
+type Action struct {
+	DeviceId string `json:"deviceid"`
+	// Instead of DeviceId, targets every device of the owner that has
+	// these tags when it runs
+	Tags     TagFilter `json:"tags,omitempty"`
+	Function string    `json:"function,omitempty"`
+	Args     []string  `json:"args,omitempty"`
+	Cmd      string    `json:"cmd,omitempty"`
+}
+
+var ErrInvalidAction = errors.New("invalid action: needs a device or tags and either function or cmd")
+
+func (a *Action) Check() error {
+	if (a.DeviceId == "") == (len(a.Tags) == 0) || (a.Function == "") == (a.Cmd == "") {
+		return ErrInvalidAction
+	}
+	for k := range a.Tags {
+		if !validTagKey(k) {
+			return ErrInvalidAction
+		}
+	}
+	return nil
+}
+
+// Whether it targets a device or tags
+func (a *Action) HasTarget() bool {
+	return a.DeviceId != "" || len(a.Tags) > 0
+}
@@ -0,0 +1,75 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// What an API key may do
+type Scope = string
+
+const (
+	// List devices and read their shadow, telemetry, history, logs and
+	// events
+	ScopeDevicesRead Scope = "devices:read"
+	// Invoke functions, send commands and activate scenes
+	ScopeDevicesInvoke = "devices:invoke"
+	// Create, change and remove rules, schedules and scenes
+	ScopeRulesManage = "rules:manage"
+)
+
+func ValidScope(s Scope) bool {
+	switch s {
+	case ScopeDevicesRead, ScopeDevicesInvoke, ScopeRulesManage:
+		return true
+	}
+	return false
+}
+
+// Every API key starts with it, so they're told apart from JWTs and easy
+// to spot if they leak
+const APIKeyPrefix = "iotk_"
+
+// A long-lived credential scripts and integrations use instead of signing
+// in, acting as its owner within its scopes. Only a hash of the key is
+// kept, it's shown once when it's created.
+type APIKey struct {
+	Id     bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner  string        `json:"owner"`
+	Name   string        `json:"name"`
+	Scopes []Scope       `json:"scopes"`
+	// The first characters of the key, to tell keys apart
+	Hint    string `json:"hint"`
+	Created int64  `json:"created"`
+	// Unix time it stops working, 0 if it doesn't
+	Expires int64 `json:"expires,omitempty"`
+	// See HashAPIKey
+	Hash string `json:"-" bson:"hash"`
+}
+
+func (k *APIKey) Allows(s Scope) bool {
+	for _, scope := range k.Scopes {
+		if scope == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) Expired(now int64) bool {
+	return k.Expires != 0 && k.Expires <= now
+}
+
+// Returns what an API key is stored and looked up by, the hex SHA-256 of
+// the key
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
@@ -0,0 +1,66 @@
+package model
+
+import "gopkg.in/mgo.v2/bson"
+
+type AuditAction = string
+
+const (
+	// A function or command sent to a device
+	AuditInvoke AuditAction = "invoke"
+	AuditRename             = "rename"
+	// The desired state of the device's shadow changed
+	AuditDesired = "desired"
+	AuditShare   = "share"
+	AuditUnshare = "unshare"
+	// The device got an owner, by pairing or onboarding
+	AuditClaim = "claim"
+	// The owner let go of the device, or the janitor deleted it for not
+	// being seen in too long
+	AuditRemove = "remove"
+	// The owner brought back a deleted device
+	AuditRestore = "restore"
+)
+
+// Something done to a device, kept for good in the audit log
+type AuditEntry struct {
+	Id   bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Time int64         `json:"time" bson:"time"`
+	// Email of the user acting, or of the owner of the rule or schedule.
+	// Empty for callers of the gRPC API, which are trusted services, and
+	// for the janitor.
+	Actor string `json:"actor" bson:"actor"`
+	// How they did it: api, graphql, rpc, assistant, mqtt, device (a new
+	// device announcing its owner), janitor (enforcing retention), or
+	// apikey:<id>, rule:<id>, schedule:<id> and scene:<id>
+	Via      string      `json:"via" bson:"via"`
+	Action   AuditAction `json:"action" bson:"action"`
+	DeviceId string      `json:"deviceid" bson:"deviceid"`
+	// Owner of the device at the time, whose log the entry is in
+	Owner string `json:"owner" bson:"owner"`
+	// The command sent, the new name, the desired changes, or who the
+	// device was shared with and as what
+	Payload    string `json:"payload,omitempty" bson:"payload,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty" bson:"remote_addr,omitempty"`
+}
+
+// Selects audit entries, empty fields match anything
+type AuditQuery struct {
+	Owner    string
+	DeviceId string
+	Actor    string
+	// Unix times, inclusive
+	Since int64
+	Until int64
+	// Only entries older than this one, to page through them
+	Before bson.ObjectId
+	Limit  int
+}
+
+func (q *AuditQuery) Matches(e *AuditEntry) bool {
+	return (q.Owner == "" || e.Owner == q.Owner) &&
+		(q.DeviceId == "" || e.DeviceId == q.DeviceId) &&
+		(q.Actor == "" || e.Actor == q.Actor) &&
+		(q.Since == 0 || e.Time >= q.Since) &&
+		(q.Until == 0 || e.Time <= q.Until) &&
+		(q.Before == "" || e.Id < q.Before)
+}
@@ -4,4 +4,6 @@ type DashboardInfo struct {
 	User      *User       `json:"user"`
 	Devices   []*Device   `json:"devices"`
 	Functions []*Function `json:"functions"`
+	// Cursor of the next page of devices, if they were paged
+	Next string `json:"next,omitempty"`
 }
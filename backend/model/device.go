@@ -1,11 +1,15 @@
 package model
 
+import "strings"
+
 type State = int
 
 const (
 	StatePendingHello State = iota
 	StatePendingOwner
 	StateConnected
+	// Waiting for a user to enter the pairing code sent to the device
+	StateUnclaimed
 )
 
 type Response = string
@@ -15,8 +19,136 @@ const (
 	RespOwner          = "OWNER"
 	RespName           = "NAME"
 	RespBye            = "BYE"
+	// WILL <key> <value>...: published if the connection dies without a BYE
+	RespWill = "WILL"
+	// ACK <seq>: the device got the message with that sequence number
+	RespAck = "ACK"
+	// REPORT <key> <value>...: the current state of the device
+	RespReport = "REPORT"
+	// TELEMETRY <metric> <value>...: sensor readings
+	RespTelemetry = "TELEMETRY"
+	// FUNCS <json>: the functions the device has, see Function
+	RespFuncs = "FUNCS"
+	// INFO model <hardware> firmware <version>: what the device is
+	RespInfo = "INFO"
+	// OTASTATUS <state> [progress|detail]: how an update is going, the
+	// state is downloading, installing or failed
+	RespOTAStatus = "OTASTATUS"
+	// FILEACK <id> <offset>: the part of a file the device has, see
+	// ws.Conn.SendFile
+	RespFileAck = "FILEACK"
+	// FILEERR <id> <reason>: the device gave up on a file
+	RespFileError = "FILEERR"
+	// SEND <device> <command>: run a command on another device of the owner
+	RespSend = "SEND"
+	// SUB <filter>, UNSUB <filter> and PUB <topic> <payload>: topics
+	// devices and dashboards share, see ws/topics.go
+	RespSubscribe   = "SUB"
+	RespUnsubscribe = "UNSUB"
+	RespPublish     = "PUB"
+	// KEYACK <key id>: the device trusts the signing key sent in KEY now
+	RespKeyAck = "KEYACK"
+	// LOG <level> <text>: a line of the device's own log, see DeviceLog
+	RespLog = "LOG"
+	// TIME: asks for the time, answered with MsgTime
+	RespTime = "TIME"
 )
 
+// The backend's answer to OWNER for devices speaking version 2: OWNER
+// accepted <email> or OWNER rejected <reason>
+const (
+	OwnerAccepted = "accepted"
+	OwnerRejected = "rejected"
+
+	// No such user, or not in the device's tenant
+	OwnerUnknown = "unknown"
+	// The user was disabled by an operator
+	OwnerDisabled = "disabled"
+	// The device belongs to someone else
+	OwnerMismatch = "mismatch"
+	// The user has as many devices as they may
+	OwnerQuota = "quota"
+	// The device must be onboarded first, see require_registered
+	OwnerUnregistered = "unregistered"
+	// The device was deleted
+	OwnerRemoved = "removed"
+	// The backend couldn't check, try again later
+	OwnerUnavailable = "unavailable"
+)
+
+// Sent by the backend to devices, besides function commands
+const (
+	// PAIR <code>: the device is unclaimed, show the code to its user
+	MsgPair = "PAIR"
+	// DELTA <key> <value>...: desired state the device hasn't reported yet
+	MsgDelta = "DELTA"
+	// OTA <url> <sha256> <version>: download and install a firmware
+	MsgOTA = "OTA"
+	// FILE <id> <name> <size> <sha256>: a file follows in binary frames
+	MsgFile = "FILE"
+	// FILEABORT <id>: the file won't be sent after all
+	MsgFileAbort = "FILEABORT"
+	// MSG <topic> <payload>: something was published to a subscribed topic
+	MsgTopic = "MSG"
+	// ERR <code> [detail]: the device did something wrong, the connection
+	// is usually closed right after
+	MsgError = "ERR"
+	// SIG <key id> <time> <signature> <command>: a command signed for
+	// devices that verify them, see the signing package
+	MsgSigned = "SIG"
+	// KEY <key id> <public key>: the key the backend signs with now, sent
+	// signed with the one the device trusts
+	MsgKey = "KEY"
+	// TIME <unix ms> <utc offset> <timezone>: the time for devices without
+	// a clock, e.g. TIME 1700000000000 3600 Europe/Madrid, see TimeArgs
+	MsgTime = "TIME"
+)
+
+// Error codes sent in ERR
+const (
+	// ERR version <min>: the firmware's protocol version is too old
+	ErrCodeVersion = "version"
+	// ERR unknown <cmd>: the command isn't supported
+	ErrCodeUnknown = "unknown"
+	// ERR malformed <cmd>: the arguments or payload couldn't be parsed
+	ErrCodeMalformed = "malformed"
+	// ERR forbidden <device>: SEND to a device the owner can't control
+	ErrCodeForbidden = "forbidden"
+	// ERR unreachable <device>: SEND couldn't send nor queue the message
+	ErrCodeUnreachable = "unreachable"
+	// ERR quota telemetry: the message was dropped for going over a quota
+	ErrCodeQuota = "quota"
+	// ERR signkey <key id>: the backend doesn't have the signing key the
+	// device trusts, it signs with this one
+	ErrCodeSigningKey = "signkey"
+	// ERR duplicate <id>: another connection has the id, HELLO may be sent
+	// again
+	ErrCodeDuplicate = "duplicate"
+)
+
+// Longest id a device may have
+const MaxDeviceIdLen = 64
+
+// Ids are up to MaxDeviceIdLen printable characters without spaces
+func ValidDeviceId(id string) bool {
+	if id == "" || len(id) > MaxDeviceIdLen {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Devices onboarded from now on can't have ':', which separates tenants,
+// nor '/', '+' and '#', which would break MQTT topics. Those that already
+// have one keep it.
+func ValidNewDeviceId(id string) bool {
+	return ValidDeviceId(id) && !strings.ContainsAny(id, ":/+#")
+}
+
 type Value = string
 
 const (
@@ -24,14 +156,82 @@ const (
 	ValLow        = "LOW"
 )
 
-// Not to be stored in database
+// Functions, State and Online live on the connection, the rest is persisted
 type Device struct {
 	Id    string `json:"id"`
 	Owner string `json:"owner"`
+	// Empty for the default tenant
+	Tenant string `json:"tenant,omitempty"`
 
 	Name      string     `json:"name"`
 	Confirmed bool       `json:"confirmed"`
-	Functions []Function `json:"functions"`
-	State     State      `json:"state"`
+	Functions []Function `json:"functions" bson:"-"`
+	State     State      `json:"state" bson:"-"`
 	LastSeen  int64      `json:"lastseen"`
+	Online    bool       `json:"online" bson:"-"`
+	// Address it's connected from, as far as trusted proxies tell
+	RemoteAddr string `json:"remote_addr,omitempty" bson:"-"`
+	// What the user listing the device can do with it, if they don't own it
+	Role Role `json:"role,omitempty" bson:"-"`
+	// Its recent pings, nil until it answered one or if it's connected
+	// to another node
+	Link *Link `json:"link,omitempty" bson:"-"`
+
+	// Commands kept while offline and for how many seconds,
+	// 0 means the hub's default and -1 disables the queue
+	QueueSize int   `json:"queue_size"`
+	QueueTTL  int64 `json:"queue_ttl"`
+	// What happens to messages that don't fit in the send queue while
+	// it's connected, empty means the hub's default
+	Overflow Overflow `json:"overflow,omitempty"`
+
+	// Hardware model and firmware version the device announced in INFO
+	Model    string `json:"model"`
+	Firmware string `json:"firmware"`
+	// Set by its users, like {"floor": "2", "location": "kitchen"}, see
+	// TagFilter
+	Tags map[string]string `json:"tags,omitempty"`
+	// What kind of thing it is, announced in INFO or set by its owner,
+	// see ProfileSpec
+	Profile Profile `json:"profile,omitempty"`
+	// IANA name like "Europe/Madrid" of where it is, set by its owner.
+	// Devices asking for the time get its offset, the hub's default if
+	// empty.
+	Timezone string `json:"timezone,omitempty"`
+	// Unix time it was deleted, 0 if it wasn't. Deleted devices can't
+	// connect and are hidden until they're purged.
+	Deleted int64 `json:"deleted,omitempty"`
+
+	// X25519 key commands are sealed for, base64, if the device does E2E.
+	// Kept from when it was registered, it must be paired again to change.
+	PublicKey string `json:"public_key,omitempty"`
+	// Id of the backend's key the device verifies commands with, if it
+	// does, so old keys can be retired once no device trusts them
+	SigningKey string `json:"signing_key,omitempty"`
+	// Mixed into its provisioning token, a new one revokes the old token.
+	// Empty for devices onboarded before tokens had one.
+	TokenNonce string `json:"-"`
+}
+
+// What happens to a message for a device whose send queue is full
+type Overflow = string
+
+const (
+	// The message is dropped
+	OverflowDropNewest Overflow = "drop-newest"
+	// The oldest queued message is dropped to make room
+	OverflowDropOldest = "drop-oldest"
+	// The device is disconnected, a session lets it resume where it was
+	OverflowDisconnect = "disconnect"
+	// The message goes to the offline queue, which is delivered once the
+	// device catches up
+	OverflowSpill = "spill"
+)
+
+func ValidOverflow(o Overflow) bool {
+	switch o {
+	case OverflowDropNewest, OverflowDropOldest, OverflowDisconnect, OverflowSpill:
+		return true
+	}
+	return false
 }
@@ -0,0 +1,39 @@
+package model
+
+// How important a line a device logged is
+type LogLevel = string
+
+const (
+	LogDebug LogLevel = "debug"
+	LogInfo           = "info"
+	LogWarn           = "warn"
+	LogError          = "error"
+)
+
+// Orders the levels, 0 for unknown ones
+var logLevels = map[LogLevel]int{LogDebug: 1, LogInfo: 2, LogWarn: 3, LogError: 4}
+
+func ValidLogLevel(l string) bool {
+	return logLevels[l] > 0
+}
+
+// A line a device sent with LOG
+type DeviceLog struct {
+	Time  int64    `json:"time"`
+	Level LogLevel `json:"level"`
+	Text  string   `json:"text"`
+}
+
+// Selects the lines of a device's log, empty fields match anything
+type DeviceLogQuery struct {
+	// Unix time of the oldest line
+	Since int64
+	// Lines at least as important
+	Level LogLevel
+	// Only the newest ones
+	Limit int
+}
+
+func (q *DeviceLogQuery) Matches(l *DeviceLog) bool {
+	return l.Time >= q.Since && logLevels[l.Level] >= logLevels[q.Level]
+}
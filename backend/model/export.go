@@ -0,0 +1,88 @@
+package model
+
+// Version of the export format, imports of other versions are refused
+const ExportVersion = 1
+
+// A user's configuration as exported by /api/export, to be imported back
+// later or on another instance. Device ids are as the API knows them in
+// Tenant.
+type Export struct {
+	Version int    `json:"version"`
+	Time    int64  `json:"time"`
+	Owner   string `json:"owner"`
+	Tenant  string `json:"tenant,omitempty"`
+
+	Devices   []*ExportedDevice `json:"devices"`
+	Groups    []*Group          `json:"groups"`
+	Scenes    []*Scene          `json:"scenes"`
+	Rules     []*Rule           `json:"rules"`
+	Schedules []*Schedule       `json:"schedules"`
+}
+
+// The settings of a device its owner chose, which go with it to another
+// instance. The rest is announced by the device.
+type ExportedDevice struct {
+	Id        string            `json:"id"`
+	Name      string            `json:"name"`
+	QueueSize int               `json:"queue_size,omitempty"`
+	QueueTTL  int64             `json:"queue_ttl,omitempty"`
+	Overflow  Overflow          `json:"overflow,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Profile   Profile           `json:"profile,omitempty"`
+	Timezone  string            `json:"timezone,omitempty"`
+	// So E2E keeps working without pairing it again
+	PublicKey string `json:"public_key,omitempty"`
+}
+
+func ExportDevice(d *Device) *ExportedDevice {
+	return &ExportedDevice{
+		Id:        d.Id,
+		Name:      d.Name,
+		QueueSize: d.QueueSize,
+		QueueTTL:  d.QueueTTL,
+		Overflow:  d.Overflow,
+		Tags:      d.Tags,
+		Profile:   d.Profile,
+		Timezone:  d.Timezone,
+		PublicKey: d.PublicKey,
+	}
+}
+
+// What an import does with what the user already has: devices with the
+// same id, and groups, scenes, rules and schedules with the same id or name
+type ImportConflict = string
+
+const (
+	// What exists is left as it is
+	ImportSkip ImportConflict = "skip"
+	// What exists is overwritten
+	ImportReplace = "replace"
+	// Both are kept, devices are skipped since ids are unique
+	ImportDuplicate = "duplicate"
+)
+
+func ValidImportConflict(c ImportConflict) bool {
+	switch c {
+	case ImportSkip, ImportReplace, ImportDuplicate:
+		return true
+	}
+	return false
+}
+
+type ImportCounts struct {
+	Created  int `json:"created"`
+	Replaced int `json:"replaced"`
+	Skipped  int `json:"skipped"`
+	Failed   int `json:"failed"`
+}
+
+type ImportResult struct {
+	Devices   ImportCounts `json:"devices"`
+	Groups    ImportCounts `json:"groups"`
+	Scenes    ImportCounts `json:"scenes"`
+	Rules     ImportCounts `json:"rules"`
+	Schedules ImportCounts `json:"schedules"`
+	// Why things failed or were imported only in part, like
+	// "rule Lights: device not found"
+	Errors []string `json:"errors"`
+}
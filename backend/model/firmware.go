@@ -0,0 +1,112 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A Firmware is an image built for one hardware model. The image itself is
+// stored apart and devices download it through a signed URL.
+type Firmware struct {
+	Id      bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner   string        `json:"owner"`
+	Model   string        `json:"model"`
+	Version string        `json:"version"`
+	Size    int64         `json:"size"`
+	// Hex SHA-256 of the image, devices check it before installing
+	SHA256  string `json:"sha256"`
+	Created int64  `json:"created"`
+}
+
+var ErrInvalidFirmware = errors.New("invalid firmware")
+
+// Models and versions are sent to devices as single words
+func validWord(s string) bool {
+	return s != "" && len(s) <= 64 && !strings.ContainsAny(s, " \t\r\n")
+}
+
+func (f *Firmware) Check() error {
+	if !validWord(f.Model) {
+		return fmt.Errorf("%w: model", ErrInvalidFirmware)
+	}
+	if !validWord(f.Version) {
+		return fmt.Errorf("%w: version", ErrInvalidFirmware)
+	}
+	return nil
+}
+
+type TargetState = string
+
+const (
+	// Waiting for the device to come online
+	TargetPending TargetState = "pending"
+	// The device was told where to fetch the firmware
+	TargetSent        = "sent"
+	TargetDownloading = "downloading"
+	TargetInstalling  = "installing"
+	// The device came back running the new version
+	TargetDone   = "done"
+	TargetFailed = "failed"
+	// The device is of another model, or doesn't say which
+	TargetSkipped  = "skipped"
+	TargetCanceled = "canceled"
+)
+
+// Progress of a rollout on one device
+type RolloutTarget struct {
+	DeviceId string      `json:"deviceid"`
+	State    TargetState `json:"state"`
+	// Percentage the device reported while downloading
+	Progress int    `json:"progress"`
+	Detail   string `json:"detail,omitempty"`
+	Updated  int64  `json:"updated"`
+}
+
+// Returns true if the target hasn't finished one way or another
+func (t *RolloutTarget) Active() bool {
+	switch t.State {
+	case TargetPending, TargetSent, TargetDownloading, TargetInstalling:
+		return true
+	}
+	return false
+}
+
+// A Rollout installs a firmware on a set of devices, each one as soon as
+// it's online
+type Rollout struct {
+	Id         bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner      string        `json:"owner"`
+	FirmwareId string        `json:"firmware"`
+	Model      string        `json:"model"`
+	Version    string        `json:"version"`
+	Created    int64         `json:"created"`
+	Canceled   bool          `json:"canceled"`
+
+	Targets []RolloutTarget `json:"targets"`
+}
+
+// Returns the target for the device with id, or nil
+func (r *Rollout) Target(id string) *RolloutTarget {
+	for i := range r.Targets {
+		if r.Targets[i].DeviceId == id {
+			return &r.Targets[i]
+		}
+	}
+	return nil
+}
+
+// Returns true if some target hasn't finished
+func (r *Rollout) Active() bool {
+	if r.Canceled {
+		return false
+	}
+	for i := range r.Targets {
+		if r.Targets[i].Active() {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,13 @@
 package model
 
-import "gopkg.in/mgo.v2/bson"
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
 
 type Command = string
 
@@ -13,6 +20,8 @@ const (
 	CmdIntervalAnalogRead         = "IAR"
 	CmdSetServo                   = "SERVO"
 	CmdIRSend                     = "IRSEND"
+	// A command sealed for the device, see the e2e package, answered in kind
+	CmdE2E = "E2E"
 )
 
 type Execution struct {
@@ -28,4 +37,111 @@ type Function struct {
 	Pin      int                    `json:"pin"`
 	Cmd      Command                `json:"cmd"`
 	Data     map[string]interface{} `json:"data"`
+	// Arguments it takes after the pin, in order
+	Params []Param `json:"params,omitempty"`
+	// Only invoked sealed, through POST /api/devices/{id}/e2e
+	E2E bool `json:"e2e,omitempty"`
+}
+
+type ParamType = string
+
+const (
+	ParamInt   ParamType = "int"
+	ParamFloat           = "float"
+	ParamBool            = "bool"
+	// One of Values
+	ParamEnum = "enum"
+	// A single word
+	ParamString = "string"
+)
+
+// A Param describes an argument of a function, so dashboards can render
+// a control for it and invocations can be checked before they're sent
+type Param struct {
+	Name string    `json:"name"`
+	Type ParamType `json:"type"`
+	// Inclusive range of numbers
+	Min  *float64 `json:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty"`
+	Unit string   `json:"unit,omitempty"`
+	// Allowed values of enums
+	Values []string `json:"values,omitempty"`
+}
+
+var ErrInvalidParam = errors.New("invalid parameter")
+
+// Returns an error if p itself doesn't make sense
+func (p *Param) Check() error {
+	switch p.Type {
+	case ParamInt, ParamFloat, ParamBool, ParamString:
+	case ParamEnum:
+		if len(p.Values) == 0 {
+			return fmt.Errorf("%w: enum %q has no values", ErrInvalidParam, p.Name)
+		}
+	default:
+		return fmt.Errorf("%w: %q has unknown type %q", ErrInvalidParam, p.Name, p.Type)
+	}
+	if p.Name == "" {
+		return fmt.Errorf("%w: missing name", ErrInvalidParam)
+	}
+	if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+		return fmt.Errorf("%w: %q has min > max", ErrInvalidParam, p.Name)
+	}
+	return nil
+}
+
+// Returns an error if arg isn't a valid value of p
+func (p *Param) Validate(arg string) error {
+	switch p.Type {
+	case ParamInt, ParamFloat:
+		var v float64
+		var err error
+		if p.Type == ParamInt {
+			var i int64
+			i, err = strconv.ParseInt(arg, 10, 64)
+			v = float64(i)
+		} else {
+			v, err = strconv.ParseFloat(arg, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s must be %s, got %q", ErrInvalidParam, p.Name, p.Type, arg)
+		}
+		if p.Min != nil && v < *p.Min || p.Max != nil && v > *p.Max {
+			return fmt.Errorf("%w: %s out of range", ErrInvalidParam, p.Name)
+		}
+	case ParamBool:
+		if _, err := strconv.ParseBool(arg); err != nil {
+			return fmt.Errorf("%w: %s must be a bool, got %q", ErrInvalidParam, p.Name, arg)
+		}
+	case ParamEnum:
+		for _, v := range p.Values {
+			if v == arg {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s must be one of %v", ErrInvalidParam, p.Name, p.Values)
+	}
+	return nil
+}
+
+// Returns the command that invokes f with args, e.g. "DW 5 HIGH"
+func (f *Function) Command(args []string) string {
+	return strings.Join(append([]string{f.Cmd, strconv.Itoa(f.Pin)}, args...), " ")
+}
+
+// Returns an error if args don't match the parameters of f. Functions
+// without parameters take any arguments, like they used to.
+func (f *Function) Validate(args []string) error {
+	if len(f.Params) == 0 {
+		return nil
+	}
+	if len(args) != len(f.Params) {
+		return fmt.Errorf("%w: %s takes %d arguments, got %d", ErrInvalidParam, f.Name, len(f.Params), len(args))
+	}
+	for i := range f.Params {
+		if err := f.Params[i].Validate(args[i]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,31 @@
+package model
+
+import "gopkg.in/mgo.v2/bson"
+
+// A Group is a set of devices of the same owner, like the ones in a room
+type Group struct {
+	Id      bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Name    string        `json:"name"`
+	Owner   string        `json:"owner"`
+	Devices []string      `json:"devices"`
+}
+
+// Returns true if the device with id is a member
+func (g *Group) Has(id string) bool {
+	for _, d := range g.Devices {
+		if d == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the device with id from the members, if it is one
+func (g *Group) Remove(id string) {
+	for i, d := range g.Devices {
+		if d == id {
+			g.Devices = append(g.Devices[:i], g.Devices[i+1:]...)
+			return
+		}
+	}
+}
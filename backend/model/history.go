@@ -0,0 +1,60 @@
+package model
+
+import "gopkg.in/mgo.v2/bson"
+
+// What came of a command sent to a device
+type CommandResult = string
+
+const (
+	// The device answered
+	ResultOK CommandResult = "ok"
+	// Sent, no answer was waited for
+	ResultSent = "sent"
+	// Kept until the device comes back
+	ResultQueued  = "queued"
+	ResultTimeout = "timeout"
+	// The device wasn't connected and the command wasn't queued
+	ResultOffline = "offline"
+	ResultError   = "error"
+)
+
+func ValidResult(r string) bool {
+	switch r {
+	case ResultOK, ResultSent, ResultQueued, ResultTimeout, ResultOffline, ResultError:
+		return true
+	}
+	return false
+}
+
+// A command sent to a device and what came of it
+type HistoryEntry struct {
+	Id       bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	DeviceId string        `json:"deviceid" bson:"deviceid"`
+	Time     int64         `json:"time" bson:"time"`
+	// The function invoked, if the command came from one
+	Function string        `json:"function,omitempty" bson:"function,omitempty"`
+	Command  string        `json:"command" bson:"command"`
+	Result   CommandResult `json:"result" bson:"result"`
+	// The device's answer, in the text protocol
+	Response string `json:"response,omitempty" bson:"response,omitempty"`
+	Error    string `json:"error,omitempty" bson:"error,omitempty"`
+	// Milliseconds the device took to answer
+	Latency int64 `json:"latency,omitempty" bson:"latency,omitempty"`
+}
+
+// Selects the history of a device, empty fields match anything
+type HistoryQuery struct {
+	DeviceId string
+	Function string
+	Result   CommandResult
+	// Only entries older than this one, to page through them
+	Before bson.ObjectId
+	Limit  int
+}
+
+func (q *HistoryQuery) Matches(e *HistoryEntry) bool {
+	return e.DeviceId == q.DeviceId &&
+		(q.Function == "" || e.Function == q.Function) &&
+		(q.Result == "" || e.Result == q.Result) &&
+		(q.Before == "" || e.Id < q.Before)
+}
@@ -0,0 +1,11 @@
+package model
+
+// An account at a sign in provider (google, github or oidc), linked to the
+// user signing in with it. A user has at most one of each provider.
+type Identity struct {
+	Provider string `json:"provider"`
+	// Who the provider says they are, stable even if their email changes
+	Subject string `json:"subject"`
+	Email   string `json:"email"`
+	Linked  int64  `json:"linked"`
+}
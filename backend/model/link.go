@@ -0,0 +1,25 @@
+package model
+
+// How well a device's connection is doing, judged from its recent pings
+type LinkQuality = string
+
+const (
+	LinkGood LinkQuality = "good"
+	LinkFair             = "fair"
+	LinkPoor             = "poor"
+)
+
+// Round-trip times of the last pings of a connection, in milliseconds,
+// and how many of them went unanswered
+type Link struct {
+	// Average, fastest and slowest answer
+	RTT    int64 `json:"rtt"`
+	RTTMin int64 `json:"rtt_min"`
+	RTTMax int64 `json:"rtt_max"`
+	// Average difference between consecutive answers
+	Jitter int64 `json:"jitter"`
+	// Pings in the window, and the ones that got no pong
+	Pings   int         `json:"pings"`
+	Lost    int         `json:"lost"`
+	Quality LinkQuality `json:"quality"`
+}
@@ -0,0 +1,85 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+)
+
+// Channels a user can be notified through
+const (
+	ChannelEmail    = "email"
+	ChannelFCM      = "fcm"
+	ChannelTelegram = "telegram"
+)
+
+// What a user is told, e.g. by a rule when it fires
+type Notification struct {
+	Title string `json:"title"`
+	Body  string `json:"body,omitempty"`
+}
+
+var ErrInvalidNotification = errors.New("invalid notification")
+
+func (n *Notification) Check() error {
+	if n.Title == "" || len(n.Title) > 128 || len(n.Body) > 1024 {
+		return ErrInvalidNotification
+	}
+	return nil
+}
+
+// How a user wants to be notified. Channels maps each channel to where it
+// reaches them: an email address, the FCM registration token of their
+// phone or their Telegram chat id.
+type NotificationPrefs struct {
+	Email    string            `json:"-" bson:"email"`
+	Channels map[string]string `json:"channels"`
+	// Presence states of their devices they want to hear about, e.g.
+	// offline
+	Presence []PresenceState `json:"presence"`
+	// Whether to tell them when a device leaves its will
+	Will bool `json:"will"`
+	// Most notifications sent per hour, 0 for the default
+	Hourly int `json:"hourly"`
+}
+
+var ErrInvalidPrefs = errors.New("invalid notification preferences")
+
+func (p *NotificationPrefs) Check() error {
+	for ch, to := range p.Channels {
+		switch ch {
+		case ChannelEmail, ChannelFCM, ChannelTelegram:
+		default:
+			return fmt.Errorf("%w: unknown channel %q", ErrInvalidPrefs, ch)
+		}
+		if to == "" || len(to) > 512 {
+			return fmt.Errorf("%w: %s", ErrInvalidPrefs, ch)
+		}
+		if ch == ChannelEmail {
+			if a, err := mail.ParseAddress(to); err != nil || a.Address != to {
+				return fmt.Errorf("%w: email", ErrInvalidPrefs)
+			}
+		}
+	}
+	for _, st := range p.Presence {
+		switch st {
+		case PresenceOnline, PresenceStale, PresenceOffline:
+		default:
+			return fmt.Errorf("%w: unknown presence %q", ErrInvalidPrefs, st)
+		}
+	}
+	if p.Hourly < 0 || p.Hourly > 1000 {
+		return fmt.Errorf("%w: hourly", ErrInvalidPrefs)
+	}
+	return nil
+}
+
+// Returns true if the user wants to hear about devices going state
+func (p *NotificationPrefs) WantsPresence(state PresenceState) bool {
+	for _, st := range p.Presence {
+		if st == state {
+			return true
+		}
+	}
+	return false
+}
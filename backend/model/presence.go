@@ -0,0 +1,21 @@
+package model
+
+type PresenceState = string
+
+const (
+	// Connected and heard from recently
+	PresenceOnline PresenceState = "online"
+	// Still connected, but silent for longer than it should be
+	PresenceStale = "stale"
+	// Disconnected and didn't come back in time
+	PresenceOffline = "offline"
+)
+
+// A change of the presence of a device
+type PresenceChange struct {
+	DeviceId string        `json:"deviceid" bson:"deviceid"`
+	State    PresenceState `json:"state" bson:"state"`
+	Time     int64         `json:"time" bson:"time"`
+	// When the device was last heard from at the time
+	LastSeen int64 `json:"lastseen" bson:"lastseen"`
+}
@@ -0,0 +1,149 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+// What kind of thing a device is. Devices of a profile have its standard
+// functions and report its state attributes by name, e.g. a light has an
+// "on" function and reports "REPORT on true", so dashboards and assistants
+// can treat them alike.
+type Profile = string
+
+const (
+	ProfileLight      Profile = "light"
+	ProfileSwitch             = "switch"
+	ProfileSensor             = "sensor"
+	ProfileLock               = "lock"
+	ProfileCover              = "cover"
+	ProfileThermostat         = "thermostat"
+)
+
+var ErrNonConforming = errors.New("device doesn't conform to its profile")
+
+// A piece of state devices of a profile report, or send as telemetry if
+// it's a reading
+type Attribute struct {
+	Name string    `json:"name"`
+	Type ParamType `json:"type"`
+	// Sent in TELEMETRY rather than REPORT
+	Telemetry bool   `json:"telemetry,omitempty"`
+	Unit      string `json:"unit,omitempty"`
+	Optional  bool   `json:"optional,omitempty"`
+}
+
+// A function devices of a profile have. It sets the attribute with its
+// name.
+type ProfileFunction struct {
+	Name     string  `json:"name"`
+	Params   []Param `json:"params"`
+	Optional bool    `json:"optional,omitempty"`
+}
+
+type ProfileSpec struct {
+	Profile   Profile           `json:"profile"`
+	Functions []ProfileFunction `json:"functions"`
+	State     []Attribute       `json:"state"`
+}
+
+func rangeParam(name string, typ ParamType, min, max float64, unit string) Param {
+	return Param{Name: name, Type: typ, Min: &min, Max: &max, Unit: unit}
+}
+
+var boolParam = Param{Name: "value", Type: ParamBool}
+
+// The profiles there are, in the order they're listed
+var Profiles = []*ProfileSpec{
+	{
+		Profile: ProfileLight,
+		Functions: []ProfileFunction{
+			{Name: "on", Params: []Param{boolParam}},
+			{Name: "brightness", Params: []Param{rangeParam("value", ParamInt, 0, 100, "%")}, Optional: true},
+		},
+		State: []Attribute{
+			{Name: "on", Type: ParamBool},
+			{Name: "brightness", Type: ParamInt, Unit: "%", Optional: true},
+		},
+	},
+	{
+		Profile:   ProfileSwitch,
+		Functions: []ProfileFunction{{Name: "on", Params: []Param{boolParam}}},
+		State:     []Attribute{{Name: "on", Type: ParamBool}},
+	},
+	{
+		Profile:   ProfileSensor,
+		Functions: []ProfileFunction{},
+		State: []Attribute{
+			{Name: "temperature", Type: ParamFloat, Telemetry: true, Unit: "°C", Optional: true},
+			{Name: "humidity", Type: ParamFloat, Telemetry: true, Unit: "%", Optional: true},
+			{Name: "motion", Type: ParamBool, Optional: true},
+			{Name: "contact", Type: ParamBool, Optional: true},
+		},
+	},
+	{
+		Profile:   ProfileLock,
+		Functions: []ProfileFunction{{Name: "locked", Params: []Param{boolParam}}},
+		State:     []Attribute{{Name: "locked", Type: ParamBool}},
+	},
+	{
+		Profile:   ProfileCover,
+		Functions: []ProfileFunction{{Name: "position", Params: []Param{rangeParam("value", ParamInt, 0, 100, "%")}}},
+		State:     []Attribute{{Name: "position", Type: ParamInt, Unit: "%"}},
+	},
+	{
+		Profile:   ProfileThermostat,
+		Functions: []ProfileFunction{{Name: "setpoint", Params: []Param{rangeParam("value", ParamFloat, 5, 35, "°C")}}},
+		State: []Attribute{
+			{Name: "setpoint", Type: ParamFloat, Unit: "°C"},
+			{Name: "temperature", Type: ParamFloat, Telemetry: true, Unit: "°C"},
+		},
+	},
+}
+
+// Returns the spec of p, or nil if there's no such profile
+func FindProfile(p Profile) *ProfileSpec {
+	for _, spec := range Profiles {
+		if spec.Profile == p {
+			return spec
+		}
+	}
+	return nil
+}
+
+// Returns an error if functions lack one the profile needs, or have one
+// with its name that takes other arguments
+func (spec *ProfileSpec) Check(functions []*Function) error {
+	byName := make(map[string]*Function, len(functions))
+	for _, f := range functions {
+		byName[f.Name] = f
+	}
+	for _, pf := range spec.Functions {
+		f := byName[pf.Name]
+		if f == nil {
+			if pf.Optional {
+				continue
+			}
+			return fmt.Errorf("%w: missing function %q", ErrNonConforming, pf.Name)
+		}
+		if len(f.Params) != len(pf.Params) {
+			return fmt.Errorf("%w: %q takes %d arguments", ErrNonConforming, pf.Name, len(pf.Params))
+		}
+		for i := range pf.Params {
+			if f.Params[i].Type != pf.Params[i].Type {
+				return fmt.Errorf("%w: argument %d of %q must be %s", ErrNonConforming, i+1, pf.Name, pf.Params[i].Type)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the function of the profile called name, or nil
+func (spec *ProfileSpec) Function(name string) *ProfileFunction {
+	for i := range spec.Functions {
+		if spec.Functions[i].Name == name {
+			return &spec.Functions[i]
+		}
+	}
+	return nil
+}
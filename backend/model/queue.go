@@ -0,0 +1,7 @@
+package model
+
+// A command waiting for its device to come back online
+type QueuedMessage struct {
+	Msg     string `json:"msg"`
+	Expires int64  `json:"expires"`
+}
@@ -0,0 +1,130 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// What happens on a device that can trigger a rule
+type TriggerEvent = string
+
+const (
+	// The device sent a sensor reading of Key
+	TriggerTelemetry TriggerEvent = "telemetry"
+	// The device reported the state of Key
+	TriggerReport       = "report"
+	TriggerConnected    = "connected"
+	TriggerDisconnected = "disconnected"
+	// The device went away without a BYE, optionally with Key in its WILL
+	TriggerWill = "will"
+)
+
+// A Rule runs an action when something happens on a device, optionally
+// only if the value of a reading or state passes a condition. It fires
+// when the condition becomes true, not again until it's been false. It
+// can notify its owner instead of, or as well as, running an action.
+type Rule struct {
+	Id      bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner   string        `json:"owner"`
+	Name    string        `json:"name"`
+	Enabled bool          `json:"enabled"`
+
+	Trigger Trigger `json:"trigger"`
+	// Always true if nil
+	Condition *Condition `json:"condition,omitempty"`
+	Action    Action     `json:"action"`
+	// Sent to the owner when it fires, nil for none
+	Notify *Notification `json:"notify,omitempty"`
+}
+
+// Returns true if the rule runs an action when it fires
+func (r *Rule) HasAction() bool {
+	return r.Notify == nil || r.Action.HasTarget()
+}
+
+type Trigger struct {
+	DeviceId string       `json:"deviceid"`
+	Event    TriggerEvent `json:"event"`
+	// Metric or state key, for telemetry and report, or key of the will
+	Key string `json:"key,omitempty"`
+}
+
+// Compares the value that triggered a rule with Value. Numbers are
+// compared as such, anything else only with == and !=.
+type Condition struct {
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+var ErrInvalidRule = errors.New("invalid rule")
+
+var conditionOps = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// Returns an error if r can't work, it doesn't check the devices exist
+func (r *Rule) Check() error {
+	switch {
+	case r.Name == "" || len(r.Name) > 64:
+		return fmt.Errorf("%w: name", ErrInvalidRule)
+	case r.Trigger.DeviceId == "":
+		return fmt.Errorf("%w: missing trigger device", ErrInvalidRule)
+	case r.Condition != nil && !conditionOps[r.Condition.Op]:
+		return fmt.Errorf("%w: unknown condition op", ErrInvalidRule)
+	}
+	switch r.Trigger.Event {
+	case TriggerTelemetry, TriggerReport:
+		if r.Trigger.Key == "" {
+			return fmt.Errorf("%w: trigger needs a key", ErrInvalidRule)
+		}
+	case TriggerConnected, TriggerDisconnected:
+		if r.Condition != nil {
+			return fmt.Errorf("%w: connection triggers have no value", ErrInvalidRule)
+		}
+	case TriggerWill:
+		if r.Condition != nil && r.Trigger.Key == "" {
+			return fmt.Errorf("%w: condition needs a key", ErrInvalidRule)
+		}
+	default:
+		return fmt.Errorf("%w: unknown trigger event", ErrInvalidRule)
+	}
+	if r.Notify != nil {
+		if err := r.Notify.Check(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidRule, err)
+		}
+	}
+	if !r.HasAction() {
+		return nil
+	}
+	return r.Action.Check()
+}
+
+func (c *Condition) Match(v string) bool {
+	a, errA := strconv.ParseFloat(v, 64)
+	b, errB := strconv.ParseFloat(c.Value, 64)
+	if errA != nil || errB != nil {
+		switch c.Op {
+		case "==":
+			return v == c.Value
+		case "!=":
+			return v != c.Value
+		}
+		return false
+	}
+	switch c.Op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	MaxSceneSteps = 32
+	// Longest a scene may take to run, adding up the delays of its steps
+	MaxSceneDelay = 60000
+)
+
+// A Scene is a named list of actions run one after the other, like
+// turning off every light of the house and closing the blinds
+type Scene struct {
+	Id    bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner string        `json:"owner"`
+	Name  string        `json:"name"`
+	Steps []Step        `json:"steps"`
+}
+
+type Step struct {
+	Action `bson:",inline"`
+	// Milliseconds to wait before running the action
+	Delay int `json:"delay,omitempty"`
+}
+
+var ErrInvalidScene = errors.New("invalid scene")
+
+// Returns an error if s can't work, it doesn't check the devices exist
+func (s *Scene) Check() error {
+	if s.Name == "" || len(s.Name) > 64 {
+		return fmt.Errorf("%w: name", ErrInvalidScene)
+	}
+	if len(s.Steps) == 0 || len(s.Steps) > MaxSceneSteps {
+		return fmt.Errorf("%w: needs 1 to %d steps", ErrInvalidScene, MaxSceneSteps)
+	}
+	total := 0
+	for i := range s.Steps {
+		st := &s.Steps[i]
+		if st.Delay < 0 {
+			return fmt.Errorf("%w: step %d: negative delay", ErrInvalidScene, i)
+		}
+		total += st.Delay
+		if err := st.Action.Check(); err != nil {
+			return fmt.Errorf("%w: step %d: %v", ErrInvalidScene, i, err)
+		}
+	}
+	if total > MaxSceneDelay {
+		return fmt.Errorf("%w: delays add up to more than %dms", ErrInvalidScene, MaxSceneDelay)
+	}
+	return nil
+}
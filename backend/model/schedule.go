@@ -0,0 +1,55 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A Schedule runs an action at a given time, or repeatedly following a cron
+// expression like "30 7 * * 1-5" in the timezone of its owner
+type Schedule struct {
+	Id      bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner   string        `json:"owner"`
+	Name    string        `json:"name"`
+	Enabled bool          `json:"enabled"`
+
+	// Standard 5 field cron expression, empty for a one-shot schedule
+	Cron string `json:"cron,omitempty"`
+	// Unix time a one-shot schedule runs at
+	At int64 `json:"at,omitempty"`
+	// IANA name like "Europe/Madrid" the cron expression is in, UTC if empty
+	Timezone string `json:"timezone,omitempty"`
+	Action   Action `json:"action"`
+
+	// Unix time of the next run, 0 if it won't run again
+	Next      int64  `json:"next"`
+	LastRun   int64  `json:"lastrun,omitempty"`
+	LastError string `json:"lasterror,omitempty"`
+}
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+// Returns an error if s can't work. The cron expression is checked when
+// computing the next run.
+func (s *Schedule) Check() error {
+	switch {
+	case s.Name == "" || len(s.Name) > 64:
+		return fmt.Errorf("%w: name", ErrInvalidSchedule)
+	case (s.Cron == "") == (s.At == 0):
+		return fmt.Errorf("%w: needs either cron or at", ErrInvalidSchedule)
+	}
+	if _, err := s.Location(); err != nil {
+		return fmt.Errorf("%w: timezone: %v", ErrInvalidSchedule, err)
+	}
+	return s.Action.Check()
+}
+
+func (s *Schedule) Location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(s.Timezone)
+}
@@ -0,0 +1,33 @@
+package model
+
+// A Shadow is the state of a device as users want it (Desired) and as the
+// device last said it is (Reported). Devices are sent the difference
+// whenever it changes and when they reconnect, so they converge to the
+// desired state even if they were offline when it was set.
+type Shadow struct {
+	DeviceId string            `json:"id" bson:"id"`
+	Desired  map[string]string `json:"desired" bson:"desired"`
+	Reported map[string]string `json:"reported" bson:"reported"`
+	// Incremented on every change
+	Version int64 `json:"version" bson:"version"`
+	Updated int64 `json:"updated" bson:"updated"`
+}
+
+func NewShadow(deviceId string) *Shadow {
+	return &Shadow{
+		DeviceId: deviceId,
+		Desired:  make(map[string]string),
+		Reported: make(map[string]string),
+	}
+}
+
+// Returns the desired values the device hasn't reported yet
+func (s *Shadow) Delta() map[string]string {
+	delta := make(map[string]string)
+	for k, v := range s.Desired {
+		if s.Reported[k] != v {
+			delta[k] = v
+		}
+	}
+	return delta
+}
@@ -0,0 +1,40 @@
+package model
+
+// What a user can do with a device that was shared with them. Each role
+// can do everything the previous ones can.
+type Role string
+
+const (
+	// See the device, its state and its telemetry
+	RoleViewer Role = "viewer"
+	// Send commands and invoke functions
+	RoleController Role = "controller"
+	// Change the device's settings and share it with others
+	RoleAdmin Role = "admin"
+	// Not a share, the user that claimed the device
+	RoleOwner Role = "owner"
+)
+
+var roleRanks = map[Role]int{
+	RoleViewer:     1,
+	RoleController: 2,
+	RoleAdmin:      3,
+	RoleOwner:      4,
+}
+
+// Returns true if r is a role a device can be shared with
+func (r Role) Valid() bool {
+	return roleRanks[r] > 0 && r != RoleOwner
+}
+
+// Returns true if r can do what need can
+func (r Role) Allows(need Role) bool {
+	return roleRanks[r] > 0 && roleRanks[r] >= roleRanks[need]
+}
+
+// A Share gives a user other than the owner access to a device
+type Share struct {
+	DeviceId string `json:"deviceid"`
+	Email    string `json:"email"`
+	Role     Role   `json:"role"`
+}
@@ -0,0 +1,76 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// Most tags a device may have
+	MaxTags = 32
+	// Longest key or value of a tag
+	maxTagLen = 64
+)
+
+var ErrInvalidTags = errors.New("invalid tags")
+
+// Tag keys are letters, digits, '-', '_' and '.', so filters can tell them
+// from their values
+func validTagKey(k string) bool {
+	if k == "" || len(k) > maxTagLen {
+		return false
+	}
+	for _, c := range k {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns an error if there are too many tags or one isn't valid
+func CheckTags(tags map[string]string) error {
+	if len(tags) > MaxTags {
+		return fmt.Errorf("%w: at most %d", ErrInvalidTags, MaxTags)
+	}
+	for k, v := range tags {
+		if !validTagKey(k) {
+			return fmt.Errorf("%w: key %q", ErrInvalidTags, k)
+		}
+		if v == "" || len(v) > maxTagLen || strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("%w: value of %q", ErrInvalidTags, k)
+		}
+	}
+	return nil
+}
+
+// Selects the devices that have all of its tags, an empty value selects
+// any device that has the key
+type TagFilter map[string]string
+
+// Parses filters like "floor=2" or "location", nil if there are none
+func ParseTagFilter(filters []string) (TagFilter, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	f := make(TagFilter, len(filters))
+	for _, s := range filters {
+		k, v, _ := strings.Cut(s, "=")
+		if !validTagKey(k) {
+			return nil, fmt.Errorf("%w: key %q", ErrInvalidTags, k)
+		}
+		f[k] = v
+	}
+	return f, nil
+}
+
+func (f TagFilter) Matches(d *Device) bool {
+	for k, v := range f {
+		got, ok := d.Tags[k]
+		if !ok || v != "" && got != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A Tenant is an installation sharing the backend with others. Its users
+// only see each other and its devices, which connect through one of its
+// Domains. Users and devices without a tenant belong to the default one,
+// which has the domains no tenant claims.
+type Tenant struct {
+	Id      string   `json:"id" bson:"id"`
+	Name    string   `json:"name" bson:"name"`
+	Domains []string `json:"domains" bson:"domains"`
+	Created int64    `json:"created" bson:"created"`
+}
+
+var ErrInvalidTenant = errors.New("invalid tenant")
+
+func validTenantId(id string) bool {
+	if id == "" || len(id) > 32 {
+		return false
+	}
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Tenant) Check() error {
+	if !validTenantId(t.Id) {
+		return fmt.Errorf("%w: id must be up to 32 lowercase letters, digits or dashes", ErrInvalidTenant)
+	}
+	if t.Name == "" || len(t.Name) > 64 {
+		return fmt.Errorf("%w: name", ErrInvalidTenant)
+	}
+	for _, d := range t.Domains {
+		if d == "" || len(d) > 253 || strings.ContainsAny(d, "/: \t") {
+			return fmt.Errorf("%w: domain %q", ErrInvalidTenant, d)
+		}
+	}
+	return nil
+}
+
+// Returns the id devices of tenant are known by, the one they announce
+// prefixed with the tenant so they can't collide with those of others
+func QualifyId(tenant, id string) string {
+	if tenant == "" {
+		return id
+	}
+	return tenant + ":" + id
+}
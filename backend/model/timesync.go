@@ -0,0 +1,31 @@
+package model
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Returns the location named tz, an IANA name like "Europe/Madrid", or def
+// if it's empty
+func LoadTimezone(tz string, def *time.Location) (*time.Location, error) {
+	if tz == "" {
+		return def, nil
+	}
+	if tz == "Local" {
+		// Whatever the server happens to run in isn't a place
+		return nil, errors.New("unknown time zone Local")
+	}
+	return time.LoadLocation(tz)
+}
+
+// The arguments of TIME at t in loc: unix milliseconds, the offset from
+// UTC in seconds, and the zone's name
+func TimeArgs(t time.Time, loc *time.Location) []string {
+	_, offset := t.In(loc).Zone()
+	return []string{
+		strconv.FormatInt(t.UnixMilli(), 10),
+		strconv.Itoa(offset),
+		loc.String(),
+	}
+}
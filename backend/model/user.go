@@ -10,4 +10,12 @@ type User struct {
 	Email         string `json:"email"`
 	EmailVerified bool   `json:"email_verified"`
 	Gender        string `json:"gender"`
+	// Empty for the default tenant
+	Tenant string `json:"tenant,omitempty"`
+
+	// Empty for users that only sign in with a provider, see Identity
+	PasswordHash string `json:"-"`
+	// Set by operators, disabled users can't sign in and their devices
+	// can't connect
+	Disabled bool `json:"disabled,omitempty"`
 }
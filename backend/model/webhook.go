@@ -0,0 +1,62 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A rule of the owner fired
+const WebhookRule = "rule"
+
+// Events a webhook can be told about, the device ones are the same as those
+// of the browser event stream
+var webhookEvents = map[string]bool{
+	"connected": true, "disconnected": true, "updated": true, "message": true,
+	"shadow": true, "telemetry": true, "will": true, "presence": true, WebhookRule: true,
+}
+
+// A Webhook is a URL that gets a POST with a JSON payload when something
+// happens on the devices of its owner. Payloads are signed with Secret, so
+// the receiver can tell they come from us.
+type Webhook struct {
+	Id      bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner   string        `json:"owner"`
+	URL     string        `json:"url"`
+	Secret  string        `json:"secret"`
+	Events  []string      `json:"events"`
+	Enabled bool          `json:"enabled"`
+}
+
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+func (w *Webhook) Check() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(w.URL) > 2048 {
+		return fmt.Errorf("%w: url", ErrInvalidWebhook)
+	}
+	if len(w.Events) == 0 {
+		return fmt.Errorf("%w: no events", ErrInvalidWebhook)
+	}
+	for _, ev := range w.Events {
+		if !webhookEvents[ev] {
+			return fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, ev)
+		}
+	}
+	return nil
+}
+
+// Returns true if w is enabled and wants to be told about event
+func (w *Webhook) Wants(event string) bool {
+	if !w.Enabled {
+		return false
+	}
+	for _, ev := range w.Events {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
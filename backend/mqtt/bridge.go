@@ -0,0 +1,225 @@
+// Package mqtt lets devices that speak MQTT instead of the WebSocket
+// protocol join a hub through an MQTT broker.
+//
+// A device publishes its messages to iot/{owner}/{device}/state and
+// receives commands on iot/{owner}/{device}/cmd. Payloads are the same
+// messages the WebSocket protocol uses, in text or JSON (if they start
+// with "{"). Publishing "offline" to iot/{owner}/{device}/status, e.g. as
+// the last will, disconnects the device right away.
+//
+// The broker is trusted to only let a device publish under its owner's
+// topics, no HELLO or token is needed. See discovery.go for Home Assistant.
+package mqtt
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/twinone/iot/backend/ws"
+)
+
+const (
+	topicPrefix = "iot"
+	// Commands are delivered at least once
+	qos = 1
+	// How often devices are marked as seen while the broker is connected
+	touchPeriod = 15 * time.Second
+)
+
+type Bridge struct {
+	hub    *ws.Hub
+	client paho.Client
+
+	// Attached devices by id
+	conns map[string]*device
+	mx    sync.Mutex
+	quit  chan struct{}
+
+	// Home Assistant discovery, disabled if nil
+	discovery *discovery
+}
+
+type device struct {
+	id    string
+	owner string
+	codec ws.Codec
+	conn  *ws.Conn
+}
+
+// Creates a bridge for hub to the broker at url, e.g. tcp://localhost:1883
+func New(hub *ws.Hub, url, clientId, username, password string) *Bridge {
+	b := &Bridge{
+		hub:   hub,
+		conns: make(map[string]*device),
+		quit:  make(chan struct{}),
+	}
+	opts := paho.NewClientOptions().
+		AddBroker(url).
+		SetClientID(clientId).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		// Subscriptions are lost with the session, renew them
+		SetOnConnectHandler(b.subscribe).
+		SetConnectionLostHandler(func(c paho.Client, err error) {
+			slog.Warn("lost connection to MQTT broker", "err", err)
+		})
+	b.client = paho.NewClient(opts)
+	return b
+}
+
+func (b *Bridge) Start() error {
+	if t := b.client.Connect(); t.Wait() && t.Error() != nil {
+		return t.Error()
+	}
+	go b.touchLoop()
+	if b.discovery != nil {
+		b.startDiscovery()
+	}
+	return nil
+}
+
+// Disconnects every device and the broker
+func (b *Bridge) Stop() {
+	if b.discovery != nil {
+		b.discovery.unhook()
+	}
+	close(b.quit)
+	b.mx.Lock()
+	devices := make([]*device, 0, len(b.conns))
+	for _, d := range b.conns {
+		devices = append(devices, d)
+	}
+	b.mx.Unlock()
+	for _, d := range devices {
+		d.conn.Close()
+	}
+	b.client.Disconnect(250)
+}
+
+func (b *Bridge) subscribe(c paho.Client) {
+	slog.Info("connected to MQTT broker")
+	for _, topic := range []string{"state", "status"} {
+		t := c.Subscribe(topicPrefix+"/+/+/"+topic, qos, b.handle)
+		if t.Wait() && t.Error() != nil {
+			slog.Error("subscribing to MQTT topic", "topic", topic, "err", t.Error())
+		}
+	}
+	if b.discovery != nil {
+		if t := c.Subscribe(haRoot+"/+/+/set", qos, b.handleSet); t.Wait() && t.Error() != nil {
+			slog.Error("subscribing to Home Assistant commands", "err", t.Error())
+		}
+	}
+}
+
+func (b *Bridge) handle(c paho.Client, m paho.Message) {
+	// iot/{owner}/{device}/{kind}
+	parts := strings.Split(m.Topic(), "/")
+	if len(parts) != 4 || parts[1] == "" || parts[2] == "" {
+		return
+	}
+	owner, id, kind := parts[1], parts[2], parts[3]
+
+	switch kind {
+	case "state":
+		d := b.device(owner, id, m.Payload())
+		if d != nil {
+			d.conn.Receive(m.Payload())
+		}
+	case "status":
+		if string(m.Payload()) != "offline" {
+			return
+		}
+		b.mx.Lock()
+		d := b.conns[id]
+		b.mx.Unlock()
+		if d != nil && d.owner == owner {
+			d.conn.Close()
+		}
+	}
+}
+
+// Returns the attached device, attaching it on its first message
+func (b *Bridge) device(owner, id string, first []byte) *device {
+	b.mx.Lock()
+	d := b.conns[id]
+	b.mx.Unlock()
+	if d != nil {
+		if d.owner != owner {
+			slog.Warn("MQTT device published under another owner", "device", id, "owner", owner)
+			return nil
+		}
+		return d
+	}
+
+	codec := ws.TextCodec
+	if len(first) > 0 && first[0] == '{' {
+		codec = ws.JSONCodec
+	}
+	d = &device{id: id, owner: owner, codec: codec}
+	// Not holding mx, Attach may close the connection and call back
+	conn, err := b.hub.Attach(id, owner, codec, func() { b.forget(d) })
+	if err != nil {
+		slog.Warn("attaching MQTT device", "device", id, "owner", owner, "err", err)
+		return nil
+	}
+	d.conn = conn
+	b.mx.Lock()
+	b.conns[id] = d
+	b.mx.Unlock()
+	slog.Info("MQTT device attached", "device", id, "owner", owner)
+	go b.writeLoop(d)
+	return d
+}
+
+// Publishes what the hub sends to the device until the connection closes
+func (b *Bridge) writeLoop(d *device) {
+	topic := strings.Join([]string{topicPrefix, d.owner, d.id, "cmd"}, "/")
+	for msg := range d.conn.Send {
+		data, err := d.codec.Encode(msg)
+		if err != nil {
+			slog.Error("encoding message", "device", d.id, "err", err)
+			d.conn.Sent(msg, err)
+			continue
+		}
+		b.client.Publish(topic, qos, false, data)
+		// Handed to the broker client, which retries on its own
+		d.conn.Sent(msg, nil)
+	}
+	d.conn.Close()
+	// In case it was closed before being added
+	b.forget(d)
+}
+
+func (b *Bridge) forget(d *device) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.conns[d.id] == d {
+		delete(b.conns, d.id)
+	}
+}
+
+// Devices don't answer pings through the broker, they're considered alive
+// for as long as the broker is
+func (b *Bridge) touchLoop() {
+	ticker := time.NewTicker(touchPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !b.client.IsConnected() {
+				continue
+			}
+			b.mx.Lock()
+			for _, d := range b.conns {
+				d.conn.Touch()
+			}
+			b.mx.Unlock()
+		case <-b.quit:
+			return
+		}
+	}
+}
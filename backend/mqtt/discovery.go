@@ -0,0 +1,369 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/twinone/iot/backend/audit"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/rules"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+// Home Assistant MQTT discovery: the functions of every device connected to
+// this instance, over any transport, show up in Home Assistant. Digital
+// writes without parameters and functions taking a bool become switches,
+// those taking a number, enum or word become numbers, selects and texts,
+// and those without parameters buttons. Telemetry metrics become sensors
+// when they're first seen.
+//
+// Entities use iot-ha/{device}/availability, iot-ha/{device}/{function}/state
+// and /set, and iot-ha/{device}/sensor/{metric}, with base64url encoded ids.
+// Like the rest of the bridge, anyone that can publish to the broker can
+// control the devices.
+const (
+	haRoot = "iot-ha"
+	// Updates waiting to be published before new ones are dropped
+	discoveryQueueSize = 256
+	// How long a command from Home Assistant may take to be sent
+	haCommandTimeout = 5 * time.Second
+)
+
+const (
+	haSwitch = "switch"
+	haNumber = "number"
+	haSelect = "select"
+	haText   = "text"
+	haButton = "button"
+	haSensor = "sensor"
+)
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+// Config of an entity, see https://www.home-assistant.io/integrations/mqtt
+type haConfig struct {
+	Name              string   `json:"name"`
+	UniqueId          string   `json:"unique_id"`
+	Device            haDevice `json:"device"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	StateTopic        string   `json:"state_topic,omitempty"`
+	CommandTopic      string   `json:"command_topic,omitempty"`
+	PayloadOn         string   `json:"payload_on,omitempty"`
+	PayloadOff        string   `json:"payload_off,omitempty"`
+	Min               *float64 `json:"min,omitempty"`
+	Max               *float64 `json:"max,omitempty"`
+	Step              float64  `json:"step,omitempty"`
+	Options           []string `json:"options,omitempty"`
+	Unit              string   `json:"unit_of_measurement,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+}
+
+type discovery struct {
+	prefix string
+	store  store.Store
+	work   chan func()
+	unhook func()
+
+	// Only used by the discovery goroutine, by device id
+	functions map[string][]*model.Function
+	// Config topics published, to clear those of removed functions
+	announced map[string]map[string]bool
+	sensors   map[string]map[string]bool
+}
+
+// Announces devices to Home Assistant under prefix, usually "homeassistant".
+// Must be called before Start.
+func (b *Bridge) Discover(st store.Store, prefix string) {
+	b.discovery = &discovery{
+		prefix:    prefix,
+		store:     st,
+		work:      make(chan func(), discoveryQueueSize),
+		functions: make(map[string][]*model.Function),
+		announced: make(map[string]map[string]bool),
+		sensors:   make(map[string]map[string]bool),
+	}
+}
+
+func encodeId(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func decodeId(s string) (string, bool) {
+	id, err := base64.RawURLEncoding.DecodeString(s)
+	return string(id), err == nil
+}
+
+func haComponent(f *model.Function) string {
+	switch {
+	case len(f.Params) == 0 && f.Cmd == model.CmdDigitalWrite:
+		return haSwitch
+	case len(f.Params) == 0:
+		return haButton
+	case len(f.Params) > 1:
+		return ""
+	}
+	switch f.Params[0].Type {
+	case model.ParamBool:
+		return haSwitch
+	case model.ParamInt, model.ParamFloat:
+		return haNumber
+	case model.ParamEnum:
+		return haSelect
+	case model.ParamString:
+		return haText
+	}
+	return ""
+}
+
+func (b *Bridge) startDiscovery() {
+	ds := b.discovery
+	ds.unhook = b.hub.OnEvent(func(ev *ws.Event) {
+		// The device is a snapshot, safe to use from the discovery goroutine
+		d := ev.Device
+		var f func()
+		switch ev.Type {
+		case ws.EventConnected, ws.EventUpdated:
+			f = func() { b.announce(d) }
+		case ws.EventDisconnected:
+			f = func() { b.unavailable(d) }
+		case ws.EventShadow:
+			if ev.Message == nil {
+				return
+			}
+			values := ev.Message.Values()
+			f = func() { b.publishState(d, values) }
+		case ws.EventTelemetry:
+			values := ev.Message.Values()
+			f = func() { b.publishSensors(d, values) }
+		default:
+			return
+		}
+		select {
+		case ds.work <- f:
+		default:
+			slog.Warn("Home Assistant discovery falling behind, dropping update", "device", d.Id)
+		}
+	})
+	go func() {
+		for {
+			select {
+			case f := <-ds.work:
+				f()
+			case <-b.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (b *Bridge) publish(topic string, retained bool, payload interface{}) {
+	var data []byte
+	switch p := payload.(type) {
+	case string:
+		data = []byte(p)
+	default:
+		var err error
+		if data, err = json.Marshal(p); err != nil {
+			slog.Error("encoding Home Assistant config", "err", err)
+			return
+		}
+	}
+	b.client.Publish(topic, qos, retained, data)
+}
+
+func haDeviceTopic(d *model.Device) string {
+	return haRoot + "/" + encodeId(d.Id)
+}
+
+func (b *Bridge) haEntity(d *model.Device, component string, objectId string, name string) (topic string, cfg *haConfig) {
+	node := "iot_" + encodeId(d.Id)
+	cfg = &haConfig{
+		Name:              name,
+		UniqueId:          node + "_" + objectId,
+		AvailabilityTopic: haDeviceTopic(d) + "/availability",
+		Device: haDevice{
+			Identifiers:  []string{node},
+			Name:         d.Name,
+			Manufacturer: "iot",
+		},
+	}
+	if cfg.Device.Name == "" {
+		cfg.Device.Name = d.Id
+	}
+	return strings.Join([]string{b.discovery.prefix, component, node, objectId, "config"}, "/"), cfg
+}
+
+// Publishes the entities of the functions of d and its current state
+func (b *Bridge) announce(d *model.Device) {
+	ds := b.discovery
+	functions, err := store.DeviceFunctions(ds.store, d)
+	if err != nil {
+		slog.Error("finding functions", "device", d.Id, "err", err)
+		return
+	}
+	ds.functions[d.Id] = functions
+
+	topics := make(map[string]bool)
+	for _, f := range functions {
+		component := haComponent(f)
+		if component == "" {
+			continue
+		}
+		base := haDeviceTopic(d) + "/" + encodeId(f.Name)
+		topic, cfg := b.haEntity(d, component, encodeId(f.Name), f.Name)
+		cfg.CommandTopic = base + "/set"
+		if component != haButton {
+			cfg.StateTopic = base + "/state"
+		}
+		switch component {
+		case haSwitch:
+			cfg.PayloadOn, cfg.PayloadOff = "ON", "OFF"
+		case haNumber:
+			p := &f.Params[0]
+			cfg.Min, cfg.Max, cfg.Unit = p.Min, p.Max, p.Unit
+			cfg.Step = 1
+			if p.Type == model.ParamFloat {
+				cfg.Step = 0.1
+			}
+		case haSelect:
+			cfg.Options = f.Params[0].Values
+		}
+		b.publish(topic, true, cfg)
+		topics[topic] = true
+	}
+	// Functions that are gone
+	for topic := range ds.announced[d.Id] {
+		if !topics[topic] {
+			b.publish(topic, true, "")
+		}
+	}
+	ds.announced[d.Id] = topics
+	for metric := range ds.sensors[d.Id] {
+		b.announceSensor(d, metric)
+	}
+	b.publish(haDeviceTopic(d)+"/availability", true, "online")
+
+	if sh, err := ds.store.FindShadow(d.Id); err == nil {
+		b.publishState(d, sh.Reported)
+	}
+}
+
+func (b *Bridge) unavailable(d *model.Device) {
+	b.publish(haDeviceTopic(d)+"/availability", true, "offline")
+	delete(b.discovery.functions, d.Id)
+}
+
+// Publishes the state of the functions of d from reported values keyed by pin
+func (b *Bridge) publishState(d *model.Device, reported map[string]string) {
+	for _, f := range b.discovery.functions[d.Id] {
+		v, ok := reported[strconv.Itoa(f.Pin)]
+		component := haComponent(f)
+		if !ok || component == "" || component == haButton {
+			continue
+		}
+		if component == haSwitch {
+			if isOn(v) {
+				v = "ON"
+			} else {
+				v = "OFF"
+			}
+		}
+		b.publish(haDeviceTopic(d)+"/"+encodeId(f.Name)+"/state", true, v)
+	}
+}
+
+func isOn(v string) bool {
+	switch strings.ToLower(v) {
+	case "high", "1", "true", "on":
+		return true
+	}
+	return false
+}
+
+func (b *Bridge) announceSensor(d *model.Device, metric string) {
+	topic, cfg := b.haEntity(d, haSensor, "t_"+encodeId(metric), metric)
+	cfg.StateTopic = haDeviceTopic(d) + "/sensor/" + encodeId(metric)
+	cfg.StateClass = "measurement"
+	b.publish(topic, true, cfg)
+}
+
+func (b *Bridge) publishSensors(d *model.Device, values map[string]string) {
+	ds := b.discovery
+	if ds.sensors[d.Id] == nil {
+		ds.sensors[d.Id] = make(map[string]bool)
+	}
+	for metric, v := range values {
+		if !ds.sensors[d.Id][metric] {
+			ds.sensors[d.Id][metric] = true
+			b.announceSensor(d, metric)
+		}
+		b.publish(haDeviceTopic(d)+"/sensor/"+encodeId(metric), false, v)
+	}
+}
+
+// Runs a command Home Assistant published to iot-ha/{device}/{function}/set.
+// Only the instance the device is connected to acts on it.
+func (b *Bridge) handleSet(c paho.Client, m paho.Message) {
+	parts := strings.Split(m.Topic(), "/")
+	if len(parts) != 4 {
+		return
+	}
+	id, ok1 := decodeId(parts[1])
+	name, ok2 := decodeId(parts[2])
+	if !ok1 || !ok2 {
+		return
+	}
+	conn := b.hub.GetConn(id)
+	if conn == nil {
+		return
+	}
+	d := conn.Device
+	f, err := store.FindFunction(b.discovery.store, d, name)
+	if f == nil {
+		slog.Warn("Home Assistant command for unknown function", "device", id, "function", name, "err", err)
+		return
+	}
+
+	payload := string(m.Payload())
+	var args []string
+	switch haComponent(f) {
+	case haSwitch:
+		on := payload == "ON"
+		switch {
+		case len(f.Params) == 1:
+			args = []string{strconv.FormatBool(on)}
+		case on:
+			args = []string{model.ValHigh}
+		default:
+			args = []string{model.ValLow}
+		}
+	case haNumber:
+		if v, err := strconv.ParseFloat(payload, 64); err == nil && f.Params[0].Type == model.ParamInt {
+			payload = strconv.FormatInt(int64(v), 10)
+		}
+		args = []string{payload}
+	case haSelect, haText:
+		args = []string{payload}
+	case haButton:
+	default:
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(audit.WithVia(context.Background(), "mqtt"), haCommandTimeout)
+	defer cancel()
+	action := &model.Action{DeviceId: d.Id, Function: f.Name, Args: args}
+	if _, err := rules.Run(ctx, b.hub, b.discovery.store, d.Owner, action); err != nil {
+		slog.Warn("running Home Assistant command", "device", id, "function", name, "err", err)
+	}
+}
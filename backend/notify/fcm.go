@@ -0,0 +1,54 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/twinone/iot/backend/model"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// Sends push notifications to phones through Firebase Cloud Messaging,
+// addressed by their registration token
+type FCM struct {
+	project string
+	client  *http.Client
+}
+
+// Returns an FCM that authenticates with the JSON key of a service account
+// of the Firebase project
+func NewFCM(ctx context.Context, credentials []byte) (*FCM, error) {
+	creds, err := google.CredentialsFromJSON(ctx, credentials, fcmScope)
+	if err != nil {
+		return nil, err
+	}
+	client := oauth2.NewClient(ctx, creds.TokenSource)
+	client.Timeout = sendTimeout
+	return &FCM{project: creds.ProjectID, client: client}, nil
+}
+
+func (f *FCM) Send(ctx context.Context, to string, n *model.Notification) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{"token": to, "notification": n},
+	})
+	if err != nil {
+		return err
+	}
+	url := "https://fcm.googleapis.com/v1/projects/" + f.project + "/messages:send"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
@@ -0,0 +1,261 @@
+// Package notify tells users about their devices by email, push
+// notification or Telegram, as they choose, without flooding them when a
+// device keeps flapping
+package notify
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+const (
+	// Notifications waiting to be sent before new ones are dropped
+	jobQueueSize = 256
+	// Timeout of sending a notification through one channel
+	sendTimeout = 10 * time.Second
+	// How long the same thing about the same device isn't told again
+	repeatAfter = 10 * time.Minute
+	// Default of NotificationPrefs.Hourly
+	defaultHourly = 20
+)
+
+// A Sender delivers notifications through one channel. to is where the
+// user gets them there, like their email address.
+type Sender interface {
+	Send(ctx context.Context, to string, n *model.Notification) error
+}
+
+var httpClient = &http.Client{Timeout: sendTimeout}
+
+// Returns an error with the status and the start of the body if resp
+// isn't a success
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s: %s", resp.Status, body)
+}
+
+type job struct {
+	owner string
+	// What it's about, notifications about the same one are held back for
+	// repeatAfter
+	subject string
+	n       *model.Notification
+	// Whether the preferences ask for it, always if nil
+	wants func(p *model.NotificationPrefs) bool
+}
+
+type Notifier struct {
+	hub     *ws.Hub
+	store   store.Store
+	senders map[string]Sender
+
+	// Most notifications a user gets per hour unless they say otherwise
+	Hourly int
+
+	jobs   chan *job
+	quit   chan struct{}
+	unhook func()
+
+	// Only used by run: when each user was notified within the last hour,
+	// when each subject last notified and how many notifications were held
+	// back since the user was last told
+	sent map[string][]time.Time
+	last map[string]time.Time
+	held map[string]int
+}
+
+func New(hub *ws.Hub, st store.Store) *Notifier {
+	return &Notifier{
+		hub:     hub,
+		store:   st,
+		senders: make(map[string]Sender),
+		Hourly:  defaultHourly,
+		jobs:    make(chan *job, jobQueueSize),
+		quit:    make(chan struct{}),
+		sent:    make(map[string][]time.Time),
+		last:    make(map[string]time.Time),
+		held:    make(map[string]int),
+	}
+}
+
+// Sends notifications for channel through s, must be called before Start
+func (n *Notifier) Register(channel string, s Sender) {
+	n.senders[channel] = s
+}
+
+// Returns true if notifications can be sent through channel
+func (n *Notifier) Has(channel string) bool {
+	return n.senders[channel] != nil
+}
+
+// Starts telling users about the presence changes and wills of their
+// devices, if they asked for it
+func (n *Notifier) Start() {
+	n.unhook = n.hub.OnEvent(func(ev *ws.Event) {
+		d := ev.Device
+		name := d.Name
+		if name == "" {
+			name = d.Id
+		}
+		switch ev.Type {
+		case ws.EventPresence:
+			state := ev.State
+			n.push(&job{
+				owner:   d.Owner,
+				subject: d.Id + "/presence/" + state,
+				n:       &model.Notification{Title: name + " is " + state},
+				wants:   func(p *model.NotificationPrefs) bool { return p.WantsPresence(state) },
+			})
+		case ws.EventWill:
+			nt := &model.Notification{Title: name + " went away unexpectedly"}
+			if ev.Message != nil {
+				nt.Body = ev.Message.Tail()
+			}
+			n.push(&job{
+				owner:   d.Owner,
+				subject: d.Id + "/will",
+				n:       nt,
+				wants:   func(p *model.NotificationPrefs) bool { return p.Will },
+			})
+		}
+	})
+	go n.run()
+}
+
+func (n *Notifier) Stop() {
+	n.unhook()
+	close(n.quit)
+}
+
+// Tells the owner of a rule that fired, if it has a notification. Meant
+// for rules.Engine.OnFire.
+func (n *Notifier) RuleFired(r *model.Rule, cmd string, err error) {
+	if r.Notify == nil {
+		return
+	}
+	nt := *r.Notify
+	if err != nil {
+		nt.Body += "\n\nThe action failed: " + err.Error()
+	}
+	n.push(&job{owner: r.Owner, subject: "rule/" + r.Id.Hex(), n: &nt})
+}
+
+// Called from hooks, so notifications are dropped if we fall behind
+func (n *Notifier) push(j *job) {
+	select {
+	case n.jobs <- j:
+	default:
+		slog.Warn("notifier falling behind, dropping notification", "owner", j.owner)
+	}
+}
+
+func (n *Notifier) run() {
+	ticker := time.NewTicker(repeatAfter)
+	defer ticker.Stop()
+	for {
+		select {
+		case j := <-n.jobs:
+			n.deliver(j)
+		case now := <-ticker.C:
+			n.forget(now)
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+// Sends j through every channel of its owner, unless it's too soon
+func (n *Notifier) deliver(j *job) {
+	log := slog.With("owner", j.owner, "subject", j.subject)
+	prefs, err := n.store.FindNotificationPrefs(j.owner)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Error("finding notification preferences", "err", err)
+		}
+		return
+	}
+	if len(prefs.Channels) == 0 || j.wants != nil && !j.wants(prefs) {
+		return
+	}
+	if !n.allow(j, prefs) {
+		n.held[j.owner]++
+		log.Info("holding back notification")
+		return
+	}
+
+	nt := *j.n
+	if held := n.held[j.owner]; held > 0 {
+		nt.Body += fmt.Sprintf("\n\n%d more notifications were held back.", held)
+		delete(n.held, j.owner)
+	}
+	for ch, to := range prefs.Channels {
+		s := n.senders[ch]
+		if s == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		err := s.Send(ctx, to, &nt)
+		cancel()
+		if err != nil {
+			log.Warn("sending notification", "channel", ch, "err", err)
+		}
+	}
+}
+
+// Returns true if j may be sent now, and counts it if so
+func (n *Notifier) allow(j *job, prefs *model.NotificationPrefs) bool {
+	now := time.Now()
+	key := j.owner + " " + j.subject
+	if t, ok := n.last[key]; ok && now.Sub(t) < repeatAfter {
+		return false
+	}
+	limit := prefs.Hourly
+	if limit == 0 {
+		limit = n.Hourly
+	}
+	sent := recent(n.sent[j.owner], now.Add(-time.Hour))
+	if len(sent) >= limit {
+		n.sent[j.owner] = sent
+		return false
+	}
+	n.last[key] = now
+	n.sent[j.owner] = append(sent, now)
+	return true
+}
+
+// Returns the times in ts after since, which are in order
+func recent(ts []time.Time, since time.Time) []time.Time {
+	for i, t := range ts {
+		if t.After(since) {
+			return ts[i:]
+		}
+	}
+	return nil
+}
+
+// Drops what allow doesn't need anymore
+func (n *Notifier) forget(now time.Time) {
+	for key, t := range n.last {
+		if now.Sub(t) >= repeatAfter {
+			delete(n.last, key)
+		}
+	}
+	for owner, ts := range n.sent {
+		if ts = recent(ts, now.Add(-time.Hour)); len(ts) == 0 {
+			delete(n.sent, owner)
+		} else {
+			n.sent[owner] = ts
+		}
+	}
+}
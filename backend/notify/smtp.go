@@ -0,0 +1,41 @@
+package notify
+
+import (
+	"context"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// Sends notifications as plain text emails. The server must offer
+// STARTTLS if Username is set.
+type SMTP struct {
+	// host:port of the server
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// net/smtp can't be canceled, so ctx is ignored
+func (s *SMTP) Send(ctx context.Context, to string, n *model.Notification) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	var msg strings.Builder
+	msg.WriteString("From: " + s.From + "\r\n")
+	msg.WriteString("To: " + to + "\r\n")
+	// Encoded if it has line breaks too, so it can't add headers
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", n.Title) + "\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(n.Body, "\n", "\r\n"))
+	return smtp.SendMail(s.Addr, auth, s.From, []string{to}, []byte(msg.String()))
+}
@@ -0,0 +1,44 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	neturl "net/url"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// Sends notifications as messages of a Telegram bot, addressed by chat id.
+// Users get their chat id by talking to the bot first.
+type Telegram struct {
+	Token string
+}
+
+func (t *Telegram) Send(ctx context.Context, to string, n *model.Notification) error {
+	text := n.Title
+	if n.Body != "" {
+		text += "\n\n" + n.Body
+	}
+	body, err := json.Marshal(map[string]string{"chat_id": to, "text": text})
+	if err != nil {
+		return err
+	}
+	url := "https://api.telegram.org/bot" + t.Token + "/sendMessage"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		// Without the URL, which has the token
+		if uerr, ok := err.(*neturl.Error); ok {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
@@ -0,0 +1,335 @@
+// Package ota updates the firmware of devices over the air: it tells them
+// where to download a new image and tracks how each update goes
+package ota
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+const (
+	// How long the download URL sent to a device works
+	urlTTL = time.Hour
+	// Status updates waiting to be recorded before new ones are dropped
+	jobQueueSize = 256
+	// Timeout of sending the OTA message to a device
+	sendTimeout = 10 * time.Second
+	// Longest failure detail kept from a device
+	maxDetailLen = 256
+)
+
+var ErrFirmwareNotFound = errors.New("firmware not found")
+
+type Manager struct {
+	hub    *ws.Hub
+	store  store.Store
+	secret []byte
+	// Download URLs are relative to it, like https://iot.example.com
+	baseURL string
+
+	jobs   chan func()
+	quit   chan struct{}
+	unhook []func()
+
+	// Serializes changes to rollouts
+	mx sync.Mutex
+}
+
+func New(hub *ws.Hub, st store.Store, secret []byte, baseURL string) *Manager {
+	return &Manager{
+		hub:     hub,
+		store:   st,
+		secret:  secret,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		jobs:    make(chan func(), jobQueueSize),
+		quit:    make(chan struct{}),
+	}
+}
+
+// Starts sending updates to devices as they come online and recording
+// what they report
+func (m *Manager) Start() {
+	m.unhook = []func(){
+		m.hub.OnEvent(func(ev *ws.Event) {
+			if ev.Type != ws.EventConnected && ev.Type != ws.EventUpdated {
+				return
+			}
+			connected := ev.Type == ws.EventConnected
+			m.push(func() { m.check(ev.Device, connected) })
+		}),
+		m.hub.OnMessage(func(d *model.Device, msg *ws.Message) {
+			if msg.Cmd != model.RespOTAStatus {
+				return
+			}
+			id, owner := d.Id, d.Owner
+			m.push(func() { m.status(id, owner, msg) })
+		}),
+	}
+	go m.run()
+}
+
+func (m *Manager) Stop() {
+	for _, f := range m.unhook {
+		f()
+	}
+	close(m.quit)
+}
+
+// Hooks can't block, so jobs are dropped if we fall behind
+func (m *Manager) push(job func()) {
+	select {
+	case m.jobs <- job:
+	default:
+		slog.Warn("ota falling behind, dropping update")
+	}
+}
+
+func (m *Manager) run() {
+	for {
+		select {
+		case job := <-m.jobs:
+			job()
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// Returns the URL the firmware with id can be downloaded from until exp
+func (m *Manager) SignedURL(id string, exp time.Time) string {
+	e := strconv.FormatInt(exp.Unix(), 10)
+	q := url.Values{"exp": {e}, "sig": {m.sign(id, e)}}
+	return m.baseURL + "/ota/" + id + "?" + q.Encode()
+}
+
+// Returns true if sig was made by SignedURL for id and exp hasn't passed
+func (m *Manager) Verify(id, exp, sig string) bool {
+	e, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > e {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(m.sign(id, exp)))
+}
+
+func (m *Manager) sign(id, exp string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(id + "." + exp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Creates a rollout of f to devices and sends it to the ones online, the
+// rest get it when they connect. Devices of another model are skipped,
+// and older rollouts still going on for the others are canceled for them.
+func (m *Manager) Begin(f *model.Firmware, devices []*model.Device) (*model.Rollout, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	now := time.Now().Unix()
+	r := &model.Rollout{
+		Owner:      f.Owner,
+		FirmwareId: f.Id.Hex(),
+		Model:      f.Model,
+		Version:    f.Version,
+		Created:    now,
+	}
+	for _, d := range devices {
+		t := model.RolloutTarget{DeviceId: d.Id, State: model.TargetPending, Updated: now}
+		switch {
+		case d.Model == "":
+			t.State, t.Detail = model.TargetSkipped, "unknown model"
+		case d.Model != f.Model:
+			t.State, t.Detail = model.TargetSkipped, "model "+d.Model
+		case d.Firmware == f.Version:
+			t.State, t.Progress = model.TargetDone, 100
+		}
+		r.Targets = append(r.Targets, t)
+	}
+	if err := m.supersede(r); err != nil {
+		return nil, err
+	}
+	if _, err := m.store.InsertRollout(r); err != nil {
+		return nil, err
+	}
+
+	for i := range r.Targets {
+		if t := &r.Targets[i]; t.State == model.TargetPending {
+			m.send(r, t)
+		}
+	}
+	return r, m.store.SaveRollout(r)
+}
+
+// Cancels the targets of older rollouts that r also targets
+func (m *Manager) supersede(r *model.Rollout) error {
+	rollouts, err := m.store.FindRolloutsByOwner(r.Owner)
+	if err != nil {
+		return err
+	}
+	for _, old := range rollouts {
+		if !old.Active() {
+			continue
+		}
+		changed := false
+		for i := range old.Targets {
+			t := &old.Targets[i]
+			if t.Active() && r.Target(t.DeviceId) != nil {
+				setState(t, model.TargetCanceled, "superseded")
+				changed = true
+			}
+		}
+		if changed {
+			if err := m.store.SaveRollout(old); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Stops sending a rollout to devices. Those that already got it may still
+// install it.
+func (m *Manager) Cancel(r *model.Rollout) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	// It may have changed since the caller loaded it
+	r, err := m.store.FindRollout(r.Id.Hex())
+	if err != nil {
+		return err
+	}
+	r.Canceled = true
+	for i := range r.Targets {
+		if t := &r.Targets[i]; t.Active() {
+			setState(t, model.TargetCanceled, "")
+		}
+	}
+	return m.store.SaveRollout(r)
+}
+
+// Returns the newest rollout still going on for the device with id and
+// its target there, or nil
+func (m *Manager) activeTarget(owner, id string) (*model.Rollout, *model.RolloutTarget) {
+	rollouts, err := m.store.FindRolloutsByOwner(owner)
+	if err != nil {
+		slog.Error("finding rollouts", "owner", owner, "err", err)
+		return nil, nil
+	}
+	for i := len(rollouts) - 1; i >= 0; i-- {
+		r := rollouts[i]
+		if r.Canceled {
+			continue
+		}
+		if t := r.Target(id); t != nil && t.Active() {
+			return r, t
+		}
+	}
+	return nil, nil
+}
+
+// Tells the device to install the firmware of r. The target stays pending
+// if it can't be reached.
+func (m *Manager) send(r *model.Rollout, t *model.RolloutTarget) {
+	f, err := m.store.FindFirmware(r.FirmwareId)
+	if err != nil {
+		if err == store.ErrNotFound {
+			setState(t, model.TargetFailed, ErrFirmwareNotFound.Error())
+		} else {
+			slog.Error("finding firmware", "firmware", r.FirmwareId, "err", err)
+		}
+		return
+	}
+	msg := fmt.Sprintf("%s %s %s %s", model.MsgOTA,
+		m.SignedURL(f.Id.Hex(), time.Now().Add(urlTTL)), f.SHA256, f.Version)
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if err := m.hub.SendToDevice(ctx, t.DeviceId, []byte(msg)); err != nil {
+		if err != ws.ErrNotConnected {
+			slog.Warn("sending firmware update", "device", t.DeviceId, "err", err)
+		}
+		return
+	}
+	setState(t, model.TargetSent, "")
+	slog.Info("sent firmware update", "device", t.DeviceId, "rollout", r.Id.Hex(), "version", f.Version)
+}
+
+// Handles a device that connected or changed: it's done if it runs the
+// version of its rollout, otherwise it's sent the update if it doesn't
+// have it yet or lost it while reconnecting
+func (m *Manager) check(d *model.Device, connected bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	r, t := m.activeTarget(d.Owner, d.Id)
+	if t == nil {
+		return
+	}
+	switch {
+	case d.Firmware == r.Version:
+		t.Progress = 100
+		setState(t, model.TargetDone, "")
+		slog.Info("firmware updated", "device", d.Id, "rollout", r.Id.Hex(), "version", r.Version)
+	case t.State == model.TargetPending,
+		connected && (t.State == model.TargetSent || t.State == model.TargetDownloading):
+		m.send(r, t)
+	default:
+		return
+	}
+	if err := m.store.SaveRollout(r); err != nil {
+		slog.Error("saving rollout", "rollout", r.Id.Hex(), "err", err)
+	}
+}
+
+// Records an OTASTATUS message, e.g. "OTASTATUS downloading 40" or
+// "OTASTATUS failed checksum mismatch"
+func (m *Manager) status(id, owner string, msg *ws.Message) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	r, t := m.activeTarget(owner, id)
+	if t == nil {
+		return
+	}
+	switch state := msg.Arg(0); state {
+	case model.TargetDownloading:
+		if p, err := strconv.Atoi(msg.Arg(1)); err == nil && p >= 0 && p <= 100 {
+			t.Progress = p
+		}
+		setState(t, state, "")
+	case model.TargetInstalling:
+		t.Progress = 100
+		setState(t, state, "")
+	case model.TargetFailed:
+		detail := strings.Join(msg.Args[1:], " ")
+		if len(detail) > maxDetailLen {
+			detail = detail[:maxDetailLen]
+		}
+		setState(t, state, detail)
+		slog.Warn("firmware update failed", "device", id, "rollout", r.Id.Hex(), "detail", detail)
+	default:
+		slog.Warn("unknown OTASTATUS", "device", id, "state", state)
+		return
+	}
+	if err := m.store.SaveRollout(r); err != nil {
+		slog.Error("saving rollout", "rollout", r.Id.Hex(), "err", err)
+	}
+}
+
+func setState(t *model.RolloutTarget, state model.TargetState, detail string) {
+	t.State, t.Detail = state, detail
+	t.Updated = time.Now().Unix()
+}
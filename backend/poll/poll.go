@@ -0,0 +1,249 @@
+// Package poll lets devices talk to the hub over plain HTTP requests, for
+// those behind NATs and proxies that don't let them keep a WebSocket open.
+//
+// Devices authenticate every request with HTTP basic auth, their id as the
+// user and their provisioning token as the password, and must have been
+// onboarded so that their owner is known. POST /report takes anything a
+// WebSocket device could send, one message per line, e.g.
+// "TELEMETRY temp 21.5". POST /poll waits up to ?wait= seconds for what
+// the hub has for the device and returns it one message per line, or 204
+// if nothing came.
+//
+// A device counts as online until it goes silent for as long as a
+// WebSocket one would, so it should poll again right away.
+package poll
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+const (
+	// Wait of polls that don't say
+	defaultWait = 20 * time.Second
+	// Most messages returned by a single poll
+	maxBatch = 64
+	// Largest report
+	maxReportSize = 16 << 10
+)
+
+type Server struct {
+	hub *ws.Hub
+
+	// Attached devices by id
+	devices map[string]*device
+	mx      sync.Mutex
+}
+
+type device struct {
+	id   string
+	conn *ws.Conn
+	// Whether a poll is waiting, only one may at a time
+	polling bool
+}
+
+// The hub needs a Store and a TokenSecret
+func New(hub *ws.Hub) *Server {
+	return &Server{
+		hub:     hub,
+		devices: make(map[string]*device),
+	}
+}
+
+// Returns the attached device that authenticated r, attaching it if
+// needed, or writes the error and returns nil
+func (s *Server) auth(w http.ResponseWriter, r *http.Request) *device {
+	id, token, ok := r.BasicAuth()
+	if !ok || s.hub.TokenSecret == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+	switch err := s.hub.VerifyToken(id, token); err {
+	case nil:
+	case ws.ErrUnavailable:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return nil
+	default:
+		slog.Warn("invalid polling token", "device", id, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+	d := s.device(id)
+	if d == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	d.conn.Touch()
+	return d
+}
+
+// Returns the attached device, attaching it if needed
+func (s *Server) device(id string) *device {
+	s.mx.Lock()
+	d := s.devices[id]
+	s.mx.Unlock()
+	if d != nil {
+		return d
+	}
+
+	saved, err := s.hub.Store.FindDevice(id)
+	if err != nil {
+		if err != store.ErrNotFound {
+			slog.Error("finding device", "device", id, "err", err)
+		}
+		return nil
+	}
+
+	d = &device{id: id}
+	// Not holding mx, Attach may close the connection and call back
+	conn, err := s.hub.Attach(id, saved.Owner, ws.TextCodec, func() { s.forget(d) })
+	if err != nil {
+		slog.Warn("attaching polling device", "device", id, "err", err)
+		return nil
+	}
+	d.conn = conn
+	s.mx.Lock()
+	s.devices[id] = d
+	s.mx.Unlock()
+	return d
+}
+
+func (s *Server) forget(d *device) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.devices[d.id] == d {
+		delete(s.devices, d.id)
+	}
+}
+
+// Hands each line of the body to the hub as a message from the device.
+// A bare HELLO just marks it as seen.
+func (s *Server) ReportHandler(w http.ResponseWriter, r *http.Request) {
+	d := s.auth(w, r)
+	if d == nil {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxReportSize+1))
+	if err != nil || len(body) > maxReportSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, maxReportSize)
+	for scanner.Scan() {
+		msg := strings.TrimSpace(scanner.Text())
+		if msg == "" || strings.HasPrefix(msg, model.RespHello) {
+			continue
+		}
+		d.conn.Receive([]byte(msg))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Waits for what the hub has for the device and writes it, one message per
+// line. Answers 409 if the device is already polling.
+func (s *Server) PollHandler(w http.ResponseWriter, r *http.Request) {
+	d := s.auth(w, r)
+	if d == nil {
+		return
+	}
+	wait := defaultWait
+	if v := r.URL.Query().Get("wait"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		wait = time.Duration(n) * time.Second
+	}
+	// Returning before the device would count as gone
+	if p := d.conn.PingPeriod(); wait > p {
+		wait = p
+	}
+
+	s.mx.Lock()
+	busy := d.polling
+	d.polling = true
+	s.mx.Unlock()
+	if busy {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	defer func() {
+		s.mx.Lock()
+		d.polling = false
+		s.mx.Unlock()
+		d.conn.Touch()
+	}()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var batch []*ws.Message
+	select {
+	case msg, ok := <-d.conn.Send:
+		if !ok {
+			// Closed meanwhile, the next request attaches it again
+			d.conn.Close()
+			s.forget(d)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		batch = append(batch, msg)
+	case <-timer.C:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	// Whatever else is queued goes along
+	for len(batch) < maxBatch {
+		msg, ok := d.next()
+		if !ok {
+			break
+		}
+		batch = append(batch, msg)
+	}
+
+	var buf bytes.Buffer
+	written := batch[:0]
+	for _, msg := range batch {
+		data, err := ws.TextCodec.Encode(msg)
+		if err != nil {
+			slog.Error("encoding message", "device", d.id, "err", err)
+			d.conn.Sent(msg, err)
+			continue
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+		written = append(written, msg)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		slog.Info("sending polled messages", "device", d.id, "err", err)
+	}
+	for _, msg := range written {
+		d.conn.Sent(msg, err)
+	}
+}
+
+// Returns the next queued message without waiting
+func (d *device) next() (*ws.Message, bool) {
+	select {
+	case msg, ok := <-d.conn.Send:
+		return msg, ok
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,264 @@
+// Package presence tells whether devices are online, stale or offline,
+// records when that changes and announces it as hub events. Each node
+// tracks the devices connected to it.
+package presence
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+const (
+	// How often devices are checked
+	sweepPeriod = 5 * time.Second
+	// How often the LastSeen of connected devices is saved
+	persistPeriod = time.Minute
+	// Events waiting to be handled before new ones are dropped
+	jobQueueSize = 256
+	// Timeout of asking the cluster where a device went
+	lookupTimeout = 5 * time.Second
+)
+
+type Config struct {
+	// How long past its ping period a connected device may stay silent
+	// before it's stale
+	StaleAfter time.Duration
+	// How long a device that disconnected has to come back before it's
+	// offline, so quick reconnections go unnoticed
+	OfflineAfter time.Duration
+}
+
+var DefaultConfig = Config{
+	StaleAfter:   15 * time.Second,
+	OfflineAfter: 30 * time.Second,
+}
+
+type entry struct {
+	// As of its last event, LastSeen is kept up to date
+	device model.Device
+	state  model.PresenceState
+	// When it disconnected, zero while connected
+	left time.Time
+	// LastSeen as last saved to the store
+	saved int64
+}
+
+type Tracker struct {
+	hub   *ws.Hub
+	store store.Store
+	cfg   Config
+
+	jobs   chan func()
+	quit   chan struct{}
+	unhook func()
+
+	// Guards devices, which holds those connected to this node and those
+	// that left less than OfflineAfter ago
+	mx      sync.Mutex
+	devices map[string]*entry
+}
+
+func New(hub *ws.Hub, st store.Store, cfg Config) *Tracker {
+	if cfg.StaleAfter == 0 {
+		cfg.StaleAfter = DefaultConfig.StaleAfter
+	}
+	if cfg.OfflineAfter == 0 {
+		cfg.OfflineAfter = DefaultConfig.OfflineAfter
+	}
+	return &Tracker{
+		hub:     hub,
+		store:   st,
+		cfg:     cfg,
+		jobs:    make(chan func(), jobQueueSize),
+		quit:    make(chan struct{}),
+		devices: make(map[string]*entry),
+	}
+}
+
+func (t *Tracker) Start() {
+	t.unhook = t.hub.OnEvent(func(ev *ws.Event) {
+		d := ev.Device
+		switch ev.Type {
+		case ws.EventConnected:
+			t.push(func() { t.connected(d) })
+		case ws.EventDisconnected:
+			t.push(func() { t.disconnected(d) })
+		}
+	})
+	go t.run()
+}
+
+func (t *Tracker) Stop() {
+	t.unhook()
+	close(t.quit)
+}
+
+// Hooks can't block, so events are dropped if we fall behind. The sweep
+// notices the devices that left anyway.
+func (t *Tracker) push(job func()) {
+	select {
+	case t.jobs <- job:
+	default:
+		slog.Warn("presence falling behind, dropping event")
+	}
+}
+
+func (t *Tracker) run() {
+	ticker := time.NewTicker(sweepPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case job := <-t.jobs:
+			job()
+		case now := <-ticker.C:
+			t.sweep(now)
+		case <-t.quit:
+			return
+		}
+	}
+}
+
+func (t *Tracker) connected(d *model.Device) {
+	t.mx.Lock()
+	e := t.devices[d.Id]
+	if e == nil {
+		e = &entry{saved: d.LastSeen}
+		t.devices[d.Id] = e
+	}
+	e.device, e.left = *d, time.Time{}
+	changed := e.state != model.PresenceOnline
+	e.state = model.PresenceOnline
+	t.mx.Unlock()
+
+	if changed {
+		t.record(d, model.PresenceOnline)
+	}
+}
+
+// The device only goes offline if it isn't back by the time the sweep
+// looks at it again
+func (t *Tracker) disconnected(d *model.Device) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if e := t.devices[d.Id]; e != nil && e.left.IsZero() {
+		e.device, e.left = *d, time.Now()
+	}
+}
+
+// Finds the devices that went stale, came back or have been gone for long
+// enough to be offline, and saves how recently connected ones were seen
+func (t *Tracker) sweep(now time.Time) {
+	var changed []entry
+	var gone []*model.Device
+	t.mx.Lock()
+	for id, e := range t.devices {
+		if !e.left.IsZero() {
+			if now.Sub(e.left) >= t.cfg.OfflineAfter {
+				delete(t.devices, id)
+				d := e.device
+				gone = append(gone, &d)
+			}
+			continue
+		}
+		conn := t.hub.GetConn(id)
+		if conn == nil {
+			// We missed it leaving
+			e.left = now
+			continue
+		}
+		e.device.LastSeen = atomic.LoadInt64(&conn.Device.LastSeen)
+		state := model.PresenceOnline
+		if now.Sub(time.Unix(e.device.LastSeen, 0)) > conn.PingPeriod()+t.cfg.StaleAfter {
+			state = model.PresenceStale
+		}
+		if state != e.state {
+			e.state = state
+			changed = append(changed, *e)
+		}
+		if e.device.LastSeen-e.saved >= int64(persistPeriod/time.Second) {
+			if err := t.store.SaveLastSeen(id, e.device.LastSeen); err != nil {
+				slog.Error("saving last seen", "device", id, "err", err)
+			} else {
+				e.saved = e.device.LastSeen
+			}
+		}
+	}
+	t.mx.Unlock()
+
+	for i := range changed {
+		t.record(&changed[i].device, changed[i].state)
+	}
+	if len(gone) == 0 {
+		return
+	}
+	// Those that came back to us or another node are tracked there
+	ids := make([]string, len(gone))
+	for i, d := range gone {
+		ids[i] = d.Id
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	remote := t.hub.RemoteOnline(ctx, ids)
+	cancel()
+	for _, d := range gone {
+		if t.hub.GetConn(d.Id) == nil && !remote[d.Id] {
+			t.record(d, model.PresenceOffline)
+		}
+	}
+}
+
+// Saves a change of the presence of d and tells its owner
+func (t *Tracker) record(d *model.Device, state model.PresenceState) {
+	now := time.Now().Unix()
+	err := t.store.InsertPresence(&model.PresenceChange{
+		DeviceId: d.Id,
+		State:    state,
+		Time:     now,
+		LastSeen: d.LastSeen,
+	})
+	if err != nil {
+		slog.Error("recording presence", "device", d.Id, "err", err)
+	}
+	snapshot := *d
+	snapshot.Online = state != model.PresenceOffline
+	t.hub.PublishEvent(&ws.Event{Type: ws.EventPresence, Time: now, Device: &snapshot, State: state})
+	slog.Info("presence changed", "device", d.Id, "state", state)
+}
+
+// Returns the presence of d and when it was last heard from
+func (t *Tracker) State(d *model.Device) (model.PresenceState, int64) {
+	t.mx.Lock()
+	e := t.devices[d.Id]
+	var state model.PresenceState
+	// d may be the one of a live connection
+	lastSeen := atomic.LoadInt64(&d.LastSeen)
+	if e != nil {
+		state, lastSeen = e.state, e.device.LastSeen
+	}
+	t.mx.Unlock()
+
+	if conn := t.hub.GetConn(d.Id); conn != nil {
+		lastSeen = atomic.LoadInt64(&conn.Device.LastSeen)
+		if state == model.PresenceStale {
+			return state, lastSeen
+		}
+		return model.PresenceOnline, lastSeen
+	}
+	if state != "" {
+		// It left, but still has time to come back
+		return state, lastSeen
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	if t.hub.RemoteOnline(ctx, []string{d.Id})[d.Id] {
+		return model.PresenceOnline, lastSeen
+	}
+	return model.PresenceOffline, lastSeen
+}
@@ -0,0 +1,139 @@
+package realip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a proxy may take to send the PROXY header
+const headerTimeout = 5 * time.Second
+
+var ErrBadHeader = errors.New("invalid PROXY protocol header")
+
+// The signature of PROXY protocol v2 headers
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Wraps l so connections from trusted proxies report the client address
+// their PROXY protocol header (v1 or v2) says. Connections from anyone
+// else are left alone. The header is read on the connection's first
+// Read or RemoteAddr, so a slow proxy doesn't hold up Accept.
+func (t Trusted) Listen(l net.Listener) net.Listener {
+	return &listener{Listener: l, trusted: t}
+}
+
+type listener struct {
+	net.Listener
+	trusted Trusted
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := c.RemoteAddr().(*net.TCPAddr); !ok || !l.trusted.Contains(tcp.IP) {
+		return c, nil
+	}
+	return &conn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+type conn struct {
+	net.Conn
+	r    *bufio.Reader
+	once sync.Once
+	// From the header, nil if it was LOCAL or UNKNOWN
+	remote net.Addr
+	err    error
+}
+
+func (c *conn) header() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+		c.remote, c.err = readHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.header()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	c.header()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(v2Signature))
+	if err == nil && bytes.Equal(sig, v2Signature) {
+		return readV2(r)
+	}
+	return readV1(r)
+}
+
+// PROXY TCP4 <src> <dst> <srcport> <dstport>\r\n
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	// At most 107 bytes long
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrBadHeader
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, ErrBadHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, ErrBadHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrBadHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var h [16]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, ErrBadHeader
+	}
+	version, command, family := h[12]>>4, h[12]&0xf, h[13]>>4
+	body := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(r, body); err != nil || version != 2 {
+		return nil, ErrBadHeader
+	}
+	if command == 0 {
+		// LOCAL, the proxy checking on us
+		return nil, nil
+	}
+	switch {
+	case family == 1 && len(body) >= 12:
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case family == 2 && len(body) >= 36:
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// Unix sockets and unknown families, keep the proxy's address
+	return nil, nil
+}
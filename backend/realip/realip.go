@@ -0,0 +1,83 @@
+// Package realip finds the address of clients behind trusted proxies, from
+// the X-Forwarded-For header or the PROXY protocol.
+package realip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Proxies whose word about the client's address is taken. A nil Trusted
+// trusts no one.
+type Trusted []*net.IPNet
+
+// Parses comma separated addresses and CIDR ranges, like
+// "10.0.0.0/8,192.168.1.2"
+func ParseTrusted(s string) (Trusted, error) {
+	var t Trusted
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, n)
+	}
+	return t, nil
+}
+
+func (t Trusted) Contains(ip net.IP) bool {
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the host of addr, or addr if it has no port
+func Host(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Returns the IP of the client that sent r. Requests from trusted proxies
+// are followed back through X-Forwarded-For, from the right, to the first
+// address that isn't a trusted proxy.
+func (t Trusted) ClientIP(r *http.Request) string {
+	ip := Host(r.RemoteAddr)
+	if len(t) == 0 {
+		return ip
+	}
+	hops := r.Header.Values("X-Forwarded-For")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addrs := strings.Split(hops[i], ",")
+		for j := len(addrs) - 1; j >= 0; j-- {
+			parsed := net.ParseIP(ip)
+			if parsed == nil || !t.Contains(parsed) {
+				return ip
+			}
+			next := strings.TrimSpace(addrs[j])
+			if net.ParseIP(next) == nil {
+				// Garbage from the client, the proxy is all we know
+				return ip
+			}
+			ip = next
+		}
+	}
+	return ip
+}
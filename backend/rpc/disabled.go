@@ -0,0 +1,24 @@
+//go:build !grpc
+
+package rpc
+
+import (
+	"errors"
+
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+// Built without the grpc tag, so the binary doesn't need the generated
+// iotpb package. Serve fails, setting grpc_addr needs a build with it.
+type Server struct{}
+
+func New(hub *ws.Hub, st store.Store, token string) *Server {
+	return &Server{}
+}
+
+func (s *Server) Serve(addr string) error {
+	return errors.New("built without gRPC, run go generate ./rpc and build with -tags grpc")
+}
+
+func (s *Server) Stop() {}
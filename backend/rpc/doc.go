@@ -0,0 +1,6 @@
+// Package rpc serves devices to our other services over gRPC, see
+// iot.proto. The generated iotpb package isn't committed: run go generate
+// after changing it, and build with -tags grpc to include the server.
+package rpc
+
+//go:generate protoc --go_out=iotpb --go_opt=paths=source_relative --go-grpc_out=iotpb --go-grpc_opt=paths=source_relative iot.proto
@@ -0,0 +1,290 @@
+//go:build grpc
+
+package rpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/twinone/iot/backend/audit"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/rpc/iotpb"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// How long to wait for a device to answer a function invocation
+const invokeTimeout = 10 * time.Second
+
+type Server struct {
+	iotpb.UnimplementedIoTServer
+
+	hub   *ws.Hub
+	store store.Store
+	// Callers send it as "authorization: Bearer <token>". Users' API keys
+	// are taken too, limited to their scopes and devices.
+	token string
+	srv   *grpc.Server
+}
+
+func New(hub *ws.Hub, st store.Store, token string) *Server {
+	s := &Server{hub: hub, store: st, token: token}
+	s.srv = grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := s.authorize(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := s.authorize(ss.Context())
+			if err != nil {
+				return err
+			}
+			return handler(srv, &stream{ss, ctx})
+		}),
+	)
+	iotpb.RegisterIoTServer(s.srv, s)
+	return s
+}
+
+// Serves on addr until Stop
+func (s *Server) Serve(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("serving gRPC", "addr", addr)
+	return s.srv.Serve(lis)
+}
+
+// Stops taking calls and waits for the ones going on, event streams are
+// cut short
+func (s *Server) Stop() {
+	s.srv.GracefulStop()
+}
+
+// A server stream with the context authorize returned
+type stream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *stream) Context() context.Context { return s.ctx }
+
+type apiKeyContextKey struct{}
+
+// Returns ctx with the API key the call is made with, if any
+func (s *Server) authorize(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		tok := strings.TrimPrefix(v, "Bearer ")
+		if model.IsAPIKey(tok) {
+			k, err := store.FindAPIKey(s.store, tok)
+			if err != nil {
+				if err != store.ErrNotFound {
+					slog.Error("finding API key", "err", err)
+				}
+				continue
+			}
+			if u, err := s.store.FindUserByEmail(k.Owner); err != nil || u.Disabled {
+				continue
+			}
+			return context.WithValue(ctx, apiKeyContextKey{}, k), nil
+		}
+		if s.token != "" && subtle.ConstantTimeCompare([]byte(tok), []byte(s.token)) == 1 {
+			return ctx, nil
+		}
+	}
+	return nil, status.Error(codes.Unauthenticated, "bad token")
+}
+
+// Checks the API key the call is made with, if any, has scope and returns
+// the owner the call is limited to, or owner if there's no key
+func scoped(ctx context.Context, scope model.Scope, owner string) (string, error) {
+	k, _ := ctx.Value(apiKeyContextKey{}).(*model.APIKey)
+	if k == nil {
+		return owner, nil
+	}
+	if !k.Allows(scope) {
+		return "", status.Error(codes.PermissionDenied, "API key lacks scope "+scope)
+	}
+	if owner != "" && owner != k.Owner {
+		return "", status.Error(codes.PermissionDenied, "API key is for another owner")
+	}
+	return k.Owner, nil
+}
+
+func (s *Server) ListDevices(ctx context.Context, req *iotpb.ListDevicesRequest) (*iotpb.ListDevicesResponse, error) {
+	owner, err := scoped(ctx, model.ScopeDevicesRead, req.Owner)
+	if err != nil {
+		return nil, err
+	}
+	if owner == "" {
+		return nil, status.Error(codes.InvalidArgument, "owner required")
+	}
+	live := s.hub.GetDevices(owner)
+	saved, err := s.store.FindDevicesByOwner(owner)
+	if err != nil {
+		slog.Error("finding devices", "owner", owner, "err", err)
+		return nil, status.Error(codes.Internal, "finding devices")
+	}
+
+	res := &iotpb.ListDevicesResponse{}
+	seen := make(map[string]bool, len(live))
+	for _, d := range live {
+		seen[d.Id] = true
+		res.Devices = append(res.Devices, device(d))
+	}
+	var ids []string
+	for _, d := range saved {
+		if !seen[d.Id] {
+			ids = append(ids, d.Id)
+		}
+	}
+	remote := s.hub.RemoteOnline(ctx, ids)
+	for _, d := range saved {
+		if !seen[d.Id] {
+			d.Online = remote[d.Id]
+			res.Devices = append(res.Devices, device(d))
+		}
+	}
+	return res, nil
+}
+
+func (s *Server) InvokeFunction(ctx context.Context, req *iotpb.InvokeFunctionRequest) (*iotpb.InvokeFunctionResponse, error) {
+	user, err := scoped(ctx, model.ScopeDevicesInvoke, "")
+	if err != nil {
+		return nil, err
+	}
+	var d *model.Device
+	if conn := s.hub.GetConn(req.DeviceId); conn != nil {
+		d = conn.Device
+	} else {
+		var err error
+		if d, err = s.store.FindDevice(req.DeviceId); err != nil {
+			if err != store.ErrNotFound {
+				slog.Error("finding device", "device", req.DeviceId, "err", err)
+				return nil, status.Error(codes.Internal, "finding device")
+			}
+			return nil, status.Error(codes.NotFound, "device not found")
+		}
+	}
+	if user != "" && !s.allowed(d, user) {
+		return nil, status.Error(codes.NotFound, "device not found")
+	}
+	f, err := store.FindFunction(s.store, d, req.Function)
+	if err != nil {
+		slog.Error("finding functions", "device", d.Id, "err", err)
+	}
+	if f == nil {
+		return nil, status.Error(codes.NotFound, "function not found")
+	}
+	for _, arg := range req.Args {
+		if arg == "" || strings.ContainsAny(arg, " \t\r\n") {
+			return nil, status.Error(codes.InvalidArgument, "malformed argument")
+		}
+	}
+	if err := f.Validate(req.Args); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ws.WithFunction(ctx, f.Name), invokeTimeout)
+	defer cancel()
+	cmd := f.Command(req.Args)
+	via := "rpc"
+	if k, _ := ctx.Value(apiKeyContextKey{}).(*model.APIKey); k != nil {
+		via = "apikey:" + k.Id.Hex()
+	}
+	audit.Record(audit.WithVia(ctx, via), s.store, user, model.AuditInvoke, d, cmd)
+	resp, err := s.hub.Request(ctx, d.Id, []byte(cmd))
+	switch err {
+	case nil:
+		return &iotpb.InvokeFunctionResponse{Reply: message(resp)}, nil
+	case ws.ErrTimeout:
+		return nil, status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+}
+
+// Whether user may invoke functions on d, as owner or shared with them
+func (s *Server) allowed(d *model.Device, user string) bool {
+	if d.Deleted != 0 {
+		return false
+	}
+	if d.Owner == user {
+		return true
+	}
+	sh, err := s.store.FindShare(d.Id, user)
+	return err == nil && sh.Role.Allows(model.RoleController)
+}
+
+func (s *Server) StreamEvents(req *iotpb.StreamEventsRequest, stream iotpb.IoT_StreamEventsServer) error {
+	owner, err := scoped(stream.Context(), model.ScopeDevicesRead, req.Owner)
+	if err != nil {
+		return err
+	}
+	if owner == "" {
+		return status.Error(codes.InvalidArgument, "owner required")
+	}
+	types := make(map[string]bool, len(req.Types))
+	for _, t := range req.Types {
+		types[t] = true
+	}
+
+	sub := s.hub.Subscribe(owner)
+	defer s.hub.Unsubscribe(sub)
+	for {
+		select {
+		case ev := <-sub.Events:
+			if len(types) > 0 && !types[ev.Type] || req.DeviceId != "" && ev.Device.Id != req.DeviceId {
+				continue
+			}
+			if err := stream.Send(event(ev)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func device(d *model.Device) *iotpb.Device {
+	return &iotpb.Device{
+		Id:       d.Id,
+		Owner:    d.Owner,
+		Tenant:   d.Tenant,
+		Name:     d.Name,
+		Online:   d.Online,
+		LastSeen: d.LastSeen,
+		Model:    d.Model,
+		Firmware: d.Firmware,
+	}
+}
+
+func message(msg *ws.Message) *iotpb.Message {
+	if msg == nil {
+		return nil
+	}
+	return &iotpb.Message{Cmd: msg.Cmd, Args: msg.Args, Payload: msg.Payload}
+}
+
+func event(ev *ws.Event) *iotpb.Event {
+	return &iotpb.Event{
+		Type:    ev.Type,
+		Time:    ev.Time,
+		Device:  device(ev.Device),
+		Message: message(ev.Message),
+		State:   ev.State,
+	}
+}
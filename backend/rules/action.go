@@ -0,0 +1,84 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/twinone/iot/backend/audit"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+var ErrForbidden = errors.New("not allowed to control the device")
+
+// Runs action a on behalf of the user with email owner, sending the command
+// to the device or queueing it if it's offline. Returns the command sent,
+// which is audited as coming from the source in ctx. Actions targeting tags
+// run on every device of owner that has them.
+func Run(ctx context.Context, hub *ws.Hub, st store.Store, owner string, a *model.Action) (string, error) {
+	if a.DeviceId == "" && len(a.Tags) > 0 {
+		return runTagged(ctx, hub, st, owner, a)
+	}
+	var d *model.Device
+	if conn := hub.GetConn(a.DeviceId); conn != nil {
+		d = conn.Device
+	} else {
+		var err error
+		if d, err = st.FindDevice(a.DeviceId); err != nil {
+			return "", err
+		}
+	}
+	if !allowed(st, owner, d.Owner, d.Id, model.RoleController) {
+		return "", ErrForbidden
+	}
+
+	cmd := a.Cmd
+	if a.Function != "" {
+		f, err := store.FindFunction(st, d, a.Function)
+		if f == nil {
+			if err == nil {
+				err = fmt.Errorf("function %q not found", a.Function)
+			}
+			return "", err
+		}
+		if err := f.Validate(a.Args); err != nil {
+			return "", err
+		}
+		cmd = f.Command(a.Args)
+		ctx = ws.WithFunction(ctx, f.Name)
+	}
+
+	audit.Record(ctx, st, owner, model.AuditInvoke, d, cmd)
+	if _, err := hub.SendOrQueue(ctx, d.Id, []byte(cmd)); err != nil {
+		return "", err
+	}
+	return cmd, nil
+}
+
+// Runs a on the devices of owner with its tags. Returns the commands sent,
+// one per device, and the errors of those that failed.
+func runTagged(ctx context.Context, hub *ws.Hub, st store.Store, owner string, a *model.Action) (string, error) {
+	devices, err := st.FindDevicesByOwner(owner)
+	if err != nil {
+		return "", err
+	}
+	var cmds []string
+	var errs []error
+	for _, d := range devices {
+		if !a.Tags.Matches(d) {
+			continue
+		}
+		one := *a
+		one.DeviceId, one.Tags = d.Id, nil
+		cmd, err := Run(ctx, hub, st, owner, &one)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.Id, err))
+			continue
+		}
+		cmds = append(cmds, d.Id+": "+cmd)
+	}
+	return strings.Join(cmds, ", "), errors.Join(errs...)
+}
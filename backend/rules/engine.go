@@ -0,0 +1,218 @@
+// Package rules runs the automations users define: when a device sends a
+// reading or changes state, check a condition and act on another device
+package rules
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/twinone/iot/backend/audit"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Events waiting to be evaluated before new ones are dropped
+	eventQueueSize = 256
+	// How long the rules of a device are cached. Changes made through
+	// this instance invalidate them right away, other instances see them
+	// after this long.
+	cacheTTL = time.Minute
+	// How long an action may take to be sent or queued
+	actionTimeout = 10 * time.Second
+)
+
+// Something that happened on a device
+type event struct {
+	deviceId string
+	owner    string
+	kind     model.TriggerEvent
+	msg      *ws.Message
+}
+
+type cached struct {
+	rules  []*model.Rule
+	loaded time.Time
+}
+
+type Engine struct {
+	hub   *ws.Hub
+	store store.Store
+
+	events chan *event
+	quit   chan struct{}
+	unhook []func()
+
+	mx    sync.Mutex
+	cache map[string]*cached
+
+	// Rules whose condition held the last time, only used by run
+	active map[bson.ObjectId]bool
+
+	// Called after a rule fired with the command sent or the error, may be
+	// nil. Must be set before Start and must not block.
+	OnFire func(r *model.Rule, cmd string, err error)
+}
+
+func New(hub *ws.Hub, st store.Store) *Engine {
+	return &Engine{
+		hub:    hub,
+		store:  st,
+		events: make(chan *event, eventQueueSize),
+		quit:   make(chan struct{}),
+		cache:  make(map[string]*cached),
+		active: make(map[bson.ObjectId]bool),
+	}
+}
+
+// Starts evaluating rules on the events of the hub
+func (e *Engine) Start() {
+	e.unhook = []func(){
+		e.hub.OnMessage(func(d *model.Device, msg *ws.Message) {
+			switch msg.Cmd {
+			case model.RespTelemetry:
+				e.push(&event{deviceId: d.Id, owner: d.Owner, kind: model.TriggerTelemetry, msg: msg})
+			case model.RespReport:
+				e.push(&event{deviceId: d.Id, owner: d.Owner, kind: model.TriggerReport, msg: msg})
+			}
+		}),
+		e.hub.OnConnect(func(d *model.Device) {
+			e.push(&event{deviceId: d.Id, owner: d.Owner, kind: model.TriggerConnected})
+		}),
+		e.hub.OnDisconnect(func(d *model.Device) {
+			e.push(&event{deviceId: d.Id, owner: d.Owner, kind: model.TriggerDisconnected})
+		}),
+		e.hub.OnEvent(func(ev *ws.Event) {
+			if ev.Type == ws.EventWill {
+				e.push(&event{deviceId: ev.Device.Id, owner: ev.Device.Owner, kind: model.TriggerWill, msg: ev.Message})
+			}
+		}),
+	}
+	go e.run()
+}
+
+func (e *Engine) Stop() {
+	for _, f := range e.unhook {
+		f()
+	}
+	close(e.quit)
+}
+
+// Forgets the cached rules of a device, call it after changing them
+func (e *Engine) Invalidate(deviceId string) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	delete(e.cache, deviceId)
+}
+
+// Hooks can't block, so events are dropped if we fall behind
+func (e *Engine) push(ev *event) {
+	select {
+	case e.events <- ev:
+	default:
+		slog.Warn("rules falling behind, dropping event", "device", ev.deviceId)
+	}
+}
+
+func (e *Engine) run() {
+	for {
+		select {
+		case ev := <-e.events:
+			e.evaluate(ev)
+		case <-e.quit:
+			return
+		}
+	}
+}
+
+func (e *Engine) rules(deviceId string) []*model.Rule {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	if c := e.cache[deviceId]; c != nil && time.Since(c.loaded) < cacheTTL {
+		return c.rules
+	}
+	rules, err := e.store.FindRulesByDevice(deviceId)
+	if err != nil {
+		slog.Error("loading rules", "device", deviceId, "err", err)
+		return nil
+	}
+	e.cache[deviceId] = &cached{rules: rules, loaded: time.Now()}
+	return rules
+}
+
+func (e *Engine) evaluate(ev *event) {
+	rules := e.rules(ev.deviceId)
+	if len(rules) == 0 {
+		return
+	}
+	values := eventValues(ev)
+	for _, r := range rules {
+		if !r.Enabled || r.Trigger.Event != ev.kind {
+			continue
+		}
+		v, ok := values[r.Trigger.Key]
+		if ev.kind == model.TriggerTelemetry || ev.kind == model.TriggerReport ||
+			ev.kind == model.TriggerWill && r.Trigger.Key != "" {
+			if !ok {
+				// The event is about something else
+				continue
+			}
+		}
+		match := r.Condition == nil || r.Condition.Match(v)
+		// Connection events have no state, they fire every time
+		edge := ev.kind == model.TriggerConnected || ev.kind == model.TriggerDisconnected ||
+			ev.kind == model.TriggerWill
+		was := e.active[r.Id]
+		e.active[r.Id] = match && !edge
+		if !match || was {
+			continue
+		}
+		if !allowed(e.store, r.Owner, ev.owner, ev.deviceId, model.RoleViewer) {
+			continue
+		}
+		e.fire(r)
+	}
+}
+
+// Returns the values of the keys a message is about
+func eventValues(ev *event) map[string]string {
+	if ev.msg == nil {
+		return map[string]string{}
+	}
+	return ev.msg.Values()
+}
+
+// Returns true if the user with email owns the device or it's shared with
+// them with at least the role need
+func allowed(st store.Store, email string, owner string, deviceId string, need model.Role) bool {
+	if email == owner {
+		return true
+	}
+	sh, err := st.FindShare(deviceId, email)
+	return err == nil && sh.Role.Allows(need)
+}
+
+// Runs the action of a rule, if it has one
+func (e *Engine) fire(r *model.Rule) {
+	log := slog.With("rule", r.Id.Hex(), "device", r.Action.DeviceId)
+	var cmd string
+	var err error
+	if r.HasAction() {
+		ctx, cancel := context.WithTimeout(audit.WithVia(context.Background(), "rule:"+r.Id.Hex()), actionTimeout)
+		cmd, err = Run(ctx, e.hub, e.store, r.Owner, &r.Action)
+		cancel()
+	}
+	if e.OnFire != nil {
+		e.OnFire(r, cmd, err)
+	}
+	if err != nil {
+		log.Warn("running rule action", "err", err)
+		return
+	}
+	log.Info("rule fired", "name", r.Name, "cmd", cmd)
+}
@@ -0,0 +1,115 @@
+// Package scheduler runs the actions of schedules when they are due. They
+// live in the store, so they survive restarts.
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/twinone/iot/backend/audit"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/rules"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+const (
+	// How often the store is checked for due schedules
+	pollPeriod = 10 * time.Second
+	// How long an action may take to be sent or queued
+	actionTimeout = 10 * time.Second
+)
+
+// Returns the unix time sc runs at next after after, or 0 if it won't
+func Next(sc *model.Schedule, after time.Time) (int64, error) {
+	if sc.Cron == "" {
+		if sc.At > after.Unix() {
+			return sc.At, nil
+		}
+		return 0, nil
+	}
+	loc, err := sc.Location()
+	if err != nil {
+		return 0, err
+	}
+	spec, err := cron.ParseStandard(sc.Cron)
+	if err != nil {
+		return 0, fmt.Errorf("%w: cron: %v", model.ErrInvalidSchedule, err)
+	}
+	next := spec.Next(after.In(loc))
+	if next.IsZero() {
+		return 0, nil
+	}
+	return next.Unix(), nil
+}
+
+// Only one instance of a cluster should run a Scheduler, or due schedules
+// run once per instance
+type Scheduler struct {
+	hub   *ws.Hub
+	store store.Store
+	quit  chan struct{}
+}
+
+func New(hub *ws.Hub, st store.Store) *Scheduler {
+	return &Scheduler{hub: hub, store: st, quit: make(chan struct{})}
+}
+
+func (s *Scheduler) Start() {
+	go s.run()
+}
+
+func (s *Scheduler) Stop() {
+	close(s.quit)
+}
+
+func (s *Scheduler) run() {
+	t := time.NewTicker(pollPeriod)
+	defer t.Stop()
+	for {
+		s.tick(time.Now())
+		select {
+		case <-t.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// Runs what's due at now. Runs missed while the backend was down happen
+// once, then the schedule continues from now.
+func (s *Scheduler) tick(now time.Time) {
+	due, err := s.store.FindDueSchedules(now.Unix())
+	if err != nil {
+		slog.Error("finding due schedules", "err", err)
+		return
+	}
+	for _, sc := range due {
+		log := slog.With("schedule", sc.Id.Hex(), "device", sc.Action.DeviceId)
+		sc.LastRun = now.Unix()
+		sc.LastError = ""
+		ctx, cancel := context.WithTimeout(audit.WithVia(context.Background(), "schedule:"+sc.Id.Hex()), actionTimeout)
+		cmd, err := rules.Run(ctx, s.hub, s.store, sc.Owner, &sc.Action)
+		cancel()
+		if err != nil {
+			log.Warn("running scheduled action", "err", err)
+			sc.LastError = err.Error()
+		} else {
+			log.Info("schedule ran", "name", sc.Name, "cmd", cmd)
+		}
+
+		if sc.Next, err = Next(sc, now); err != nil {
+			sc.LastError = err.Error()
+		}
+		// It may have been removed through the API in the meantime
+		if _, err := s.store.FindSchedule(sc.Id.Hex()); err != nil {
+			continue
+		}
+		if err := s.store.SaveSchedule(sc); err != nil {
+			log.Error("saving schedule", "err", err)
+		}
+	}
+}
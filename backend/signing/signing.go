@@ -0,0 +1,127 @@
+// Package signing lets devices check that commands and firmware updates
+// come from the backend. It signs them with Ed25519 keys, named by the
+// first 8 bytes of the SHA-256 of their public half in hex. Devices are
+// provisioned with a public key and say which one they trust in HELLO.
+//
+// What's signed is the device id, the Unix time and the command in the
+// text protocol, separated by spaces, like "lamp 1700000000 DW 5 HIGH".
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidKey = errors.New("invalid signing key")
+
+type Key struct {
+	Id     string
+	Public ed25519.PublicKey
+	// Nil for keys only used to verify
+	private ed25519.PrivateKey
+}
+
+// Returns a new private key, base64 like ParseKey takes it
+func GenerateKey() (string, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(priv.Seed()), nil
+}
+
+// Parses a private key, the base64 of its 32 byte seed
+func ParseKey(s string) (*Key, error) {
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, ErrInvalidKey
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	k := PublicKey(priv.Public().(ed25519.PublicKey))
+	k.private = priv
+	return k, nil
+}
+
+// Parses a public key in base64
+func ParsePublicKey(s string) (*Key, error) {
+	pub, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, ErrInvalidKey
+	}
+	return PublicKey(pub), nil
+}
+
+func PublicKey(pub ed25519.PublicKey) *Key {
+	sum := sha256.Sum256(pub)
+	return &Key{Id: hex.EncodeToString(sum[:8]), Public: pub}
+}
+
+// The public half in base64
+func (k *Key) Encode() string {
+	return base64.StdEncoding.EncodeToString(k.Public)
+}
+
+// Returns the base64 signature of text for the device with id at t
+func (k *Key) Sign(id string, t time.Time, text []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(k.private, signed(id, t.Unix(), text)))
+}
+
+// Reports whether sig is k's signature of text for the device with id at t
+func (k *Key) Verify(id string, t int64, text []byte, sig string) bool {
+	b, err := base64.StdEncoding.DecodeString(sig)
+	return err == nil && ed25519.Verify(k.Public, signed(id, t, text), b)
+}
+
+func signed(id string, t int64, text []byte) []byte {
+	b := make([]byte, 0, len(id)+len(text)+22)
+	b = append(b, id...)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, t, 10)
+	b = append(b, ' ')
+	return append(b, text...)
+}
+
+// Signs with the current key and still knows the ones it replaced, for
+// devices that haven't moved to it yet
+type Signer struct {
+	keys []*Key
+}
+
+// Returns a signer with the current key and the old ones, all base64 seeds
+func NewSigner(current string, old ...string) (*Signer, error) {
+	s := &Signer{}
+	for _, v := range append([]string{current}, old...) {
+		k, err := ParseKey(v)
+		if err != nil {
+			return nil, err
+		}
+		s.keys = append(s.keys, k)
+	}
+	return s, nil
+}
+
+func (s *Signer) Current() *Key {
+	return s.keys[0]
+}
+
+// Returns the key with id, or nil
+func (s *Signer) Key(id string) *Key {
+	for _, k := range s.keys {
+		if k.Id == id {
+			return k
+		}
+	}
+	return nil
+}
+
+// The current key first
+func (s *Signer) Keys() []*Key {
+	return s.keys
+}
@@ -0,0 +1,1033 @@
+// Package bolt implements store.Store in a single local file using
+// bbolt, for deployments that don't want to run a database server
+package bolt
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	usersBucket        = []byte("users")
+	accessTokensBucket = []byte("accesstokens")
+	// Keyed by provider and subject
+	identitiesBucket = []byte("identities")
+	// Keyed by the hash of the key
+	apiKeysBucket      = []byte("apikeys")
+	devicesBucket      = []byte("devices")
+	functionsBucket    = []byte("functions")
+	queuesBucket       = []byte("queues")
+	shadowsBucket      = []byte("shadows")
+	groupsBucket       = []byte("groups")
+	sharesBucket       = []byte("shares")
+	rulesBucket        = []byte("rules")
+	schedulesBucket    = []byte("schedules")
+	scenesBucket       = []byte("scenes")
+	webhooksBucket     = []byte("webhooks")
+	firmwareBucket     = []byte("firmware")
+	firmwareDataBucket = []byte("firmwaredata")
+	rolloutsBucket     = []byte("rollouts")
+	tenantsBucket      = []byte("tenants")
+	presenceBucket     = []byte("presence")
+	notifyPrefsBucket  = []byte("notifyprefs")
+	// Keyed by id, whose hex sorts by time
+	auditBucket = []byte("audit")
+	// Keyed by historyKey
+	historyBucket = []byte("history")
+)
+
+type Store struct {
+	db *bolt.DB
+}
+
+// Opens or creates the database file at path
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{usersBucket, accessTokensBucket, identitiesBucket, apiKeysBucket, devicesBucket, functionsBucket, queuesBucket, shadowsBucket, groupsBucket, sharesBucket, rulesBucket, schedulesBucket, scenesBucket, webhooksBucket, firmwareBucket, firmwareDataBucket, rolloutsBucket, tenantsBucket, presenceBucket, notifyPrefsBucket, auditBucket, historyBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// The file is local, this only fails once it's closed
+func (s *Store) Ping() error {
+	return s.db.View(func(tx *bolt.Tx) error { return nil })
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Unmarshals the value at key in bucket into v
+func (s *Store) get(bucket []byte, key string, v interface{}) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		if data == nil {
+			return store.ErrNotFound
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+func (s *Store) put(bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+func (s *Store) delete(bucket []byte, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+// Calls fn with every value in bucket, there are no secondary indexes
+// so lookups by owner scan the whole bucket
+func (s *Store) each(bucket []byte, fn func(data []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			return fn(v)
+		})
+	})
+}
+
+// A device as it's stored, with the fields the API doesn't show
+type device struct {
+	*model.Device
+	TokenNonce string `json:"token_nonce,omitempty"`
+}
+
+func unmarshalDevice(data []byte) (*model.Device, error) {
+	sd := &device{Device: &model.Device{}}
+	if err := json.Unmarshal(data, sd); err != nil {
+		return nil, err
+	}
+	sd.Device.TokenNonce = sd.TokenNonce
+	return sd.Device, nil
+}
+
+func (s *Store) FindDevice(id string) (*model.Device, error) {
+	sd := &device{Device: &model.Device{}}
+	if err := s.get(devicesBucket, id, sd); err != nil {
+		return nil, err
+	}
+	sd.Device.TokenNonce = sd.TokenNonce
+	return sd.Device, nil
+}
+
+func (s *Store) FindDevicesByOwner(owner string) ([]*model.Device, error) {
+	return s.findDevices(func(d *model.Device) bool {
+		return d.Owner == owner && d.Deleted == 0
+	})
+}
+
+func (s *Store) FindStaleDevices(seenBefore int64) ([]*model.Device, error) {
+	return s.findDevices(func(d *model.Device) bool {
+		return d.Deleted == 0 && d.LastSeen > 0 && d.LastSeen < seenBefore
+	})
+}
+
+func (s *Store) FindDeletedDevices(owner string, deletedBefore int64) ([]*model.Device, error) {
+	return s.findDevices(func(d *model.Device) bool {
+		return d.Deleted != 0 && d.Deleted < deletedBefore && (owner == "" || d.Owner == owner)
+	})
+}
+
+func (s *Store) findDevices(match func(d *model.Device) bool) ([]*model.Device, error) {
+	var res []*model.Device
+	err := s.each(devicesBucket, func(data []byte) error {
+		d, err := unmarshalDevice(data)
+		if err != nil {
+			return err
+		}
+		if match(d) {
+			res = append(res, d)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) SaveDevice(d *model.Device) error {
+	return s.put(devicesBucket, d.Id, &device{&model.Device{
+		Id:         d.Id,
+		Owner:      d.Owner,
+		Name:       d.Name,
+		Confirmed:  d.Confirmed,
+		LastSeen:   d.LastSeen,
+		QueueSize:  d.QueueSize,
+		QueueTTL:   d.QueueTTL,
+		Overflow:   d.Overflow,
+		Model:      d.Model,
+		Firmware:   d.Firmware,
+		Tags:       d.Tags,
+		Profile:    d.Profile,
+		Timezone:   d.Timezone,
+		Deleted:    d.Deleted,
+		Tenant:     d.Tenant,
+		PublicKey:  d.PublicKey,
+		SigningKey: d.SigningKey,
+	}, d.TokenNonce})
+}
+
+func (s *Store) RemoveDevice(id string) error {
+	return s.delete(devicesBucket, id)
+}
+
+func (s *Store) SaveLastSeen(id string, lastSeen int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(devicesBucket)
+		data := b.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		d, err := unmarshalDevice(data)
+		if err != nil {
+			return err
+		}
+		d.LastSeen = lastSeen
+		data, err = json.Marshal(&device{d, d.TokenNonce})
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+}
+
+// The changes of a device are kept together, newest first
+func (s *Store) FindPresence(deviceId string) ([]*model.PresenceChange, error) {
+	var res []*model.PresenceChange
+	if err := s.get(presenceBucket, deviceId, &res); err != nil && err != store.ErrNotFound {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *Store) InsertPresence(p *model.PresenceChange) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(presenceBucket)
+		var changes []*model.PresenceChange
+		if data := b.Get([]byte(p.DeviceId)); data != nil {
+			if err := json.Unmarshal(data, &changes); err != nil {
+				return err
+			}
+		}
+		changes = append([]*model.PresenceChange{p}, changes...)
+		if len(changes) > store.MaxPresence {
+			changes = changes[:store.MaxPresence]
+		}
+		data, err := json.Marshal(changes)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(p.DeviceId), data)
+	})
+}
+
+// The password hash isn't part of the user's JSON
+type userRecord struct {
+	*model.User
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+func (s *Store) FindUserByEmail(email string) (*model.User, error) {
+	rec := &userRecord{User: &model.User{}}
+	if err := s.get(usersBucket, email, rec); err != nil {
+		return nil, err
+	}
+	rec.User.PasswordHash = rec.PasswordHash
+	return rec.User, nil
+}
+
+func (s *Store) InsertUser(u *model.User) error {
+	return s.put(usersBucket, u.Email, &userRecord{User: u, PasswordHash: u.PasswordHash})
+}
+
+func (s *Store) SaveUserTenant(email string, tenant string) error {
+	u, err := s.FindUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	u.Tenant = tenant
+	return s.InsertUser(u)
+}
+
+func (s *Store) SaveUserDisabled(email string, disabled bool) error {
+	u, err := s.FindUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	u.Disabled = disabled
+	return s.InsertUser(u)
+}
+
+func (s *Store) FindUserByAccessToken(token string) (*model.User, error) {
+	t := &model.AccessToken{}
+	if err := s.get(accessTokensBucket, token, t); err != nil {
+		return nil, err
+	}
+	return s.FindUserByEmail(t.Email)
+}
+
+func (s *Store) InsertAccessToken(t *model.AccessToken) error {
+	return s.put(accessTokensBucket, t.Token, t)
+}
+
+func (s *Store) RemoveAccessToken(token string) error {
+	return s.delete(accessTokensBucket, token)
+}
+
+func identityKey(provider string, subject string) string {
+	return provider + "\x00" + subject
+}
+
+func (s *Store) FindIdentity(provider string, subject string) (*model.Identity, error) {
+	id := &model.Identity{}
+	if err := s.get(identitiesBucket, identityKey(provider, subject), id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+func (s *Store) FindIdentitiesByUser(email string) ([]*model.Identity, error) {
+	var res []*model.Identity
+	err := s.each(identitiesBucket, func(data []byte) error {
+		id := &model.Identity{}
+		if err := json.Unmarshal(data, id); err != nil {
+			return err
+		}
+		if id.Email == email {
+			res = append(res, id)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) InsertIdentity(id *model.Identity) error {
+	return s.put(identitiesBucket, identityKey(id.Provider, id.Subject), id)
+}
+
+func (s *Store) RemoveIdentity(email string, provider string) error {
+	ids, err := s.FindIdentitiesByUser(email)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id.Provider == provider {
+			return s.delete(identitiesBucket, identityKey(id.Provider, id.Subject))
+		}
+	}
+	return store.ErrNotFound
+}
+
+// The hash isn't part of the key's JSON
+type apiKeyRecord struct {
+	*model.APIKey
+	Hash string `json:"hash"`
+}
+
+func (s *Store) FindAPIKeyByHash(hash string) (*model.APIKey, error) {
+	rec := &apiKeyRecord{APIKey: &model.APIKey{}}
+	if err := s.get(apiKeysBucket, hash, rec); err != nil {
+		return nil, err
+	}
+	rec.APIKey.Hash = rec.Hash
+	return rec.APIKey, nil
+}
+
+func (s *Store) FindAPIKeysByOwner(owner string) ([]*model.APIKey, error) {
+	var res []*model.APIKey
+	err := s.each(apiKeysBucket, func(data []byte) error {
+		rec := &apiKeyRecord{APIKey: &model.APIKey{}}
+		if err := json.Unmarshal(data, rec); err != nil {
+			return err
+		}
+		if rec.Owner == owner {
+			rec.APIKey.Hash = rec.Hash
+			res = append(res, rec.APIKey)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) InsertAPIKey(k *model.APIKey) (string, error) {
+	k.Id = bson.NewObjectId()
+	if err := s.put(apiKeysBucket, k.Hash, &apiKeyRecord{APIKey: k, Hash: k.Hash}); err != nil {
+		return "", err
+	}
+	return k.Id.Hex(), nil
+}
+
+func (s *Store) RemoveAPIKey(id string, owner string) error {
+	keys, err := s.FindAPIKeysByOwner(owner)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if k.Id.Hex() == id {
+			return s.delete(apiKeysBucket, k.Hash)
+		}
+	}
+	return store.ErrNotFound
+}
+
+func (s *Store) FindFunctionsByOwner(owner string) ([]*model.Function, error) {
+	var res []*model.Function
+	err := s.each(functionsBucket, func(data []byte) error {
+		f := &model.Function{}
+		if err := json.Unmarshal(data, f); err != nil {
+			return err
+		}
+		if f.Owner == owner {
+			res = append(res, f)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) InsertFunction(f *model.Function) (string, error) {
+	f.Id = bson.NewObjectId()
+	if err := s.put(functionsBucket, f.Id.Hex(), f); err != nil {
+		return "", err
+	}
+	return f.Id.Hex(), nil
+}
+
+func (s *Store) RemoveFunction(id string, owner string) error {
+	f := &model.Function{}
+	if err := s.get(functionsBucket, id, f); err != nil {
+		return err
+	}
+	if f.Owner != owner {
+		return store.ErrNotFound
+	}
+	return s.delete(functionsBucket, id)
+}
+
+func (s *Store) FindQueue(deviceId string) ([]*model.QueuedMessage, error) {
+	var q []*model.QueuedMessage
+	if err := s.get(queuesBucket, deviceId, &q); err != nil && err != store.ErrNotFound {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (s *Store) SaveQueue(deviceId string, q []*model.QueuedMessage) error {
+	if len(q) == 0 {
+		return s.delete(queuesBucket, deviceId)
+	}
+	return s.put(queuesBucket, deviceId, q)
+}
+
+func (s *Store) FindShadow(deviceId string) (*model.Shadow, error) {
+	sh := &model.Shadow{}
+	if err := s.get(shadowsBucket, deviceId, sh); err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
+
+func (s *Store) SaveShadow(sh *model.Shadow) error {
+	return s.put(shadowsBucket, sh.DeviceId, sh)
+}
+
+func (s *Store) FindGroup(id string) (*model.Group, error) {
+	g := &model.Group{}
+	if err := s.get(groupsBucket, id, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (s *Store) FindGroupsByOwner(owner string) ([]*model.Group, error) {
+	var res []*model.Group
+	err := s.each(groupsBucket, func(data []byte) error {
+		g := &model.Group{}
+		if err := json.Unmarshal(data, g); err != nil {
+			return err
+		}
+		if g.Owner == owner {
+			res = append(res, g)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) InsertGroup(g *model.Group) (string, error) {
+	g.Id = bson.NewObjectId()
+	if err := s.put(groupsBucket, g.Id.Hex(), g); err != nil {
+		return "", err
+	}
+	return g.Id.Hex(), nil
+}
+
+func (s *Store) SaveGroup(g *model.Group) error {
+	return s.put(groupsBucket, g.Id.Hex(), g)
+}
+
+func (s *Store) RemoveGroup(id string, owner string) error {
+	g, err := s.FindGroup(id)
+	if err != nil {
+		return err
+	}
+	if g.Owner != owner {
+		return store.ErrNotFound
+	}
+	return s.delete(groupsBucket, id)
+}
+
+func shareKey(deviceId string, email string) string {
+	return deviceId + "\x00" + email
+}
+
+func (s *Store) FindShare(deviceId string, email string) (*model.Share, error) {
+	sh := &model.Share{}
+	if err := s.get(sharesBucket, shareKey(deviceId, email), sh); err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
+
+// Returns the shares for which match returns true
+func (s *Store) findShares(match func(sh *model.Share) bool) ([]*model.Share, error) {
+	var res []*model.Share
+	err := s.each(sharesBucket, func(data []byte) error {
+		sh := &model.Share{}
+		if err := json.Unmarshal(data, sh); err != nil {
+			return err
+		}
+		if match(sh) {
+			res = append(res, sh)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) FindSharesByDevice(deviceId string) ([]*model.Share, error) {
+	return s.findShares(func(sh *model.Share) bool { return sh.DeviceId == deviceId })
+}
+
+func (s *Store) FindSharesByUser(email string) ([]*model.Share, error) {
+	return s.findShares(func(sh *model.Share) bool { return sh.Email == email })
+}
+
+func (s *Store) SaveShare(sh *model.Share) error {
+	return s.put(sharesBucket, shareKey(sh.DeviceId, sh.Email), sh)
+}
+
+func (s *Store) RemoveShare(deviceId string, email string) error {
+	return s.delete(sharesBucket, shareKey(deviceId, email))
+}
+
+func (s *Store) FindRule(id string) (*model.Rule, error) {
+	r := &model.Rule{}
+	if err := s.get(rulesBucket, id, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s *Store) findRules(match func(r *model.Rule) bool) ([]*model.Rule, error) {
+	var res []*model.Rule
+	err := s.each(rulesBucket, func(data []byte) error {
+		r := &model.Rule{}
+		if err := json.Unmarshal(data, r); err != nil {
+			return err
+		}
+		if match(r) {
+			res = append(res, r)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) FindRulesByOwner(owner string) ([]*model.Rule, error) {
+	return s.findRules(func(r *model.Rule) bool { return r.Owner == owner })
+}
+
+func (s *Store) FindRulesByDevice(deviceId string) ([]*model.Rule, error) {
+	return s.findRules(func(r *model.Rule) bool { return r.Trigger.DeviceId == deviceId })
+}
+
+func (s *Store) InsertRule(r *model.Rule) (string, error) {
+	r.Id = bson.NewObjectId()
+	if err := s.put(rulesBucket, r.Id.Hex(), r); err != nil {
+		return "", err
+	}
+	return r.Id.Hex(), nil
+}
+
+func (s *Store) SaveRule(r *model.Rule) error {
+	return s.put(rulesBucket, r.Id.Hex(), r)
+}
+
+func (s *Store) RemoveRule(id string, owner string) error {
+	r, err := s.FindRule(id)
+	if err != nil {
+		return err
+	}
+	if r.Owner != owner {
+		return store.ErrNotFound
+	}
+	return s.delete(rulesBucket, id)
+}
+
+func (s *Store) FindSchedule(id string) (*model.Schedule, error) {
+	sc := &model.Schedule{}
+	if err := s.get(schedulesBucket, id, sc); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (s *Store) findSchedules(match func(sc *model.Schedule) bool) ([]*model.Schedule, error) {
+	var res []*model.Schedule
+	err := s.each(schedulesBucket, func(data []byte) error {
+		sc := &model.Schedule{}
+		if err := json.Unmarshal(data, sc); err != nil {
+			return err
+		}
+		if match(sc) {
+			res = append(res, sc)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) FindSchedulesByOwner(owner string) ([]*model.Schedule, error) {
+	return s.findSchedules(func(sc *model.Schedule) bool { return sc.Owner == owner })
+}
+
+func (s *Store) FindDueSchedules(now int64) ([]*model.Schedule, error) {
+	return s.findSchedules(func(sc *model.Schedule) bool {
+		return sc.Enabled && sc.Next > 0 && sc.Next <= now
+	})
+}
+
+func (s *Store) InsertSchedule(sc *model.Schedule) (string, error) {
+	sc.Id = bson.NewObjectId()
+	if err := s.put(schedulesBucket, sc.Id.Hex(), sc); err != nil {
+		return "", err
+	}
+	return sc.Id.Hex(), nil
+}
+
+func (s *Store) SaveSchedule(sc *model.Schedule) error {
+	return s.put(schedulesBucket, sc.Id.Hex(), sc)
+}
+
+func (s *Store) RemoveSchedule(id string, owner string) error {
+	sc, err := s.FindSchedule(id)
+	if err != nil {
+		return err
+	}
+	if sc.Owner != owner {
+		return store.ErrNotFound
+	}
+	return s.delete(schedulesBucket, id)
+}
+
+func (s *Store) FindScene(id string) (*model.Scene, error) {
+	sc := &model.Scene{}
+	if err := s.get(scenesBucket, id, sc); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (s *Store) FindScenesByOwner(owner string) ([]*model.Scene, error) {
+	var res []*model.Scene
+	err := s.each(scenesBucket, func(data []byte) error {
+		sc := &model.Scene{}
+		if err := json.Unmarshal(data, sc); err != nil {
+			return err
+		}
+		if sc.Owner == owner {
+			res = append(res, sc)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) InsertScene(sc *model.Scene) (string, error) {
+	sc.Id = bson.NewObjectId()
+	if err := s.put(scenesBucket, sc.Id.Hex(), sc); err != nil {
+		return "", err
+	}
+	return sc.Id.Hex(), nil
+}
+
+func (s *Store) SaveScene(sc *model.Scene) error {
+	return s.put(scenesBucket, sc.Id.Hex(), sc)
+}
+
+func (s *Store) RemoveScene(id string, owner string) error {
+	sc, err := s.FindScene(id)
+	if err != nil {
+		return err
+	}
+	if sc.Owner != owner {
+		return store.ErrNotFound
+	}
+	return s.delete(scenesBucket, id)
+}
+
+func (s *Store) FindWebhook(id string) (*model.Webhook, error) {
+	wh := &model.Webhook{}
+	if err := s.get(webhooksBucket, id, wh); err != nil {
+		return nil, err
+	}
+	return wh, nil
+}
+
+func (s *Store) FindWebhooksByOwner(owner string) ([]*model.Webhook, error) {
+	var res []*model.Webhook
+	err := s.each(webhooksBucket, func(data []byte) error {
+		wh := &model.Webhook{}
+		if err := json.Unmarshal(data, wh); err != nil {
+			return err
+		}
+		if wh.Owner == owner {
+			res = append(res, wh)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) InsertWebhook(wh *model.Webhook) (string, error) {
+	wh.Id = bson.NewObjectId()
+	if err := s.put(webhooksBucket, wh.Id.Hex(), wh); err != nil {
+		return "", err
+	}
+	return wh.Id.Hex(), nil
+}
+
+func (s *Store) SaveWebhook(wh *model.Webhook) error {
+	return s.put(webhooksBucket, wh.Id.Hex(), wh)
+}
+
+func (s *Store) RemoveWebhook(id string, owner string) error {
+	wh, err := s.FindWebhook(id)
+	if err != nil {
+		return err
+	}
+	if wh.Owner != owner {
+		return store.ErrNotFound
+	}
+	return s.delete(webhooksBucket, id)
+}
+
+func (s *Store) FindFirmware(id string) (*model.Firmware, error) {
+	f := &model.Firmware{}
+	if err := s.get(firmwareBucket, id, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *Store) FindFirmwaresByOwner(owner string) ([]*model.Firmware, error) {
+	var res []*model.Firmware
+	err := s.each(firmwareBucket, func(data []byte) error {
+		f := &model.Firmware{}
+		if err := json.Unmarshal(data, f); err != nil {
+			return err
+		}
+		if f.Owner == owner {
+			res = append(res, f)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) InsertFirmware(f *model.Firmware, data []byte) (string, error) {
+	f.Id = bson.NewObjectId()
+	meta, err := json.Marshal(f)
+	if err != nil {
+		return "", err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(firmwareDataBucket).Put([]byte(f.Id.Hex()), data); err != nil {
+			return err
+		}
+		return tx.Bucket(firmwareBucket).Put([]byte(f.Id.Hex()), meta)
+	})
+	if err != nil {
+		return "", err
+	}
+	return f.Id.Hex(), nil
+}
+
+func (s *Store) FindFirmwareData(id string) ([]byte, error) {
+	var res []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(firmwareDataBucket).Get([]byte(id))
+		if data == nil {
+			return store.ErrNotFound
+		}
+		// Only valid during the transaction
+		res = append([]byte(nil), data...)
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) RemoveFirmware(id string, owner string) error {
+	f, err := s.FindFirmware(id)
+	if err != nil {
+		return err
+	}
+	if f.Owner != owner {
+		return store.ErrNotFound
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(firmwareDataBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		return tx.Bucket(firmwareBucket).Delete([]byte(id))
+	})
+}
+
+func (s *Store) FindRollout(id string) (*model.Rollout, error) {
+	r := &model.Rollout{}
+	if err := s.get(rolloutsBucket, id, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s *Store) FindRolloutsByOwner(owner string) ([]*model.Rollout, error) {
+	var res []*model.Rollout
+	err := s.each(rolloutsBucket, func(data []byte) error {
+		r := &model.Rollout{}
+		if err := json.Unmarshal(data, r); err != nil {
+			return err
+		}
+		if r.Owner == owner {
+			res = append(res, r)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) InsertRollout(r *model.Rollout) (string, error) {
+	r.Id = bson.NewObjectId()
+	if err := s.put(rolloutsBucket, r.Id.Hex(), r); err != nil {
+		return "", err
+	}
+	return r.Id.Hex(), nil
+}
+
+func (s *Store) SaveRollout(r *model.Rollout) error {
+	return s.put(rolloutsBucket, r.Id.Hex(), r)
+}
+
+// The email isn't part of the JSON of the preferences, it's the key
+func (s *Store) FindNotificationPrefs(email string) (*model.NotificationPrefs, error) {
+	p := &model.NotificationPrefs{}
+	if err := s.get(notifyPrefsBucket, email, p); err != nil {
+		return nil, err
+	}
+	p.Email = email
+	return p, nil
+}
+
+func (s *Store) SaveNotificationPrefs(p *model.NotificationPrefs) error {
+	return s.put(notifyPrefsBucket, p.Email, p)
+}
+
+// The device id and the entry's id, so the history of a device is
+// together and in order
+func historyKey(deviceId string, id bson.ObjectId) []byte {
+	return []byte(deviceId + "\x00" + id.Hex())
+}
+
+// Walks the history of the device back from the newest entry, or from
+// q.Before
+func (s *Store) FindHistory(q *model.HistoryQuery) ([]*model.HistoryEntry, error) {
+	prefix := []byte(q.DeviceId + "\x00")
+	var res []*model.HistoryEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBucket).Cursor()
+		// Right past the newest entry of the device
+		end := []byte(q.DeviceId + "\x01")
+		if q.Before != "" {
+			end = historyKey(q.DeviceId, q.Before)
+		}
+		k, v := c.Seek(end)
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefix) && (q.Limit == 0 || len(res) < q.Limit); k, v = c.Prev() {
+			e := &model.HistoryEntry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			if q.Matches(e) {
+				res = append(res, e)
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) InsertHistory(e *model.HistoryEntry) error {
+	e.Id = bson.NewObjectId()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	prefix := []byte(e.DeviceId + "\x00")
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		if err := b.Put(historyKey(e.DeviceId, e.Id), data); err != nil {
+			return err
+		}
+		n := 0
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			n++
+		}
+		// The oldest is always the first one
+		for ; n > store.MaxHistory; n-- {
+			k, _ := c.Seek(prefix)
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) PruneHistory(before int64) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		var old [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			e := &model.HistoryEntry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			if e.Time < before {
+				old = append(old, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Deleting while iterating skips keys
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(old)
+		return nil
+	})
+	return n, err
+}
+
+func (s *Store) InsertAudit(e *model.AuditEntry) error {
+	e.Id = bson.NewObjectId()
+	return s.put(auditBucket, e.Id.Hex(), e)
+}
+
+// Walks the log back from the newest entry, or from q.Before
+func (s *Store) FindAudit(q *model.AuditQuery) ([]*model.AuditEntry, error) {
+	var res []*model.AuditEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(auditBucket).Cursor()
+		k, v := c.Last()
+		if q.Before != "" {
+			if k, v = c.Seek([]byte(q.Before.Hex())); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		for ; k != nil && (q.Limit == 0 || len(res) < q.Limit); k, v = c.Prev() {
+			e := &model.AuditEntry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			if q.Since != 0 && e.Time < q.Since {
+				// Older ones can't match either
+				break
+			}
+			if q.Matches(e) {
+				res = append(res, e)
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) FindTenant(id string) (*model.Tenant, error) {
+	t := &model.Tenant{}
+	if err := s.get(tenantsBucket, id, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *Store) FindTenants() ([]*model.Tenant, error) {
+	var res []*model.Tenant
+	err := s.each(tenantsBucket, func(data []byte) error {
+		t := &model.Tenant{}
+		if err := json.Unmarshal(data, t); err != nil {
+			return err
+		}
+		res = append(res, t)
+		return nil
+	})
+	return res, err
+}
+
+func (s *Store) SaveTenant(t *model.Tenant) error {
+	return s.put(tenantsBucket, t.Id, t)
+}
+
+func (s *Store) RemoveTenant(id string) error {
+	if _, err := s.FindTenant(id); err != nil {
+		return err
+	}
+	return s.delete(tenantsBucket, id)
+}
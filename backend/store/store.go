@@ -0,0 +1,255 @@
+// Package store defines how the backend persists devices, users and
+// functions, so that it can run on top of different databases.
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Presence changes kept per device, older ones are dropped
+const MaxPresence = 100
+
+// Commands kept in the history of each device, older ones are dropped
+const MaxHistory = 1000
+
+type Store interface {
+	// Devices are identified by their id alone. Deleted ones are found by
+	// id only.
+	FindDevice(id string) (*model.Device, error)
+	FindDevicesByOwner(owner string) ([]*model.Device, error)
+	// Devices that aren't deleted and were seen, but not since seenBefore
+	FindStaleDevices(seenBefore int64) ([]*model.Device, error)
+	// Devices of owner, or anyone if empty, deleted before deletedBefore
+	FindDeletedDevices(owner string, deletedBefore int64) ([]*model.Device, error)
+	// Inserts or replaces the persistent fields of a device
+	SaveDevice(d *model.Device) error
+	RemoveDevice(id string) error
+	// Updates when a device was last heard from, nothing if it isn't known
+	SaveLastSeen(id string, lastSeen int64) error
+
+	// Changes of the presence of a device, newest first
+	FindPresence(deviceId string) ([]*model.PresenceChange, error)
+	// Records a change, dropping the oldest beyond MaxPresence
+	InsertPresence(p *model.PresenceChange) error
+
+	FindUserByEmail(email string) (*model.User, error)
+	InsertUser(u *model.User) error
+	// Moves a user to another tenant, "" for the default one
+	SaveUserTenant(email string, tenant string) error
+	// Disables a user or enables them again
+	SaveUserDisabled(email string, disabled bool) error
+
+	FindIdentity(provider string, subject string) (*model.Identity, error)
+	FindIdentitiesByUser(email string) ([]*model.Identity, error)
+	InsertIdentity(id *model.Identity) error
+	RemoveIdentity(email string, provider string) error
+
+	FindTenant(id string) (*model.Tenant, error)
+	FindTenants() ([]*model.Tenant, error)
+	// Inserts or replaces a tenant
+	SaveTenant(t *model.Tenant) error
+	RemoveTenant(id string) error
+
+	// API keys are looked up by the hash of the key, see model.HashAPIKey
+	FindAPIKeyByHash(hash string) (*model.APIKey, error)
+	FindAPIKeysByOwner(owner string) ([]*model.APIKey, error)
+	// Returns the id of the new key
+	InsertAPIKey(k *model.APIKey) (string, error)
+	RemoveAPIKey(id string, owner string) error
+
+	FindUserByAccessToken(token string) (*model.User, error)
+	InsertAccessToken(t *model.AccessToken) error
+	RemoveAccessToken(token string) error
+
+	FindFunctionsByOwner(owner string) ([]*model.Function, error)
+	// Returns the id of the new function
+	InsertFunction(f *model.Function) (string, error)
+	RemoveFunction(id string, owner string) error
+
+	// Commands queued for an offline device, oldest first
+	FindQueue(deviceId string) ([]*model.QueuedMessage, error)
+	// Replaces the queue of a device, an empty one removes it
+	SaveQueue(deviceId string, q []*model.QueuedMessage) error
+
+	FindShadow(deviceId string) (*model.Shadow, error)
+	SaveShadow(s *model.Shadow) error
+
+	FindGroup(id string) (*model.Group, error)
+	FindGroupsByOwner(owner string) ([]*model.Group, error)
+	// Returns the id of the new group
+	InsertGroup(g *model.Group) (string, error)
+	// Replaces the name and members of an existing group
+	SaveGroup(g *model.Group) error
+	RemoveGroup(id string, owner string) error
+
+	FindShare(deviceId string, email string) (*model.Share, error)
+	FindSharesByDevice(deviceId string) ([]*model.Share, error)
+	FindSharesByUser(email string) ([]*model.Share, error)
+	// Inserts or replaces the share of a device with a user
+	SaveShare(s *model.Share) error
+	RemoveShare(deviceId string, email string) error
+
+	FindRule(id string) (*model.Rule, error)
+	FindRulesByOwner(owner string) ([]*model.Rule, error)
+	// Rules triggered by the device with deviceId
+	FindRulesByDevice(deviceId string) ([]*model.Rule, error)
+	// Returns the id of the new rule
+	InsertRule(r *model.Rule) (string, error)
+	// Replaces an existing rule
+	SaveRule(r *model.Rule) error
+	RemoveRule(id string, owner string) error
+
+	FindSchedule(id string) (*model.Schedule, error)
+	FindSchedulesByOwner(owner string) ([]*model.Schedule, error)
+	// Enabled schedules whose next run is at or before now
+	FindDueSchedules(now int64) ([]*model.Schedule, error)
+	// Returns the id of the new schedule
+	InsertSchedule(sc *model.Schedule) (string, error)
+	// Replaces an existing schedule
+	SaveSchedule(sc *model.Schedule) error
+	RemoveSchedule(id string, owner string) error
+
+	FindScene(id string) (*model.Scene, error)
+	FindScenesByOwner(owner string) ([]*model.Scene, error)
+	// Returns the id of the new scene
+	InsertScene(sc *model.Scene) (string, error)
+	// Replaces an existing scene
+	SaveScene(sc *model.Scene) error
+	RemoveScene(id string, owner string) error
+
+	FindWebhook(id string) (*model.Webhook, error)
+	FindWebhooksByOwner(owner string) ([]*model.Webhook, error)
+	// Returns the id of the new webhook
+	InsertWebhook(wh *model.Webhook) (string, error)
+	// Replaces an existing webhook
+	SaveWebhook(wh *model.Webhook) error
+	RemoveWebhook(id string, owner string) error
+
+	FindFirmware(id string) (*model.Firmware, error)
+	FindFirmwaresByOwner(owner string) ([]*model.Firmware, error)
+	// Stores f and its image, returns the id of the new firmware
+	InsertFirmware(f *model.Firmware, data []byte) (string, error)
+	// Returns the image of the firmware with id
+	FindFirmwareData(id string) ([]byte, error)
+	RemoveFirmware(id string, owner string) error
+
+	FindRollout(id string) (*model.Rollout, error)
+	FindRolloutsByOwner(owner string) ([]*model.Rollout, error)
+	// Returns the id of the new rollout
+	InsertRollout(r *model.Rollout) (string, error)
+	// Replaces an existing rollout and the state of its targets
+	SaveRollout(r *model.Rollout) error
+
+	// How the user with email wants to be notified
+	FindNotificationPrefs(email string) (*model.NotificationPrefs, error)
+	// Inserts or replaces the preferences of p.Email
+	SaveNotificationPrefs(p *model.NotificationPrefs) error
+
+	// Commands sent to a device matching q, newest first, at most q.Limit
+	// unless it's 0
+	FindHistory(q *model.HistoryQuery) ([]*model.HistoryEntry, error)
+	// Records a command, dropping the oldest of its device beyond MaxHistory
+	InsertHistory(e *model.HistoryEntry) error
+	// Removes commands sent before before, returns how many
+	PruneHistory(before int64) (int, error)
+
+	// Appends e to the audit log, which is never changed or trimmed
+	InsertAudit(e *model.AuditEntry) error
+	// Entries matching q, newest first, at most q.Limit unless it's 0
+	FindAudit(q *model.AuditQuery) ([]*model.AuditEntry, error)
+
+	// Returns an error if the database can't be reached
+	Ping() error
+	Close() error
+}
+
+// Returns the function called name on d, or nil. Functions the owner
+// defined take precedence over the ones the device declared.
+func FindFunction(s Store, d *model.Device, name string) (*model.Function, error) {
+	functions, err := s.FindFunctionsByOwner(d.Owner)
+	for _, f := range functions {
+		if f.DeviceId == d.Id && f.Name == name {
+			return f, nil
+		}
+	}
+	for i := range d.Functions {
+		if d.Functions[i].Name == name {
+			return &d.Functions[i], nil
+		}
+	}
+	return nil, err
+}
+
+// Returns the API key key, ErrNotFound if there's no such key or it
+// expired
+func FindAPIKey(s Store, key string) (*model.APIKey, error) {
+	k, err := s.FindAPIKeyByHash(model.HashAPIKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if k.Expired(time.Now().Unix()) {
+		return nil, ErrNotFound
+	}
+	return k, nil
+}
+
+// Removes d for good, with its offline queue, shares and group memberships
+func PurgeDevice(s Store, d *model.Device) error {
+	if err := s.RemoveDevice(d.Id); err != nil {
+		return err
+	}
+	if err := s.SaveQueue(d.Id, nil); err != nil {
+		return err
+	}
+	shares, err := s.FindSharesByDevice(d.Id)
+	if err != nil {
+		return err
+	}
+	for _, sh := range shares {
+		if err := s.RemoveShare(sh.DeviceId, sh.Email); err != nil {
+			return err
+		}
+	}
+	groups, err := s.FindGroupsByOwner(d.Owner)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g.Has(d.Id) {
+			g.Remove(d.Id)
+			if err := s.SaveGroup(g); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns every function of d, the ones the owner defined and then those the
+// device declared that aren't overridden by name
+func DeviceFunctions(s Store, d *model.Device) ([]*model.Function, error) {
+	functions, err := s.FindFunctionsByOwner(d.Owner)
+	if err != nil {
+		return nil, err
+	}
+	var res []*model.Function
+	seen := make(map[string]bool)
+	for _, f := range functions {
+		if f.DeviceId == d.Id && !seen[f.Name] {
+			seen[f.Name] = true
+			res = append(res, f)
+		}
+	}
+	for i := range d.Functions {
+		if f := &d.Functions[i]; !seen[f.Name] {
+			seen[f.Name] = true
+			res = append(res, f)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,122 @@
+// Package influx implements telemetry.Store on InfluxDB 1.x through its
+// HTTP API. Points go to the "telemetry" measurement, tagged with the
+// device id and metric.
+package influx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twinone/iot/backend/telemetry"
+)
+
+const measurement = "telemetry"
+
+type Store struct {
+	// e.g. http://localhost:8086
+	addr   string
+	db     string
+	client *http.Client
+}
+
+// Connects to the database in dsn, e.g. "http://localhost:8086/iot"
+func Open(dsn string) (*Store, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db := strings.Trim(u.Path, "/")
+	if db == "" {
+		return nil, fmt.Errorf("no database in influx dsn %q", dsn)
+	}
+	u.Path = ""
+	return &Store{
+		addr:   u.String(),
+		db:     db,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Escapes commas, equal signs and spaces in tag values
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func (s *Store) Write(deviceId string, points []telemetry.Point) error {
+	var buf bytes.Buffer
+	for _, p := range points {
+		fmt.Fprintf(&buf, "%s,device=%s,metric=%s value=%s %d\n", measurement,
+			tagEscaper.Replace(deviceId), tagEscaper.Replace(p.Metric),
+			strconv.FormatFloat(p.Value, 'g', -1, 64), p.Time)
+	}
+	res, err := s.client.Post(s.addr+"/write?precision=s&db="+url.QueryEscape(s.db), "text/plain", &buf)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("influx write: %s: %s", res.Status, body)
+	}
+	return nil
+}
+
+// Quotes a string literal for InfluxQL
+func quote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func (s *Store) Query(deviceId string, metric string, from, to time.Time) ([]telemetry.Point, error) {
+	q := fmt.Sprintf("SELECT metric, value FROM %s WHERE device = %s AND time >= %ds AND time <= %ds",
+		measurement, quote(deviceId), from.Unix(), to.Unix())
+	if metric != "" {
+		q += " AND metric = " + quote(metric)
+	}
+	v := url.Values{"db": {s.db}, "q": {q + " ORDER BY time"}, "epoch": {"s"}}
+	res, err := s.client.Get(s.addr + "/query?" + v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		Results []struct {
+			Error  string `json:"error"`
+			Series []struct {
+				// Columns are time, metric, value
+				Values [][]interface{} `json:"values"`
+			} `json:"series"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	var points []telemetry.Point
+	for _, r := range body.Results {
+		if r.Error != "" {
+			return nil, fmt.Errorf("influx query: %s", r.Error)
+		}
+		for _, series := range r.Series {
+			for _, row := range series.Values {
+				if len(row) != 3 {
+					continue
+				}
+				t, _ := row[0].(float64)
+				m, _ := row[1].(string)
+				val, _ := row[2].(float64)
+				points = append(points, telemetry.Point{Time: int64(t), Metric: m, Value: val})
+			}
+		}
+	}
+	return points, nil
+}
+
+func (s *Store) Close() error {
+	return nil
+}
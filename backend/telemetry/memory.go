@@ -0,0 +1,107 @@
+package telemetry
+
+import (
+	"sync"
+	"time"
+)
+
+// Points kept per device by a Memory store before the oldest are overwritten
+const DefaultRingSize = 4096
+
+// Memory keeps the latest points of every device in a ring buffer.
+// Nothing survives a restart.
+type Memory struct {
+	size  int
+	rings map[string]*ring
+	mx    sync.RWMutex
+}
+
+type ring struct {
+	points []Point
+	// Index of the next write
+	next int
+	full bool
+}
+
+func NewMemory(size int) *Memory {
+	if size <= 0 {
+		size = DefaultRingSize
+	}
+	return &Memory{size: size, rings: make(map[string]*ring)}
+}
+
+func (m *Memory) Write(deviceId string, points []Point) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	r := m.rings[deviceId]
+	if r == nil {
+		r = &ring{points: make([]Point, m.size)}
+		m.rings[deviceId] = r
+	}
+	for _, p := range points {
+		r.points[r.next] = p
+		r.next = (r.next + 1) % m.size
+		if r.next == 0 {
+			r.full = true
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Query(deviceId string, metric string, from, to time.Time) ([]Point, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	r := m.rings[deviceId]
+	if r == nil {
+		return nil, nil
+	}
+	// Oldest first
+	ordered := r.points[:r.next]
+	if r.full {
+		ordered = append(append([]Point{}, r.points[r.next:]...), r.points[:r.next]...)
+	}
+
+	var res []Point
+	for _, p := range ordered {
+		if p.Time >= from.Unix() && p.Time <= to.Unix() && (metric == "" || p.Metric == metric) {
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+func (m *Memory) Prune(before time.Time) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	n := 0
+	for id, r := range m.rings {
+		ordered := r.points[:r.next]
+		if r.full {
+			ordered = append(append([]Point{}, r.points[r.next:]...), r.points[:r.next]...)
+		}
+		kept := &ring{points: make([]Point, m.size)}
+		for _, p := range ordered {
+			if p.Time < before.Unix() {
+				n++
+				continue
+			}
+			kept.points[kept.next] = p
+			kept.next++
+		}
+		if kept.next == 0 {
+			delete(m.rings, id)
+		} else {
+			kept.full = kept.next == m.size
+			kept.next %= m.size
+			m.rings[id] = kept
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,87 @@
+// Package sqlite implements telemetry.Store in a local SQLite file
+package sqlite
+
+import (
+	"database/sql"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/twinone/iot/backend/telemetry"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS telemetry (
+	device_id TEXT NOT NULL,
+	metric    TEXT NOT NULL,
+	time      INTEGER NOT NULL,
+	value     REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS telemetry_device_time ON telemetry (device_id, time);
+`
+
+type Store struct {
+	db *sql.DB
+}
+
+// Opens or creates the database file at path
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Write(deviceId string, points []telemetry.Point) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, p := range points {
+		_, err := tx.Exec("INSERT INTO telemetry (device_id, metric, time, value) VALUES (?, ?, ?, ?)",
+			deviceId, p.Metric, p.Time, p.Value)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) Query(deviceId string, metric string, from, to time.Time) ([]telemetry.Point, error) {
+	rows, err := s.db.Query(`SELECT metric, time, value FROM telemetry
+		WHERE device_id = ? AND time BETWEEN ? AND ? AND (? = '' OR metric = ?)
+		ORDER BY time`,
+		deviceId, from.Unix(), to.Unix(), metric, metric)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []telemetry.Point
+	for rows.Next() {
+		var p telemetry.Point
+		if err := rows.Scan(&p.Metric, &p.Time, &p.Value); err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
+
+func (s *Store) Prune(before time.Time) (int, error) {
+	res, err := s.db.Exec("DELETE FROM telemetry WHERE time < ?", before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,112 @@
+// Package telemetry stores the sensor readings devices report and
+// downsamples them for charts
+package telemetry
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+var ErrUnknownAggregation = errors.New("unknown aggregation")
+
+// A single reading of a metric, like a temperature
+type Point struct {
+	Time   int64   `json:"time"`
+	Metric string  `json:"metric"`
+	Value  float64 `json:"value"`
+}
+
+type Store interface {
+	Write(deviceId string, points []Point) error
+	// Returns the points of a device between from and to (inclusive) sorted
+	// by time. An empty metric returns all of them.
+	Query(deviceId string, metric string, from, to time.Time) ([]Point, error)
+	Close() error
+}
+
+// Implemented by stores that can drop old points on demand. Others, like
+// InfluxDB, have their own retention.
+type Pruner interface {
+	// Removes the points older than before, returns how many
+	Prune(before time.Time) (int, error)
+}
+
+type Aggregation = string
+
+const (
+	AggAvg   Aggregation = "avg"
+	AggMin               = "min"
+	AggMax               = "max"
+	AggSum               = "sum"
+	AggCount             = "count"
+	AggLast              = "last"
+)
+
+// Groups the points of every metric into buckets of step and reduces
+// each bucket to a single point at its start with agg
+func Downsample(points []Point, step time.Duration, agg Aggregation) ([]Point, error) {
+	reduce, ok := reducers[agg]
+	if !ok {
+		return nil, ErrUnknownAggregation
+	}
+	width := int64(step / time.Second)
+	if width <= 0 {
+		return points, nil
+	}
+
+	type key struct {
+		metric string
+		start  int64
+	}
+	buckets := make(map[key][]float64)
+	var keys []key
+	for _, p := range points {
+		k := key{p.Metric, p.Time - p.Time%width}
+		if _, ok := buckets[k]; !ok {
+			keys = append(keys, k)
+		}
+		buckets[k] = append(buckets[k], p.Value)
+	}
+
+	res := make([]Point, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, Point{Time: k.start, Metric: k.metric, Value: reduce(buckets[k])})
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Time < res[j].Time })
+	return res, nil
+}
+
+var reducers = map[Aggregation]func([]float64) float64{
+	AggAvg: func(v []float64) float64 {
+		sum := 0.0
+		for _, x := range v {
+			sum += x
+		}
+		return sum / float64(len(v))
+	},
+	AggMin: func(v []float64) float64 {
+		min := math.Inf(1)
+		for _, x := range v {
+			min = math.Min(min, x)
+		}
+		return min
+	},
+	AggMax: func(v []float64) float64 {
+		max := math.Inf(-1)
+		for _, x := range v {
+			max = math.Max(max, x)
+		}
+		return max
+	},
+	AggSum: func(v []float64) float64 {
+		sum := 0.0
+		for _, x := range v {
+			sum += x
+		}
+		return sum
+	},
+	AggCount: func(v []float64) float64 { return float64(len(v)) },
+	AggLast:  func(v []float64) float64 { return v[len(v)-1] },
+}
@@ -0,0 +1,171 @@
+// Package udp accepts device messages in single datagrams, for battery
+// powered sensors that wake up, report and go back to sleep instead of
+// holding a WebSocket open.
+//
+// Every datagram is "<id> <token> <message>", where token is the device's
+// provisioning token and message is anything a WebSocket device could
+// send, e.g. "sensor1 3q2-7w TELEMETRY temp 21.5". A bare HELLO just marks
+// the device as seen. Devices must have been onboarded (their token
+// requested) so that their owner is known.
+//
+// A device counts as online until it goes silent for as long as a
+// WebSocket one would. Whatever the hub sends it meanwhile is sent back
+// to the address of its last datagram.
+package udp
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+// Datagrams are small, anything bigger is dropped
+const maxDatagramSize = 512
+
+type Server struct {
+	hub  *ws.Hub
+	conn net.PacketConn
+
+	// Attached devices by id
+	devices map[string]*device
+	mx      sync.Mutex
+}
+
+type device struct {
+	id   string
+	conn *ws.Conn
+	// Where replies go, the source of the last datagram
+	addr net.Addr
+}
+
+// Listens on addr, e.g. ":5683". The hub needs a Store and a TokenSecret.
+func Listen(hub *ws.Hub, addr string) (*Server, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		hub:     hub,
+		conn:    conn,
+		devices: make(map[string]*device),
+	}, nil
+}
+
+// Handles datagrams until Close is called
+func (s *Server) Serve() {
+	buf := make([]byte, maxDatagramSize+1)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		if n > maxDatagramSize {
+			continue
+		}
+		s.handle(string(buf[:n]), addr)
+	}
+}
+
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Server) handle(data string, addr net.Addr) {
+	fields := strings.SplitN(strings.TrimSpace(data), " ", 3)
+	if len(fields) != 3 {
+		return
+	}
+	id, token, msg := fields[0], fields[1], fields[2]
+	if s.hub.TokenSecret == nil {
+		return
+	}
+	if err := s.hub.VerifyToken(id, token); err != nil {
+		slog.Warn("invalid UDP token", "device", id, "remote", addr.String(), "err", err)
+		return
+	}
+
+	d := s.device(id, addr)
+	if d == nil {
+		return
+	}
+	s.mx.Lock()
+	d.addr = addr
+	s.mx.Unlock()
+
+	if strings.HasPrefix(msg, model.RespHello) {
+		d.conn.Touch()
+		return
+	}
+	d.conn.Receive([]byte(msg))
+}
+
+// Returns the attached device, attaching it if needed
+func (s *Server) device(id string, addr net.Addr) *device {
+	s.mx.Lock()
+	d := s.devices[id]
+	s.mx.Unlock()
+	if d != nil {
+		return d
+	}
+
+	saved, err := s.hub.Store.FindDevice(id)
+	if err != nil {
+		if err != store.ErrNotFound {
+			slog.Error("finding device", "device", id, "err", err)
+		}
+		return nil
+	}
+
+	// Replies may be sent as soon as it's attached
+	d = &device{id: id, addr: addr}
+	// Not holding mx, Attach may close the connection and call back
+	conn, err := s.hub.Attach(id, saved.Owner, ws.TextCodec, func() { s.forget(d) })
+	if err != nil {
+		slog.Warn("attaching UDP device", "device", id, "err", err)
+		return nil
+	}
+	d.conn = conn
+	s.mx.Lock()
+	s.devices[id] = d
+	s.mx.Unlock()
+	go s.writeLoop(d)
+	return d
+}
+
+// Sends what the hub queues for the device to its last address
+func (s *Server) writeLoop(d *device) {
+	for msg := range d.conn.Send {
+		data, err := ws.TextCodec.Encode(msg)
+		if err != nil {
+			slog.Error("encoding message", "device", d.id, "err", err)
+			d.conn.Sent(msg, err)
+			continue
+		}
+		s.mx.Lock()
+		addr := d.addr
+		s.mx.Unlock()
+		if _, err = s.conn.WriteTo(data, addr); err != nil {
+			slog.Info("sending UDP reply", "device", d.id, "err", err)
+		}
+		d.conn.Sent(msg, err)
+	}
+	d.conn.Close()
+	// In case it was closed before being added
+	s.forget(d)
+}
+
+func (s *Server) forget(d *device) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.devices[d.id] == d {
+		delete(s.devices, d.id)
+	}
+}
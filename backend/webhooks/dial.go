@@ -0,0 +1,58 @@
+package webhooks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/twinone/iot/backend/realip"
+)
+
+var ErrInternalAddress = errors.New("webhooks can't reach internal addresses")
+
+// Shared address space of carrier-grade NAT, which some clusters use for
+// their own services
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Returns true if ip is loopback, private, link-local (like the cloud
+// metadata service at 169.254.169.254) or otherwise not on the internet
+func internal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || sharedAddressSpace.Contains(ip) || ip.To4() != nil && ip.To4()[0] == 0
+}
+
+// Returns a client that refuses to connect to internal addresses, unless
+// they're in allowed. It's checked on the address each connection is made
+// to, after DNS and on every redirect, so a hostname can't point
+// somewhere else once the webhook was registered.
+func newClient(allowed realip.Trusted) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: requestTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || internal(ip) && !allowed.Contains(ip) {
+				return fmt.Errorf("%w: %s", ErrInternalAddress, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			// Not from the environment, a proxy would connect anywhere
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: requestTimeout,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConns:        100,
+		},
+	}
+}
@@ -0,0 +1,288 @@
+// Package webhooks tells the URLs users registered about what happens on
+// their devices, so other systems don't have to poll
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/realip"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/ws"
+)
+
+const (
+	// Events waiting to be matched with webhooks before new ones are dropped
+	eventQueueSize = 256
+	// Deliveries waiting for a worker before new ones are dropped
+	deliveryQueueSize = 1024
+	workers           = 4
+	// Timeout of each POST
+	requestTimeout = 10 * time.Second
+	// Failed deliveries are retried after 2s, 4s, 8s... up to maxAttempts
+	maxAttempts = 6
+	baseBackoff = 2 * time.Second
+	// How long the webhooks of an owner are cached, see rules.Engine
+	cacheTTL = time.Minute
+)
+
+// Headers of every delivery. The signature is "sha256=" and the hex
+// HMAC-SHA256 of the body keyed with the secret of the webhook.
+const (
+	HeaderEvent     = "X-Iot-Event"
+	HeaderDelivery  = "X-Iot-Delivery"
+	HeaderSignature = "X-Iot-Signature"
+)
+
+// What a webhook is sent
+type Payload struct {
+	// Unique per event, the same across retries
+	Id     string        `json:"id"`
+	Event  string        `json:"event"`
+	Time   int64         `json:"time"`
+	Device *model.Device `json:"device,omitempty"`
+	// The message the device sent, if any
+	Message *ws.Message `json:"message,omitempty"`
+	// For presence events, online, stale or offline
+	State string `json:"state,omitempty"`
+	// For rule events, the rule that fired and its outcome
+	Rule  *model.Rule `json:"rule,omitempty"`
+	Cmd   string      `json:"cmd,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+type event struct {
+	owner   string
+	payload *Payload
+}
+
+type delivery struct {
+	hook    *model.Webhook
+	event   string
+	id      string
+	body    []byte
+	attempt int
+}
+
+type cached struct {
+	hooks  []*model.Webhook
+	loaded time.Time
+}
+
+type Dispatcher struct {
+	store  store.Store
+	client *http.Client
+
+	events     chan *event
+	deliveries chan *delivery
+	quit       chan struct{}
+	unhook     func()
+
+	mx    sync.Mutex
+	cache map[string]*cached
+}
+
+// Webhooks may only reach internal addresses in allowed, see newClient
+func New(st store.Store, allowed realip.Trusted) *Dispatcher {
+	return &Dispatcher{
+		store:      st,
+		client:     newClient(allowed),
+		events:     make(chan *event, eventQueueSize),
+		deliveries: make(chan *delivery, deliveryQueueSize),
+		quit:       make(chan struct{}),
+		cache:      make(map[string]*cached),
+	}
+}
+
+// Starts delivering the events of hub
+func (d *Dispatcher) Start(hub *ws.Hub) {
+	d.unhook = hub.OnEvent(func(ev *ws.Event) {
+		d.push(ev.Device.Owner, &Payload{
+			Event:   ev.Type,
+			Time:    ev.Time,
+			Device:  ev.Device,
+			Message: ev.Message,
+			State:   ev.State,
+		})
+	})
+	go d.run()
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+}
+
+// Deliveries waiting to be retried are lost
+func (d *Dispatcher) Stop() {
+	d.unhook()
+	close(d.quit)
+}
+
+// Forgets the cached webhooks of owner, call it after changing them
+func (d *Dispatcher) Invalidate(owner string) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	delete(d.cache, owner)
+}
+
+// Tells the webhooks of the owner of r it fired, see rules.Engine.OnFire
+func (d *Dispatcher) RuleFired(r *model.Rule, cmd string, err error) {
+	p := &Payload{
+		Event: model.WebhookRule,
+		Time:  time.Now().Unix(),
+		Rule:  r,
+		Cmd:   cmd,
+	}
+	if err != nil {
+		p.Error = err.Error()
+	}
+	d.push(r.Owner, p)
+}
+
+// Called from hooks, so events are dropped if we fall behind
+func (d *Dispatcher) push(owner string, p *Payload) {
+	select {
+	case d.events <- &event{owner: owner, payload: p}:
+	default:
+		slog.Warn("webhooks falling behind, dropping event", "owner", owner)
+	}
+}
+
+func (d *Dispatcher) run() {
+	for {
+		select {
+		case ev := <-d.events:
+			d.match(ev)
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) hooks(owner string) []*model.Webhook {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if c := d.cache[owner]; c != nil && time.Since(c.loaded) < cacheTTL {
+		return c.hooks
+	}
+	hooks, err := d.store.FindWebhooksByOwner(owner)
+	if err != nil {
+		slog.Error("loading webhooks", "owner", owner, "err", err)
+		return nil
+	}
+	d.cache[owner] = &cached{hooks: hooks, loaded: time.Now()}
+	return hooks
+}
+
+// Queues a delivery of ev to each webhook that wants it
+func (d *Dispatcher) match(ev *event) {
+	var body []byte
+	for _, h := range d.hooks(ev.owner) {
+		if !h.Wants(ev.payload.Event) {
+			continue
+		}
+		if body == nil {
+			ev.payload.Id = newId()
+			var err error
+			if body, err = json.Marshal(ev.payload); err != nil {
+				slog.Error("encoding webhook payload", "err", err)
+				return
+			}
+		}
+		d.enqueue(&delivery{hook: h, event: ev.payload.Event, id: ev.payload.Id, body: body})
+	}
+}
+
+func (d *Dispatcher) enqueue(del *delivery) {
+	select {
+	case d.deliveries <- del:
+	case <-d.quit:
+	default:
+		slog.Warn("webhook queue full, dropping delivery", "webhook", del.hook.Id.Hex())
+	}
+}
+
+func (d *Dispatcher) work() {
+	for {
+		select {
+		case del := <-d.deliveries:
+			d.deliver(del)
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(del *delivery) {
+	log := slog.With("webhook", del.hook.Id.Hex(), "event", del.event, "delivery", del.id)
+	retry, err := d.post(del)
+	if err == nil {
+		log.Debug("webhook delivered", "attempt", del.attempt)
+		return
+	}
+	del.attempt++
+	if !retry || del.attempt >= maxAttempts {
+		log.Warn("webhook delivery failed", "attempts", del.attempt, "err", err)
+		return
+	}
+	wait := baseBackoff << (del.attempt - 1)
+	log.Info("webhook delivery failed, retrying", "in", wait, "err", err)
+	time.AfterFunc(wait, func() { d.enqueue(del) })
+}
+
+// Returns whether it's worth retrying if it failed
+func (d *Dispatcher) post(del *delivery) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, del.hook.URL, bytes.NewReader(del.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, del.event)
+	req.Header.Set(HeaderDelivery, del.id)
+	req.Header.Set(HeaderSignature, Sign(del.hook.Secret, del.body))
+
+	resp, err := d.client.Do(req)
+	if errors.Is(err, ErrInternalAddress) {
+		return false, err
+	}
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("status %d", resp.StatusCode)
+}
+
+// Returns the signature header of body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns a random secret for a new webhook
+func NewSecret() string {
+	return newId() + newId()
+}
+
+func newId() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
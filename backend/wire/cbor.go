@@ -0,0 +1,77 @@
+package wire
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// CBOR messages are maps with the same keys as JSON ones, in binary
+// frames. The payload is any CBOR value JSON could hold too, and is kept
+// as JSON once decoded.
+type cborMessage struct {
+	Cmd       string      `cbor:"cmd"`
+	Id        string      `cbor:"id,omitempty"`
+	Seq       uint64      `cbor:"seq,omitempty"`
+	Version   int         `cbor:"version,omitempty"`
+	Args      []string    `cbor:"args,omitempty"`
+	Payload   interface{} `cbor:"payload,omitempty"`
+	KeepAlive int         `cbor:"keepalive,omitempty"`
+	Resume    *uint64     `cbor:"resume,omitempty"`
+}
+
+// Decodes maps with string keys, which is all JSON can take
+var cborDecoder, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+type cborCodec struct{}
+
+func (cborCodec) Decode(data []byte) (*Message, error) {
+	var m cborMessage
+	if err := cborDecoder.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if m.Cmd == "" {
+		return nil, ErrEmptyMessage
+	}
+	msg := &Message{
+		Cmd:       strings.ToUpper(m.Cmd),
+		Id:        m.Id,
+		Seq:       m.Seq,
+		Version:   m.Version,
+		Args:      m.Args,
+		KeepAlive: m.KeepAlive,
+		Resume:    m.Resume,
+	}
+	if m.Payload != nil {
+		payload, err := json.Marshal(m.Payload)
+		if err != nil {
+			return nil, err
+		}
+		msg.Payload = payload
+	}
+	return msg, nil
+}
+
+func (cborCodec) Encode(msg *Message) ([]byte, error) {
+	m := cborMessage{
+		Cmd:       msg.Cmd,
+		Id:        msg.Id,
+		Seq:       msg.Seq,
+		Version:   msg.Version,
+		Args:      msg.Args,
+		KeepAlive: msg.KeepAlive,
+		Resume:    msg.Resume,
+	}
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &m.Payload); err != nil {
+			return nil, err
+		}
+	}
+	return cbor.Marshal(m)
+}
+
+func (cborCodec) Binary() bool { return true }
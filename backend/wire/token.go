@@ -0,0 +1,107 @@
+package wire
+
+import (
+	"math"
+	"unsafe"
+)
+
+// A Tokenizer walks the space separated fields of a text message without
+// allocating, the tokens it returns point into the message:
+//
+//	t := Tokenizer{Data: data}
+//	for tok, ok := t.Next(); ok; tok, ok = t.Next() {
+//		...
+//	}
+type Tokenizer struct {
+	Data []byte
+	pos  int
+}
+
+var asciiSpace = [256]bool{' ': true, '\t': true, '\n': true, '\v': true, '\f': true, '\r': true}
+
+// Returns the next field, false once there are no more
+func (t *Tokenizer) Next() ([]byte, bool) {
+	start, end, ok := t.span()
+	if !ok {
+		return nil, false
+	}
+	return t.Data[start:end], true
+}
+
+// Returns the offsets of the next field in Data
+func (t *Tokenizer) span() (int, int, bool) {
+	for t.pos < len(t.Data) && asciiSpace[t.Data[t.pos]] {
+		t.pos++
+	}
+	if t.pos == len(t.Data) {
+		return 0, 0, false
+	}
+	start := t.pos
+	for t.pos < len(t.Data) && !asciiSpace[t.Data[t.pos]] {
+		t.pos++
+	}
+	return start, t.pos, true
+}
+
+// Returns what follows the first n fields of a text message as it was
+// sent, spaces in it included, but without the ones around it
+func TextTail(data []byte, n int) string {
+	t := Tokenizer{Data: data}
+	for ; n > 0; n-- {
+		if _, _, ok := t.span(); !ok {
+			return ""
+		}
+	}
+	start, end := t.pos, len(data)
+	for start < end && asciiSpace[data[start]] {
+		start++
+	}
+	for end > start && asciiSpace[data[end-1]] {
+		end--
+	}
+	return string(data[start:end])
+}
+
+// Parses a decimal sequence number, false if tok isn't one
+func ParseSeq(tok []byte) (uint64, bool) {
+	if len(tok) == 0 {
+		return 0, false
+	}
+	var n uint64
+	for _, b := range tok {
+		if b < '0' || b > '9' {
+			return 0, false
+		}
+		d := uint64(b - '0')
+		if n > (math.MaxUint64-d)/10 {
+			return 0, false
+		}
+		n = n*10 + d
+	}
+	return n, true
+}
+
+// Splits a text message into its optional sequence number, command and
+// arguments, which it appends to args. The command and arguments point
+// into data, which mustn't be changed afterwards, so a message costs no
+// allocation if args has room for its arguments.
+func SplitText(data []byte, args []string) (uint64, string, []string, error) {
+	t := Tokenizer{Data: data}
+	start, end, ok := t.span()
+	if !ok {
+		return 0, "", args, ErrEmptyMessage
+	}
+	var seq uint64
+	if s, ok := ParseSeq(data[start:end]); ok {
+		// A lone number is a command
+		if next, nend, ok := t.span(); ok {
+			seq, start, end = s, next, nend
+		}
+	}
+	str := unsafe.String(unsafe.SliceData(data), len(data))
+	cmd := str[start:end]
+	for start, end, ok := t.span(); ok; start, end, ok = t.span() {
+		args = append(args, str[start:end])
+	}
+	return seq, cmd, args, nil
+}
@@ -0,0 +1,15 @@
+package wire
+
+import "testing"
+
+func BenchmarkSplitText(b *testing.B) {
+	data := []byte("17 REPORT 5 HIGH 4 LOW temp 21.5")
+	args := make([]string, 0, 8)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := SplitText(data, args[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Package wire encodes the messages devices and the backend exchange in
+// each of the formats a device can ask for as a WebSocket subprotocol. The
+// hub and the Go client share it, so both sides agree byte for byte.
+package wire
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Subprotocols a device can ask for during the upgrade. Devices that
+// don't ask for any get the legacy space-delimited text protocol.
+const (
+	SubprotocolText = "iot.text"
+	SubprotocolJSON = "iot.json"
+	SubprotocolCBOR = "iot.cbor"
+)
+
+var ErrEmptyMessage = errors.New("empty message")
+
+// A Message independent of its wire format. In the text protocol
+// "OWNER me@example.com" decodes to Cmd "OWNER" and Args
+// ["me@example.com"], the JSON equivalent is
+// {"cmd":"owner","args":["me@example.com"]}.
+//
+// Messages that must be acknowledged carry a sequence number, which the
+// text protocol puts in front: "17 DW 5 HIGH".
+type Message struct {
+	Cmd     string          `json:"cmd"`
+	Id      string          `json:"id,omitempty"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Version int             `json:"version,omitempty"`
+	Args    []string        `json:"args,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Seconds the device may stay silent, only in HELLO
+	KeepAlive int `json:"keepalive,omitempty"`
+	// Highest sequence number the device got, only in HELLO
+	Resume *uint64 `json:"resume,omitempty"`
+}
+
+type Codec interface {
+	Decode(data []byte) (*Message, error)
+	Encode(msg *Message) ([]byte, error)
+	// True if messages go in binary WebSocket frames
+	Binary() bool
+}
+
+var (
+	// Decoded messages point into the data, which mustn't be changed
+	// while they're in use, see SplitText
+	Text Codec = textCodec{}
+	JSON Codec = jsonCodec{}
+	CBOR Codec = cborCodec{}
+)
+
+// Returns the codec for a negotiated subprotocol
+func ForSubprotocol(subprotocol string) Codec {
+	switch subprotocol {
+	case SubprotocolJSON:
+		return JSON
+	case SubprotocolCBOR:
+		return CBOR
+	}
+	return Text
+}
+
+type textCodec struct{}
+
+// The command and arguments point into data
+func (textCodec) Decode(data []byte) (*Message, error) {
+	seq, cmd, args, err := SplitText(data, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Seq: seq, Cmd: cmd, Args: args}, nil
+}
+
+func (textCodec) Encode(msg *Message) ([]byte, error) {
+	parts := append([]string{msg.Cmd}, msg.Args...)
+	if msg.Seq != 0 {
+		parts = append([]string{strconv.FormatUint(msg.Seq, 10)}, parts...)
+	}
+	if len(msg.Payload) > 0 {
+		parts = append(parts, string(msg.Payload))
+	}
+	return []byte(strings.Join(parts, " ")), nil
+}
+
+func (textCodec) Binary() bool { return false }
+
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(data []byte) (*Message, error) {
+	msg := &Message{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	if msg.Cmd == "" {
+		return nil, ErrEmptyMessage
+	}
+	// Commands are case insensitive in JSON, the text protocol uses upper case
+	msg.Cmd = strings.ToUpper(msg.Cmd)
+	return msg, nil
+}
+
+func (jsonCodec) Encode(msg *Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Binary() bool { return false }
@@ -0,0 +1,73 @@
+package ws
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// What operators see of a connection when debugging a device
+type ConnInfo struct {
+	Id    string      `json:"id"`
+	Owner string      `json:"owner"`
+	Name  string      `json:"name"`
+	State model.State `json:"state"`
+	// Empty for the default tenant
+	Tenant string `json:"tenant,omitempty"`
+	// Remote address, empty for devices attached through MQTT or UDP
+	RemoteAddr string `json:"remote_addr"`
+	Codec      string `json:"codec"`
+	Version    int    `json:"version"`
+	// Unix times it connected and was last heard from
+	Connected int64 `json:"connected"`
+	LastSeen  int64 `json:"lastseen"`
+	// Seconds it may stay silent
+	KeepAlive int `json:"keepalive"`
+	// Messages waiting to be written, out of QueueSize
+	Queue     int `json:"queue"`
+	QueueSize int `json:"queue_size"`
+	// What happens when it's full, and how many messages didn't fit
+	Overflow  model.Overflow `json:"overflow"`
+	Overflows uint64         `json:"overflows"`
+	// Its recent pings, nil if it hasn't answered one yet
+	Link *model.Link `json:"link,omitempty"`
+}
+
+func (c *Conn) Info() *ConnInfo {
+	c.mx.Lock()
+	overflow, name := c.overflowPolicy(), c.Device.Name
+	c.mx.Unlock()
+	return &ConnInfo{
+		Id:         c.Device.Id,
+		Owner:      c.Device.Owner,
+		Name:       name,
+		State:      c.Device.State,
+		Tenant:     c.Device.Tenant,
+		RemoteAddr: c.ip,
+		Codec:      codecName(c.codec),
+		Version:    c.version,
+		Connected:  c.opened.Unix(),
+		LastSeen:   atomic.LoadInt64(&c.Device.LastSeen),
+		KeepAlive:  int(c.keepAlive() / time.Second),
+		Queue:      len(c.Send),
+		QueueSize:  cap(c.Send),
+		Overflow:   overflow,
+		Overflows:  atomic.LoadUint64(&c.overflows),
+		Link:       c.Device.Link,
+	}
+}
+
+// Returns the connections of the devices connected to this node, by id
+func (h *Hub) Conns() []*Conn {
+	h.mx.RLock()
+	res := make([]*Conn, 0, len(h.IdsToConns))
+	for _, conn := range h.IdsToConns {
+		res = append(res, conn)
+	}
+	h.mx.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Device.Id < res[j].Device.Id })
+	return res
+}
@@ -0,0 +1,44 @@
+package ws
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+var (
+	ErrUnknownOwner  = errors.New("unknown owner")
+	ErrOwnerMismatch = errors.New("device belongs to another owner")
+	ErrInvalidId     = errors.New("invalid device id")
+)
+
+// Registers a device that talks through another transport, like MQTT,
+// which already authenticated it as belonging to owner. Such devices are
+// in the default tenant. The transport
+// reads messages for the device from Send, encoded with codec, until it's
+// closed, reports each one with Sent, and hands received ones to Receive. onClose, if not nil, is
+// called once when the connection is closed.
+func (h *Hub) Attach(id, owner string, codec Codec, onClose func()) (*Conn, error) {
+	// A ':' would reach into a tenant
+	if !model.ValidDeviceId(id) || strings.Contains(id, ":") {
+		return nil, ErrInvalidId
+	}
+	c := newConn(h, codec)
+	c.Device.Id = id
+	c.Device.Owner = owner
+	// Bridged firmware is newer than versioning
+	c.version = ProtocolVersion
+	if err := h.checkOwner(owner, ""); err != nil {
+		return nil, err
+	}
+	if err := h.loadDevice(c.Device); err != nil {
+		return nil, err
+	}
+	if err := h.addLive(c); err != nil {
+		return nil, err
+	}
+	c.onClose = onClose
+	h.connect(c)
+	return c, nil
+}
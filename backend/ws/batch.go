@@ -0,0 +1,105 @@
+package ws
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Dashboards getting hundreds of events per second can ask for them in
+// batches with ?batch=100ms on the event stream: what comes within that
+// time, up to batch_size frames, is written as a single
+// {"type":"batch","batch":[...]} frame instead of one frame each.
+const (
+	maxBatchInterval = time.Second
+	defaultBatchSize = 100
+	maxBatchSize     = 1000
+)
+
+var ErrInvalidBatch = errors.New("batch must be a duration up to 1s and batch_size between 1 and 1000")
+
+type batchFrame struct {
+	Type  string        `json:"type"`
+	Batch []interface{} `json:"batch"`
+}
+
+// Writes frames with send, one at a time if interval is 0
+type batcher struct {
+	send     func(f interface{}) error
+	interval time.Duration
+	size     int
+	pending  []interface{}
+	timer    *time.Timer
+}
+
+// Returns a batcher for the options in query, send must be set before
+// writing
+func newBatcher(query url.Values) (*batcher, error) {
+	b := &batcher{size: defaultBatchSize}
+	if s := query.Get("batch"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 || d > maxBatchInterval {
+			return nil, ErrInvalidBatch
+		}
+		b.interval = d
+	}
+	if s := query.Get("batch_size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxBatchSize {
+			return nil, ErrInvalidBatch
+		}
+		b.size = n
+	}
+	return b, nil
+}
+
+// Writes f, or keeps it for the next batch
+func (b *batcher) write(f interface{}) error {
+	if b.interval == 0 {
+		return b.send(f)
+	}
+	b.pending = append(b.pending, f)
+	if len(b.pending) >= b.size {
+		return b.flush()
+	}
+	if len(b.pending) == 1 {
+		if b.timer == nil {
+			b.timer = time.NewTimer(b.interval)
+		} else {
+			b.timer.Reset(b.interval)
+		}
+	}
+	return nil
+}
+
+// Fires when the pending frames are due, nil if there are none
+func (b *batcher) due() <-chan time.Time {
+	if len(b.pending) == 0 {
+		return nil
+	}
+	return b.timer.C
+}
+
+// Writes the pending frames
+func (b *batcher) flush() error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+	if b.timer != nil && !b.timer.Stop() {
+		// Fired, drain it unless due() already did
+		select {
+		case <-b.timer.C:
+		default:
+		}
+	}
+	err := b.send(&batchFrame{Type: "batch", Batch: b.pending})
+	b.pending = nil
+	return err
+}
+
+func (b *batcher) stop() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
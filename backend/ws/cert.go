@@ -0,0 +1,36 @@
+package ws
+
+import "net/http"
+
+// Devices can authenticate with a client certificate instead of a token
+// when the backend serves TLS and verifies them against a CA, see
+// tls_client_ca. The certificate names the device by its common name or
+// a DNS name, and its HELLO must use one of those ids. Devices behind a
+// proxy that terminates TLS present no certificate.
+
+// Returns the ids the verified client certificate of r is issued for, nil
+// if it has none
+func certIds(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	ids := make([]string, 0, 1+len(cert.DNSNames))
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return append(ids, cert.DNSNames...)
+}
+
+// Returns true if c has no certificate, or one issued for id
+func (c *Conn) certifies(id string) bool {
+	if c.certIds == nil {
+		return true
+	}
+	for _, i := range c.certIds {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package ws
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/twinone/iot/backend/model"
+)
+
+// Close codes sent to devices in the close frame, with a reason string.
+// Shutdowns use the standard 1001 (going away) and BYE 1000 (normal).
+const (
+	// The message couldn't be parsed
+	CloseMalformed = 4000
+	// The message isn't valid at this point, e.g. a second HELLO
+	CloseUnexpected = 4001
+	// The token in HELLO is missing or wrong
+	CloseUnauthorized = 4003
+	// The device id is registered to another owner
+	CloseOwnerMismatch = 4004
+	// The owner announced in OWNER doesn't exist, or the device's owner
+	// was disabled
+	CloseUnknownOwner = 4005
+	// The firmware's protocol version is no longer supported
+	CloseVersion = 4006
+	// The device was deleted, by its owner or for not being seen in a
+	// long time, and must be restored or paired again
+	CloseRemoved = 4010
+	// An operator disconnected the device
+	CloseKicked = 4011
+	// The device didn't keep up with its messages, see overflow.go
+	CloseSlow = 4012
+	// The owner has as many devices or connections as they may, see quota.go
+	CloseQuota = 4013
+	// Another connection said HELLO with the device's id, see duplicate.go
+	CloseReplaced = 4014
+	// The device's id is already connected, see duplicate.go
+	CloseDuplicate = 4015
+	// The device hasn't been onboarded and Config.RequireRegistered is set
+	CloseUnregistered = 4016
+	// The device couldn't be checked because the store failed, it should
+	// reconnect later (the standard 1013, try again later)
+	CloseTryAgain = websocket.CloseTryAgainLater
+)
+
+// Stops accepting messages and closes the connection with code and
+// reason once what's already queued is written
+func (c *Conn) fail(code int, reason string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closeCode, c.closeReason = code, reason
+	c.closed = true
+	close(c.outbox)
+}
+
+// Returns the close frame to send once Send is drained
+func (c *Conn) closeFrame() []byte {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.closeCode == 0 {
+		return websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+	}
+	return websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+}
+
+// Tells the device about a recoverable error: ERR <code> <detail>
+func (c *Conn) sendError(code string, detail string) {
+	c.send(&Message{Cmd: model.MsgError, Args: []string{code, detail}})
+}
@@ -0,0 +1,292 @@
+package ws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// A Broker lets the hubs of several backend instances share which node
+// each device is connected to and pass messages to each other, so devices
+// can be spread across replicas behind a load balancer
+type Broker interface {
+	Publish(ctx context.Context, channel string, data []byte) error
+	// Calls handler for every message on channel until ctx is done
+	Subscribe(ctx context.Context, channel string, handler func(data []byte)) error
+	// Records that device id is connected to node for ttl
+	SetPresence(ctx context.Context, id, node string, ttl time.Duration) error
+	// Forgets the presence of id, unless another node claimed it since
+	ClearPresence(ctx context.Context, id, node string) error
+	// Returns the node each of ids is connected to, "" if none
+	Presence(ctx context.Context, ids ...string) ([]string, error)
+}
+
+// A DeviceRouter is a Broker that can address devices directly. The hub
+// subscribes to every device it registers and forwards messages without
+// looking up presence first.
+type DeviceRouter interface {
+	Broker
+	SubscribeDevice(ctx context.Context, id string, handler func(data []byte)) (unsubscribe func(), err error)
+	// Returns ErrNotConnected if no node is subscribed to id
+	PublishDevice(ctx context.Context, id string, data []byte) error
+}
+
+// Presence expires if a node stops refreshing it, e.g. because it crashed
+const PresenceTTL = 3 * reapPeriod
+
+const (
+	// Timeout of each call to the broker
+	brokerTimeout = 5 * time.Second
+	// Broker calls made off the hub goroutine that can be pending at once
+	clusterQueueSize = 256
+
+	allChannel = "iot:all"
+)
+
+func nodeChannel(node string) string {
+	return "iot:node:" + node
+}
+
+// Operations nodes ask each other to do
+const (
+	opSend       = "send"
+	opBroadcast  = "broadcast"
+	opDisconnect = "disconnect"
+	opEvent      = "event"
+	opTopic      = "topic"
+)
+
+type clusterMsg struct {
+	Op string `json:"op"`
+	// The node that sent it
+	Node   string `json:"node"`
+	Device string `json:"device,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	// In the text protocol format
+	Msg    string `json:"msg,omitempty"`
+	Code   int    `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Event  *Event `json:"event,omitempty"`
+	Topic  string `json:"topic,omitempty"`
+	// Trace context of the sender
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+type cluster struct {
+	broker Broker
+	node   string
+	// Broker calls that must not block the hub, run in order
+	work chan func(ctx context.Context)
+	// Device subscriptions of a DeviceRouter, only used by run
+	devices map[string]func()
+	handler func(data []byte)
+}
+
+// Makes the hub part of a cluster of hubs sharing broker. node identifies
+// this instance and must be unique, a random one is used if empty.
+// Must be called before Run.
+func (h *Hub) JoinCluster(b Broker, node string) error {
+	if node == "" {
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		node = hex.EncodeToString(buf)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-h.quit
+		cancel()
+	}()
+
+	h.cluster = &cluster{
+		broker:  b,
+		node:    node,
+		work:    make(chan func(ctx context.Context), clusterQueueSize),
+		devices: make(map[string]func()),
+		handler: h.handleCluster,
+	}
+	for _, ch := range []string{nodeChannel(node), allChannel} {
+		if err := b.Subscribe(ctx, ch, h.handleCluster); err != nil {
+			cancel()
+			h.cluster = nil
+			return err
+		}
+	}
+	go h.cluster.run(ctx)
+	slog.Info("joined cluster", "node", node)
+	return nil
+}
+
+func (c *cluster) run(ctx context.Context) {
+	for {
+		select {
+		case f := <-c.work:
+			fctx, cancel := context.WithTimeout(ctx, brokerTimeout)
+			f(fctx)
+			cancel()
+		case <-ctx.Done():
+			for _, unsubscribe := range c.devices {
+				unsubscribe()
+			}
+			return
+		}
+	}
+}
+
+// Runs f on the cluster goroutine. If too much work is pending it's
+// dropped, presence is refreshed periodically anyway.
+func (c *cluster) enqueue(f func(ctx context.Context)) {
+	select {
+	case c.work <- f:
+	default:
+		slog.Warn("cluster queue full, dropping broker call")
+	}
+}
+
+func (c *cluster) encode(ctx context.Context, m *clusterMsg) ([]byte, error) {
+	m.Node = c.node
+	m.Trace = make(map[string]string)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(m.Trace))
+	return json.Marshal(m)
+}
+
+func (c *cluster) publish(ctx context.Context, channel string, m *clusterMsg) error {
+	data, err := c.encode(ctx, m)
+	if err != nil {
+		return err
+	}
+	return c.broker.Publish(ctx, channel, data)
+}
+
+// Tells the other nodes that device id is connected here
+func (c *cluster) join(id string) {
+	c.enqueue(func(ctx context.Context) {
+		c.setPresence(ctx, id)
+		r, ok := c.broker.(DeviceRouter)
+		if !ok || c.devices[id] != nil {
+			return
+		}
+		// Subscriptions outlive the call, so they don't get its timeout
+		unsubscribe, err := r.SubscribeDevice(context.Background(), id, c.handler)
+		if err != nil {
+			slog.Error("subscribing to device", "device", id, "err", err)
+			return
+		}
+		c.devices[id] = unsubscribe
+	})
+}
+
+func (c *cluster) refresh(id string) {
+	c.enqueue(func(ctx context.Context) {
+		c.setPresence(ctx, id)
+	})
+}
+
+func (c *cluster) leave(id string) {
+	c.enqueue(func(ctx context.Context) {
+		if unsubscribe := c.devices[id]; unsubscribe != nil {
+			unsubscribe()
+			delete(c.devices, id)
+		}
+		if err := c.broker.ClearPresence(ctx, id, c.node); err != nil {
+			slog.Error("clearing presence", "device", id, "err", err)
+		}
+	})
+}
+
+func (c *cluster) setPresence(ctx context.Context, id string) {
+	if err := c.broker.SetPresence(ctx, id, c.node, PresenceTTL); err != nil {
+		slog.Error("setting presence", "device", id, "err", err)
+	}
+}
+
+// Hands m to the node device id is connected to
+func (h *Hub) forward(ctx context.Context, m *clusterMsg) error {
+	if h.cluster == nil {
+		return ErrNotConnected
+	}
+	if r, ok := h.cluster.broker.(DeviceRouter); ok {
+		data, err := h.cluster.encode(ctx, m)
+		if err != nil {
+			return err
+		}
+		return r.PublishDevice(ctx, m.Device, data)
+	}
+	nodes, err := h.cluster.broker.Presence(ctx, m.Device)
+	if err != nil {
+		return err
+	}
+	// Our own presence may be stale if the device just left
+	if nodes[0] == "" || nodes[0] == h.cluster.node {
+		return ErrNotConnected
+	}
+	return h.cluster.publish(ctx, nodeChannel(nodes[0]), m)
+}
+
+// Returns which of ids are connected to another node
+func (h *Hub) RemoteOnline(ctx context.Context, ids []string) map[string]bool {
+	res := make(map[string]bool)
+	if h.cluster == nil || len(ids) == 0 {
+		return res
+	}
+	nodes, err := h.cluster.broker.Presence(ctx, ids...)
+	if err != nil {
+		slog.Error("looking up presence", "err", err)
+		return res
+	}
+	for i, n := range nodes {
+		if n != "" && n != h.cluster.node {
+			res[ids[i]] = true
+		}
+	}
+	return res
+}
+
+// Handles what other nodes ask us to do
+func (h *Hub) handleCluster(data []byte) {
+	m := &clusterMsg{}
+	if err := json.Unmarshal(data, m); err != nil {
+		slog.Error("decoding cluster message", "err", err)
+		return
+	}
+	if m.Node == h.cluster.node {
+		return
+	}
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(m.Trace))
+
+	switch m.Op {
+	case opSend:
+		msg, err := TextCodec.Decode([]byte(m.Msg))
+		if err != nil {
+			return
+		}
+		msg.ctx = ctx
+		if conn := h.GetConn(m.Device); conn != nil {
+			if err := conn.send(msg); err != nil {
+				conn.logger().Info("forwarded send failed", "node", m.Node, "err", err)
+			}
+		}
+	case opBroadcast:
+		msg, err := TextCodec.Decode([]byte(m.Msg))
+		if err != nil {
+			return
+		}
+		msg.ctx = ctx
+		h.broadcastLocal(m.Owner, msg)
+	case opDisconnect:
+		if conn := h.GetConn(m.Device); conn != nil {
+			conn.fail(m.Code, m.Reason)
+		}
+	case opEvent:
+		if m.Event != nil && m.Event.Device != nil {
+			h.dispatch(m.Event)
+		}
+	case opTopic:
+		h.deliverTopic(m.Topic, m.Msg)
+	}
+}
@@ -0,0 +1,214 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/twinone/iot/backend/wire"
+)
+
+// Subprotocols a device can ask for during the upgrade, see the wire
+// package. Devices that don't ask for any get the legacy space-delimited
+// text protocol.
+const (
+	SubprotocolText = wire.SubprotocolText
+	SubprotocolJSON = wire.SubprotocolJSON
+	SubprotocolCBOR = wire.SubprotocolCBOR
+)
+
+var ErrEmptyMessage = wire.ErrEmptyMessage
+
+// A Message is a wire.Message as the hub handles it. In the text protocol
+// "OWNER me@example.com" decodes to Cmd "OWNER" and Args
+// ["me@example.com"], the JSON equivalent is
+// {"cmd":"owner","args":["me@example.com"]}.
+//
+// Messages that must be acknowledged carry a sequence number, which the
+// text protocol puts in front: "17 DW 5 HIGH".
+type Message struct {
+	Cmd     string          `json:"cmd"`
+	Id      string          `json:"id,omitempty"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Version int             `json:"version,omitempty"`
+	Args    []string        `json:"args,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Seconds the device may stay silent, only in HELLO
+	KeepAlive int `json:"keepalive,omitempty"`
+	// Highest sequence number the device got, only in HELLO, see session.go
+	Resume *uint64 `json:"resume,omitempty"`
+
+	// Trace context of whoever sent it, not part of the wire format
+	ctx context.Context
+	// If set, written as is in a binary frame instead, see SendFile
+	data []byte
+	// If set, told whether it was written, see Conn.SendMessage
+	result chan error
+	// The text message it was decoded from, if it was, see TailFrom
+	text []byte
+}
+
+// Reports whether the message was written to whoever's waiting for it
+func (m *Message) finish(err error) {
+	if m.result == nil {
+		return
+	}
+	select {
+	case m.result <- err:
+	default:
+	}
+}
+
+// Returns the i-th argument or "" if there aren't enough arguments
+func (m *Message) Arg(i int) string {
+	if i < len(m.Args) {
+		return m.Args[i]
+	}
+	return ""
+}
+
+// Returns all arguments as they were sent, for things like names
+func (m *Message) Tail() string {
+	return m.TailFrom(0)
+}
+
+// Returns the arguments from the i-th on. For text messages that's the
+// rest of the message as it was sent, repeated spaces and all, otherwise
+// they're joined by spaces.
+func (m *Message) TailFrom(i int) string {
+	if i >= len(m.Args) {
+		return ""
+	}
+	if m.text == nil {
+		return strings.Join(m.Args[i:], " ")
+	}
+	// The sequence number and command come before the arguments
+	fields := 0
+	t := wire.Tokenizer{Data: m.text}
+	for _, ok := t.Next(); ok; _, ok = t.Next() {
+		fields++
+	}
+	return wire.TextTail(m.text, fields-len(m.Args)+i)
+}
+
+// Returns the keys and values of messages like REPORT and TELEMETRY, either
+// "REPORT 5 HIGH 4 LOW" or a JSON payload like {"5": "HIGH", "temp": 21.5}
+func (m *Message) Values() map[string]string {
+	values := make(map[string]string)
+	if len(m.Payload) > 0 {
+		var raw map[string]interface{}
+		if err := json.Unmarshal(m.Payload, &raw); err != nil {
+			return values
+		}
+		for k, v := range raw {
+			switch v := v.(type) {
+			case float64:
+				values[k] = strconv.FormatFloat(v, 'f', -1, 64)
+			case string:
+				values[k] = v
+			case bool:
+				values[k] = strconv.FormatBool(v)
+			}
+		}
+		return values
+	}
+	for i := 0; i+1 < len(m.Args); i += 2 {
+		values[m.Args[i]] = m.Args[i+1]
+	}
+	return values
+}
+
+type Codec interface {
+	Decode(data []byte) (*Message, error)
+	Encode(msg *Message) ([]byte, error)
+}
+
+var (
+	// Like wire.Text, decoded messages point into the data, see decodeText
+	TextCodec Codec = wireCodec{wire.Text}
+	JSONCodec Codec = wireCodec{wire.JSON}
+	CBORCodec Codec = wireCodec{wire.CBOR}
+)
+
+// Returns the codec for a negotiated subprotocol
+func codecFor(subprotocol string) Codec {
+	switch subprotocol {
+	case SubprotocolJSON:
+		return JSONCodec
+	case SubprotocolCBOR:
+		return CBORCodec
+	}
+	return TextCodec
+}
+
+// Returns the name of a codec for logs and the admin API
+func codecName(c Codec) string {
+	switch c {
+	case JSONCodec:
+		return "json"
+	case CBORCodec:
+		return "cbor"
+	}
+	return "text"
+}
+
+// A text message with room for the arguments most messages have, so
+// decoding one takes a single allocation. Its strings point into the data.
+type textMessage struct {
+	Message
+	args [8]string
+}
+
+// Decodes a text message given to the hub. The caller may reuse msg once
+// we return while the message is still queued or waiting to be resent, so
+// unlike frames read from a socket it's copied first.
+func decodeText(msg []byte) (*Message, error) {
+	return TextCodec.Decode(bytes.Clone(msg))
+}
+
+// Encodes and decodes hub messages with a codec of the wire package
+type wireCodec struct {
+	codec wire.Codec
+}
+
+func (c wireCodec) Decode(data []byte) (*Message, error) {
+	if c.codec == wire.Text {
+		// Most messages, parsed straight into a hub message
+		m := &textMessage{}
+		seq, cmd, args, err := wire.SplitText(data, m.args[:0])
+		if err != nil {
+			return nil, err
+		}
+		m.Seq, m.Cmd, m.Args, m.text = seq, cmd, args, data
+		return &m.Message, nil
+	}
+	m, err := c.codec.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		Cmd:       m.Cmd,
+		Id:        m.Id,
+		Seq:       m.Seq,
+		Version:   m.Version,
+		Args:      m.Args,
+		Payload:   m.Payload,
+		KeepAlive: m.KeepAlive,
+		Resume:    m.Resume,
+	}, nil
+}
+
+func (c wireCodec) Encode(msg *Message) ([]byte, error) {
+	return c.codec.Encode(&wire.Message{
+		Cmd:       msg.Cmd,
+		Id:        msg.Id,
+		Seq:       msg.Seq,
+		Version:   msg.Version,
+		Args:      msg.Args,
+		Payload:   msg.Payload,
+		KeepAlive: msg.KeepAlive,
+		Resume:    msg.Resume,
+	})
+}
@@ -0,0 +1,14 @@
+package ws
+
+import "testing"
+
+func BenchmarkTextDecode(b *testing.B) {
+	data := []byte("17 REPORT 5 HIGH 4 LOW temp 21.5")
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := TextCodec.Decode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
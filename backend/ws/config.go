@@ -0,0 +1,184 @@
+package ws
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/realip"
+)
+
+// Config tunes device connections. Zero fields take the value in
+// DefaultConfig, except Limits, where zero disables a limit, SessionTTL,
+// where zero disables sessions, and Workers, where zero handles messages
+// in the connections' read loops.
+type Config struct {
+	// Origins allowed to open device connections, e.g.
+	// "https://iot.example.com". Firmware doesn't send an Origin header
+	// and is always let in. Empty allows any origin.
+	AllowedOrigins []string
+
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Time allowed to write a message to the device
+	WriteWait time.Duration
+	// Time allowed to read the next pong from the device
+	PongWait time.Duration
+	// How often devices are pinged, must be less than PongWait
+	PingPeriod time.Duration
+	// Bounds of the keepalive devices can ask for in HELLO, which replaces
+	// PongWait for them and pings them every 70% of it
+	MinKeepAlive time.Duration
+	MaxKeepAlive time.Duration
+
+	// Messages queued for a device before sends fail
+	QueueSize int
+	// What happens to messages for a device whose queue is full, unless
+	// the device has its own policy, see overflow.go
+	Overflow model.Overflow
+	// Largest message accepted from a device
+	MaxMessageSize int64
+
+	// Negotiate permessage-deflate with devices that offer it, which helps
+	// those on metered links sending JSON. Messages are compressed at
+	// CompressionLevel, from 1 (fastest) to 9 (smallest), 0 for the
+	// default, unless they're shorter than compressMin.
+	Compression      bool
+	CompressionLevel int
+
+	Limits Limits
+
+	// Proxies in front of the backend, whose X-Forwarded-For header gives
+	// the device's address for rate limits and logs
+	TrustedProxies realip.Trusted
+
+	// Turn away devices without a verified client certificate, see cert.go
+	RequireClientCert bool
+	// Turn away devices that haven't been onboarded instead of pairing them
+	RequireRegistered bool
+	// What happens when a device connects with the id of one that's
+	// connected, see duplicate.go
+	Duplicates Duplicates
+
+	// How long the session of a device that dropped without a BYE is kept
+	// for it to resume, and how many unacknowledged messages it keeps,
+	// see session.go
+	SessionTTL    time.Duration
+	SessionBuffer int
+
+	// Goroutines handling device messages, and how many messages each
+	// queues before connections wait for it, see worker.go
+	Workers   int
+	WorkQueue int
+
+	// Log the messages devices send, at debug level. They may be private.
+	LogPayloads bool
+
+	// Lines kept of each device's own log, negative to keep none, and
+	// for how long, see devicelog.go
+	LogLines int
+	LogTTL   time.Duration
+
+	// Timezone of devices that don't have one when they ask for the time,
+	// UTC if nil, and how often the time is pushed to those that asked, 0
+	// to only answer, see timesync.go
+	Timezone *time.Location
+	TimePush time.Duration
+}
+
+var DefaultConfig = Config{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	WriteWait:       writeWait,
+	PongWait:        pongWait,
+	PingPeriod:      pingPeriod,
+	MinKeepAlive:    minKeepAlive,
+	MaxKeepAlive:    maxKeepAlive,
+	QueueSize:       queueSize,
+	Overflow:        overflow,
+	Duplicates:      DuplicatesKick,
+	MaxMessageSize:  maxMessageSize,
+	Limits:          DefaultLimits,
+	SessionTTL:      sessionTTL,
+	SessionBuffer:   sessionBuffer,
+	Workers:         workers,
+	WorkQueue:       workQueue,
+	LogLines:        logLines,
+	LogTTL:          logTTL,
+}
+
+func (c Config) withDefaults() Config {
+	d := DefaultConfig
+	if c.ReadBufferSize == 0 {
+		c.ReadBufferSize = d.ReadBufferSize
+	}
+	if c.WriteBufferSize == 0 {
+		c.WriteBufferSize = d.WriteBufferSize
+	}
+	if c.WriteWait == 0 {
+		c.WriteWait = d.WriteWait
+	}
+	if c.PongWait == 0 {
+		c.PongWait = d.PongWait
+	}
+	if c.PingPeriod == 0 || c.PingPeriod >= c.PongWait {
+		c.PingPeriod = c.PongWait * 7 / 10
+	}
+	if c.MinKeepAlive == 0 {
+		c.MinKeepAlive = d.MinKeepAlive
+	}
+	if c.MaxKeepAlive == 0 || c.MaxKeepAlive < c.MinKeepAlive {
+		c.MaxKeepAlive = d.MaxKeepAlive
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = d.QueueSize
+	}
+	if c.Overflow == "" {
+		c.Overflow = d.Overflow
+	}
+	if c.Duplicates == "" {
+		c.Duplicates = d.Duplicates
+	}
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = d.MaxMessageSize
+	}
+	if c.SessionBuffer == 0 {
+		c.SessionBuffer = d.SessionBuffer
+	}
+	if c.WorkQueue == 0 {
+		c.WorkQueue = d.WorkQueue
+	}
+	if c.LogLines == 0 {
+		c.LogLines = d.LogLines
+	}
+	if c.LogTTL == 0 {
+		c.LogTTL = d.LogTTL
+	}
+	return c
+}
+
+func (c Config) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(c.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, o := range c.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Config) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin:       c.checkOrigin,
+		Subprotocols:      []string{SubprotocolCBOR, SubprotocolJSON, SubprotocolText},
+		ReadBufferSize:    c.ReadBufferSize,
+		WriteBufferSize:   c.WriteBufferSize,
+		EnableCompression: c.Compression,
+	}
+}
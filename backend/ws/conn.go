@@ -1,14 +1,18 @@
 package ws
 
 import (
-	"log"
+	"context"
+	"net"
 	"net/http"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/signing"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type State int
@@ -19,8 +23,9 @@ const (
 	StateConnected
 )
 
+// Defaults for Config, the browser event streams use them as they are
 const (
-	// Number of messages in receiving and sending queues before blocking
+	// Number of messages in the sending queue before sends fail
 	queueSize = 16
 
 	// Time allowed to write a message to the peer.
@@ -32,153 +37,744 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 7) / 10
 
+	// Bounds of the keepalive a device can ask for instead of pongWait
+	minKeepAlive = 10 * time.Second
+	maxKeepAlive = 15 * time.Minute
+
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512
+
+	// Shorter messages aren't worth compressing
+	compressMin = 128
+
+	// What happens to messages for a device whose queue is full
+	overflow = model.OverflowDropNewest
+
+	// How long a dropped device may take to resume its session, and how
+	// many unacknowledged messages the session keeps
+	sessionTTL    = 30 * time.Second
+	sessionBuffer = 64
+
+	// Lines kept of each device's log, and for how long
+	logLines = 500
+	logTTL   = 24 * time.Hour
+
+	// Goroutines handling device messages, and messages each one queues
+	workers   = 16
+	workQueue = 256
+
+	// TCP keepalive period on the underlying connection, so half-open
+	// sockets are detected by the kernel even when we're not writing.
+	keepAlivePeriod = 15 * time.Second
+
+	// Extra time after pongWait before the hub reaps a silent connection.
+	reapSlack = 10 * time.Second
 )
 
 // WSHandler using the DefaultHub
 var DefaultWSHandler = GenWSHandler(DefaultHub)
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin:     func(r *http.Request) bool { return true },
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
 type Conn struct {
-	hub  *Hub
-	ws   *websocket.Conn
-	Send chan []byte
-	Recv chan []byte
+	hub *Hub
+	// nil for connections attached by other transports
+	ws    *websocket.Conn
+	codec Codec
+	// Parses what the device sends, depends on the protocol version and is
+	// only used by the reading goroutine
+	decoder Codec
+	// Protocol version negotiated in HELLO
+	version int
+	// Messages for the device. Transports other than WebSocket read them
+	// until it's closed and report each one with Sent.
+	Send <-chan *Message
+	// The same queue, which only send and the close path write or close
+	outbox chan *Message
+	// Called once the connection is closed, if set
+	onClose func()
+	// Identifies the connection in logs
+	id uint64
+	// Remote address, empty for other transports
+	ip string
+	// What the device's client certificate was issued for, see cert.go
+	certIds []string
+	// When it was opened
+	opened time.Time
+	// Done once the connection is closed, goroutines working for it stop
+	// with it
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Rate limits applied by readPump, nil if disabled
+	messages *bucket
+	bytes    *bucket
+	// Applied to TELEMETRY, nil if disabled
+	telemetryRate *bucket
+	// What commands are signed with, nil if the device doesn't verify
+	// them. Guarded by mx.
+	signKey *signing.Key
+	// The PongWait of this connection, which the device may change in
+	// HELLO, and the new ping period for writePump when it does
+	pongWait  int64
+	pingReset chan time.Duration
+	// Recent round-trip times, see link.go
+	link link
+	// 1 once the device asked for the time, it's pushed from then on, see
+	// timesync.go
+	timeSync int32
+	// Messages that didn't fit in Send, and whether some were spilled to
+	// the offline queue, see overflow.go
+	overflows uint64
+	spilled   int32
 
 	Device *model.Device
+	// Set while the device waits to be claimed
+	pairingCode string
+	// Requests waiting for an answer, by responseKey
+	waiters map[string][]chan *Message
+	// Published if the connection dies without a BYE, set by WILL
+	will *Message
+	bye  bool
+	// File transfers waiting for acknowledgements, by transfer id
+	transfers    map[string]chan *Message
+	nextTransfer uint32
 
-	mx     sync.Mutex
+	mx sync.Mutex
+	// No more messages can be queued
 	closed bool
+	// Close has run
+	finished bool
+	// Sent in the close frame, 0 means going away
+	closeCode   int
+	closeReason string
+	// Set in HELLO if the device keeps a session, see session.go, and the
+	// last sequence number it got
+	session *session
+	resumed uint64
+	// Tracks readPump and writePump
+	pumps sync.WaitGroup
 }
 
 func (c *Conn) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	cfg := &c.hub.Config
+	ticker := time.NewTicker(cfg.PingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.Close()
+		c.pumps.Done()
 	}()
 	for {
 		select {
 		case msg, ok := <-c.Send:
 			if !ok {
-				c.ws.WriteMessage(websocket.CloseMessage, []byte{})
+				// Everything queued before drain or Close has been written
+				c.ws.SetWriteDeadline(time.Now().Add(cfg.WriteWait))
+				c.ws.WriteMessage(websocket.CloseMessage, c.closeFrame())
+				return
+			}
+			if err := c.write(msg); err != nil {
 				return
 			}
-			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
-			c.ws.WriteMessage(websocket.TextMessage, msg)
+			c.flushSpilled()
+		case period := <-c.pingReset:
+			ticker.Reset(period)
+		case <-c.ctx.Done():
+			// Closed without draining, the socket is gone already
+			return
 		case <-ticker.C:
-			if err := c.ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			c.ws.SetWriteDeadline(time.Now().Add(cfg.WriteWait))
+			payload := pingPayload()
+			c.pinged(payload)
+			if err := c.ws.WriteMessage(websocket.PingMessage, payload); err != nil {
+				// The peer is gone, don't wait for pongWait on the read side
+				c.logger().Info("ping failed, closing", "err", err)
 				return
 			}
 		}
 	}
 }
 
+// Writes a message to the socket and tells its sender how it went. Only a
+// failed write is returned, a message that can't be encoded is dropped but
+// the connection is fine.
+func (c *Conn) write(msg *Message) error {
+	// What the sender is told
+	var result error
+	if msg.ctx != nil {
+		var span trace.Span
+		_, span = tracer.Start(msg.ctx, "ws.write")
+		defer func() { endSpan(span, result) }()
+	}
+	defer func() { msg.finish(result) }()
+
+	frame, data := websocket.TextMessage, msg.data
+	if data != nil || c.codec == CBORCodec {
+		frame = websocket.BinaryMessage
+	}
+	if data == nil {
+		if data, result = c.codec.Encode(msg); result != nil {
+			c.logger().Error("encoding message", "err", result)
+			return nil
+		}
+	}
+	// Does nothing unless the device negotiated compression
+	c.ws.EnableWriteCompression(c.hub.Config.Compression && len(data) >= compressMin)
+	c.ws.SetWriteDeadline(time.Now().Add(c.hub.Config.WriteWait))
+	if result = c.ws.WriteMessage(frame, data); result != nil {
+		return result
+	}
+	messagesSent.Inc()
+	return nil
+}
+
 func (c *Conn) readPump() {
-	defer c.Close()
-	c.ws.SetReadLimit(maxMessageSize)
-	c.ws.SetReadDeadline(time.Now().Add(pongWait))
-	c.ws.SetPongHandler(func(string) error {
-		c.Device.LastSeen = time.Now().Unix()
-		c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	defer func() {
+		c.hub.finishWork(c)
+		c.Close()
+		c.pumps.Done()
+	}()
+	cfg := &c.hub.Config
+	c.ws.SetReadLimit(cfg.MaxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(c.keepAlive()))
+	c.ws.SetPongHandler(func(payload string) error {
+		c.ponged(payload)
+		c.Touch()
+		c.ws.SetReadDeadline(time.Now().Add(c.keepAlive()))
 		return nil
 	})
 	for {
 		_, message, err := c.ws.ReadMessage()
 		if err != nil {
-			//if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
-			//	log.Printf("error: %v", err)
-			//}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				c.logger().Debug("read failed", "err", err)
+			}
 			break
 		}
-		c.Device.LastSeen = time.Now().Unix()
-		log.Println("RECV:", string(message))
-		c.processMessage(message)
-
-		c.mx.Lock()
-		if !c.closed {
-			c.Recv <- message
+		bytesReceived.Add(float64(len(message)))
+		if !c.limit(len(message)) {
+			// Keep reading until the close handshake ends
+			continue
 		}
-		c.mx.Unlock()
+		if c.hub.Config.LogPayloads {
+			c.logger().Debug("received", "payload", string(message))
+		}
+		c.Receive(message)
+	}
+}
+
+// Handles a message from the device
+func (c *Conn) Receive(data []byte) {
+	messagesReceived.Inc()
+	c.Touch()
+	if c.isClosed() {
+		// Closing, whatever comes meanwhile is ignored
+		return
+	}
+	if len(c.hub.work) > 0 {
+		c.hub.queueWork(work{c: c, data: data, queued: time.Now()})
+		return
 	}
+	c.processMessage(data)
 }
 
-// Returns true if message is ok (expected message)
-func (c *Conn) processMessage(message []byte) {
-	msg := string(message)
-	ss := strings.Split(msg, " ")
-	cmd := strings.Trim(ss[0], " \t\r\n")
-	switch cmd {
+func (c *Conn) processMessage(data []byte) {
+	msg, err := c.decoder.Decode(data)
+	if err != nil {
+		c.logger().Warn("malformed message", "err", err)
+		c.fail(CloseMalformed, err.Error())
+		return
+	}
+	cmd := msg.Cmd
+	if msg, err = c.hub.interceptors.runInbound(c.Device, msg); err != nil {
+		if err != ErrDropped {
+			c.logger().Info("message rejected", "cmd", cmd, "err", err)
+			c.sendError(model.ErrCodeForbidden, cmd)
+		}
+		return
+	}
+	if c.Device.State == model.StateConnected {
+		c.hub.hooks.runMessage(c.Device, msg)
+	}
+	switch msg.Cmd {
 	case model.RespHello:
-		if len(ss) < 2 || c.Device.State != model.StatePendingHello {
-			c.Close()
+		// HELLO <id> [token] [version=N], JSON devices may put the id in the envelope
+		id, args := msg.Id, msg.Args
+		if id == "" && len(args) > 0 {
+			id, args = args[0], args[1:]
+		}
+		if id == "" || c.Device.State != model.StatePendingHello {
+			c.fail(CloseUnexpected, "unexpected HELLO")
 			return
 		}
-		c.Device.Id = ss[1]
-		// TODO check if id is ok
-		c.Device.State = model.StatePendingOwner
+		if !model.ValidDeviceId(id) {
+			c.fail(CloseMalformed, "invalid id")
+			return
+		}
+		if !c.certifies(id) {
+			c.logger().Warn("certificate for another device", "hello_id", id, "cert", c.certIds)
+			c.fail(CloseUnauthorized, "certificate doesn't match id")
+			return
+		}
+		// Tokens are issued for the qualified id too
+		id = model.QualifyId(c.Device.Tenant, id)
+		version, args := helloVersion(msg, args)
+		keepAlive, args := helloKeepAlive(msg, args)
+		resume, resuming, args := helloResume(msg, args)
+		c.Device.PublicKey, args = helloKey(c, args)
+		signKey, args := helloVerify(args)
+		if version < MinProtocolVersion {
+			c.logger().Warn("unsupported protocol version", "hello_id", id, "version", version)
+			c.sendError(model.ErrCodeVersion, strconv.Itoa(MinProtocolVersion))
+			c.fail(CloseVersion, "unsupported protocol version")
+			return
+		}
+		if version > ProtocolVersion {
+			version = ProtocolVersion
+		}
+		// A certificate is as good as a token
+		if c.hub.TokenSecret != nil && c.certIds == nil {
+			token := ""
+			if len(args) > 0 {
+				token = args[0]
+			}
+			switch err := c.hub.VerifyToken(id, token); {
+			case err == nil:
+			case err == ErrUnregistered && token == "" && c.hub.Store != nil:
+				// New devices don't have one yet, they can only be paired.
+				// Their owner gets the token afterwards.
+			case err == ErrUnavailable:
+				c.fail(CloseTryAgain, ErrUnavailable.Error())
+				return
+			default:
+				c.logger().Warn("invalid token", "hello_id", id)
+				c.fail(CloseUnauthorized, ErrInvalidToken.Error())
+				return
+			}
+		}
+		if !c.hub.admitId(c, id) {
+			return
+		}
+		c.version = version
+		c.decoder = decoderFor(c.codec, version)
+		reply := &Message{Cmd: model.RespHello, Version: version, Args: []string{strconv.Itoa(version)}}
+		if keepAlive != 0 {
+			granted := c.setKeepAlive(keepAlive)
+			c.logger().Debug("keepalive", "asked", keepAlive, "granted", granted)
+			reply.KeepAlive = int(granted / time.Second)
+			reply.Args = append(reply.Args, "keepalive="+strconv.Itoa(reply.KeepAlive))
+		}
+		c.Device.Id = id
+		if resuming && version >= 2 && c.hub.Config.SessionTTL > 0 {
+			if !c.hub.resumeSession(c, resume) {
+				resume = 0
+			}
+			c.logger().Debug("session", "resume", resume)
+			reply.Resume = &resume
+			reply.Args = append(reply.Args, "resume="+strconv.FormatUint(resume, 10))
+		}
+		if version >= 2 {
+			// Tell the device what we'll speak, how long it may be silent
+			// and whether it resumed
+			c.send(reply)
+		}
+		c.trustKey(signKey)
+		c.hub.hello(c)
 	case model.RespOwner:
-		if len(ss) < 2 || c.Device.State != model.StatePendingOwner {
-			c.Close()
+		if c.Device.State == model.StateConnected || c.Device.State == model.StateUnclaimed {
+			// Owners come from the store or from pairing now, old firmware
+			// still announces one
+			if msg.Arg(0) != c.Device.Owner {
+				c.logger().Info("ignoring OWNER", "announced", msg.Arg(0))
+			}
 			return
 		}
-		c.Device.Owner = ss[1]
-		// TODO check if owner is registered etc
-		c.Device.State = model.StateConnected
-		c.hub.register <- c
+		if len(msg.Args) < 1 || c.Device.State != model.StatePendingOwner {
+			c.fail(CloseUnexpected, "unexpected OWNER")
+			return
+		}
+		c.owner(msg)
 	case model.RespName:
-		if len(ss) >= 2 {
-			c.Device.Name = strings.Trim(strings.SplitN(msg, " ", 2)[1], " \t\n")
+		if len(msg.Args) >= 1 {
+			c.mx.Lock()
+			c.Device.Name = msg.Tail()
+			c.mx.Unlock()
+			if c.Device.State == model.StateConnected {
+				d := c.Snapshot()
+				c.hub.saveDevice(d)
+				c.hub.Publish(EventUpdated, d, nil)
+			}
 		}
 
 	case model.RespBye:
-		c.Close()
+		c.mx.Lock()
+		c.bye = true
+		c.mx.Unlock()
+		c.fail(websocket.CloseNormalClosure, "")
+	case model.RespWill:
+		if c.Device.State != model.StatePendingHello {
+			c.setWill(msg)
+		}
+	case model.RespReport:
+		if c.Device.State == model.StateConnected {
+			c.report(msg)
+		}
+	case model.RespTelemetry:
+		if c.Device.State == model.StateConnected {
+			c.telemetry(msg)
+		}
+	case model.RespFuncs:
+		if c.Device.State != model.StatePendingHello {
+			c.funcs(msg)
+		}
+	case model.RespKeyAck:
+		if c.Device.State == model.StateConnected {
+			c.keyAck(msg)
+		}
+	case model.RespLog:
+		if c.Device.State == model.StateConnected {
+			c.log(msg)
+		}
+	case model.RespTime:
+		if c.Device.State == model.StateConnected {
+			c.timeRequest(msg)
+		}
+	case model.RespAck:
+		if c.Device.State == model.StateConnected {
+			seq := parseAck(msg)
+			c.hub.acknowledge(c.Device.Id, seq)
+			c.ackSession(seq)
+		}
+	case model.RespInfo:
+		if c.Device.State != model.StatePendingHello {
+			c.info(msg)
+		}
+	case model.RespSend:
+		if c.Device.State == model.StateConnected {
+			c.route(msg)
+		}
+	case model.RespSubscribe, model.RespUnsubscribe, model.RespPublish:
+		if c.Device.State == model.StateConnected {
+			c.topic(msg)
+		}
+	case model.RespFileAck, model.RespFileError:
+		if c.Device.State == model.StateConnected {
+			c.fileReply(msg)
+		}
+	case model.RespOTAStatus:
+		// Tracked by the ota package through the message hook
+		if c.Device.State == model.StateConnected {
+			c.hub.Publish(EventMessage, c.Device, msg)
+		}
+	case model.CmdE2E:
+		// Sealed answers, all the hub can tell is which request they're for
+		if c.Device.State == model.StateConnected {
+			c.deliver(msg)
+			c.hub.Publish(EventMessage, c.Device, msg)
+		}
 	default:
-		log.Println("Unexpected msg:", msg)
-		c.Close()
+		if commands[msg.Cmd] && c.Device.State == model.StateConnected {
+			// Answers nobody waits for, like IAR readings, are fine too
+			c.deliver(msg)
+			c.hub.Publish(EventMessage, c.Device, msg)
+			return
+		}
+		c.logger().Warn("unexpected message", "cmd", msg.Cmd)
+		if c.Device.State == model.StateConnected {
+			// Probably newer firmware, not worth disconnecting it
+			c.sendError(model.ErrCodeUnknown, msg.Cmd)
+			return
+		}
+		c.fail(CloseUnexpected, "unexpected "+msg.Cmd)
 		return
 	}
 }
 
-func (c *Conn) Close() {
+// Queues msg for the device and waits until it's written to the
+// connection, which doesn't mean the device handled it, Deliver and
+// Request wait for that. It's safe to call at any time, also while or
+// after the connection closes. Returns ErrNotConnected if it closes before
+// msg is written, ErrQueueFull if the device isn't keeping up (or
+// ErrSpilled if msg went to the offline queue instead), and ctx.Err() if
+// ctx is done first, in which case msg may still be written.
+func (c *Conn) SendMessage(ctx context.Context, msg *Message) error {
+	m := *msg
+	m.ctx = ctx
+	m.result = make(chan error, 1)
+	if err := c.send(&m); err != nil {
+		return err
+	}
+	select {
+	case err := <-m.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reports that a message read from Send was written, or why it wasn't, for
+// transports other than WebSocket
+func (c *Conn) Sent(msg *Message, err error) {
+	msg.finish(err)
+	if err == nil {
+		c.flushSpilled()
+	}
+}
+
+// Queues a message without blocking, failing if the connection is
+// closed, stale or not keeping up, or the context it was sent with is done
+func (c *Conn) send(msg *Message) error {
+	msg, err := c.hub.interceptors.runOutbound(c.Device, msg)
+	if err != nil {
+		return err
+	}
+	msg = c.sign(msg)
+	policy, err := c.queue(msg)
+	if err == ErrQueueFull {
+		return c.overflow(policy, msg)
+	}
+	if err == nil {
+		c.flushSpilled()
+	}
+	return err
+}
+
+// Puts msg in the send queue, or returns ErrQueueFull and the overflow
+// policy if it's full and the policy isn't handled here
+func (c *Conn) queue(msg *Message) (model.Overflow, error) {
 	c.mx.Lock()
 	defer c.mx.Unlock()
 
+	if c.closed {
+		return "", ErrNotConnected
+	}
+	// Whoever sent it gave up already, deliveries keep their first context
+	// for tracing only
+	if msg.ctx != nil && msg.Seq == 0 && msg.ctx.Err() != nil {
+		return "", msg.ctx.Err()
+	}
+	if c.Stale() {
+		return "", ErrStaleConnection
+	}
+	sendQueueUsage.Observe(float64(len(c.outbox)) / float64(cap(c.outbox)))
+	// Deliveries have their own sequence numbers and retries, and the
+	// HELLO reply isn't part of the session
+	s := c.session
+	if s != nil && msg.Seq == 0 && msg.data == nil && msg.Cmd != model.RespHello {
+		msg = numbered(c.hub, msg)
+	} else {
+		s = nil
+	}
+	select {
+	case c.outbox <- msg:
+		if s != nil {
+			s.keep(msg, c.hub.Config.SessionBuffer)
+		}
+		return "", nil
+	default:
+	}
+
+	policy := c.overflowPolicy()
+	sendQueueFull.WithLabelValues(policy).Inc()
+	atomic.AddUint64(&c.overflows, 1)
+	switch policy {
+	case model.OverflowDropOldest:
+		select {
+		case old := <-c.outbox:
+			old.finish(ErrQueueFull)
+		default:
+		}
+		select {
+		case c.outbox <- msg:
+			if s != nil {
+				s.keep(msg, c.hub.Config.SessionBuffer)
+			}
+			return "", nil
+		default:
+			return policy, ErrQueueFull
+		}
+	case model.OverflowDisconnect:
+		if s != nil {
+			// Sent when the device resumes
+			s.keep(msg, c.hub.Config.SessionBuffer)
+		}
+	}
+	return policy, ErrQueueFull
+}
+
+// Returns a context that's done once the connection is closed
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+func (c *Conn) isClosed() bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.closed
+}
+
+// Marks the device as seen now, transports without pings call it to
+// keep the connection from being reaped
+func (c *Conn) Touch() {
+	atomic.StoreInt64(&c.Device.LastSeen, time.Now().Unix())
+}
+
+// Returns true if nothing has been heard from the device for longer
+// than its keepalive, i.e. the socket is probably half-open
+func (c *Conn) Stale() bool {
+	lastSeen := time.Unix(atomic.LoadInt64(&c.Device.LastSeen), 0)
+	return time.Since(lastSeen) > c.keepAlive()
+}
+
+// Queues a BYE and stops accepting messages, writePump then flushes the
+// queue, sends a close frame and closes the connection
+func (c *Conn) drain() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.closed {
+		return
+	}
+	select {
+	case c.outbox <- &Message{Cmd: model.RespBye}:
+	default:
+	}
+	c.closeCode, c.closeReason = websocket.CloseGoingAway, "server shutting down"
+	c.closed = true
+	close(c.outbox)
+}
+
+func (c *Conn) Close() {
+	c.mx.Lock()
+	if c.finished {
+		c.mx.Unlock()
+		return
+	}
+	c.finished = true
+	c.cancel()
+	connectionsClosed.WithLabelValues(strconv.Itoa(c.closeCode)).Inc()
+	// Saving it would bring it back
+	removed := c.closeCode == CloseRemoved
 	if !c.closed {
 		c.closed = true
-		close(c.Send)
-		close(c.Recv)
+		close(c.outbox)
+	}
+	if c.ws != nil {
 		c.ws.Close()
-		if c.Device.State == model.StateConnected {
-			c.hub.unregister <- c
+	}
+	// Wake up pending requests
+	for _, chs := range c.waiters {
+		for _, ch := range chs {
+			close(ch)
+		}
+	}
+	c.waiters = make(map[string][]chan *Message)
+	for _, ch := range c.transfers {
+		close(ch)
+	}
+	c.transfers = make(map[string]chan *Message)
+	c.mx.Unlock()
+
+	// Nothing can be queued anymore, and what's left won't be written
+	for msg := range c.outbox {
+		msg.finish(ErrNotConnected)
+	}
+	if c.onClose != nil {
+		c.onClose()
+	}
+	// Talking to the hub while holding mx could deadlock with Run
+	c.hub.removeLive(c)
+	c.forgetLink()
+	c.hub.UnsubscribeTopic(c, "")
+	c.hub.leaveSession(c)
+	switch c.Device.State {
+	case model.StateConnected:
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.quit:
 		}
+		if !removed {
+			c.hub.saveDevice(c.Snapshot())
+		}
+	case model.StateUnclaimed:
+		c.hub.stopPairing(c)
 	}
 }
 
+func newConn(hub *Hub, codec Codec) *Conn {
+	c := &Conn{
+		id:        nextConnId(),
+		opened:    time.Now(),
+		codec:     codec,
+		decoder:   codec,
+		outbox:    make(chan *Message, hub.Config.QueueSize),
+		waiters:   make(map[string][]chan *Message),
+		transfers: make(map[string]chan *Message),
+		pongWait:  int64(hub.Config.PongWait),
+		pingReset: make(chan time.Duration, 1),
+		Device: &model.Device{
+			State: model.StatePendingHello,
+		},
+		hub: hub,
+	}
+	c.Send = c.outbox
+	c.telemetryRate = newBucket(hub.Config.Limits.TelemetryPerSecond, hub.Config.Limits.TelemetryBurst)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.Touch()
+	return c
+}
+
 // Generate a new WS Handler associated to a Hub
 func GenWSHandler(hub *Hub) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ws, err := upgrader.Upgrade(w, r, nil)
+		if hub.isShuttingDown() {
+			http.Error(w, ErrShuttingDown.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		var tenant string
+		if hub.TenantOf != nil {
+			var ok bool
+			if tenant, ok = hub.TenantOf(r); !ok {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		certIds := certIds(r)
+		if certIds == nil && hub.Config.RequireClientCert {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		// Behind a proxy, the client it forwards for
+		ip := hub.Config.TrustedProxies.ClientIP(r)
+		if hub.tooManyConns(ip) {
+			http.Error(w, ErrTooManyConns.Error(), http.StatusTooManyRequests)
+			return
+		}
+		ws, err := hub.upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			return
 		}
+		if tcp, ok := ws.UnderlyingConn().(*net.TCPConn); ok {
+			tcp.SetKeepAlive(true)
+			tcp.SetKeepAlivePeriod(keepAlivePeriod)
+		}
+		if level := hub.Config.CompressionLevel; level != 0 {
+			ws.SetCompressionLevel(level)
+		}
 
-		conn := &Conn{
-			Send: make(chan []byte, queueSize),
-			Recv: make(chan []byte, queueSize),
-			Device: &model.Device{
-				State: model.StatePendingHello,
-			},
-			ws:  ws,
-			hub: hub,
+		conn := newConn(hub, codecFor(ws.Subprotocol()))
+		conn.ws = ws
+		conn.ip = ip
+		conn.Device.RemoteAddr = ip
+		conn.certIds = certIds
+		conn.Device.Tenant = tenant
+		limits := hub.Config.Limits
+		conn.messages = newBucket(limits.MessagesPerSecond, limits.MessageBurst)
+		conn.bytes = newBucket(limits.BytesPerSecond, limits.ByteBurst)
+		if err := hub.addLive(conn); err != nil {
+			// Lost a race with other connections from ip or with Shutdown
+			ws.Close()
+			return
 		}
 
+		conn.pumps.Add(2)
 		go conn.writePump()
 		go conn.readPump()
 
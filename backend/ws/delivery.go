@@ -0,0 +1,157 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// Time to wait for the first ACK, doubled on every retry
+	ackTimeout = 2 * time.Second
+	// Sends before a delivery is given up
+	maxDeliveryAttempts = 6
+)
+
+var ErrNotAcknowledged = errors.New("device didn't acknowledge the message")
+
+type delivery struct {
+	deviceId string
+	msg      *Message
+	attempts int
+	timer    *time.Timer
+	result   chan error
+	span     trace.Span
+}
+
+// Sends a message in the text protocol format to a device, tagged with a
+// sequence number the device must ACK. Unacknowledged messages are resent
+// with exponential backoff, including after the device reconnects.
+// The returned channel receives nil once acknowledged or an error when
+// the hub gives up.
+func (h *Hub) Deliver(ctx context.Context, id string, msg []byte) <-chan error {
+	result := make(chan error, 1)
+	ctx, span := tracer.Start(ctx, "hub.Deliver", trace.WithAttributes(attribute.String("device.id", id)))
+	m, err := decodeText(msg)
+	if err != nil {
+		endSpan(span, err)
+		result <- err
+		return result
+	}
+	m.Seq = atomic.AddUint64(&h.seq, 1)
+	m.ctx = ctx
+	span.SetAttributes(attribute.Int64("delivery.seq", int64(m.Seq)))
+
+	d := &delivery{deviceId: id, msg: m, result: result, span: span}
+	h.deliveryMx.Lock()
+	if h.deliveries[id] == nil {
+		h.deliveries[id] = make(map[uint64]*delivery)
+	}
+	h.deliveries[id][m.Seq] = d
+	h.deliveryMx.Unlock()
+
+	h.attempt(d)
+	return result
+}
+
+// Sends d once more, or gives up
+func (h *Hub) attempt(d *delivery) {
+	h.deliveryMx.Lock()
+	defer h.deliveryMx.Unlock()
+
+	if h.deliveries[d.deviceId][d.msg.Seq] != d {
+		// Acknowledged meanwhile
+		return
+	}
+	if d.attempts >= maxDeliveryAttempts {
+		h.finish(d, ErrNotAcknowledged)
+		return
+	}
+	if conn := h.GetConn(d.deviceId); conn != nil {
+		msg := d.msg
+		if conn.version < 2 {
+			// Can't ACK, so it's delivered as soon as it's queued
+			plain := *d.msg
+			plain.Seq = 0
+			msg = &plain
+		}
+		err := conn.send(msg)
+		if err == nil && msg != d.msg {
+			h.finish(d, nil)
+			return
+		}
+		if err != nil {
+			conn.logger().Info("delivery failed", "seq", d.msg.Seq, "err", err)
+		}
+	}
+	wait := ackTimeout << uint(d.attempts)
+	d.attempts++
+	d.span.AddEvent("attempt", trace.WithAttributes(attribute.Int("delivery.attempt", d.attempts)))
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.timer = time.AfterFunc(wait, func() { h.attempt(d) })
+}
+
+// Must be called with deliveryMx held
+func (h *Hub) finish(d *delivery, err error) {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	delete(h.deliveries[d.deviceId], d.msg.Seq)
+	if len(h.deliveries[d.deviceId]) == 0 {
+		delete(h.deliveries, d.deviceId)
+	}
+	endSpan(d.span, err)
+	d.result <- err
+}
+
+// Gives up on every pending delivery
+func (h *Hub) failDeliveries(err error) {
+	h.deliveryMx.Lock()
+	defer h.deliveryMx.Unlock()
+
+	for _, pending := range h.deliveries {
+		for _, d := range pending {
+			h.finish(d, err)
+		}
+	}
+}
+
+func (h *Hub) acknowledge(deviceId string, seq uint64) {
+	h.deliveryMx.Lock()
+	defer h.deliveryMx.Unlock()
+
+	if d := h.deliveries[deviceId][seq]; d != nil {
+		d.span.AddEvent("ack")
+		h.finish(d, nil)
+	}
+}
+
+// Resends pending deliveries to a device that just (re)connected
+func (h *Hub) redeliver(d *model.Device) {
+	h.deliveryMx.Lock()
+	pending := make([]*delivery, 0, len(h.deliveries[d.Id]))
+	for _, del := range h.deliveries[d.Id] {
+		pending = append(pending, del)
+	}
+	h.deliveryMx.Unlock()
+
+	for _, del := range pending {
+		go h.attempt(del)
+	}
+}
+
+func parseAck(msg *Message) uint64 {
+	if msg.Seq != 0 {
+		return msg.Seq
+	}
+	seq, _ := strconv.ParseUint(msg.Arg(0), 10, 64)
+	return seq
+}
@@ -0,0 +1,126 @@
+package ws
+
+import (
+	"sync"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// Devices stream their own logs with LOG <level> <text>. The last lines of
+// each device are kept in memory, on every node since they're taken from
+// the log events, up to Config.LogLines and for Config.LogTTL.
+
+type deviceLogs struct {
+	mx sync.Mutex
+	// By device id
+	rings map[string]*logRing
+}
+
+// The last lines of a device, once full each new line replaces the oldest
+type logRing struct {
+	lines []*model.DeviceLog
+	// Index of the oldest line once full
+	start int
+}
+
+func (r *logRing) add(l *model.DeviceLog, max int) {
+	if len(r.lines) < max {
+		r.lines = append(r.lines, l)
+		return
+	}
+	r.lines[r.start] = l
+	r.start = (r.start + 1) % len(r.lines)
+}
+
+// Returns a copy of the lines, oldest first
+func (r *logRing) all() []*model.DeviceLog {
+	res := make([]*model.DeviceLog, 0, len(r.lines))
+	res = append(res, r.lines[r.start:]...)
+	return append(res, r.lines[:r.start]...)
+}
+
+// Handles LOG from a connected device
+func (c *Conn) log(msg *Message) {
+	if !model.ValidLogLevel(msg.Arg(0)) || len(msg.Args) < 2 {
+		c.logger().Warn("invalid LOG", "args", len(msg.Args))
+		c.sendError(model.ErrCodeMalformed, msg.Cmd)
+		return
+	}
+	c.hub.Publish(EventLog, c.Device, msg)
+}
+
+// Keeps the line of a log event
+func (h *Hub) keepLog(ev *Event) {
+	if h.Config.LogLines < 0 || ev.Message == nil || len(ev.Message.Args) < 2 {
+		return
+	}
+	l := &model.DeviceLog{
+		Time:  ev.Time,
+		Level: ev.Message.Args[0],
+		Text:  ev.Message.TailFrom(1),
+	}
+
+	h.logs.mx.Lock()
+	defer h.logs.mx.Unlock()
+	if h.logs.rings == nil {
+		h.logs.rings = make(map[string]*logRing)
+	}
+	r := h.logs.rings[ev.Device.Id]
+	if r == nil {
+		r = &logRing{}
+		h.logs.rings[ev.Device.Id] = r
+	}
+	r.add(l, h.Config.LogLines)
+}
+
+// Returns the kept lines of the device with id matching q, oldest first
+func (h *Hub) DeviceLogs(id string, q *model.DeviceLogQuery) []*model.DeviceLog {
+	expired := time.Now().Add(-h.Config.LogTTL).Unix()
+	h.logs.mx.Lock()
+	var lines []*model.DeviceLog
+	if r := h.logs.rings[id]; r != nil {
+		lines = r.all()
+	}
+	h.logs.mx.Unlock()
+
+	res := []*model.DeviceLog{}
+	for _, l := range lines {
+		if l.Time >= expired && q.Matches(l) {
+			res = append(res, l)
+		}
+	}
+	if q.Limit > 0 && len(res) > q.Limit {
+		res = res[len(res)-q.Limit:]
+	}
+	return res
+}
+
+// Forgets the log of the device with id on this node, e.g. when it's
+// deleted. Other nodes let it expire.
+func (h *Hub) ClearDeviceLogs(id string) {
+	h.logs.mx.Lock()
+	defer h.logs.mx.Unlock()
+	delete(h.logs.rings, id)
+}
+
+// Drops lines older than LogTTL, and devices left without any. Called by
+// reap.
+func (h *Hub) expireLogs() {
+	expired := time.Now().Add(-h.Config.LogTTL).Unix()
+	h.logs.mx.Lock()
+	defer h.logs.mx.Unlock()
+	for id, r := range h.logs.rings {
+		lines := r.all()
+		i := 0
+		for i < len(lines) && lines[i].Time < expired {
+			i++
+		}
+		switch {
+		case i == len(lines):
+			delete(h.logs.rings, id)
+		case i > 0:
+			h.logs.rings[id] = &logRing{lines: lines[i:]}
+		}
+	}
+}
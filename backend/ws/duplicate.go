@@ -0,0 +1,68 @@
+package ws
+
+import "github.com/twinone/iot/backend/model"
+
+// What happens when a device says HELLO with the id of one that's still
+// connected to this node, e.g. because its old socket is half-open or two
+// devices were flashed with the same id
+type Duplicates = string
+
+const (
+	// The old connection is closed with CloseReplaced
+	DuplicatesKick Duplicates = "kick"
+	// The new connection is closed with CloseDuplicate
+	DuplicatesReject = "reject"
+	// The new connection is sent ERR duplicate and may say HELLO again,
+	// e.g. once the old one is reaped
+	DuplicatesError = "error"
+)
+
+func ValidDuplicates(p Duplicates) bool {
+	switch p {
+	case DuplicatesKick, DuplicatesReject, DuplicatesError:
+		return true
+	}
+	return false
+}
+
+// Returns false, turning c away as the policy says, if another connection
+// has id. Must be called from the reading goroutine before the HELLO
+// changes anything.
+func (h *Hub) admitId(c *Conn, id string) bool {
+	old := h.GetConn(id)
+	if old == nil || old == c {
+		return true
+	}
+	switch h.Config.Duplicates {
+	case DuplicatesReject:
+		c.logger().Warn("id already connected", "hello_id", id)
+		c.fail(CloseDuplicate, "id already connected")
+		return false
+	case DuplicatesError:
+		c.logger().Info("id already connected", "hello_id", id)
+		c.sendError(model.ErrCodeDuplicate, id)
+		return false
+	}
+	return true
+}
+
+// Settles who keeps the id when conn registers while another connection
+// has it, which admitId can't rule out. Returns false if conn must not be
+// registered. Must be called from Run.
+func (h *Hub) takeId(conn *Conn) bool {
+	h.mx.RLock()
+	old := h.IdsToConns[conn.Device.Id]
+	registered := old != nil && old != conn && h.conns[old]
+	h.mx.RUnlock()
+	if !registered {
+		return true
+	}
+	if h.Config.Duplicates == DuplicatesKick {
+		old.logger().Info("replaced by a new connection")
+		old.fail(CloseReplaced, "replaced by a new connection")
+		return true
+	}
+	conn.logger().Warn("id already connected")
+	conn.fail(CloseDuplicate, "id already connected")
+	return false
+}
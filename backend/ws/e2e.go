@@ -0,0 +1,45 @@
+package ws
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/twinone/iot/backend/e2e"
+	"github.com/twinone/iot/backend/model"
+)
+
+// Devices doing E2E announce their public key with "key=<base64>" in HELLO,
+// commands for them are sealed with it and the hub only routes the blobs,
+// see the e2e package.
+
+// Extracts the "key=" argument of a HELLO. Returns the remaining arguments
+// and "" if there is none or it isn't a valid key.
+func helloKey(c *Conn, args []string) (string, []string) {
+	rest := make([]string, 0, len(args))
+	key := ""
+	for _, a := range args {
+		if !strings.HasPrefix(a, "key=") {
+			rest = append(rest, a)
+			continue
+		}
+		k := strings.TrimPrefix(a, "key=")
+		if _, err := e2e.ParsePublicKey(k); err != nil {
+			c.logger().Warn("invalid e2e key", "err", err)
+			continue
+		}
+		key = k
+	}
+	return key, rest
+}
+
+// Keeps the key saved for d when it was registered over the one it
+// announces now, which would let whoever has its token read its commands
+func keepKey(d *model.Device, saved string) {
+	if saved == "" {
+		return
+	}
+	if d.PublicKey != "" && d.PublicKey != saved {
+		slog.Warn("ignoring new e2e key, the device must be paired again", "device", d.Id)
+	}
+	d.PublicKey = saved
+}
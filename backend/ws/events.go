@@ -0,0 +1,243 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/twinone/iot/backend/model"
+)
+
+type EventType = string
+
+const (
+	EventConnected    EventType = "connected"
+	EventDisconnected           = "disconnected"
+	// The device changed, e.g. it was renamed
+	EventUpdated = "updated"
+	// The device sent a message, like the new state of a pin
+	EventMessage = "message"
+	// The desired or reported state of the device changed
+	EventShadow = "shadow"
+	// The device reported sensor readings
+	EventTelemetry = "telemetry"
+	// The device went away without a BYE, with the WILL it left
+	EventWill = "will"
+	// The device came online, went stale or offline, see State
+	EventPresence = "presence"
+	// The device logged a line, see devicelog.go
+	EventLog = "log"
+)
+
+// Number of events buffered per subscriber before they're dropped
+const eventQueueSize = 64
+
+type Event struct {
+	Type    EventType     `json:"type"`
+	Time    int64         `json:"time"`
+	Device  *model.Device `json:"device"`
+	Message *Message      `json:"message,omitempty"`
+	// Of presence events, online, stale or offline
+	State string `json:"state,omitempty"`
+}
+
+// A Subscription receives the events of all devices of an owner
+type Subscription struct {
+	Owner  string
+	Events chan *Event
+}
+
+func (h *Hub) Subscribe(owner string) *Subscription {
+	sub := &Subscription{
+		Owner:  owner,
+		Events: make(chan *Event, eventQueueSize),
+	}
+
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if h.subscriptions[owner] == nil {
+		h.subscriptions[owner] = make(map[*Subscription]bool)
+	}
+	h.subscriptions[owner][sub] = true
+	return sub
+}
+
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	delete(h.subscriptions[sub.Owner], sub)
+	if len(h.subscriptions[sub.Owner]) == 0 {
+		delete(h.subscriptions, sub.Owner)
+	}
+}
+
+// Sends an event about d to its owner's subscribers, on every node.
+// Slow subscribers miss events rather than slowing down the hub.
+func (h *Hub) Publish(typ EventType, d *model.Device, msg *Message) {
+	snapshot := *d
+	h.PublishEvent(&Event{
+		Type:    typ,
+		Time:    time.Now().Unix(),
+		Device:  &snapshot,
+		Message: msg,
+	})
+}
+
+// Like Publish, for events built by the caller. ev.Device must not change
+// afterwards.
+func (h *Hub) PublishEvent(ev *Event) {
+	if c := h.cluster; c != nil {
+		c.enqueue(func(ctx context.Context) {
+			if err := c.publish(ctx, allChannel, &clusterMsg{Op: opEvent, Event: ev}); err != nil {
+				slog.Error("publishing event", "err", err)
+			}
+		})
+	}
+	h.dispatch(ev)
+	h.hooks.runEvent(ev)
+}
+
+func (h *Hub) dispatch(ev *Event) {
+	d := ev.Device
+	if ev.Type == EventLog {
+		h.keepLog(ev)
+	}
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+	for sub := range h.subscriptions[d.Owner] {
+		select {
+		case sub.Events <- ev:
+		default:
+			slog.Warn("dropping event for slow subscriber", "owner", d.Owner)
+		}
+	}
+}
+
+// Browsers authenticate with cookies, so unlike devices they must come
+// from our own origin (the default check)
+var eventsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// What browsers send on the event stream to use topics, e.g.
+// {"op": "sub", "topic": "owner/me@example.com/room/#"}
+type topicRequest struct {
+	// sub, unsub or pub
+	Op      string `json:"op"`
+	Topic   string `json:"topic"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// What browsers get on the event stream about topics: messages published
+// to the ones they subscribed to and requests that failed
+type topicFrame struct {
+	Type    string `json:"type"`
+	Topic   string `json:"topic"`
+	Payload string `json:"payload,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Upgrades a request from an authenticated user and streams the events
+// of their devices to it as JSON until either side goes away, in batches
+// if asked to, see batch.go. The user can also publish and subscribe to
+// topics through it.
+func ServeEvents(h *Hub, owner string, w http.ResponseWriter, r *http.Request) {
+	out, err := newBatcher(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := eventsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	out.send = func(f interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		return conn.WriteJSON(f)
+	}
+	defer out.stop()
+
+	sub := h.Subscribe(owner)
+	defer h.Unsubscribe(sub)
+
+	frames := make(chan *topicFrame, eventQueueSize)
+	push := func(f *topicFrame) {
+		select {
+		case frames <- f:
+		default:
+			slog.Warn("dropping topic message for slow subscriber", "owner", owner)
+		}
+	}
+
+	// Reading also processes pongs and notices when the browser leaves
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Only this goroutine subscribes
+		defer h.UnsubscribeTopic(sub, "")
+		conn.SetReadLimit(maxMessageSize)
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetPongHandler(func(string) error {
+			conn.SetReadDeadline(time.Now().Add(pongWait))
+			return nil
+		})
+		for {
+			var req topicRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				switch err.(type) {
+				case *json.SyntaxError, *json.UnmarshalTypeError:
+					continue
+				}
+				return
+			}
+			var err error
+			switch req.Op {
+			case "sub":
+				err = h.SubscribeTopic(sub, owner, req.Topic, func(topic, payload string) {
+					push(&topicFrame{Type: "topic", Topic: topic, Payload: payload})
+				})
+			case "unsub":
+				h.UnsubscribeTopic(sub, req.Topic)
+			case "pub":
+				err = h.PublishTopic(r.Context(), owner, req.Topic, req.Payload)
+			default:
+				err = ErrInvalidTopic
+			}
+			if err != nil {
+				push(&topicFrame{Type: "error", Topic: req.Topic, Error: err.Error()})
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-sub.Events:
+			if err := out.write(ev); err != nil {
+				return
+			}
+		case f := <-frames:
+			if err := out.write(f); err != nil {
+				return
+			}
+		case <-out.due():
+			if err := out.flush(); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package ws
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Files, like certificates or config, don't fit in a message, so they're
+// sent in binary frames of up to fileChunkSize bytes, each acknowledged
+// before the next one goes out:
+//
+//	-> FILE <id> <name> <size> <sha256>
+//	<- FILEACK <id> <offset>       how much of the file the device has
+//	-> <id> <offset> <crc32> data  binary, big endian uint32s
+//	<- FILEACK <id> <offset>       the offset it wants next
+//	...
+//	<- FILEACK <id> <size>         once the whole file matches the SHA-256
+//
+// A device that kept part of a file with the same name and SHA-256 from
+// an interrupted transfer resumes it by acknowledging that offset. Chunks
+// that fail the CRC are asked for again by acknowledging the same offset.
+// The device gives up with FILEERR <id> <reason>, and is sent FILEABORT
+// <id> if we do.
+const (
+	fileChunkSize  = 256
+	fileHeaderSize = 12
+	// Largest file sent, it's kept in memory while it goes out
+	MaxFileSize = 1 << 20
+	// How long the device may take to acknowledge a chunk
+	fileAckTimeout = 30 * time.Second
+	// Acknowledgements in a row that don't move forward before giving up
+	maxFileRetries = 5
+	maxFileNameLen = 64
+)
+
+var (
+	ErrFileRejected    = errors.New("device rejected the file")
+	ErrFileTooLarge    = errors.New("file too large")
+	ErrInvalidFileName = errors.New("invalid file name")
+	// Transports other than WebSocket can't send binary frames
+	ErrFilesUnsupported = errors.New("device can't receive files")
+)
+
+// Sends the contents of r to the device as a file called name, and
+// returns once the device has all of it and checked its SHA-256
+func (c *Conn) SendFile(ctx context.Context, name string, r io.Reader) (err error) {
+	if c.ws == nil {
+		return ErrFilesUnsupported
+	}
+	if name == "" || len(name) > maxFileNameLen || strings.ContainsAny(name, " \t\r\n") {
+		return ErrInvalidFileName
+	}
+	// The SHA-256 goes first, so the file is read in full
+	data, err := io.ReadAll(io.LimitReader(r, MaxFileSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxFileSize {
+		return ErrFileTooLarge
+	}
+	sum := sha256.Sum256(data)
+
+	id := atomic.AddUint32(&c.nextTransfer, 1)
+	key := strconv.FormatUint(uint64(id), 10)
+	replies := make(chan *Message, 4)
+	c.mx.Lock()
+	if c.closed {
+		c.mx.Unlock()
+		return ErrNotConnected
+	}
+	c.transfers[key] = replies
+	c.mx.Unlock()
+	defer func() {
+		c.mx.Lock()
+		delete(c.transfers, key)
+		c.mx.Unlock()
+		if err != nil && err != ErrNotConnected {
+			c.send(&Message{Cmd: model.MsgFileAbort, Args: []string{key}})
+		}
+	}()
+
+	// Returns the next offset the device wants
+	wait := func() (int, error) {
+		timer := time.NewTimer(fileAckTimeout)
+		defer timer.Stop()
+		select {
+		case msg, ok := <-replies:
+			if !ok {
+				return 0, ErrNotConnected
+			}
+			if msg.Cmd == model.RespFileError {
+				return 0, fmt.Errorf("%w: %s", ErrFileRejected, msg.TailFrom(1))
+			}
+			off, err := strconv.Atoi(msg.Arg(1))
+			if err != nil || off < 0 || off > len(data) {
+				return 0, fmt.Errorf("%w: bad offset %q", ErrFileRejected, msg.Arg(1))
+			}
+			return off, nil
+		case <-timer.C:
+			return 0, ErrTimeout
+		case <-c.ctx.Done():
+			return 0, ErrNotConnected
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	err = c.send(&Message{Cmd: model.MsgFile, Args: []string{key, name, strconv.Itoa(len(data)), hex.EncodeToString(sum[:])}})
+	if err != nil {
+		return err
+	}
+	off, err := wait()
+	retries := 0
+	for err == nil && off < len(data) {
+		end := off + fileChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err = c.send(&Message{data: fileChunk(id, off, data[off:end])}); err != nil {
+			break
+		}
+		var next int
+		if next, err = wait(); err != nil {
+			break
+		}
+		if next <= off {
+			if retries++; retries > maxFileRetries {
+				err = fmt.Errorf("%w: stuck at offset %d", ErrFileRejected, off)
+			}
+		} else {
+			retries = 0
+		}
+		off = next
+	}
+	if err == nil {
+		c.logger().Info("sent file", "name", name, "size", len(data))
+	}
+	return err
+}
+
+func fileChunk(id uint32, off int, data []byte) []byte {
+	buf := make([]byte, fileHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:], id)
+	binary.BigEndian.PutUint32(buf[4:], uint32(off))
+	binary.BigEndian.PutUint32(buf[8:], crc32.ChecksumIEEE(data))
+	copy(buf[fileHeaderSize:], data)
+	return buf
+}
+
+// Hands a FILEACK or FILEERR to the transfer it's about. Answers to
+// transfers that ended already are dropped.
+func (c *Conn) fileReply(msg *Message) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	ch := c.transfers[msg.Arg(0)]
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- msg:
+	default:
+		c.logger().Warn("dropping file reply", "cmd", msg.Cmd)
+	}
+}
+
+// Sends a file to the device with id, see Conn.SendFile. The device must
+// be connected to this node.
+func (h *Hub) SendFile(ctx context.Context, id string, name string, r io.Reader) (err error) {
+	ctx, span := tracer.Start(ctx, "hub.SendFile", trace.WithAttributes(attribute.String("device.id", id)))
+	defer func() { endSpan(span, err) }()
+
+	conn := h.GetConn(id)
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.SendFile(ctx, name, r)
+}
@@ -0,0 +1,50 @@
+package ws
+
+import (
+	"encoding/json"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// Most functions a device may declare
+const maxDeclaredFunctions = 64
+
+// Stores the functions a device declares in a FUNCS message, a JSON list
+// like [{"name": "light", "cmd": "DW", "pin": 5, "params": [{"name":
+// "value", "type": "enum", "values": ["HIGH", "LOW"]}]}]. It's the payload
+// in JSON and follows the command in the text protocol.
+func (c *Conn) funcs(msg *Message) {
+	data := []byte(msg.Payload)
+	if len(data) == 0 {
+		data = []byte(msg.Tail())
+	}
+	var fs []model.Function
+	if err := json.Unmarshal(data, &fs); err != nil || len(fs) > maxDeclaredFunctions {
+		c.logger().Warn("invalid FUNCS", "err", err)
+		c.sendError(model.ErrCodeMalformed, msg.Cmd)
+		return
+	}
+	for i := range fs {
+		f := &fs[i]
+		if f.Name == "" || !commands[f.Cmd] {
+			c.logger().Warn("invalid function in FUNCS", "name", f.Name, "cmd", f.Cmd)
+			c.sendError(model.ErrCodeMalformed, msg.Cmd)
+			return
+		}
+		for j := range f.Params {
+			if err := f.Params[j].Check(); err != nil {
+				c.logger().Warn("invalid function in FUNCS", "name", f.Name, "err", err)
+				c.sendError(model.ErrCodeMalformed, msg.Cmd)
+				return
+			}
+		}
+		f.DeviceId = c.Device.Id
+	}
+
+	c.mx.Lock()
+	c.Device.Functions = fs
+	c.mx.Unlock()
+	if c.Device.State == model.StateConnected {
+		c.hub.Publish(EventUpdated, c.Snapshot(), nil)
+	}
+}
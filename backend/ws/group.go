@@ -0,0 +1,32 @@
+package ws
+
+import (
+	"context"
+
+	"github.com/twinone/iot/backend/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Sends or queues a message in the text protocol format to every member
+// of g. Returns the error of each member that didn't get it, nil if all
+// did.
+func (h *Hub) BroadcastToGroup(ctx context.Context, g *model.Group, msg []byte) map[string]error {
+	ctx, span := tracer.Start(ctx, "hub.BroadcastToGroup", trace.WithAttributes(attribute.Int("group.size", len(g.Devices))))
+	defer span.End()
+	return h.Broadcast(ctx, g.Devices, msg)
+}
+
+// Like BroadcastToGroup, to the devices with ids
+func (h *Hub) Broadcast(ctx context.Context, ids []string, msg []byte) map[string]error {
+	var errs map[string]error
+	for _, id := range ids {
+		if _, err := h.SendOrQueue(ctx, id, msg); err != nil {
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			errs[id] = err
+		}
+	}
+	return errs
+}
@@ -0,0 +1,51 @@
+package ws
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrNotRunning = errors.New("hub not running")
+
+// Implemented by brokers that can tell whether they reach their server
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Returns an error unless Run answers before ctx is done
+func (h *Hub) Alive(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case h.probe <- done:
+	case <-h.quit:
+		return ErrNotRunning
+	case <-ctx.Done():
+		return ErrNotRunning
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ErrNotRunning
+	}
+}
+
+// Returns an error if the hub is shutting down
+func (h *Hub) Accepting() error {
+	if h.isShuttingDown() {
+		return ErrShuttingDown
+	}
+	return nil
+}
+
+// Returns an error if the hub is in a cluster and can't reach the broker,
+// nil if it isn't or the broker can't tell
+func (h *Hub) ClusterReady(ctx context.Context) error {
+	if h.cluster == nil {
+		return nil
+	}
+	if p, ok := h.cluster.broker.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
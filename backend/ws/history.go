@@ -0,0 +1,56 @@
+package ws
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// Commands sent through Request and SendOrQueue are kept in the history of
+// their device with what came of them, see Store.FindHistory. Callers that
+// send them on behalf of a function say which with WithFunction.
+
+type functionKey struct{}
+
+// Returns ctx saying the commands sent with it invoke the function name
+func WithFunction(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, functionKey{}, name)
+}
+
+// Records msg, sent to the device with id at start, and its outcome
+func (h *Hub) recordCommand(ctx context.Context, id string, msg []byte, start time.Time, result model.CommandResult, resp *Message, err error) {
+	if h.Store == nil {
+		return
+	}
+	e := &model.HistoryEntry{
+		DeviceId: id,
+		Time:     start.Unix(),
+		Command:  string(msg),
+		Result:   result,
+	}
+	e.Function, _ = ctx.Value(functionKey{}).(string)
+	if resp != nil {
+		text, _ := TextCodec.Encode(resp)
+		e.Response = string(text)
+		e.Latency = time.Since(start).Milliseconds()
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if err := h.Store.InsertHistory(e); err != nil {
+		slog.Error("recording command", "device", id, "err", err)
+	}
+}
+
+// The result of a command that failed with err
+func failure(err error) model.CommandResult {
+	switch err {
+	case ErrTimeout:
+		return model.ResultTimeout
+	case ErrNotConnected, ErrStaleConnection, ErrQueueDisabled, ErrOfflineQueueFull:
+		return model.ResultOffline
+	}
+	return model.ResultError
+}
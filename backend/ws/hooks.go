@@ -0,0 +1,98 @@
+package ws
+
+import (
+	"sync"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// Hooks run on the hub or connection goroutine, so they must not block.
+// Anything slow should be handed off to another goroutine.
+type (
+	DeviceHook  func(d *model.Device)
+	MessageHook func(d *model.Device, msg *Message)
+	EventHook   func(ev *Event)
+)
+
+type hooks struct {
+	mx         sync.RWMutex
+	next       int
+	connect    map[int]DeviceHook
+	disconnect map[int]DeviceHook
+	message    map[int]MessageHook
+	event      map[int]EventHook
+}
+
+// Adds a hook for devices that got registered, returns a func to remove it
+func (h *Hub) OnConnect(f DeviceHook) (remove func()) {
+	return h.hooks.add(func(id int) { h.hooks.connect[id] = f }, func(id int) { delete(h.hooks.connect, id) })
+}
+
+// Adds a hook for registered devices that went away
+func (h *Hub) OnDisconnect(f DeviceHook) (remove func()) {
+	return h.hooks.add(func(id int) { h.hooks.disconnect[id] = f }, func(id int) { delete(h.hooks.disconnect, id) })
+}
+
+// Adds a hook for every message received from a registered device
+func (h *Hub) OnMessage(f MessageHook) (remove func()) {
+	return h.hooks.add(func(id int) { h.hooks.message[id] = f }, func(id int) { delete(h.hooks.message, id) })
+}
+
+// Adds a hook for every event published on this node. Events from other
+// nodes of a cluster only run the hooks there.
+func (h *Hub) OnEvent(f EventHook) (remove func()) {
+	return h.hooks.add(func(id int) { h.hooks.event[id] = f }, func(id int) { delete(h.hooks.event, id) })
+}
+
+func (hs *hooks) add(add func(id int), del func(id int)) func() {
+	hs.mx.Lock()
+	defer hs.mx.Unlock()
+
+	if hs.connect == nil {
+		hs.connect = make(map[int]DeviceHook)
+		hs.disconnect = make(map[int]DeviceHook)
+		hs.message = make(map[int]MessageHook)
+		hs.event = make(map[int]EventHook)
+	}
+	id := hs.next
+	hs.next++
+	add(id)
+
+	return func() {
+		hs.mx.Lock()
+		defer hs.mx.Unlock()
+		del(id)
+	}
+}
+
+func (hs *hooks) runConnect(d *model.Device) {
+	hs.mx.RLock()
+	defer hs.mx.RUnlock()
+	for _, f := range hs.connect {
+		f(d)
+	}
+}
+
+func (hs *hooks) runDisconnect(d *model.Device) {
+	hs.mx.RLock()
+	defer hs.mx.RUnlock()
+	for _, f := range hs.disconnect {
+		f(d)
+	}
+}
+
+func (hs *hooks) runMessage(d *model.Device, msg *Message) {
+	hs.mx.RLock()
+	defer hs.mx.RUnlock()
+	for _, f := range hs.message {
+		f(d, msg)
+	}
+}
+
+func (hs *hooks) runEvent(ev *Event) {
+	hs.mx.RLock()
+	defer hs.mx.RUnlock()
+	for _, f := range hs.event {
+		f(ev)
+	}
+}
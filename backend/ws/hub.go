@@ -1,32 +1,158 @@
 package ws
 
 import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
 	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/signing"
+	"github.com/twinone/iot/backend/store"
+	"github.com/twinone/iot/backend/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var DefaultHub = NewHub()
+// How often the hub looks for connections that stopped answering pings
+const reapPeriod = 15 * time.Second
+
+var DefaultHub = NewHub(DefaultConfig)
+
+var (
+	ErrNotConnected    = errors.New("device not connected")
+	ErrStaleConnection = errors.New("stale connection")
+	ErrQueueFull       = errors.New("send queue full")
+	ErrShuttingDown    = errors.New("hub is shutting down")
+	ErrTooManyConns    = errors.New("too many connections")
+)
 
 type Hub struct {
 	register   chan *Conn
 	unregister chan *Conn
-	conns      map[*Conn]bool
+	// Closed when Run should return
+	quit chan struct{}
+	// Run closes what it gets, see Alive
+	probe chan chan struct{}
+	// Registered connections
+	conns map[*Conn]bool
+	// All open connections, registered or not
+	live map[*Conn]bool
+	// Number of live connections by remote IP
+	ips map[string]int
+	// Number of registered connections by owner, see quota.go
+	owners       map[string]int
+	shuttingDown bool
 	// Maps email to id
 	OwnersToIds map[string]map[string]bool
 	IdsToConns  map[string]*Conn
+	// Unclaimed connections by pairing code
+	pairings map[string]*pairing
+	// Wrong pairing codes by user, and how many there were in total, see
+	// Claim
+	claimFailures map[string]*claimFailures
+	claimMisses   int
+	// Event subscriptions by owner
+	subscriptions map[string]map[*Subscription]bool
+
+	// Guards the maps above, which are written by Run and read by
+	// anyone addressing devices from outside the hub
+	mx sync.RWMutex
+
+	// Where device records are loaded from and saved to, may be nil
+	Store store.Store
+
+	// If set, devices must send a token issued with it in their HELLO
+	TokenSecret []byte
+
+	// If set, commands are signed for devices that verify them, see
+	// signing.go
+	Signer *signing.Signer
+
+	// Returns the tenant of the devices connecting with r, false to turn
+	// them away. Everyone is in the default tenant if nil. Must be set
+	// before serving devices.
+	TenantOf func(r *http.Request) (string, bool)
+
+	// Read only, set by NewHub
+	Config   Config
+	upgrader *websocket.Upgrader
+
+	// Where sensor readings go, they're dropped if nil
+	Telemetry telemetry.Store
+
+	hooks        hooks
+	interceptors interceptors
+
+	topics topics
+	// Decides who may publish or subscribe to a topic instead of the
+	// default rules, see topics.go. Must be set before Run.
+	TopicACL func(user, topic string, publish bool) bool
+
+	// Set by JoinCluster, nil if this is the only instance
+	cluster *cluster
+
+	// Last sequence number given to a delivery
+	seq uint64
+	// Deliveries waiting for an ACK, by device id and sequence number
+	deliveries map[string]map[uint64]*delivery
+	deliveryMx sync.Mutex
+
+	// Sessions of devices that may resume them, by device id
+	sessions  map[string]*session
+	sessionMx sync.Mutex
+
+	// Messages waiting for each worker, see worker.go
+	work []chan work
+
+	// The last lines devices logged, see devicelog.go
+	logs deviceLogs
+
+	// Serializes reads and writes of the offline queues in Store
+	queueMx sync.Mutex
+	// Serializes updates of the device shadows in Store
+	shadowMx sync.Mutex
 }
 
-func NewHub() *Hub {
-	return &Hub{
+func NewHub(cfg Config) *Hub {
+	cfg = cfg.withDefaults()
+	h := &Hub{
+		Config:     cfg,
+		upgrader:   cfg.upgrader(),
 		register:   make(chan *Conn),
 		unregister: make(chan *Conn),
+		quit:       make(chan struct{}),
+		probe:      make(chan chan struct{}),
 		conns:      make(map[*Conn]bool),
+		live:       make(map[*Conn]bool),
+		ips:        make(map[string]int),
+		owners:     make(map[string]int),
 
 		OwnersToIds: make(map[string]map[string]bool),
 		IdsToConns:  make(map[string]*Conn),
+		pairings:    make(map[string]*pairing),
+
+		claimFailures: make(map[string]*claimFailures),
+
+		subscriptions: make(map[string]map[*Subscription]bool),
+		deliveries:    make(map[string]map[uint64]*delivery),
+		sessions:      make(map[string]*session),
+		work:          make([]chan work, cfg.Workers),
 	}
+	for i := range h.work {
+		h.work[i] = make(chan work, cfg.WorkQueue)
+	}
+	return h
 }
 
 func (h *Hub) GetConns(owner string) []*Conn {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+
 	idmap := h.OwnersToIds[owner]
 	res := make([]*Conn, 0, len(idmap))
 
@@ -39,6 +165,9 @@ func (h *Hub) GetConns(owner string) []*Conn {
 }
 
 func (h *Hub) GetDevices(owner string) []*model.Device {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+
 	idmap := h.OwnersToIds[owner]
 	res := make([]*model.Device, 0, len(idmap))
 
@@ -50,36 +179,285 @@ func (h *Hub) GetDevices(owner string) []*model.Device {
 	return res
 }
 
+// Returns the connection of a registered device or nil
+func (h *Hub) GetConn(id string) *Conn {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+
+	return h.IdsToConns[id]
+}
+
+// Queues a message in the text protocol format (e.g. "DW 5 HIGH") to a
+// connected device. It is re-encoded if the device negotiated another
+// protocol. Devices connected to another node of the cluster get it
+// through the broker, without knowing whether it was queued.
+func (h *Hub) SendToDevice(ctx context.Context, id string, msg []byte) (err error) {
+	ctx, span := tracer.Start(ctx, "hub.SendToDevice", trace.WithAttributes(attribute.String("device.id", id)))
+	defer func() { endSpan(span, err) }()
+
+	m, err := decodeText(msg)
+	if err != nil {
+		return err
+	}
+	m.ctx = ctx
+	conn := h.GetConn(id)
+	if conn == nil {
+		err = h.forward(ctx, &clusterMsg{Op: opSend, Device: id, Msg: string(msg)})
+		if err == ErrNotConnected && h.sendToSession(id, m) {
+			return nil
+		}
+		return err
+	}
+	return conn.send(m)
+}
+
+// Queues a message to every connected device of owner, on every node.
+// Devices that can't take it are skipped, the returned error is the last
+// local failure.
+func (h *Hub) BroadcastToOwner(ctx context.Context, owner string, msg []byte) (err error) {
+	ctx, span := tracer.Start(ctx, "hub.BroadcastToOwner")
+	defer func() { endSpan(span, err) }()
+
+	m, err := decodeText(msg)
+	if err != nil {
+		return err
+	}
+	m.ctx = ctx
+	if h.cluster != nil {
+		err = h.cluster.publish(ctx, allChannel, &clusterMsg{Op: opBroadcast, Owner: owner, Msg: string(msg)})
+	}
+	if e := h.broadcastLocal(owner, m); e != nil {
+		err = e
+	}
+	return err
+}
+
+func (h *Hub) broadcastLocal(owner string, m *Message) (err error) {
+	for _, conn := range h.GetConns(owner) {
+		if e := conn.send(m); e != nil {
+			conn.logger().Info("broadcast failed", "err", e)
+			err = e
+		}
+	}
+	return err
+}
+
+// Closes the connection of a device with a close code and reason,
+// returns false if it wasn't connected
+func (h *Hub) Disconnect(id string, code int, reason string) bool {
+	conn := h.GetConn(id)
+	if conn == nil {
+		m := &clusterMsg{Op: opDisconnect, Device: id, Code: code, Reason: reason}
+		return h.forward(context.Background(), m) == nil
+	}
+	conn.fail(code, reason)
+	return true
+}
+
 func (h *Hub) Run() {
 	cleanup := func(conn *Conn) {
-		delete(h.IdsToConns, conn.Device.Id)
+		h.mx.Lock()
+		registered := h.conns[conn]
 		delete(h.conns, conn)
-		conn.Close()
+		if registered {
+			if h.owners[conn.Device.Owner]--; h.owners[conn.Device.Owner] <= 0 {
+				delete(h.owners, conn.Device.Owner)
+			}
+		}
+		// The id may already belong to a newer connection
+		current := h.IdsToConns[conn.Device.Id] == conn
+		if current {
+			delete(h.IdsToConns, conn.Device.Id)
+		}
+		conn.Device.Online = false
+		h.mx.Unlock()
+		if !registered {
+			return
+		}
+		if h.cluster != nil && current {
+			h.cluster.leave(conn.Device.Id)
+		}
+		unregistrations.Inc()
+		devicesConnected.WithLabelValues(conn.Device.Owner).Dec()
+		tenantDevicesConnected.WithLabelValues(conn.Device.Tenant).Dec()
+		// Devices aren't at fault when we're the ones going away
+		if will := conn.lastWill(); will != nil && !h.isShuttingDown() {
+			h.Publish(EventWill, conn.Device, will)
+		}
+		h.Publish(EventDisconnected, conn.Device, nil)
+		h.hooks.runDisconnect(conn.Device)
 	}
 
-	defer func() {
-
-		for c, _ := range h.conns {
-			cleanup(c)
-		}
-		close(h.register)
-		close(h.unregister)
-	}()
+	h.startWorkers()
+	reaper := time.NewTicker(reapPeriod)
+	defer reaper.Stop()
 
 	for {
 		select {
 		case conn := <-h.register:
+			if conn.isClosed() {
+				// Closed while registering, its unregister was a no-op
+				continue
+			}
+			h.mx.RLock()
+			err := h.checkConnQuota(conn)
+			h.mx.RUnlock()
+			if err != nil {
+				conn.logger().Warn("turning device away", "err", err)
+				conn.fail(CloseQuota, err.Error())
+				continue
+			}
+			if !h.takeId(conn) {
+				continue
+			}
+			// Before anyone else can send to it
+			h.resendSession(conn)
+			h.mx.Lock()
 			h.conns[conn] = true
+			h.owners[conn.Device.Owner]++
 			if _, ok := h.OwnersToIds[conn.Device.Owner]; !ok {
 				h.OwnersToIds[conn.Device.Owner] = make(map[string]bool)
 			}
 			h.OwnersToIds[conn.Device.Owner][conn.Device.Id] = true
 			h.IdsToConns[conn.Device.Id] = conn
+			conn.Device.Online = true
+			h.mx.Unlock()
+			if h.cluster != nil {
+				h.cluster.join(conn.Device.Id)
+			}
+			registrations.Inc()
+			devicesConnected.WithLabelValues(conn.Device.Owner).Inc()
+			tenantDevicesConnected.WithLabelValues(conn.Device.Tenant).Inc()
+			h.Publish(EventConnected, conn.Device, nil)
+			h.hooks.runConnect(conn.Device)
+			h.redeliver(conn.Device)
+			go h.flushQueue(conn.Device.Id)
+			go h.pushDelta(conn)
 
-			//log.Println("Registered conn")
+			conn.logger().Info("registered")
 		case conn := <-h.unregister:
-			//log.Println("Unregistered conn")
 			cleanup(conn)
+		case <-reaper.C:
+			h.reap()
+		case done := <-h.probe:
+			close(done)
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+// Stops accepting devices, says goodbye to every connected one and waits
+// until their queued messages are flushed and their pumps exit, or ctx
+// is done, in which case the remaining connections are closed abruptly and
+// whatever they had queued fails with ErrNotConnected. Deliveries still
+// waiting for an ACK fail with ErrShuttingDown. Run returns afterwards.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mx.Lock()
+	if h.shuttingDown {
+		h.mx.Unlock()
+		return ErrShuttingDown
+	}
+	h.shuttingDown = true
+	conns := make([]*Conn, 0, len(h.live))
+	for c := range h.live {
+		conns = append(conns, c)
+	}
+	h.mx.Unlock()
+
+	slog.Info("shutting down hub", "conns", len(conns))
+	for _, c := range conns {
+		c.drain()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, c := range conns {
+			c.pumps.Wait()
+		}
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	h.failDeliveries(ErrShuttingDown)
+	close(h.quit)
+	return err
+}
+
+func (h *Hub) isShuttingDown() bool {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+	return h.shuttingDown
+}
+
+// Adds a new connection unless the hub is shutting down or its IP has
+// too many already
+func (h *Hub) addLive(c *Conn) error {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if h.shuttingDown {
+		return ErrShuttingDown
+	}
+	if c.ip != "" {
+		if h.Config.Limits.ConnsPerIP > 0 && h.ips[c.ip] >= h.Config.Limits.ConnsPerIP {
+			return ErrTooManyConns
+		}
+		h.ips[c.ip]++
+	}
+	h.live[c] = true
+	return nil
+}
+
+func (h *Hub) removeLive(c *Conn) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if !h.live[c] {
+		return
+	}
+	delete(h.live, c)
+	if c.ip != "" {
+		if h.ips[c.ip]--; h.ips[c.ip] <= 0 {
+			delete(h.ips, c.ip)
+		}
+	}
+}
+
+// Returns true if ip can't open more connections
+func (h *Hub) tooManyConns(ip string) bool {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+	return h.Config.Limits.ConnsPerIP > 0 && h.ips[ip] >= h.Config.Limits.ConnsPerIP
+}
+
+// Forces closure of registered connections that haven't been seen for
+// longer than their keepalive plus some slack, and refreshes the presence
+// of the others, counts the slow ones and forgets expired sessions. Must be
+// called from Run.
+func (h *Hub) reap() {
+	now := time.Now()
+	slow := 0
+	for conn := range h.conns {
+		if len(conn.Send) > cap(conn.Send)/2 {
+			slow++
+		}
+		deadline := now.Add(-conn.keepAlive() - reapSlack).Unix()
+		if atomic.LoadInt64(&conn.Device.LastSeen) < deadline {
+			conn.logger().Info("reaping stale connection")
+			// Close unregisters through the hub, so it can't run on this goroutine
+			go conn.Close()
+		} else if h.cluster != nil {
+			h.cluster.refresh(conn.Device.Id)
 		}
 	}
+	slowDevices.Set(float64(slow))
+	h.expireSessions()
+	h.expireLogs()
 }
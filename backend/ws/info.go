@@ -0,0 +1,36 @@
+package ws
+
+import "github.com/twinone/iot/backend/model"
+
+// Records the hardware model and firmware version a device announces in
+// INFO, e.g. "INFO model esp12e firmware 1.4.0 profile light". Firmware
+// updates are only sent to devices whose model matches. The profile is
+// optional, devices that don't say keep the one their owner set.
+func (c *Conn) info(msg *Message) {
+	values := msg.Values()
+	m, fw := values["model"], values["firmware"]
+	if len(m) > 64 || len(fw) > 64 {
+		c.sendError(model.ErrCodeMalformed, msg.Cmd)
+		return
+	}
+	p, ok := values["profile"]
+	if ok && model.FindProfile(p) == nil {
+		c.sendError(model.ErrCodeMalformed, msg.Cmd)
+		return
+	}
+	c.mx.Lock()
+	if !ok {
+		p = c.Device.Profile
+	}
+	if m == c.Device.Model && fw == c.Device.Firmware && p == c.Device.Profile {
+		c.mx.Unlock()
+		return
+	}
+	c.Device.Model, c.Device.Firmware, c.Device.Profile = m, fw, p
+	c.mx.Unlock()
+	if c.Device.State == model.StateConnected {
+		d := c.Snapshot()
+		c.hub.saveDevice(d)
+		c.hub.Publish(EventUpdated, d, nil)
+	}
+}
@@ -0,0 +1,96 @@
+package ws
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// An Interceptor sees a message between a device and the hub and returns
+// the one to go on with: msg itself, a changed copy (msg must not be
+// changed in place, others may hold it), or nil to drop it. An error drops
+// it too: inbound, the device is sent ERR forbidden, outbound, the sender
+// gets the error.
+//
+// Inbound interceptors run on the connection goroutine right after a
+// message is decoded, before hooks and the hub handle it. Outbound ones
+// run on whatever goroutine sends, before the message is signed and
+// queued. Binary file chunks don't go through them. Like hooks, they must
+// not block.
+type Interceptor func(d *model.Device, msg *Message) (*Message, error)
+
+var ErrDropped = errors.New("message dropped by an interceptor")
+
+type interceptor struct {
+	id int
+	f  Interceptor
+}
+
+// Interceptors run in the order they were added
+type interceptors struct {
+	mx       sync.RWMutex
+	next     int
+	inbound  []interceptor
+	outbound []interceptor
+}
+
+// Adds an interceptor for messages from devices, returns a func to remove
+// it
+func (h *Hub) InterceptInbound(f Interceptor) (remove func()) {
+	return h.interceptors.add(&h.interceptors.inbound, f)
+}
+
+// Adds an interceptor for messages to devices, returns a func to remove it
+func (h *Hub) InterceptOutbound(f Interceptor) (remove func()) {
+	return h.interceptors.add(&h.interceptors.outbound, f)
+}
+
+func (is *interceptors) add(chain *[]interceptor, f Interceptor) func() {
+	is.mx.Lock()
+	defer is.mx.Unlock()
+	id := is.next
+	is.next++
+	// Copied so running chains aren't changed under them
+	*chain = append((*chain)[:len(*chain):len(*chain)], interceptor{id, f})
+
+	return func() {
+		is.mx.Lock()
+		defer is.mx.Unlock()
+		res := make([]interceptor, 0, len(*chain))
+		for _, i := range *chain {
+			if i.id != id {
+				res = append(res, i)
+			}
+		}
+		*chain = res
+	}
+}
+
+// Runs msg through the chain, returns nil and ErrDropped if it's dropped
+func (is *interceptors) run(chain *[]interceptor, d *model.Device, msg *Message) (*Message, error) {
+	is.mx.RLock()
+	fs := *chain
+	is.mx.RUnlock()
+	for _, i := range fs {
+		var err error
+		if msg, err = i.f(d, msg); err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			return nil, ErrDropped
+		}
+	}
+	return msg, nil
+}
+
+func (is *interceptors) runInbound(d *model.Device, msg *Message) (*Message, error) {
+	return is.run(&is.inbound, d, msg)
+}
+
+func (is *interceptors) runOutbound(d *model.Device, msg *Message) (*Message, error) {
+	if msg.data != nil {
+		return msg, nil
+	}
+	return is.run(&is.outbound, d, msg)
+}
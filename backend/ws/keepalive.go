@@ -0,0 +1,61 @@
+package ws
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Extracts the keepalive a device asks for in its HELLO, in seconds, given
+// in the envelope by JSON devices or as a "keepalive=N" argument in the
+// text protocol. Returns the remaining arguments and 0 if there is none.
+func helloKeepAlive(msg *Message, args []string) (time.Duration, []string) {
+	if msg.KeepAlive != 0 {
+		return time.Duration(msg.KeepAlive) * time.Second, args
+	}
+	rest := make([]string, 0, len(args))
+	var keepAlive time.Duration
+	for _, a := range args {
+		if !strings.HasPrefix(a, "keepalive=") {
+			rest = append(rest, a)
+			continue
+		}
+		if s, err := strconv.Atoi(strings.TrimPrefix(a, "keepalive=")); err == nil && s > 0 {
+			keepAlive = time.Duration(s) * time.Second
+		}
+	}
+	return keepAlive, rest
+}
+
+// Makes the device be considered gone after keepAlive of silence instead
+// of the hub's PongWait, within the bounds of the config. Returns what
+// was granted. Must be called from the reading goroutine.
+func (c *Conn) setKeepAlive(keepAlive time.Duration) time.Duration {
+	cfg := &c.hub.Config
+	if keepAlive < cfg.MinKeepAlive {
+		keepAlive = cfg.MinKeepAlive
+	}
+	if keepAlive > cfg.MaxKeepAlive {
+		keepAlive = cfg.MaxKeepAlive
+	}
+	atomic.StoreInt64(&c.pongWait, int64(keepAlive))
+	if c.ws != nil {
+		c.ws.SetReadDeadline(time.Now().Add(keepAlive))
+		select {
+		case c.pingReset <- c.PingPeriod():
+		default:
+		}
+	}
+	return keepAlive
+}
+
+// How long the device may stay silent before it's considered gone
+func (c *Conn) keepAlive() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.pongWait))
+}
+
+// How often the device is pinged, so it's heard from at least as often
+func (c *Conn) PingPeriod() time.Duration {
+	return c.keepAlive() * 7 / 10
+}
@@ -0,0 +1,161 @@
+package ws
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+const (
+	// Pings kept to judge a connection
+	linkWindow = 16
+	// Averages above these, or losing this share of pings, make a link
+	// fair or poor
+	fairRTT  = 300 * time.Millisecond
+	poorRTT  = time.Second
+	fairLoss = 0.05
+	poorLoss = 0.25
+)
+
+// The outcome of the last pings of a connection, written by writePump when
+// pinging and readPump when the pong comes back
+type link struct {
+	mx sync.Mutex
+	// Round-trip times, -1 for pings that got no pong, oldest first once
+	// the ring is full
+	samples [linkWindow]time.Duration
+	n, next int
+	// Payload of the ping waiting for a pong, 0 if none
+	pending int64
+	quality model.LinkQuality
+	// The connection was closed, late pongs don't count it again
+	gone bool
+}
+
+func (l *link) push(rtt time.Duration) {
+	l.samples[l.next] = rtt
+	l.next = (l.next + 1) % linkWindow
+	if l.n < linkWindow {
+		l.n++
+	}
+}
+
+// Called when a ping with payload is written, the previous one is lost if
+// it wasn't answered by now
+func (c *Conn) pinged(payload []byte) {
+	sent, _ := strconv.ParseInt(string(payload), 10, 64)
+	c.link.mx.Lock()
+	lost := c.link.pending != 0
+	if lost {
+		c.link.push(-1)
+	}
+	c.link.pending = sent
+	c.link.mx.Unlock()
+	if lost {
+		pingsLost.Inc()
+		c.updateLink()
+	}
+}
+
+// Called with the payload of each pong
+func (c *Conn) ponged(payload string) {
+	rtt, ok := observePong(payload)
+	if !ok {
+		return
+	}
+	sent, _ := strconv.ParseInt(payload, 10, 64)
+	c.link.mx.Lock()
+	// Pongs of pings already counted as lost don't count twice
+	current := sent == c.link.pending
+	if current {
+		c.link.pending = 0
+		c.link.push(rtt)
+	}
+	c.link.mx.Unlock()
+	if current {
+		c.updateLink()
+	}
+}
+
+// Publishes the state of the window in Device.Link and the quality
+// metrics
+func (c *Conn) updateLink() {
+	c.link.mx.Lock()
+	defer c.link.mx.Unlock()
+	if c.link.gone {
+		return
+	}
+	l := c.link.summary()
+	// Readers get a new value rather than one being written to
+	c.Device.Link = l
+	c.link.setQuality(l.Quality)
+}
+
+// Takes the connection out of the quality metrics once it's gone
+func (c *Conn) forgetLink() {
+	c.link.mx.Lock()
+	defer c.link.mx.Unlock()
+	c.link.setQuality("")
+	c.link.gone = true
+}
+
+// Must be called with mx held
+func (l *link) setQuality(q model.LinkQuality) {
+	if q == l.quality {
+		return
+	}
+	if l.quality != "" {
+		linkQuality.WithLabelValues(l.quality).Dec()
+	}
+	if q != "" {
+		linkQuality.WithLabelValues(q).Inc()
+	}
+	l.quality = q
+}
+
+// Must be called with mx held
+func (l *link) summary() *model.Link {
+	res := &model.Link{Pings: l.n}
+	var sum, jitter, prev, min, max time.Duration
+	answered := 0
+	for i := 0; i < l.n; i++ {
+		rtt := l.samples[(l.next-l.n+i+linkWindow)%linkWindow]
+		if rtt < 0 {
+			res.Lost++
+			continue
+		}
+		if answered == 0 || rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		if answered > 0 {
+			jitter += (rtt - prev).Abs()
+		}
+		sum += rtt
+		prev = rtt
+		answered++
+	}
+	var avg time.Duration
+	if answered > 0 {
+		avg = sum / time.Duration(answered)
+		res.RTT = avg.Milliseconds()
+		res.RTTMin, res.RTTMax = min.Milliseconds(), max.Milliseconds()
+	}
+	if answered > 1 {
+		res.Jitter = (jitter / time.Duration(answered-1)).Milliseconds()
+	}
+	loss := float64(res.Lost) / float64(res.Pings)
+	switch {
+	case answered == 0 || loss >= poorLoss || avg >= poorRTT:
+		res.Quality = model.LinkPoor
+	case loss >= fairLoss || avg >= fairRTT:
+		res.Quality = model.LinkFair
+	default:
+		res.Quality = model.LinkGood
+	}
+	return res
+}
@@ -0,0 +1,28 @@
+package ws
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// Last connection id given, they only identify connections in logs
+var lastConnId uint64
+
+func nextConnId() uint64 {
+	return atomic.AddUint64(&lastConnId, 1)
+}
+
+// Returns a logger with what's known about the connection so far
+func (c *Conn) logger() *slog.Logger {
+	l := slog.With("conn", c.id)
+	if c.ip != "" {
+		l = l.With("remote", c.ip)
+	}
+	if c.Device.Id != "" {
+		l = l.With("device", c.Device.Id)
+	}
+	if c.Device.Owner != "" {
+		l = l.With("owner", c.Device.Owner)
+	}
+	return l
+}
@@ -0,0 +1,105 @@
+package ws
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	devicesConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "iot_devices_connected",
+		Help: "Registered device connections by owner.",
+	}, []string{"owner"})
+	tenantDevicesConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "iot_tenant_devices_connected",
+		Help: "Registered device connections by tenant, empty for the default one.",
+	}, []string{"tenant"})
+	registrations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "iot_registrations_total",
+		Help: "Devices registered in the hub.",
+	})
+	unregistrations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "iot_unregistrations_total",
+		Help: "Devices unregistered from the hub.",
+	})
+	messagesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "iot_messages_received_total",
+		Help: "Messages received from devices.",
+	})
+	bytesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "iot_received_bytes_total",
+		Help: "Bytes received from devices over WebSockets.",
+	})
+	messagesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "iot_messages_sent_total",
+		Help: "Messages written to devices over WebSockets.",
+	})
+	sendQueueFull = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iot_send_queue_full_total",
+		Help: "Messages that didn't fit in a device's send queue, by the overflow policy applied.",
+	}, []string{"policy"})
+	slowDevices = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "iot_slow_devices",
+		Help: "Registered devices whose send queue was over half full at the last check.",
+	})
+	sendQueueUsage = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "iot_send_queue_usage_ratio",
+		Help:    "How full the send queue was when a message was queued.",
+		Buckets: prometheus.LinearBuckets(0, 0.1, 11),
+	})
+	pingRTT = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "iot_ping_rtt_seconds",
+		Help:    "Time between a ping and its pong.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+	pingsLost = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "iot_pings_lost_total",
+		Help: "Pings that weren't answered before the next one.",
+	})
+	linkQuality = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "iot_link_quality_devices",
+		Help: "Connected devices by the quality of their link, see model.Link.",
+	}, []string{"quality"})
+	sessionsResumed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iot_sessions_resumed_total",
+		Help: "Devices asking to resume their session, by whether they could or it had expired.",
+	}, []string{"result"})
+	workWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "iot_work_wait_seconds",
+		Help:    "Time a device message waited for a worker.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+	connectionsClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iot_connections_closed_total",
+		Help: "Closed device connections by close code, 0 if closed without a close frame.",
+	}, []string{"code"})
+	quotaExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iot_quota_exceeded_total",
+		Help: "Devices, connections and telemetry turned away for going over a quota.",
+	}, []string{"quota"})
+)
+
+func init() {
+	prometheus.MustRegister(devicesConnected, tenantDevicesConnected, registrations, unregistrations,
+		messagesReceived, bytesReceived, messagesSent, sendQueueFull, slowDevices,
+		sendQueueUsage, pingRTT, pingsLost, linkQuality, sessionsResumed, workWait, connectionsClosed, quotaExceeded)
+}
+
+// Ping payloads carry the time they were sent so pongs give the RTT
+func pingPayload() []byte {
+	return []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+// Returns the RTT of the ping the pong answers, false if the payload isn't
+// one of ours
+func observePong(payload string) (time.Duration, bool) {
+	sent, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	rtt := time.Since(time.Unix(0, sent))
+	pingRTT.Observe(rtt.Seconds())
+	return rtt, true
+}
@@ -0,0 +1,62 @@
+package ws
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// A device that doesn't read as fast as it's sent messages fills its send
+// queue. What happens to the next message depends on the device's
+// Overflow, or Config.Overflow if it has none. Spilled messages go through
+// Deliver once the queue is half empty again, so they may arrive out of
+// order with what's sent meanwhile.
+
+// Returned by Conn.SendMessage for messages that went to the offline queue
+var ErrSpilled = errors.New("send queue full, message queued offline")
+
+// Returns the policy for c, must be called with mx held
+func (c *Conn) overflowPolicy() model.Overflow {
+	if c.Device.Overflow != "" {
+		return c.Device.Overflow
+	}
+	return c.hub.Config.Overflow
+}
+
+// Handles a message that didn't fit in the send queue with the policies
+// that can't run while holding mx
+func (c *Conn) overflow(policy model.Overflow, msg *Message) error {
+	switch policy {
+	case model.OverflowDisconnect:
+		c.logger().Warn("send queue full, disconnecting")
+		c.fail(CloseSlow, "send queue full")
+	case model.OverflowSpill:
+		// Deliveries retry on their own, and files can't be queued
+		if msg.Seq != 0 || msg.data != nil || c.hub.Store == nil {
+			break
+		}
+		text, err := TextCodec.Encode(msg)
+		if err == nil {
+			err = c.hub.enqueue(c.Device.Id, text)
+		}
+		if err != nil {
+			c.logger().Info("spilling message", "err", err)
+			break
+		}
+		atomic.StoreInt32(&c.spilled, 1)
+		msg.finish(ErrSpilled)
+		return nil
+	}
+	return ErrQueueFull
+}
+
+// Delivers the spilled messages once the send queue is half empty
+func (c *Conn) flushSpilled() {
+	if atomic.LoadInt32(&c.spilled) == 0 || len(c.outbox) > cap(c.outbox)/2 {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&c.spilled, 1, 0) {
+		go c.hub.flushQueue(c.Device.Id)
+	}
+}
@@ -0,0 +1,82 @@
+package ws
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+var (
+	ErrOwnerDisabled = errors.New("owner disabled")
+	// The device hasn't been onboarded and Config.RequireRegistered is set
+	ErrUnregistered = errors.New("device not onboarded")
+	ErrRemoved      = errors.New("device removed")
+	// The store failed, so the device couldn't be checked
+	ErrUnavailable = errors.New("try again later")
+)
+
+// Returns ErrUnknownOwner if owner isn't a registered user of tenant,
+// ErrOwnerDisabled if they were disabled, or ErrUnavailable if the store
+// failed
+func (h *Hub) checkOwner(owner, tenant string) error {
+	if h.Store == nil {
+		return nil
+	}
+	u, err := h.Store.FindUserByEmail(owner)
+	switch {
+	case err == store.ErrNotFound:
+		return ErrUnknownOwner
+	case err != nil:
+		slog.Error("finding owner", "owner", owner, "err", err)
+		return ErrUnavailable
+	case u.Tenant != tenant:
+		return ErrUnknownOwner
+	case u.Disabled:
+		return ErrOwnerDisabled
+	}
+	return nil
+}
+
+// Handles OWNER <email> from a device the store didn't know the owner of.
+// The owner must be an active user of its tenant, and the device new, and
+// allowed to be claimed that way, or already theirs. Devices speaking
+// version 2 are answered "OWNER accepted <email>" or "OWNER rejected
+// <reason>" before they're let in or turned away.
+func (c *Conn) owner(msg *Message) {
+	c.Device.Owner = msg.Arg(0)
+	err := c.hub.checkOwner(c.Device.Owner, c.Device.Tenant)
+	if err == nil {
+		err = c.hub.loadDevice(c.Device)
+	}
+	var reason string
+	var code int
+	switch {
+	case err == nil:
+		if c.version >= 2 {
+			c.send(&Message{Cmd: model.RespOwner, Args: []string{model.OwnerAccepted, c.Device.Owner}})
+		}
+		c.hub.connect(c)
+		return
+	case err == ErrUnknownOwner:
+		reason, code = model.OwnerUnknown, CloseUnknownOwner
+	case err == ErrOwnerDisabled:
+		reason, code = model.OwnerDisabled, CloseUnknownOwner
+	case err == ErrOwnerMismatch:
+		reason, code = model.OwnerMismatch, CloseOwnerMismatch
+	case err == ErrUnregistered:
+		reason, code = model.OwnerUnregistered, CloseUnregistered
+	case err == ErrRemoved:
+		reason, code = model.OwnerRemoved, CloseRemoved
+	case errors.Is(err, ErrQuotaExceeded):
+		reason, code = model.OwnerQuota, CloseQuota
+	default:
+		reason, code = model.OwnerUnavailable, CloseTryAgain
+	}
+	c.logger().Warn("turning device away", "owner", c.Device.Owner, "err", err)
+	if c.version >= 2 {
+		c.send(&Message{Cmd: model.RespOwner, Args: []string{model.OwnerRejected, reason}})
+	}
+	c.fail(code, err.Error())
+}
@@ -0,0 +1,235 @@
+package ws
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+const (
+	// How long a pairing code can be used for
+	pairingTTL = 10 * time.Minute
+	// Number of digits in a pairing code
+	pairingDigits = 6
+	// Wrong codes a user may try before they have to wait claimLockout
+	// since the last one
+	maxClaimFailures = 5
+	claimLockout     = pairingTTL
+	// Wrong codes anyone may try while a code is valid before the device is
+	// sent a new one, so guessing any code is at most this many tries in a
+	// million
+	maxCodeMisses = 100
+)
+
+var (
+	ErrInvalidPairingCode = errors.New("invalid or expired pairing code")
+	ErrTooManyAttempts    = errors.New("too many wrong pairing codes, try again later")
+)
+
+type pairing struct {
+	conn    *Conn
+	expires time.Time
+	// Hub.claimMisses when it was sent
+	misses int
+}
+
+type claimFailures struct {
+	n     int
+	until time.Time
+}
+
+// Called after a valid HELLO. Devices with an owner in the store are
+// registered right away, unknown ones are sent a pairing code.
+// Without a store the device is trusted to announce its OWNER.
+func (h *Hub) hello(c *Conn) {
+	if h.Store == nil {
+		c.Device.State = model.StatePendingOwner
+		return
+	}
+
+	d, err := h.Store.FindDevice(c.Device.Id)
+	switch {
+	case err == store.ErrNotFound && h.Config.RequireRegistered:
+		c.logger().Warn("device not onboarded")
+		c.fail(CloseUnregistered, "device not onboarded")
+	case err == store.ErrNotFound && !model.ValidNewDeviceId(strings.TrimPrefix(c.Device.Id, c.Device.Tenant+":")):
+		c.logger().Warn("invalid id for a new device")
+		c.fail(CloseMalformed, "invalid id")
+	case err == store.ErrNotFound:
+		h.startPairing(c)
+	case err != nil:
+		// Not trusting OWNER instead, it could claim someone else's device
+		c.logger().Error("loading device", "err", err)
+		c.fail(CloseTryAgain, ErrUnavailable.Error())
+	case d.Deleted != 0:
+		c.logger().Warn("device removed")
+		c.fail(CloseRemoved, ErrRemoved.Error())
+	case d.Tenant != c.Device.Tenant:
+		// An old id with ':' that looks like one of the tenant's
+		c.logger().Warn("device of another tenant", "tenant", d.Tenant)
+		c.fail(CloseUnauthorized, "device of another tenant")
+	default:
+		switch h.checkOwner(d.Owner, d.Tenant) {
+		case ErrOwnerDisabled:
+			c.logger().Warn("owner disabled", "owner", d.Owner)
+			c.fail(CloseUnknownOwner, ErrOwnerDisabled.Error())
+			return
+		case ErrUnavailable:
+			c.fail(CloseTryAgain, ErrUnavailable.Error())
+			return
+		}
+		c.Device.Owner = d.Owner
+		if c.Device.Name == "" {
+			c.Device.Name = d.Name
+		}
+		c.Device.Confirmed = d.Confirmed
+		c.Device.QueueSize, c.Device.QueueTTL, c.Device.Overflow = d.QueueSize, d.QueueTTL, d.Overflow
+		c.Device.Tags, c.Device.Timezone, c.Device.TokenNonce = d.Tags, d.Timezone, d.TokenNonce
+		if c.Device.Profile == "" {
+			c.Device.Profile = d.Profile
+		}
+		keepKey(c.Device, d.PublicKey)
+		h.connect(c)
+	}
+}
+
+func (h *Hub) connect(c *Conn) {
+	c.Device.State = model.StateConnected
+	select {
+	case h.register <- c:
+	case <-h.quit:
+		c.Close()
+		return
+	}
+	h.saveDevice(c.Snapshot())
+}
+
+func (h *Hub) startPairing(c *Conn) {
+	h.mx.Lock()
+	code := ""
+	for code == "" || h.pairings[code] != nil {
+		code = randCode()
+	}
+	h.pairings[code] = &pairing{conn: c, expires: time.Now().Add(pairingTTL), misses: h.claimMisses}
+	h.mx.Unlock()
+
+	c.pairingCode = code
+	c.Device.State = model.StateUnclaimed
+	if err := c.send(&Message{Cmd: model.MsgPair, Args: []string{code}}); err != nil {
+		c.logger().Error("sending pairing code", "err", err)
+	}
+}
+
+// Drops the pairing code of a connection that's going away
+func (h *Hub) stopPairing(c *Conn) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if p := h.pairings[c.pairingCode]; p != nil && p.conn == c {
+		delete(h.pairings, c.pairingCode)
+	}
+}
+
+// Binds the device that was sent code to owner, a user of tenant, and
+// registers it. Returns the claimed device, a QuotaError if owner has as
+// many as they may, or ErrTooManyAttempts if they tried too many wrong
+// codes.
+func (h *Hub) Claim(code string, owner string, tenant string) (*model.Device, error) {
+	if err := h.CheckDeviceQuota(owner); err != nil {
+		return nil, err
+	}
+	h.mx.Lock()
+	if f := h.claimFailures[owner]; f != nil && f.n >= maxClaimFailures && time.Now().Before(f.until) {
+		h.mx.Unlock()
+		return nil, ErrTooManyAttempts
+	}
+	p := h.pairings[code]
+	if p != nil && p.conn.Device.Tenant != tenant {
+		// Not even worth burning the code
+		p = nil
+	} else {
+		delete(h.pairings, code)
+	}
+	var guessed []*Conn
+	if p == nil {
+		guessed = h.missed(owner)
+	}
+	h.mx.Unlock()
+
+	for _, c := range guessed {
+		c.mx.Lock()
+		closed := c.closed
+		c.mx.Unlock()
+		if !closed {
+			c.logger().Warn("too many wrong pairing codes, sending a new one")
+			h.startPairing(c)
+		}
+	}
+
+	if p == nil || time.Now().After(p.expires) || p.conn.Device.State != model.StateUnclaimed {
+		return nil, ErrInvalidPairingCode
+	}
+
+	c := p.conn
+	c.mx.Lock()
+	if c.closed {
+		c.mx.Unlock()
+		return nil, ErrNotConnected
+	}
+	c.Device.Owner = owner
+	c.Device.Confirmed = true
+	// Its owner gets a token with it, tokens of a purged device with the
+	// same id don't work
+	c.Device.TokenNonce = NewTokenNonce()
+	c.mx.Unlock()
+
+	h.connect(c)
+	return c.Device, nil
+}
+
+// Counts a wrong code tried by owner. Returns the connections whose code
+// was guessed at maxCodeMisses times, which are dropped from pairings to be
+// sent a new one. Must be called with mx held.
+func (h *Hub) missed(owner string) []*Conn {
+	now := time.Now()
+	for o, f := range h.claimFailures {
+		if now.After(f.until) {
+			delete(h.claimFailures, o)
+		}
+	}
+	f := h.claimFailures[owner]
+	if f == nil {
+		f = &claimFailures{}
+		h.claimFailures[owner] = f
+	}
+	f.n++
+	f.until = now.Add(claimLockout)
+
+	h.claimMisses++
+	var guessed []*Conn
+	for code, p := range h.pairings {
+		if h.claimMisses-p.misses >= maxCodeMisses {
+			delete(h.pairings, code)
+			guessed = append(guessed, p.conn)
+		}
+	}
+	return guessed
+}
+
+func randCode() string {
+	max := big.NewInt(1)
+	for i := 0; i < pairingDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%0*d", pairingDigits, n)
+}
@@ -0,0 +1,79 @@
+package ws
+
+import (
+	"fmt"
+	"testing"
+)
+
+func unclaimed(t *testing.T, h *Hub) *Conn {
+	t.Helper()
+	c := newConn(h, TextCodec)
+	h.startPairing(c)
+	if c.pairingCode == "" {
+		t.Fatal("no pairing code")
+	}
+	return c
+}
+
+// Returns a code that isn't c's
+func wrongCode(c *Conn) string {
+	if c.pairingCode == "000000" {
+		return "000001"
+	}
+	return "000000"
+}
+
+func TestClaimLocksOutUser(t *testing.T) {
+	h := NewHub(Config{})
+	c := unclaimed(t, h)
+
+	for i := 0; i < maxClaimFailures; i++ {
+		if _, err := h.Claim(wrongCode(c), "mallory@example.com", ""); err != ErrInvalidPairingCode {
+			t.Fatalf("wrong code %d: got %v, want ErrInvalidPairingCode", i, err)
+		}
+	}
+	// Even the right code is refused now
+	if _, err := h.Claim(c.pairingCode, "mallory@example.com", ""); err != ErrTooManyAttempts {
+		t.Fatalf("got %v, want ErrTooManyAttempts", err)
+	}
+	if h.pairings[c.pairingCode] == nil {
+		t.Fatal("the refused claim burnt the code")
+	}
+
+	// Other users aren't locked out
+	if _, err := h.Claim(wrongCode(c), "alice@example.com", ""); err != ErrInvalidPairingCode {
+		t.Fatalf("got %v, want ErrInvalidPairingCode", err)
+	}
+}
+
+func TestClaimRotatesGuessedCode(t *testing.T) {
+	h := NewHub(Config{})
+	c := unclaimed(t, h)
+	code := c.pairingCode
+
+	// From many users, so none is locked out
+	for i := 0; i < maxCodeMisses; i++ {
+		user := fmt.Sprintf("user%d@example.com", i)
+		if _, err := h.Claim(wrongCode(c), user, ""); err != ErrInvalidPairingCode {
+			t.Fatalf("wrong code %d: got %v, want ErrInvalidPairingCode", i, err)
+		}
+	}
+	if c.pairingCode == code {
+		t.Fatal("the code wasn't rotated")
+	}
+	if h.pairings[code] != nil {
+		t.Fatal("the old code still works")
+	}
+	if p := h.pairings[c.pairingCode]; p == nil || p.conn != c {
+		t.Fatal("the new code doesn't pair the device")
+	}
+	// The device was told
+	var sent []string
+	for len(c.outbox) > 0 {
+		m := <-c.outbox
+		sent = append(sent, m.Cmd+" "+m.Args[0])
+	}
+	if len(sent) != 2 || sent[1] != "PAIR "+c.pairingCode {
+		t.Fatalf("sent %q, want the old and new PAIR", sent)
+	}
+}
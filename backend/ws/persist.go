@@ -0,0 +1,126 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/twinone/iot/backend/audit"
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+// Merges the persisted record of a device that just announced its owner
+// into d. Returns ErrOwnerMismatch if the id is already registered to
+// another owner, ErrRemoved if it was deleted, ErrUnregistered if it's new and Config.RequireRegistered
+// is set, ErrInvalidId if it's new and its id isn't valid for new devices,
+// a QuotaError if it's new and the owner has too many, or ErrUnavailable
+// if the store failed.
+func (h *Hub) loadDevice(d *model.Device) error {
+	if h.Store == nil {
+		return nil
+	}
+	saved, err := h.Store.FindDevice(d.Id)
+	if err == store.ErrNotFound {
+		if h.Config.RequireRegistered {
+			return ErrUnregistered
+		}
+		if !model.ValidNewDeviceId(d.Id) {
+			return ErrInvalidId
+		}
+		// New devices belong to whoever they announce, if they have room
+		if err := h.CheckDeviceQuota(d.Owner); errors.Is(err, ErrQuotaExceeded) {
+			return err
+		}
+		// So tokens of a purged device with the same id don't work
+		d.TokenNonce = NewTokenNonce()
+		audit.Record(audit.WithVia(context.Background(), "device"), h.Store, d.Owner, model.AuditClaim, d, "")
+		return nil
+	}
+	if err != nil {
+		slog.Error("loading device", "device", d.Id, "err", err)
+		return ErrUnavailable
+	}
+	if saved.Owner != d.Owner {
+		return ErrOwnerMismatch
+	}
+	if saved.Deleted != 0 {
+		return ErrRemoved
+	}
+	if d.Name == "" {
+		d.Name = saved.Name
+	}
+	d.Confirmed = saved.Confirmed
+	d.QueueSize, d.QueueTTL, d.Overflow = saved.QueueSize, saved.QueueTTL, saved.Overflow
+	d.Tags, d.Timezone = saved.Tags, saved.Timezone
+	if d.Profile == "" {
+		d.Profile = saved.Profile
+	}
+	if d.Model == "" {
+		d.Model, d.Firmware = saved.Model, saved.Firmware
+	}
+	d.TokenNonce = saved.TokenNonce
+	keepKey(d, saved.PublicKey)
+	return nil
+}
+
+func (h *Hub) saveDevice(d *model.Device) {
+	if h.Store == nil {
+		return
+	}
+	if err := h.Store.SaveDevice(record(d)); err != nil {
+		slog.Error("saving device", "device", d.Id, "err", err)
+	}
+}
+
+// Returns the persisted fields of d
+func record(d *model.Device) *model.Device {
+	return &model.Device{
+		Id:         d.Id,
+		Owner:      d.Owner,
+		Name:       d.Name,
+		Confirmed:  d.Confirmed,
+		LastSeen:   atomic.LoadInt64(&d.LastSeen),
+		QueueSize:  d.QueueSize,
+		QueueTTL:   d.QueueTTL,
+		Overflow:   d.Overflow,
+		Model:      d.Model,
+		Firmware:   d.Firmware,
+		Tags:       d.Tags,
+		Profile:    d.Profile,
+		Timezone:   d.Timezone,
+		Deleted:    d.Deleted,
+		Tenant:     d.Tenant,
+		PublicKey:  d.PublicKey,
+		SigningKey: d.SigningKey,
+		TokenNonce: d.TokenNonce,
+	}
+}
+
+// Returns a copy of the device to read or change. The API changes the
+// settings of connected devices from other goroutines, so the connection
+// reads and writes them with mx held, see ApplySettings.
+func (c *Conn) Snapshot() *model.Device {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	d := record(c.Device)
+	d.Functions, d.State, d.Online = c.Device.Functions, c.Device.State, c.Device.Online
+	d.RemoteAddr, d.Link = c.Device.RemoteAddr, c.Device.Link
+	return d
+}
+
+// Applies the settings of d its owner changes through the API (name,
+// queues, tags, profile and timezone) to its connection if it's connected
+// to this node, others pick them up from the store when they connect
+func (h *Hub) ApplySettings(d *model.Device) {
+	conn := h.GetConn(d.Id)
+	if conn == nil {
+		return
+	}
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	cd := conn.Device
+	cd.Name, cd.QueueSize, cd.QueueTTL, cd.Overflow = d.Name, d.QueueSize, d.QueueTTL, d.Overflow
+	cd.Tags, cd.Profile, cd.Timezone = d.Tags, d.Profile, d.Timezone
+}
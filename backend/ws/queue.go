@@ -0,0 +1,139 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+// Used for devices that don't set their own queue size or TTL
+const (
+	defaultQueueSize = 32
+	defaultQueueTTL  = 24 * time.Hour
+)
+
+var (
+	ErrOfflineQueueFull = errors.New("offline queue full")
+	ErrQueueDisabled    = errors.New("device doesn't queue commands")
+)
+
+func queueLimits(d *model.Device) (int, time.Duration) {
+	size, ttl := d.QueueSize, time.Duration(d.QueueTTL)*time.Second
+	if size == 0 {
+		size = defaultQueueSize
+	}
+	if ttl == 0 {
+		ttl = defaultQueueTTL
+	}
+	return size, ttl
+}
+
+// Drops the messages that expired before now
+func unexpired(q []*model.QueuedMessage, now int64) []*model.QueuedMessage {
+	res := q[:0]
+	for _, m := range q {
+		if m.Expires > now {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// Sends a message in the text protocol format to a device, or queues it
+// if the device is offline. Queued messages are delivered in order when
+// it reconnects. Returns true if the message was queued. The message is
+// kept in the device's history.
+func (h *Hub) SendOrQueue(ctx context.Context, id string, msg []byte) (queued bool, err error) {
+	if _, err := TextCodec.Decode(msg); err != nil {
+		return false, err
+	}
+	start := time.Now()
+	defer func() {
+		result := model.ResultSent
+		switch {
+		case queued:
+			result = model.ResultQueued
+		case err != nil:
+			result = failure(err)
+		}
+		h.recordCommand(ctx, id, msg, start, result, nil, err)
+	}()
+
+	err = h.SendToDevice(ctx, id, msg)
+	if err != ErrNotConnected && err != ErrStaleConnection {
+		return false, err
+	}
+	if h.Store == nil {
+		return false, err
+	}
+	if err := h.enqueue(id, msg); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Appends a message in the text protocol format to the offline queue
+func (h *Hub) enqueue(id string, msg []byte) error {
+	d, err := h.Store.FindDevice(id)
+	if err == store.ErrNotFound {
+		return ErrNotConnected
+	}
+	if err != nil {
+		return err
+	}
+	// It can't connect to get them
+	if d.Deleted != 0 {
+		return ErrNotConnected
+	}
+	size, ttl := queueLimits(d)
+	if size < 0 {
+		return ErrQueueDisabled
+	}
+
+	h.queueMx.Lock()
+	defer h.queueMx.Unlock()
+
+	q, err := h.Store.FindQueue(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	q = unexpired(q, now.Unix())
+	if len(q) >= size {
+		return ErrOfflineQueueFull
+	}
+	q = append(q, &model.QueuedMessage{Msg: string(msg), Expires: now.Add(ttl).Unix()})
+	return h.Store.SaveQueue(id, q)
+}
+
+// Hands the offline queue of a device that just connected, or caught up
+// with its spilled messages, over to Deliver, which keeps retrying until
+// each message is acknowledged
+func (h *Hub) flushQueue(id string) {
+	if h.Store == nil {
+		return
+	}
+	h.queueMx.Lock()
+	defer h.queueMx.Unlock()
+
+	q, err := h.Store.FindQueue(id)
+	if err != nil {
+		slog.Error("loading queue", "device", id, "err", err)
+		return
+	}
+	if len(q) == 0 {
+		return
+	}
+	q = unexpired(q, time.Now().Unix())
+	slog.Info("flushing queue", "device", id, "messages", len(q))
+	for _, m := range q {
+		h.Deliver(context.Background(), id, []byte(m.Msg))
+	}
+	if err := h.Store.SaveQueue(id, nil); err != nil {
+		slog.Error("clearing queue", "device", id, "err", err)
+	}
+}
@@ -0,0 +1,83 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// Quotas keep a single owner from exhausting the server, see Limits. Going
+// over one fails with a QuotaError, which devices get as close code
+// CloseQuota or "ERR quota telemetry".
+const (
+	QuotaDevices     = "devices"
+	QuotaConnections = "connections"
+	QuotaTelemetry   = "telemetry"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+type QuotaError struct {
+	// One of the Quota constants
+	Quota string
+	Limit float64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%v: at most %v %s", ErrQuotaExceeded, e.Limit, e.Quota)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+func exceeded(quota string, limit float64) *QuotaError {
+	quotaExceeded.WithLabelValues(quota).Inc()
+	return &QuotaError{Quota: quota, Limit: limit}
+}
+
+// Returns a QuotaError if owner can't have another device
+func (h *Hub) CheckDeviceQuota(owner string) error {
+	max := h.Config.Limits.DevicesPerOwner
+	if max <= 0 || h.Store == nil {
+		return nil
+	}
+	devices, err := h.Store.FindDevicesByOwner(owner)
+	if err != nil {
+		return err
+	}
+	if len(devices) >= max {
+		return exceeded(QuotaDevices, float64(max))
+	}
+	return nil
+}
+
+// Returns a QuotaError if the owner of c has as many registered connections
+// as they may, not counting one c replaces. Must be called from Run with mx
+// held.
+func (h *Hub) checkConnQuota(c *Conn) error {
+	max := h.Config.Limits.ConnsPerOwner
+	if max <= 0 {
+		return nil
+	}
+	n := h.owners[c.Device.Owner]
+	if old := h.IdsToConns[c.Device.Id]; old != nil && h.conns[old] && old.Device.Owner == c.Device.Owner {
+		n--
+	}
+	if n >= max {
+		return exceeded(QuotaConnections, float64(max))
+	}
+	return nil
+}
+
+// Returns false, telling the device, if c sends telemetry faster than
+// Limits.TelemetryPerSecond
+func (c *Conn) telemetryAllowed() bool {
+	if c.telemetryRate.allow(1) {
+		return true
+	}
+	exceeded(QuotaTelemetry, c.hub.Config.Limits.TelemetryPerSecond)
+	c.sendError(model.ErrCodeQuota, QuotaTelemetry)
+	return false
+}
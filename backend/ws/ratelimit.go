@@ -0,0 +1,112 @@
+package ws
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Limits on what a single device or owner can do, zero values disable a
+// limit
+type Limits struct {
+	// Sustained rate and burst of messages from a device
+	MessagesPerSecond float64
+	MessageBurst      int
+	// Sustained rate and burst of bytes from a device
+	BytesPerSecond float64
+	ByteBurst      int
+	// Open connections from the same IP
+	ConnsPerIP int
+	// Devices a user may own and have connected at once, see quota.go
+	DevicesPerOwner int
+	ConnsPerOwner   int
+	// Sustained rate and burst of TELEMETRY from a device, the rest is
+	// dropped
+	TelemetryPerSecond float64
+	TelemetryBurst     int
+	// Close connections that exceed a rate instead of slowing down reads
+	Disconnect bool
+}
+
+var DefaultLimits = Limits{
+	MessagesPerSecond: 20,
+	MessageBurst:      50,
+	BytesPerSecond:    4096,
+	ByteBurst:         16384,
+	ConnsPerIP:        32,
+}
+
+// A token bucket, only used by the goroutine reading a connection
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Returns nil if rate is 0, nil buckets never limit
+func newBucket(rate float64, burst int) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if float64(burst) < rate {
+		burst = int(rate)
+	}
+	return &bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *bucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Takes n tokens and returns how long to wait until they would have been
+// available, 0 if they were. Tokens are taken even if there aren't enough.
+func (b *bucket) take(n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill()
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Takes n tokens if there are enough, for what's dropped rather than
+// delayed
+func (b *bucket) allow(n float64) bool {
+	if b == nil {
+		return true
+	}
+	b.refill()
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Applies the message and byte rates to a message of size bytes, returns
+// false if the connection was closed for exceeding them
+func (c *Conn) limit(size int) bool {
+	wait := c.messages.take(1)
+	if w := c.bytes.take(float64(size)); w > wait {
+		wait = w
+	}
+	if wait == 0 {
+		return true
+	}
+	if c.hub.Config.Limits.Disconnect {
+		c.logger().Warn("rate limit exceeded, closing")
+		c.fail(websocket.ClosePolicyViolation, "rate limit exceeded")
+		return false
+	}
+	time.Sleep(wait)
+	return true
+}
@@ -0,0 +1,110 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrTimeout = errors.New("device didn't answer in time")
+
+// Commands devices answer by echoing the command and pin followed by the
+// result, e.g. "DR 5" is answered with "DR 5 1"
+var commands = map[string]bool{
+	model.CmdNop:                true,
+	model.CmdDigitalRead:        true,
+	model.CmdDigitalWrite:       true,
+	model.CmdAnalogRead:         true,
+	model.CmdAnalogWrite:        true,
+	model.CmdIntervalAnalogRead: true,
+	model.CmdSetServo:           true,
+	model.CmdIRSend:             true,
+}
+
+// Responses are matched to requests by command and first argument
+func responseKey(msg *Message) string {
+	return msg.Cmd + " " + msg.Arg(0)
+}
+
+// Sends a command in the text protocol format to a device and waits for
+// its answer until ctx is done. The command is kept in the device's
+// history.
+func (h *Hub) Request(ctx context.Context, id string, msg []byte) (resp *Message, err error) {
+	ctx, span := tracer.Start(ctx, "hub.Request", trace.WithAttributes(attribute.String("device.id", id)))
+	defer func() { endSpan(span, err) }()
+
+	m, err := decodeText(msg)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	defer func() {
+		result := model.ResultOK
+		if err != nil {
+			result = failure(err)
+		}
+		h.recordCommand(ctx, id, msg, start, result, resp, err)
+	}()
+	m.ctx = ctx
+	conn := h.GetConn(id)
+	if conn == nil {
+		return nil, ErrNotConnected
+	}
+
+	key := responseKey(m)
+	ch := make(chan *Message, 1)
+	conn.mx.Lock()
+	conn.waiters[key] = append(conn.waiters[key], ch)
+	conn.mx.Unlock()
+	defer conn.forget(key, ch)
+
+	if err := conn.send(m); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, ErrNotConnected
+		}
+		return resp, nil
+	case <-conn.Context().Done():
+		return nil, ErrNotConnected
+	case <-ctx.Done():
+		return nil, ErrTimeout
+	}
+}
+
+// Hands a response to the oldest request waiting for it, returns false
+// if nobody was waiting
+func (c *Conn) deliver(msg *Message) bool {
+	key := responseKey(msg)
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	chs := c.waiters[key]
+	if len(chs) == 0 {
+		return false
+	}
+	chs[0] <- msg
+	c.waiters[key] = chs[1:]
+	return true
+}
+
+func (c *Conn) forget(key string, ch chan *Message) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	chs := c.waiters[key]
+	for i := range chs {
+		if chs[i] == ch {
+			c.waiters[key] = append(chs[:i], chs[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package ws
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+// How long routing a message to another device may take
+const routeTimeout = 10 * time.Second
+
+// Routes "SEND <device> <command>" from a device to another device its
+// owner can control, e.g. "SEND lamp DW 5 HIGH" from a button. The command
+// goes out as is, or is queued if the other device is offline.
+func (c *Conn) route(msg *Message) {
+	to := msg.Arg(0)
+	if to == "" || len(msg.Args) < 2 || !commands[msg.Args[1]] {
+		c.sendError(model.ErrCodeMalformed, msg.Cmd)
+		return
+	}
+	owner := c.Device.Owner
+	cmd := msg.TailFrom(1)
+	// The store and the broker may be slow, don't hold up reading
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), routeTimeout)
+		defer cancel()
+		if !c.hub.canControl(owner, to) {
+			c.logger().Warn("SEND to a device the owner can't control", "to", to)
+			c.sendError(model.ErrCodeForbidden, to)
+			return
+		}
+		if _, err := c.hub.SendOrQueue(ctx, to, []byte(cmd)); err != nil {
+			c.logger().Info("routing message failed", "to", to, "err", err)
+			c.sendError(model.ErrCodeUnreachable, to)
+		}
+	}()
+}
+
+// Returns true if the device with id belongs to owner or is shared with
+// them as a controller. Unknown devices can't be controlled.
+func (h *Hub) canControl(owner string, id string) bool {
+	var deviceOwner string
+	if conn := h.GetConn(id); conn != nil {
+		deviceOwner = conn.Device.Owner
+	} else if h.Store != nil {
+		d, err := h.Store.FindDevice(id)
+		if err != nil {
+			if err != store.ErrNotFound {
+				slog.Error("finding device", "device", id, "err", err)
+			}
+			return false
+		}
+		if d.Deleted != 0 {
+			return false
+		}
+		deviceOwner = d.Owner
+	}
+	if deviceOwner == owner {
+		return true
+	}
+	if h.Store == nil {
+		return false
+	}
+	sh, err := h.Store.FindShare(id, owner)
+	return err == nil && sh.Role.Allows(model.RoleController)
+}
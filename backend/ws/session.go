@@ -0,0 +1,230 @@
+package ws
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A device that says "resume=N" in its HELLO, N being the highest sequence
+// number it got or 0 the first time, gets a session: everything sent to it
+// is numbered like deliveries and kept until it's acknowledged, up to
+// Config.SessionBuffer messages. If the connection drops without a BYE the
+// session outlives it for Config.SessionTTL, and whatever is sent to the
+// device meanwhile is kept too. A device that comes back in time with
+// "resume=N" is sent the messages after N before anything else, and told
+// "resume=N" in the HELLO reply. Otherwise, or if some of those messages
+// were dropped already, the reply says "resume=0" and it starts afresh.
+//
+// Sessions live in the node the device was connected to, a device that
+// reconnects to another one starts afresh.
+type session struct {
+	mx sync.Mutex
+	// Messages not acknowledged yet, oldest first
+	sent []*Message
+	// Highest sequence number dropped unacknowledged to make room
+	dropped uint64
+	// The connection using it, nil while the device is away
+	conn *Conn
+	// When it's forgotten if the device doesn't come back
+	expires time.Time
+}
+
+// Returns a copy of msg with the next sequence number
+func numbered(h *Hub, msg *Message) *Message {
+	m := *msg
+	m.Seq = atomic.AddUint64(&h.seq, 1)
+	return &m
+}
+
+// Keeps m until it's acknowledged, dropping the oldest message if the
+// buffer is full
+func (s *session) keep(m *Message, size int) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.sent = append(s.sent, m)
+	if over := len(s.sent) - size; over > 0 {
+		s.dropped = s.sent[over-1].Seq
+		s.sent = append(s.sent[:0:0], s.sent[over:]...)
+	}
+}
+
+// Forgets the messages up to seq, the device got them in order
+func (s *session) ack(seq uint64) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	i := 0
+	for i < len(s.sent) && s.sent[i].Seq <= seq {
+		i++
+	}
+	s.sent = s.sent[i:]
+}
+
+// Returns true if a connection uses it or its device may still come back
+func (s *session) live(now time.Time) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.conn != nil || now.Before(s.expires)
+}
+
+// Returns the messages after seq, false if some were dropped
+func (s *session) since(seq uint64) ([]*Message, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if seq < s.dropped {
+		return nil, false
+	}
+	var res []*Message
+	for _, m := range s.sent {
+		if m.Seq > seq {
+			res = append(res, m)
+		}
+	}
+	return res, true
+}
+
+// Extracts the "resume=N" argument of a HELLO, or the envelope field of
+// JSON devices. Returns the remaining arguments and false if there is none.
+func helloResume(msg *Message, args []string) (uint64, bool, []string) {
+	if msg.Resume != nil {
+		return *msg.Resume, true, args
+	}
+	rest := make([]string, 0, len(args))
+	var seq uint64
+	found := false
+	for _, a := range args {
+		if !strings.HasPrefix(a, "resume=") {
+			rest = append(rest, a)
+			continue
+		}
+		if n, err := strconv.ParseUint(strings.TrimPrefix(a, "resume="), 10, 64); err == nil {
+			seq, found = n, true
+		}
+	}
+	return seq, found, rest
+}
+
+// Gives c the session its device left if it can resume after seq, or a
+// new one. Returns false in the latter case.
+func (h *Hub) resumeSession(c *Conn, seq uint64) bool {
+	h.sessionMx.Lock()
+	defer h.sessionMx.Unlock()
+
+	s := h.sessions[c.Device.Id]
+	if s != nil && seq != 0 && s.live(time.Now()) {
+		if _, ok := s.since(seq); ok {
+			// Taken over from a connection that may not know it's dead yet
+			s.mx.Lock()
+			s.conn = c
+			s.mx.Unlock()
+			c.setSession(s, seq)
+			sessionsResumed.WithLabelValues("resumed").Inc()
+			return true
+		}
+	}
+	if seq != 0 {
+		sessionsResumed.WithLabelValues("expired").Inc()
+	}
+	s = &session{conn: c}
+	h.sessions[c.Device.Id] = s
+	c.setSession(s, 0)
+	return false
+}
+
+// Sends what c's device missed, must be called from Run before c can be
+// sent anything else, so the messages arrive in order
+func (h *Hub) resendSession(c *Conn) {
+	c.mx.Lock()
+	s, seq := c.session, c.resumed
+	c.mx.Unlock()
+	if s == nil {
+		return
+	}
+	backlog, _ := s.since(seq)
+	for _, m := range backlog {
+		// Already numbered, so they aren't kept twice
+		if err := c.send(m); err != nil {
+			c.logger().Info("resending session", "seq", m.Seq, "err", err)
+			return
+		}
+	}
+}
+
+// Keeps the session c was using for the device to resume, or forgets it
+// if the device said BYE. Called once c is closed.
+func (h *Hub) leaveSession(c *Conn) {
+	c.mx.Lock()
+	s, bye := c.session, c.bye
+	c.mx.Unlock()
+	if s == nil {
+		return
+	}
+	h.sessionMx.Lock()
+	defer h.sessionMx.Unlock()
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.conn != c {
+		// Resumed by a newer connection
+		return
+	}
+	if bye {
+		delete(h.sessions, c.Device.Id)
+		return
+	}
+	s.conn = nil
+	s.expires = time.Now().Add(h.Config.SessionTTL)
+}
+
+// Keeps a message for a device that's away, or still connecting, but may
+// resume its session. Returns false if it has none.
+func (h *Hub) sendToSession(id string, msg *Message) bool {
+	h.sessionMx.Lock()
+	s := h.sessions[id]
+	h.sessionMx.Unlock()
+	if s == nil || !s.live(time.Now()) {
+		return false
+	}
+	s.keep(numbered(h, msg), h.Config.SessionBuffer)
+	return true
+}
+
+// Forgets the sessions of devices that didn't come back in time
+func (h *Hub) expireSessions() {
+	h.sessionMx.Lock()
+	defer h.sessionMx.Unlock()
+
+	now := time.Now()
+	for id, s := range h.sessions {
+		s.mx.Lock()
+		lost := len(s.sent)
+		s.mx.Unlock()
+		if !s.live(now) {
+			delete(h.sessions, id)
+			if lost > 0 {
+				slog.Info("session expired", "device", id, "lost", lost)
+			}
+		}
+	}
+}
+
+// Numbers and keeps what's sent to c from now on in s, and has the
+// messages after seq resent once c is registered
+func (c *Conn) setSession(s *session, seq uint64) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.session, c.resumed = s, seq
+}
+
+// Forgets the messages of c's session up to seq, which the device ACKed
+func (c *Conn) ackSession(seq uint64) {
+	c.mx.Lock()
+	s := c.session
+	c.mx.Unlock()
+	if s != nil {
+		s.ack(seq)
+	}
+}
@@ -0,0 +1,143 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+var ErrNoStore = errors.New("hub has no store")
+
+// Returns the shadow of a device, empty if nothing was set or reported yet
+func (h *Hub) Shadow(id string) (*model.Shadow, error) {
+	if h.Store == nil {
+		return nil, ErrNoStore
+	}
+	sh, err := h.Store.FindShadow(id)
+	if err == store.ErrNotFound {
+		return model.NewShadow(id), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sh.Desired == nil {
+		sh.Desired = make(map[string]string)
+	}
+	if sh.Reported == nil {
+		sh.Reported = make(map[string]string)
+	}
+	return sh, nil
+}
+
+// Loads the shadow of a device, lets fn change it and saves it
+func (h *Hub) updateShadow(id string, fn func(sh *model.Shadow)) (*model.Shadow, error) {
+	h.shadowMx.Lock()
+	defer h.shadowMx.Unlock()
+
+	sh, err := h.Shadow(id)
+	if err != nil {
+		return nil, err
+	}
+	fn(sh)
+	sh.Version++
+	sh.Updated = time.Now().Unix()
+	if err := h.Store.SaveShadow(sh); err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
+
+// Merges changes into the desired state of device d, nil values remove
+// a key. The device is sent the new delta if it's connected.
+func (h *Hub) SetDesired(d *model.Device, changes map[string]*string) (*model.Shadow, error) {
+	sh, err := h.updateShadow(d.Id, func(sh *model.Shadow) {
+		for k, v := range changes {
+			if v == nil {
+				delete(sh.Desired, k)
+			} else {
+				sh.Desired[k] = *v
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.Publish(EventShadow, d, nil)
+	if conn := h.GetConn(d.Id); conn != nil {
+		conn.sendDelta(sh)
+	}
+	return sh, nil
+}
+
+// Stores a REPORT from the device
+func (c *Conn) report(msg *Message) {
+	values := make(map[string]string)
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &values); err != nil {
+			c.logger().Warn("invalid REPORT", "err", err)
+			c.sendError(model.ErrCodeMalformed, msg.Cmd)
+			return
+		}
+	} else {
+		for i := 0; i+1 < len(msg.Args); i += 2 {
+			values[msg.Args[i]] = msg.Args[i+1]
+		}
+	}
+
+	_, err := c.hub.updateShadow(c.Device.Id, func(sh *model.Shadow) {
+		for k, v := range values {
+			sh.Reported[k] = v
+		}
+	})
+	if err != nil {
+		c.logger().Error("saving shadow", "err", err)
+		return
+	}
+	c.hub.Publish(EventShadow, c.Device, msg)
+}
+
+// Sends the delta of a device that just connected
+func (h *Hub) pushDelta(c *Conn) {
+	if h.Store == nil {
+		return
+	}
+	sh, err := h.Shadow(c.Device.Id)
+	if err != nil {
+		c.logger().Error("loading shadow", "err", err)
+		return
+	}
+	if c.ctx.Err() != nil {
+		// Gone while we were loading it
+		return
+	}
+	c.sendDelta(sh)
+}
+
+// Sends a DELTA with whatever the device still has to change, if anything
+func (c *Conn) sendDelta(sh *model.Shadow) {
+	delta := sh.Delta()
+	if len(delta) == 0 {
+		return
+	}
+	msg := &Message{Cmd: model.MsgDelta}
+	if c.codec != TextCodec {
+		msg.Payload, _ = json.Marshal(delta)
+	} else {
+		// Sorted so the same delta always reads the same
+		keys := make([]string, 0, len(delta))
+		for k := range delta {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			msg.Args = append(msg.Args, k, delta[k])
+		}
+	}
+	if err := c.send(msg); err != nil {
+		c.logger().Info("sending delta", "err", err)
+	}
+}
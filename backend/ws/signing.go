@@ -0,0 +1,108 @@
+package ws
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// Devices that verify what they're told say which of the backend's keys
+// they trust with "verify=<key id>" in HELLO. Commands, OTA and DELTA are
+// then sent to them as "SIG <key id> <time> <signature> <command>". A
+// device trusting an old key is sent the current one in KEY, signed with
+// the old one, and is signed for with it once it answers KEYACK.
+
+// Whether cmd changes what a device does, and is signed for it
+func signedCommand(cmd string) bool {
+	switch cmd {
+	case model.MsgOTA, model.MsgDelta, model.MsgKey, model.CmdE2E:
+		return true
+	}
+	return commands[cmd]
+}
+
+// Extracts the "verify=" argument of a HELLO. Returns the remaining
+// arguments and "" if there is none.
+func helloVerify(args []string) (string, []string) {
+	rest := make([]string, 0, len(args))
+	id := ""
+	for _, a := range args {
+		if strings.HasPrefix(a, "verify=") {
+			id = strings.TrimPrefix(a, "verify=")
+			continue
+		}
+		rest = append(rest, a)
+	}
+	return id, rest
+}
+
+// Signs for c with the key with id from now on, moving it to the current
+// key if it's an old one. Must be called from the reading goroutine.
+func (c *Conn) trustKey(id string) {
+	signer := c.hub.Signer
+	if signer == nil || id == "" {
+		return
+	}
+	k := signer.Key(id)
+	if k == nil {
+		c.logger().Warn("device trusts an unknown signing key", "key", id)
+		c.sendError(model.ErrCodeSigningKey, signer.Current().Id)
+		return
+	}
+	c.mx.Lock()
+	c.signKey = k
+	c.mx.Unlock()
+	c.Device.SigningKey = k.Id
+	if cur := signer.Current(); k != cur {
+		c.logger().Info("rotating signing key", "from", k.Id, "to", cur.Id)
+		if err := c.send(&Message{Cmd: model.MsgKey, Args: []string{cur.Id, cur.Encode()}}); err != nil {
+			c.logger().Warn("sending signing key", "err", err)
+		}
+	}
+}
+
+// Handles KEYACK <key id>, the device trusts the current key now
+func (c *Conn) keyAck(msg *Message) {
+	signer := c.hub.Signer
+	if signer == nil || msg.Arg(0) != signer.Current().Id {
+		c.sendError(model.ErrCodeMalformed, msg.Cmd)
+		return
+	}
+	c.mx.Lock()
+	c.signKey = signer.Current()
+	c.Device.SigningKey = msg.Arg(0)
+	c.mx.Unlock()
+	d := c.Snapshot()
+	c.hub.saveDevice(d)
+	c.hub.Publish(EventUpdated, d, nil)
+}
+
+// Returns msg wrapped in SIG if c verifies what it's sent
+func (c *Conn) sign(msg *Message) *Message {
+	if msg.data != nil || !signedCommand(msg.Cmd) {
+		return msg
+	}
+	c.mx.Lock()
+	k := c.signKey
+	c.mx.Unlock()
+	if k == nil {
+		return msg
+	}
+	text, err := TextCodec.Encode(&Message{Cmd: msg.Cmd, Args: msg.Args, Payload: msg.Payload})
+	if err != nil {
+		return msg
+	}
+	// Devices know themselves by the id they said in HELLO
+	id := c.Device.Id
+	if c.Device.Tenant != "" {
+		id = strings.TrimPrefix(id, c.Device.Tenant+":")
+	}
+	now := time.Now()
+	m := *msg
+	m.Cmd = model.MsgSigned
+	m.Args = append([]string{k.Id, strconv.FormatInt(now.Unix(), 10), k.Sign(id, now, text), msg.Cmd}, msg.Args...)
+	m.text = nil
+	return &m
+}
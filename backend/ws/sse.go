@@ -0,0 +1,90 @@
+package ws
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Like ServeEvents, for browsers behind networks that block WebSockets:
+// streams the same frames as Server-Sent Events, each one "data: <json>".
+// The stream only goes one way, so topics are subscribed to with ?topic=
+// (repeatable) when it starts rather than by sending "sub".
+func ServeEventStream(h *Hub, owner string, w http.ResponseWriter, r *http.Request) {
+	out, err := newBatcher(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer out.stop()
+
+	sub := h.Subscribe(owner)
+	defer h.Unsubscribe(sub)
+	defer h.UnsubscribeTopic(sub, "")
+
+	frames := make(chan *topicFrame, eventQueueSize)
+	for _, filter := range r.URL.Query()["topic"] {
+		err := h.SubscribeTopic(sub, owner, filter, func(topic, payload string) {
+			select {
+			case frames <- &topicFrame{Type: "topic", Topic: topic, Payload: payload}:
+			default:
+				slog.Warn("dropping topic message for slow subscriber", "owner", owner)
+			}
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Proxies like nginx would otherwise hold events back
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	write := func(b []byte) error {
+		rc.SetWriteDeadline(time.Now().Add(writeWait))
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	out.send = func(f interface{}) error {
+		b, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		return write(append(append([]byte("data: "), b...), '\n', '\n'))
+	}
+	if err := write([]byte(": connected\n\n")); err != nil {
+		return
+	}
+
+	// Comments keep proxies from closing an idle stream
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-sub.Events:
+			if err := out.write(ev); err != nil {
+				return
+			}
+		case f := <-frames:
+			if err := out.write(f); err != nil {
+				return
+			}
+		case <-out.due():
+			if err := out.flush(); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := write([]byte(": ping\n\n")); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package ws
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/telemetry"
+)
+
+// Stores a TELEMETRY message, either "TELEMETRY temp 21.5 hum 40" or a
+// JSON payload like {"temp": 21.5, "hum": 40}
+func (c *Conn) telemetry(msg *Message) {
+	if !c.telemetryAllowed() {
+		return
+	}
+	now := time.Now().Unix()
+	var points []telemetry.Point
+	if len(msg.Payload) > 0 {
+		values := make(map[string]float64)
+		if err := json.Unmarshal(msg.Payload, &values); err != nil {
+			c.logger().Warn("invalid TELEMETRY", "err", err)
+			c.sendError(model.ErrCodeMalformed, msg.Cmd)
+			return
+		}
+		for k, v := range values {
+			points = append(points, telemetry.Point{Time: now, Metric: k, Value: v})
+		}
+	} else {
+		for i := 0; i+1 < len(msg.Args); i += 2 {
+			v, err := strconv.ParseFloat(msg.Args[i+1], 64)
+			if err != nil {
+				c.logger().Warn("invalid TELEMETRY value", "err", err)
+				c.sendError(model.ErrCodeMalformed, msg.Cmd)
+				continue
+			}
+			points = append(points, telemetry.Point{Time: now, Metric: msg.Args[i], Value: v})
+		}
+	}
+	if len(points) == 0 {
+		return
+	}
+
+	if c.hub.Telemetry != nil {
+		if err := c.hub.Telemetry.Write(c.Device.Id, points); err != nil {
+			c.logger().Error("writing telemetry", "err", err)
+		}
+	}
+	c.hub.Publish(EventTelemetry, c.Device, msg)
+}
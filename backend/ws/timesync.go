@@ -0,0 +1,61 @@
+package ws
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/twinone/iot/backend/model"
+)
+
+// Devices without a clock ask for the time with TIME and get
+// TIME <unix ms> <utc offset> <timezone>, in the timezone of the device or
+// Config.Timezone. Those that asked get it again every Config.TimePush.
+
+// Handles TIME from a connected device
+func (c *Conn) timeRequest(msg *Message) {
+	c.sendTime()
+	if c.hub.Config.TimePush > 0 && atomic.CompareAndSwapInt32(&c.timeSync, 0, 1) {
+		go c.pushTime(c.hub.Config.TimePush)
+	}
+}
+
+// Sends the time until the connection is closed
+func (c *Conn) pushTime(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sendTime()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Conn) sendTime() {
+	def := c.hub.Config.Timezone
+	if def == nil {
+		def = time.UTC
+	}
+	c.mx.Lock()
+	tz := c.Device.Timezone
+	c.mx.Unlock()
+	loc, err := model.LoadTimezone(tz, def)
+	if err != nil {
+		c.logger().Warn("invalid timezone", "timezone", tz, "err", err)
+		loc = def
+	}
+	msg := &Message{Cmd: model.MsgTime, Args: model.TimeArgs(time.Now(), loc)}
+	if err := c.send(msg); err != nil {
+		c.logger().Debug("sending time", "err", err)
+	}
+}
+
+// Sends the time to the device with id if it's connected to this node and
+// asked for it before, e.g. because its timezone changed
+func (h *Hub) PushTime(id string) {
+	if conn := h.GetConn(id); conn != nil && atomic.LoadInt32(&conn.timeSync) == 1 {
+		conn.sendTime()
+	}
+}
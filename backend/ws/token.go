@@ -0,0 +1,79 @@
+package ws
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Returns the provisioning token for a device id. It's an HMAC of the id
+// and the device's TokenNonce, so a new nonce revokes the token and
+// rotating the secret revokes every token. Devices onboarded before tokens
+// had a nonce have an HMAC of the id alone.
+func IssueToken(secret []byte, id string, nonce string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id))
+	if nonce != "" {
+		mac.Write([]byte{0})
+		mac.Write([]byte(nonce))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func NewTokenNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Checks the token a device sent against its record. Returns
+// ErrUnregistered if there's no record, ErrInvalidToken if it doesn't
+// match or the device was deleted, or ErrUnavailable if the store failed.
+// Without a store tokens can't be revoked, they're checked against the id
+// alone.
+func (h *Hub) VerifyToken(id string, token string) error {
+	nonce := ""
+	if h.Store != nil {
+		d, err := h.Store.FindDevice(id)
+		switch {
+		case err == store.ErrNotFound:
+			return ErrUnregistered
+		case err != nil:
+			slog.Error("loading device", "device", id, "err", err)
+			return ErrUnavailable
+		case d.Deleted != 0:
+			return ErrInvalidToken
+		}
+		nonce = d.TokenNonce
+	}
+	if !hmac.Equal([]byte(IssueToken(h.TokenSecret, id, nonce)), []byte(token)) {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// Gives d, a record from the store, a new TokenNonce and saves it, which
+// revokes its token. If it's connected it's disconnected, it must connect
+// again with the new token. Returns the new token.
+func (h *Hub) RotateToken(d *model.Device) (string, error) {
+	d.TokenNonce = NewTokenNonce()
+	// Or the connection would save the old one back
+	if conn := h.GetConn(d.Id); conn != nil {
+		conn.mx.Lock()
+		conn.Device.TokenNonce = d.TokenNonce
+		conn.mx.Unlock()
+	}
+	if err := h.Store.SaveDevice(d); err != nil {
+		return "", err
+	}
+	h.Disconnect(d.Id, CloseUnauthorized, "token revoked")
+	return IssueToken(h.TokenSecret, d.Id, d.TokenNonce), nil
+}
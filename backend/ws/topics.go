@@ -0,0 +1,230 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/twinone/iot/backend/model"
+	"github.com/twinone/iot/backend/store"
+)
+
+// Devices and dashboards can also talk to each other through topics, paths
+// like "owner/me@example.com/room/kitchen/light". Subscriptions take
+// filters where "+" matches one level and a trailing "#" any number of
+// them, e.g. "owner/me@example.com/room/+/#".
+//
+// Everything under "owner/<email>/" belongs to that user. Other users can
+// subscribe to "owner/<email>/device/<id>/..." if the device is shared
+// with them, and publish there if they're a controller. Hub.TopicACL
+// replaces these rules.
+const (
+	maxTopicLen = 256
+	// Filters a device or dashboard may be subscribed to at once
+	maxTopicSubs = 32
+)
+
+var (
+	ErrInvalidTopic   = errors.New("invalid topic")
+	ErrTopicForbidden = errors.New("topic not allowed")
+	ErrTooManyTopics  = errors.New("too many topic subscriptions")
+)
+
+// Called with every message published to a topic a subscriber matched.
+// Runs on the publisher's goroutine, so it must not block.
+type TopicHandler func(topic, payload string)
+
+type topicSub struct {
+	filter  string
+	handler TopicHandler
+}
+
+type topics struct {
+	mx sync.RWMutex
+	// Filters by subscriber, a *Conn or whatever the caller uses as key
+	subs map[interface{}]map[string]*topicSub
+}
+
+// Subscribes key, acting for user, to the topics matching filter
+func (h *Hub) SubscribeTopic(key interface{}, user, filter string, handler TopicHandler) error {
+	if !validTopic(filter, true) {
+		return ErrInvalidTopic
+	}
+	if !h.topicAllowed(user, filter, false) {
+		return ErrTopicForbidden
+	}
+	t := &h.topics
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if t.subs == nil {
+		t.subs = make(map[interface{}]map[string]*topicSub)
+	}
+	subs := t.subs[key]
+	if subs == nil {
+		subs = make(map[string]*topicSub)
+		t.subs[key] = subs
+	}
+	if subs[filter] == nil && len(subs) >= maxTopicSubs {
+		return ErrTooManyTopics
+	}
+	subs[filter] = &topicSub{filter: filter, handler: handler}
+	return nil
+}
+
+// Removes a subscription of key, or all of them if filter is empty
+func (h *Hub) UnsubscribeTopic(key interface{}, filter string) {
+	t := &h.topics
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if filter == "" {
+		delete(t.subs, key)
+		return
+	}
+	delete(t.subs[key], filter)
+	if len(t.subs[key]) == 0 {
+		delete(t.subs, key)
+	}
+}
+
+// Sends payload to the subscribers of topic on every node, acting for user
+func (h *Hub) PublishTopic(ctx context.Context, user, topic, payload string) error {
+	if !validTopic(topic, false) {
+		return ErrInvalidTopic
+	}
+	if !h.topicAllowed(user, topic, true) {
+		return ErrTopicForbidden
+	}
+	if c := h.cluster; c != nil {
+		c.enqueue(func(ctx context.Context) {
+			if err := c.publish(ctx, allChannel, &clusterMsg{Op: opTopic, Topic: topic, Msg: payload}); err != nil {
+				slog.Error("publishing to topic", "err", err)
+			}
+		})
+	}
+	h.deliverTopic(topic, payload)
+	return nil
+}
+
+// Hands a message to the local subscribers of topic
+func (h *Hub) deliverTopic(topic, payload string) {
+	t := &h.topics
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+
+	for _, subs := range t.subs {
+		// A subscriber gets a message once, even if several filters match
+		for _, sub := range subs {
+			if matchTopic(sub.filter, topic) {
+				sub.handler(topic, payload)
+				break
+			}
+		}
+	}
+}
+
+// Returns true if topic, or filter if wildcards are allowed, is well formed
+func validTopic(topic string, wildcards bool) bool {
+	if topic == "" || len(topic) > maxTopicLen || strings.ContainsAny(topic, " \t\r\n") {
+		return false
+	}
+	parts := strings.Split(topic, "/")
+	for i, p := range parts {
+		if !strings.ContainsAny(p, "+#") {
+			continue
+		}
+		if !wildcards || p != "+" && (p != "#" || i != len(parts)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchTopic(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, p := range f {
+		if p == "#" {
+			return true
+		}
+		if i >= len(t) || p != "+" && p != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// Returns true if user may publish to topic, or subscribe to it if it's
+// a filter
+func (h *Hub) topicAllowed(user, topic string, publish bool) bool {
+	if h.TopicACL != nil {
+		return h.TopicACL(user, topic, publish)
+	}
+	parts := strings.Split(topic, "/")
+	if len(parts) < 2 || parts[0] != "owner" {
+		return false
+	}
+	if parts[1] == user {
+		return true
+	}
+	// Topics of a shared device, which must be named without wildcards
+	if len(parts) < 4 || parts[2] != "device" || h.Store == nil ||
+		strings.ContainsAny(parts[1]+parts[3], "+#") {
+		return false
+	}
+	d, err := h.Store.FindDevice(parts[3])
+	if err != nil {
+		if err != store.ErrNotFound {
+			slog.Error("finding device", "device", parts[3], "err", err)
+		}
+		return false
+	}
+	if d.Owner != parts[1] || d.Deleted != 0 {
+		return false
+	}
+	sh, err := h.Store.FindShare(d.Id, user)
+	if err != nil {
+		return false
+	}
+	if publish {
+		return sh.Role.Allows(model.RoleController)
+	}
+	return sh.Role.Allows(model.RoleViewer)
+}
+
+// Handles SUB <filter>, UNSUB <filter> and PUB <topic> <payload> from a
+// device, which acts for its owner. Messages reach it as MSG <topic>
+// <payload>.
+func (c *Conn) topic(msg *Message) {
+	if len(msg.Args) == 0 {
+		c.sendError(model.ErrCodeMalformed, msg.Cmd)
+		return
+	}
+	topic := msg.Args[0]
+	var err error
+	switch msg.Cmd {
+	case model.RespSubscribe:
+		err = c.hub.SubscribeTopic(c, c.Device.Owner, topic, func(topic, payload string) {
+			if err := c.send(&Message{Cmd: model.MsgTopic, Args: []string{topic, payload}}); err != nil {
+				c.logger().Info("dropping topic message", "topic", topic, "err", err)
+			}
+		})
+		if err == nil && c.isClosed() {
+			// Lost a race with Close, which already unsubscribed us
+			c.hub.UnsubscribeTopic(c, "")
+		}
+	case model.RespUnsubscribe:
+		c.hub.UnsubscribeTopic(c, topic)
+	case model.RespPublish:
+		err = c.hub.PublishTopic(context.Background(), c.Device.Owner, topic, msg.TailFrom(1))
+	}
+	switch err {
+	case nil:
+	case ErrTopicForbidden:
+		c.sendError(model.ErrCodeForbidden, topic)
+	default:
+		c.sendError(model.ErrCodeMalformed, msg.Cmd)
+	}
+}
@@ -0,0 +1,21 @@
+package ws
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans follow a command from the API through the hub to the device's
+// socket and, for deliveries, until its ACK. Nothing is recorded unless
+// a tracer provider is installed.
+var tracer = otel.Tracer("github.com/twinone/iot/backend/ws")
+
+// Ends span, marking it as failed if err isn't nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
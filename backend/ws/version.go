@@ -0,0 +1,62 @@
+package ws
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Protocol revisions:
+//  1. The original text protocol: no version in HELLO, no sequence numbers
+//  2. Sequence numbers and ACKs, REPORT/DELTA, TELEMETRY
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// Extracts the protocol version from a HELLO, given in the envelope by
+// JSON devices or as a "version=N" argument in the text protocol.
+// Returns the remaining arguments and 1 if there is no version, since
+// firmware older than versioning didn't send it. 0 means unparsable.
+func helloVersion(msg *Message, args []string) (int, []string) {
+	if msg.Version != 0 {
+		return msg.Version, args
+	}
+	rest := make([]string, 0, len(args))
+	version := 1
+	for _, a := range args {
+		if !strings.HasPrefix(a, "version=") {
+			rest = append(rest, a)
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimPrefix(a, "version="))
+		if err != nil || v <= 0 {
+			v = 0
+		}
+		version = v
+	}
+	return version, rest
+}
+
+// Returns how to parse messages from a device speaking version with c
+func decoderFor(c Codec, version int) Codec {
+	if c == TextCodec && version < 2 {
+		return legacyTextCodec{}
+	}
+	return c
+}
+
+// The text protocol before sequence numbers, where a leading number is
+// just part of the message
+type legacyTextCodec struct{}
+
+func (legacyTextCodec) Encode(msg *Message) ([]byte, error) {
+	return TextCodec.Encode(msg)
+}
+
+func (legacyTextCodec) Decode(data []byte) (*Message, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return nil, ErrEmptyMessage
+	}
+	return &Message{Cmd: fields[0], Args: fields[1:]}, nil
+}
@@ -0,0 +1,27 @@
+package ws
+
+// Keeps the message published as EventWill if the connection dies without
+// a BYE, like MQTT's last will. It has keys and values like REPORT, e.g.
+// "WILL status lost", and a WILL without any clears it.
+func (c *Conn) setWill(msg *Message) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if len(msg.Args) == 0 && len(msg.Payload) == 0 {
+		c.will = nil
+		return
+	}
+	c.will = msg
+}
+
+// Returns the will to publish now that the connection is gone, nil if
+// there's none or the device said BYE
+func (c *Conn) lastWill() *Message {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.bye {
+		return nil
+	}
+	return c.will
+}
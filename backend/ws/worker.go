@@ -0,0 +1,70 @@
+package ws
+
+import "time"
+
+// Messages from devices are handled by Config.Workers goroutines rather
+// than the connections' read loops, so a slow store write or rule doesn't
+// hold up reading pongs and the read deadline. Each connection sticks to
+// one worker, which handles its messages in order. Once a worker has
+// Config.WorkQueue messages waiting, the connections sending to it stop
+// reading until it catches up.
+
+// A message read from c, or a marker closing done once c's earlier
+// messages are handled
+type work struct {
+	c      *Conn
+	data   []byte
+	queued time.Time
+	done   chan struct{}
+}
+
+// Starts the workers, called by Run
+func (h *Hub) startWorkers() {
+	for _, queue := range h.work {
+		go h.worker(queue)
+	}
+}
+
+func (h *Hub) worker(queue chan work) {
+	for {
+		select {
+		case w := <-queue:
+			if w.done != nil {
+				close(w.done)
+				continue
+			}
+			workWait.Observe(time.Since(w.queued).Seconds())
+			if !w.c.isClosed() {
+				w.c.processMessage(w.data)
+			}
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+// Queues w for its connection's worker. Returns false if the connection
+// closed or the hub stopped while waiting for room.
+func (h *Hub) queueWork(w work) bool {
+	select {
+	case h.work[w.c.id%uint64(len(h.work))] <- w:
+		return true
+	case <-w.c.ctx.Done():
+	case <-h.quit:
+	}
+	return false
+}
+
+// Waits until c's worker handled what was read from c, so a BYE counts
+// before c is closed
+func (h *Hub) finishWork(c *Conn) {
+	done := make(chan struct{})
+	if len(h.work) == 0 || !h.queueWork(work{c: c, done: done}) {
+		return
+	}
+	select {
+	case <-done:
+	case <-c.ctx.Done():
+	case <-h.quit:
+	}
+}
@@ -68,10 +68,11 @@
         Profile.devices.forEach(function (device) {
             console.log("device:", device)
             var online = device.lastseen - new Date().getTime() < 60
+            var link = device.link ? " - " + device.link.quality + " (" + device.link.rtt + "ms)" : ""
             var deviceElement = $(template.formatUnicorn({
                 title: device.name,
                 deviceid: device.id.substr(0, 7),
-                online: online ? "online" : offline,
+                online: (online ? "online" : offline) + link,
                 id: 'device-' + device.id,
             }))
             section.append(deviceElement)
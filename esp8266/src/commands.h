@@ -10,7 +10,8 @@
 #define CMD_DIGITAL_READ   "DR"
 
 // Set a pin to HIGH or LOW
-// Format: DW HIGH|LOW
+// Format: DW pin HIGH|LOW
+// Response: DW pin HIGH|LOW
 #define CMD_DIGITAL_WRITE  "DW"
 
 // Analog read will send a message of type AR to the server
@@ -20,6 +21,7 @@
 
 // Write a PWM value
 // Format: AW pin value
+// Response: AW pin value
 #define CMD_ANALOG_WRITE   "AW" // PWM
 
 // Analog read will send a message of type IAR to the server
@@ -41,6 +43,86 @@
 #define RESP_CAP "CAP"
 
 
+// Sent by the server when the device isn't claimed yet
+// Format: PAIR code
+#define MSG_PAIR "PAIR"
+
+// Sent by the server with the desired state we haven't reported yet.
+// Numeric keys are pins, which we write and report back.
+// Format: DELTA key value [key value...]
+#define MSG_DELTA "DELTA"
+// Format: REPORT key value [key value...]
+#define RESP_REPORT "REPORT"
+
+// Protocol revision we speak, sent in HELLO
+#define PROTOCOL_VERSION "2"
+// The server answers HELLO with the version it will speak
+// Format: HELLO version [keepalive=seconds] [resume=seq], the keepalive
+// granted if we asked for one with keepalive=seconds in our HELLO. If we
+// sent resume=seq, the highest sequence number we got, resume=seq means
+// the messages we missed follow, and resume=0 that we start a new session.
+#define MSG_HELLO "HELLO"
+// Sent by the server before closing the connection because of an error
+// Format: ERR code [detail], e.g. ERR version 3 or ERR unknown FOO.
+// The reason for closing the connection also comes in the close frame,
+// see the README for the codes.
+#define MSG_ERROR "ERR"
+
+// Declares the functions of the board so dashboards can show controls
+// for them, see BOARD_FUNCS in config-sample.h
+// Format: FUNCS [{"name": "...", "cmd": "DW", "pin": 5, "params": [...]}]
+#define RESP_FUNCS "FUNCS"
+
+// Acknowledges a message the server prefixed with a sequence number
+// Format: ACK seq
+#define RESP_ACK "ACK"
+
+// Runs a command on another device of our owner, like a light from a
+// button. The server answers ERR forbidden or ERR unreachable if it can't.
+// Format: SEND device command, e.g. SEND lamp DW 5 HIGH
+#define RESP_SEND "SEND"
+
+// Published by the server if our connection dies without a BYE, send it
+// again without arguments to clear it
+// Format: WILL key value [key value...]
+#define RESP_WILL "WILL"
+
+// Topics shared with other devices and dashboards of our owner, under
+// owner/<email>/. Filters take + for one level and a trailing #.
+// Format: SUB filter, UNSUB filter, PUB topic payload
+#define RESP_SUB "SUB"
+#define RESP_UNSUB "UNSUB"
+#define RESP_PUB "PUB"
+// Something was published to a topic we subscribed to
+// Format: MSG topic payload
+#define MSG_TOPIC "MSG"
+
+// Tells the server what board and firmware we are, so it knows which
+// firmware updates fit us
+// Format: INFO model hardware firmware version
+#define RESP_INFO "INFO"
+
+// Sent by the server when there's a firmware update for us. Check the
+// SHA-256 of the image before installing it.
+// Format: OTA url sha256 version
+#define MSG_OTA "OTA"
+// Format: OTASTATUS downloading percent | installing | failed detail
+#define RESP_OTA_STATUS "OTASTATUS"
+
+// Sent by the server before a file arrives in binary frames, each one
+// starting with the id, offset and CRC-32 of its data as big endian
+// 32-bit integers
+// Format: FILE id name size sha256
+#define MSG_FILE "FILE"
+// Format: FILEABORT id
+#define MSG_FILE_ABORT "FILEABORT"
+// The offset we want next, the last one only once the SHA-256 matches
+// Format: FILEACK id offset
+#define RESP_FILE_ACK "FILEACK"
+// Format: FILEERR id reason
+#define RESP_FILE_ERROR "FILEERR"
+
+
 #define VAL_HIGH  "HIGH"
 #define VAL_LOW   "LOW"
 
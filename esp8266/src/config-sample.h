@@ -13,8 +13,14 @@
 
 // Your google account
 #define ADMIN_ACCOUNT ""
-// Random 40 byte hex string
+// Random 40 byte hex string, new boards can't have ':', '/', '+' or '#'
 #define BOARD_ID ""
+// Provisioning token, leave it empty to pair the board first, then get it
+// with POST /api/devices/BOARD_ID/token
+#define DEVICE_TOKEN ""
+
+// Optional functions to announce, as a JSON list
+// #define BOARD_FUNCS "[{\"name\":\"light\",\"cmd\":\"DW\",\"pin\":5,\"params\":[{\"name\":\"value\",\"type\":\"enum\",\"values\":[\"HIGH\",\"LOW\"]}]}]"
 
 // Change to use your own server
 #define REMOTE_ADDR "iot.twinone.xyz"
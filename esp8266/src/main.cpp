@@ -18,11 +18,14 @@ void onMessage(uint8_t *payload, size_t length) {
 
 void onConnected() {
   Serial.println("Connected");
-  m.send("HELLO " BOARD_ID);
+  m.send("HELLO " BOARD_ID " " DEVICE_TOKEN " version=" PROTOCOL_VERSION);
   m.send("OWNER " ADMIN_ACCOUNT);
   #ifdef BOARD_NAME
   m.send("NAME " BOARD_NAME);
   #endif
+  #ifdef BOARD_FUNCS
+  m.send(RESP_FUNCS " " BOARD_FUNCS);
+  #endif
 }
 
 void onDisconnected() {
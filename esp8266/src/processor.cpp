@@ -5,11 +5,49 @@
 void Processor::process(uint8_t *payload, size_t length) {
   String cmd = (char*)payload;
   String op = splitSpaceTrim(cmd, 0);
+  if (op.length() > 0 && isDigit(op[0])) {
+    // Sequence number, the server resends the message until we ACK it
+    messenger->send(String(RESP_ACK " ") + op);
+    cmd = cmd.substring(cmd.indexOf(' ') + 1);
+    op = splitSpaceTrim(cmd, 0);
+  }
+  if (op == MSG_PAIR) {
+    // Enter this code in the dashboard to claim the device
+    Serial.println("Pairing code: " + splitSpaceTrim(cmd, 1));
+    return;
+  }
+
+  if (op == MSG_HELLO) {
+    Serial.println("Server speaks protocol version " + splitSpaceTrim(cmd, 1));
+    return;
+  }
+
+  if (op == MSG_ERROR) {
+    Serial.println("Server error: " + cmd.substring(cmd.indexOf(' ') + 1));
+    return;
+  }
+
+  if (op == MSG_DELTA) {
+    String report = RESP_REPORT;
+    for (int i = 1; ; i += 2) {
+      String key = splitSpaceTrim(cmd, i);
+      String val = splitSpaceTrim(cmd, i + 1);
+      if (key.length() == 0 || val.length() == 0) break;
+      if (!isDigit(key[0])) continue;
+      int pin = atoi(key.c_str());
+      pinMode(pin, OUTPUT);
+      digitalWrite(pin, val == VAL_HIGH ? HIGH : LOW);
+      report += " " + key + " " + val;
+    }
+    if (report != RESP_REPORT) messenger->send(report);
+    return;
+  }
+
   if (op == CMD_DIGITAL_READ) {
     String pinStr = splitSpaceTrim(cmd, 1);
     int pin = atoi(pinStr.c_str());
     int value = digitalRead(pin);
-    messenger->send(op + " " + pinStr + String(value));
+    messenger->send(op + " " + pinStr + " " + String(value));
     return;
   }
 
@@ -19,6 +57,7 @@ void Processor::process(uint8_t *payload, size_t length) {
     String val = splitSpaceTrim(cmd, 2);
     pinMode(pin, OUTPUT);
     digitalWrite(pin, val == VAL_HIGH ? HIGH : LOW);
+    messenger->send(op + " " + pinStr + " " + val);
     return;
   }
 
@@ -27,7 +66,7 @@ void Processor::process(uint8_t *payload, size_t length) {
     int pin = atoi(pinStr.c_str());
     pinMode(pin, INPUT);
     int value = analogRead(pin);
-    messenger->send(op + " " + pinStr + String(value));
+    messenger->send(op + " " + pinStr + " " + String(value));
     return;
   }
 
@@ -38,6 +77,7 @@ void Processor::process(uint8_t *payload, size_t length) {
     int val = atoi(valStr.c_str());
     pinMode(pin, OUTPUT);
     analogWrite(pin, val);
+    messenger->send(op + " " + pinStr + " " + valStr);
     return;
   }
 